@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
 	"github.com/quinnovator/easy-tunnel-lb/internal/config"
@@ -12,6 +13,8 @@ import (
 	"github.com/quinnovator/easy-tunnel-lb/internal/k8s"
 	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
 	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/quinnovator/easy-tunnel-lb/internal/webhook"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 func main() {
@@ -33,21 +36,161 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create API client
-	apiClient := api_client.NewClient(cfg.ServerURL, cfg.APIKey)
+	// Set up signal handling
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create server registry
+	var tunnelServerClient controller.TunnelServerClient
+	if cfg.EnableTunnelServers {
+		tunnelServerClient = k8sClient
+	}
+	retry := api_client.DefaultRetryPolicy
+	retry.MaxRetries = cfg.APIMaxRetries
+	retry.MinBackoff = cfg.APIRetryBackoff
+	servers := controller.NewServerRegistry(tunnelServerClient, controller.NewAPIServerClientFactory(retry), logger)
+	if cfg.ServerURL != "" {
+		client := api_client.NewClient(cfg.ServerURL, cfg.APIKey)
+		client.SetRetryPolicy(retry)
+		servers.AddStaticServer(controller.DefaultServerName, client)
+	}
+	servers.SetFailureThreshold(cfg.FailoverThreshold)
+	servers.SetDryRun(cfg.DryRun)
+	if err := servers.Sync(ctx); err != nil {
+		logger.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Error("Failed to load tunnel servers")
+		os.Exit(1)
+	}
 
 	// Create tunnel manager
-	tunnelMgr := tunnel.NewManager()
+	policy := tunnel.StripUnsafe
+	if cfg.WireGuardConfigPolicy == config.WireGuardConfigPolicyReject {
+		policy = tunnel.RejectUnsafe
+	}
+	var tunnelMgr controller.TunnelManager
+	var perTunnelMgr *tunnel.Manager
+	var transports []string
+	if cfg.TunnelMode == config.TunnelModeShared {
+		shared := tunnel.NewSharedManager()
+		shared.SetConfigPolicy(policy)
+		tunnelMgr = shared
+		transports = shared.Transports()
+	} else {
+		// Every transport a server may provision runs on its registered backend. Dry
+		// runs never touch local interfaces, so no backend is set up for them.
+		backends := tunnel.NewRegistry()
+		if !cfg.DryRun {
+			backend, err := newWireGuardBackend(cfg.WireGuardBackend)
+			if err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error": err.Error(),
+				}).Error("Failed to create WireGuard backend")
+				os.Exit(1)
+			}
+			for _, transport := range []struct {
+				name    string
+				backend tunnel.Backend
+			}{
+				{tunnel.TransportWireGuard, backend},
+				{tunnel.TransportSSH, tunnel.NewSSHBackend()},
+				{tunnel.TransportTLS, tunnel.NewMuxBackend()},
+			} {
+				if err := backends.Register(transport.name, transport.backend); err != nil {
+					logger.WithFields(map[string]interface{}{
+						"transport": transport.name,
+						"error":     err.Error(),
+					}).Error("Failed to register tunnel backend")
+					os.Exit(1)
+				}
+			}
+		}
+		perTunnelMgr = tunnel.NewManagerWithRegistry(backends)
+		perTunnelMgr.SetConfigPolicy(policy)
+		tunnelMgr = perTunnelMgr
+		// Servers take the first transport they support, so WireGuard stays preferred
+		// and SSH or TLS are used where a Service or server asks for them
+		transports = []string{tunnel.TransportWireGuard, tunnel.TransportSSH, tunnel.TransportTLS}
+	}
 
 	// Create reconciler
-	reconciler := controller.NewServiceReconciler(k8sClient, apiClient, tunnelMgr, logger)
+	reconciler := controller.NewServiceReconcilerWithServers(k8sClient, servers, tunnelMgr, logger)
+	reconciler.SetTransports(transports)
+	reconciler.SetSharedInterface(cfg.TunnelMode == config.TunnelModeShared)
+
+	// Keys and tunnel state are kept in Secrets so a restart keeps the same identity
+	keys := controller.NewSecretKeyStore(k8sClient, cfg.Namespace)
+	if cfg.TunnelMode == config.TunnelModeShared {
+		// All tunnels on a shared interface use the interface's key
+		keys = controller.NewServerSecretKeyStore(k8sClient, cfg.Namespace)
+	}
+	keys.SetDryRun(cfg.DryRun)
+	reconciler.SetKeyStore(keys)
+	reconciler.SetKeyRotationInterval(cfg.KeyRotationInterval)
+
+	// Per-tunnel interfaces are monitored and their health published on the Services.
+	// A dry run brings up no interfaces, so there is nothing to monitor or report.
+	monitorTunnels := perTunnelMgr != nil && !cfg.DryRun && cfg.TunnelStalePeriod > 0
+	if monitorTunnels {
+		reconciler.SetTunnelHealth(perTunnelMgr)
+	}
+
+	// In dry-run mode every change is recorded into a plan instead of being made
+	plan := controller.NewPlan(logger)
+	if cfg.DryRun {
+		reconciler.SetDryRun(plan)
+	}
 
 	// Create service watcher
 	watcher := controller.NewServiceWatcher(k8sClient, reconciler, logger)
 
-	// Set up signal handling
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Plan mode reconciles every Service once, prints the plan and exits
+	if cfg.Plan {
+		if err := watcher.ReconcileOnce(ctx); err != nil {
+			logger.WithFields(map[string]interface{}{
+				"error": err.Error(),
+			}).Error("Failed to compute plan")
+		}
+		if err := plan.Write(os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Re-reconcile Services whenever a tunnel server fails or recovers
+	servers.OnHealthChange(func(string) {
+		watcher.EnqueueAll()
+	})
+	go servers.Run(ctx, time.Duration(cfg.WatchInterval)*time.Second)
+
+	// Restart silent tunnels and re-reconcile a tunnel's Service whenever its health changes
+	if monitorTunnels {
+		perTunnelMgr.SetHealthHandler(func(tunnelID string, health tunnel.Health) {
+			logger.WithFields(map[string]interface{}{
+				"tunnel_id": tunnelID,
+				"state":     string(health.State),
+				"reason":    health.Reason,
+				"restarts":  health.Restarts,
+			}).Info("Tunnel health changed")
+			watcher.EnqueueTunnel(tunnelID)
+		})
+		go perTunnelMgr.Monitor(ctx, cfg.TunnelHealthInterval, cfg.TunnelStalePeriod)
+	}
+
+	// Summarize what each Service's per-tunnel interfaces carried on the Service
+	if perTunnelMgr != nil && !cfg.DryRun && cfg.TrafficReportInterval > 0 {
+		trafficReporter := controller.NewTrafficReporter(k8sClient, perTunnelMgr, logger)
+		go trafficReporter.Run(ctx, cfg.TrafficReportInterval)
+	}
+
+	// Revisit every Service regularly so keys are rotated when they fall due
+	if cfg.KeyRotationInterval > 0 {
+		checkInterval := time.Hour
+		if cfg.KeyRotationInterval < checkInterval {
+			checkInterval = cfg.KeyRotationInterval
+		}
+		go wait.Until(watcher.EnqueueAll, checkInterval, ctx.Done())
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -60,6 +203,21 @@ func main() {
 		cancel()
 	}()
 
+	// Start the admission webhook
+	if cfg.WebhookAddr != "" {
+		validator := webhook.NewValidator(servers, k8sClient)
+		validator.SetSharedInterface(cfg.TunnelMode == config.TunnelModeShared)
+		webhookServer := webhook.NewServer(cfg.WebhookAddr, cfg.WebhookCertFile, cfg.WebhookKeyFile, validator, logger)
+		go func() {
+			if err := webhookServer.Start(ctx); err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error": err.Error(),
+				}).Error("Webhook server failed")
+				cancel()
+			}
+		}()
+	}
+
 	// Start the watcher
 	logger.Info("Starting easy-tunnel-lb controller")
 	if err := watcher.Start(ctx); err != nil {
@@ -68,4 +226,18 @@ func main() {
 		}).Error("Controller failed")
 		os.Exit(1)
 	}
-} 
\ No newline at end of file
+}
+
+// newWireGuardBackend returns the backend configuring per-tunnel interfaces
+func newWireGuardBackend(name string) (tunnel.Backend, error) {
+	switch name {
+	case config.WireGuardBackendNetlink:
+		return tunnel.NewNetlinkBackend()
+	case config.WireGuardBackendExec:
+		return tunnel.NewExecBackend(), nil
+	case config.WireGuardBackendUserspace:
+		return tunnel.NewUserspaceBackend(), nil
+	default:
+		return tunnel.DetectBackend(), nil
+	}
+}
@@ -2,18 +2,55 @@ package api_client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"time"
 )
 
+// IdempotencyKeyHeader carries the key that makes a retried create return the
+// tunnel created by the first attempt
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy controls how requests are retried after network errors, 5xx and
+// 429 responses. Only idempotent requests are retried: GET, PUT and DELETE, and
+// creates that carry an idempotency key.
+type RetryPolicy struct {
+	// MaxRetries is how often a request is retried; zero disables retries
+	MaxRetries int
+	// MinBackoff is the wait before the first retry, doubling with every retry
+	MinBackoff time.Duration
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of new clients
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
 // Client represents an API client for the tunnel server
 type Client struct {
 	baseURL    string
 	apiKey     string
+	caBundle   []byte
 	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// Credentials authenticate the controller to a tunnel server
+type Credentials struct {
+	APIKey string
+	// CABundle is the PEM encoded CA bundle trusted for the server, if any
+	CABundle []byte
 }
 
 // NewClient creates a new API client instance
@@ -24,13 +61,56 @@ func NewClient(baseURL, apiKey string) *Client {
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		retry: DefaultRetryPolicy,
 	}
 }
 
-// CreateTunnel sends a request to create a new tunnel
-func (c *Client) CreateTunnel(req *TunnelRequest) (*TunnelResponse, error) {
+// NewClientWithCA creates a new API client that trusts the given PEM encoded CA bundle
+// in addition to the system roots
+func NewClientWithCA(baseURL, apiKey string, caBundle []byte) (*Client, error) {
+	client := NewClient(baseURL, apiKey)
+	if len(caBundle) == 0 {
+		return client, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("failed to parse CA bundle")
+	}
+	client.caBundle = caBundle
+
+	client.httpClient.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	return client, nil
+}
+
+// Credentials returns the client's credentials, for tunnel transports that
+// connect to the same server
+func (c *Client) Credentials() Credentials {
+	return Credentials{
+		APIKey:   c.apiKey,
+		CABundle: c.caBundle,
+	}
+}
+
+// SetRetryPolicy sets how failed requests are retried
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// CreateTunnel sends a request to create a new tunnel. Creates are only retried
+// when the request carries an idempotency key.
+func (c *Client) CreateTunnel(ctx context.Context, req *TunnelRequest) (*TunnelResponse, error) {
 	resp := &TunnelResponse{}
-	err := c.doRequest("POST", "/api/tunnels", req, resp)
+	err := c.doRequest(ctx, "POST", "/api/tunnels", req.IdempotencyKey, req, resp)
 	if err != nil {
 		return nil, fmt.Errorf("create tunnel request failed: %w", err)
 	}
@@ -38,18 +118,29 @@ func (c *Client) CreateTunnel(req *TunnelRequest) (*TunnelResponse, error) {
 }
 
 // UpdateTunnel updates an existing tunnel
-func (c *Client) UpdateTunnel(tunnelID string, req *TunnelRequest) (*TunnelResponse, error) {
+func (c *Client) UpdateTunnel(ctx context.Context, tunnelID string, req *TunnelRequest) (*TunnelResponse, error) {
 	resp := &TunnelResponse{}
-	err := c.doRequest("PUT", fmt.Sprintf("/api/tunnels/%s", tunnelID), req, resp)
+	err := c.doRequest(ctx, "PUT", fmt.Sprintf("/api/tunnels/%s", tunnelID), "", req, resp)
 	if err != nil {
 		return nil, fmt.Errorf("update tunnel request failed: %w", err)
 	}
 	return resp, nil
 }
 
+// RotateKey registers a new public key for an existing tunnel. The server runs a peer
+// for the old and the new key until the grace period ends.
+func (c *Client) RotateKey(ctx context.Context, tunnelID string, req *RotateKeyRequest) (*TunnelResponse, error) {
+	resp := &TunnelResponse{}
+	err := c.doRequest(ctx, "POST", fmt.Sprintf("/api/tunnels/%s/rotate", tunnelID), "", req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("rotate key request failed: %w", err)
+	}
+	return resp, nil
+}
+
 // DeleteTunnel removes an existing tunnel
-func (c *Client) DeleteTunnel(tunnelID string) error {
-	err := c.doRequest("DELETE", fmt.Sprintf("/api/tunnels/%s", tunnelID), nil, nil)
+func (c *Client) DeleteTunnel(ctx context.Context, tunnelID string) error {
+	err := c.doRequest(ctx, "DELETE", fmt.Sprintf("/api/tunnels/%s", tunnelID), "", nil, nil)
 	if err != nil {
 		return fmt.Errorf("delete tunnel request failed: %w", err)
 	}
@@ -57,49 +148,123 @@ func (c *Client) DeleteTunnel(tunnelID string) error {
 }
 
 // GetTunnelStatus retrieves the current status of a tunnel
-func (c *Client) GetTunnelStatus(tunnelID string) (*TunnelStatus, error) {
+func (c *Client) GetTunnelStatus(ctx context.Context, tunnelID string) (*TunnelStatus, error) {
 	resp := &TunnelStatus{}
-	err := c.doRequest("GET", fmt.Sprintf("/api/tunnels/%s/status", tunnelID), nil, resp)
+	err := c.doRequest(ctx, "GET", fmt.Sprintf("/api/tunnels/%s/status", tunnelID), "", nil, resp)
 	if err != nil {
 		return nil, fmt.Errorf("get tunnel status failed: %w", err)
 	}
 	return resp, nil
 }
 
-func (c *Client) doRequest(method, path string, reqBody interface{}, respBody interface{}) error {
-	var bodyReader io.Reader
+// GetServerInfo retrieves the capabilities and capacity of the tunnel server
+func (c *Client) GetServerInfo(ctx context.Context) (*ServerInfo, error) {
+	resp := &ServerInfo{}
+	err := c.doRequest(ctx, "GET", "/api/server/info", "", nil, resp)
+	if err != nil {
+		return nil, fmt.Errorf("get server info failed: %w", err)
+	}
+	return resp, nil
+}
+
+// doRequest sends a request, retrying idempotent ones according to the retry
+// policy. A non-empty idempotency key is sent along and makes the request idempotent.
+func (c *Client) doRequest(ctx context.Context, method, path, idempotencyKey string, reqBody interface{}, respBody interface{}) error {
+	var body []byte
 	if reqBody != nil {
 		jsonData, err := json.Marshal(reqBody)
 		if err != nil {
 			return fmt.Errorf("failed to marshal request body: %w", err)
 		}
-		bodyReader = bytes.NewReader(jsonData)
+		body = jsonData
 	}
 
-	req, err := http.NewRequest(method, c.baseURL+path, bodyReader)
+	idempotent := method != http.MethodPost || idempotencyKey != ""
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(ctx, method, path, idempotencyKey, body, respBody)
+		if err == nil || !retry || !idempotent || attempt >= c.retry.MaxRetries {
+			return err
+		}
+
+		// Wait as long as the server asks, unless that is longer than we would
+		// ever back off and the caller is better off scheduling the retry
+		wait := c.backoff(attempt)
+		if after, ok := RetryAfter(err); ok {
+			if c.retry.MaxBackoff > 0 && after > c.retry.MaxBackoff {
+				return err
+			}
+			wait = max(wait, after)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w after %d attempts, last: %v", ctx.Err(), attempt+1, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends a request once and reports whether a failure may be retried
+func (c *Client) attempt(ctx context.Context, method, path, idempotencyKey string, body []byte, respBody interface{}) (bool, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bodyReader)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return false, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+c.apiKey)
 	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return retryable(ctx, err), fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		apiErr := newAPIError(resp, body)
+		return resp.StatusCode >= 500 || apiErr.Is(ErrRateLimited), apiErr
 	}
 
 	if respBody != nil {
 		if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
-			return fmt.Errorf("failed to decode response: %w", err)
+			return false, fmt.Errorf("failed to decode response: %w", err)
 		}
 	}
 
-	return nil
+	return false, nil
+}
+
+// retryable reports whether a request that failed without a response may succeed
+// when retried. Network errors are, but not our own cancellation or a server
+// certificate we do not trust.
+func retryable(ctx context.Context, err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return ctx.Err() == nil && !errors.As(err, &certErr)
+}
+
+// backoff returns the wait before a retry: exponential in the attempt, capped
+// and jittered so clients failing together do not retry together
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.retry.MinBackoff
+	for i := 0; i < attempt && backoff < c.retry.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if c.retry.MaxBackoff > 0 && backoff > c.retry.MaxBackoff {
+		backoff = c.retry.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
 } 
\ No newline at end of file
@@ -1,10 +1,14 @@
 package api_client
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,12 +21,21 @@ func TestCreateTunnel(t *testing.T) {
 		assert.Equal(t, "POST", r.Method)
 		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
 
+		var body TunnelRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "client-public-key", body.PublicKey)
+
 		// Return mock response
 		resp := &TunnelResponse{
 			TunnelID:     "test-tunnel",
 			ExternalHost: "test.example.com",
 			Status:       StatusActive,
-			WGConfig:     "test-config",
+			Peer: &PeerConfig{
+				PublicKey:  "server-public-key",
+				Endpoint:   "test.example.com:51820",
+				Addresses:  []string{"10.0.0.2/32"},
+				AllowedIPs: []string{"10.0.0.1/32"},
+			},
 		}
 		json.NewEncoder(w).Encode(resp)
 	}))
@@ -37,14 +50,57 @@ func TestCreateTunnel(t *testing.T) {
 		IngressNamespace: "default",
 		Hostname:         "test.example.com",
 		Ports:           []int{80, 443},
+		PublicKey:        "client-public-key",
 	}
 
-	resp, err := client.CreateTunnel(req)
+	resp, err := client.CreateTunnel(context.Background(), req)
 	assert.NoError(t, err)
 	assert.Equal(t, "test-tunnel", resp.TunnelID)
 	assert.Equal(t, "test.example.com", resp.ExternalHost)
 	assert.Equal(t, StatusActive, resp.Status)
-	assert.Equal(t, "test-config", resp.WGConfig)
+	if assert.NotNil(t, resp.Peer) {
+		assert.Equal(t, "server-public-key", resp.Peer.PublicKey)
+		assert.Equal(t, "test.example.com:51820", resp.Peer.Endpoint)
+		assert.Equal(t, []string{"10.0.0.2/32"}, resp.Peer.Addresses)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	// Create test server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify request
+		assert.Equal(t, "/api/tunnels/test-tunnel/rotate", r.URL.Path)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+
+		var body RotateKeyRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "new-public-key", body.PublicKey)
+		assert.Equal(t, 300, body.GracePeriodSeconds)
+
+		// Return mock response
+		resp := &TunnelResponse{
+			TunnelID: "test-tunnel",
+			Status:   StatusActive,
+			Peer:     &PeerConfig{PublicKey: "server-public-key"},
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	// Create client
+	client := NewClient(server.URL, "test-key")
+
+	// Test request
+	resp, err := client.RotateKey(context.Background(), "test-tunnel", &RotateKeyRequest{
+		PublicKey:          "new-public-key",
+		GracePeriodSeconds: 300,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "test-tunnel", resp.TunnelID)
+	if assert.NotNil(t, resp.Peer) {
+		assert.Equal(t, "server-public-key", resp.Peer.PublicKey)
+	}
 }
 
 func TestDeleteTunnel(t *testing.T) {
@@ -63,7 +119,7 @@ func TestDeleteTunnel(t *testing.T) {
 	client := NewClient(server.URL, "test-key")
 
 	// Test request
-	err := client.DeleteTunnel("test-tunnel")
+	err := client.DeleteTunnel(context.Background(), "test-tunnel")
 	assert.NoError(t, err)
 }
 
@@ -88,8 +144,352 @@ func TestGetTunnelStatus(t *testing.T) {
 	client := NewClient(server.URL, "test-key")
 
 	// Test request
-	status, err := client.GetTunnelStatus("test-tunnel")
+	status, err := client.GetTunnelStatus(context.Background(), "test-tunnel")
 	assert.NoError(t, err)
 	assert.Equal(t, "test-tunnel", status.TunnelID)
 	assert.Equal(t, StatusActive, status.Status)
-} 
\ No newline at end of file
+} 
+func TestGetServerInfo(t *testing.T) {
+	// Create test server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verify request
+		assert.Equal(t, "/api/server/info", r.URL.Path)
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+
+		// Return mock response
+		resp := &ServerInfo{
+			Capabilities:  []string{"wireguard"},
+			MaxTunnels:    10,
+			ActiveTunnels: 3,
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	// Create client
+	client := NewClient(server.URL, "test-key")
+
+	// Test request
+	info, err := client.GetServerInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wireguard"}, info.Capabilities)
+	assert.Equal(t, 10, info.MaxTunnels)
+	assert.Equal(t, 3, info.ActiveTunnels)
+}
+
+func TestRequestCancellation(t *testing.T) {
+	// Server that never answers until the client gives up or the test ends
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client := NewClient(server.URL, "test-key")
+
+	calls := map[string]func(ctx context.Context) error{
+		"create": func(ctx context.Context) error {
+			_, err := client.CreateTunnel(ctx, &TunnelRequest{})
+			return err
+		},
+		"update": func(ctx context.Context) error {
+			_, err := client.UpdateTunnel(ctx, "test-tunnel", &TunnelRequest{})
+			return err
+		},
+		"rotate": func(ctx context.Context) error {
+			_, err := client.RotateKey(ctx, "test-tunnel", &RotateKeyRequest{})
+			return err
+		},
+		"delete": func(ctx context.Context) error {
+			return client.DeleteTunnel(ctx, "test-tunnel")
+		},
+		"status": func(ctx context.Context) error {
+			_, err := client.GetTunnelStatus(ctx, "test-tunnel")
+			return err
+		},
+		"info": func(ctx context.Context) error {
+			_, err := client.GetServerInfo(ctx)
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			// Cancelling aborts the call in flight
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			err := call(ctx)
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.Less(t, time.Since(start), 5*time.Second)
+
+			// Deadlines are propagated
+			ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, call(ctx), context.DeadlineExceeded)
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// Server that fails a number of times before it answers
+	var failures, attempts int
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+		if attempts <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(&TunnelResponse{TunnelID: "test-tunnel", Status: StatusActive})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	reset := func(n int) {
+		failures, attempts, keys = n, 0, nil
+	}
+
+	// Idempotent calls are retried until they succeed
+	reset(2)
+	_, err := client.UpdateTunnel(context.Background(), "test-tunnel", &TunnelRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// ... but not beyond the policy
+	reset(10)
+	assert.Error(t, client.DeleteTunnel(context.Background(), "test-tunnel"))
+	assert.Equal(t, 4, attempts)
+
+	// Creates are retried with the same key when they carry one
+	reset(1)
+	resp, err := client.CreateTunnel(context.Background(), &TunnelRequest{IdempotencyKey: "key-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "test-tunnel", resp.TunnelID)
+	assert.Equal(t, []string{"key-1", "key-1"}, keys)
+
+	// ... and not retried without one
+	reset(1)
+	_, err = client.CreateTunnel(context.Background(), &TunnelRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, []string{""}, keys)
+
+	// Key rotations are not idempotent
+	reset(1)
+	_, err = client.RotateKey(context.Background(), "test-tunnel", &RotateKeyRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// Retries can be turned off
+	client.SetRetryPolicy(RetryPolicy{})
+	reset(1)
+	_, err = client.GetTunnelStatus(context.Background(), "test-tunnel")
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetries_ClientErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	_, err := client.UpdateTunnel(context.Background(), "test-tunnel", &TunnelRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetries_NetworkErrors(t *testing.T) {
+	// A create whose response is lost is retried and returns the tunnel created first
+	tunnels := map[string]string{}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if _, ok := tunnels[key]; !ok {
+			tunnels[key] = fmt.Sprintf("tunnel-%d", len(tunnels)+1)
+		}
+		if attempts == 1 {
+			// Drop the connection before answering
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(&TunnelResponse{TunnelID: tunnels[key], Status: StatusActive})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	resp, err := client.CreateTunnel(context.Background(), &TunnelRequest{IdempotencyKey: "key-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, "tunnel-1", resp.TunnelID)
+	assert.Len(t, tunnels, 1)
+}
+
+func TestRetries_Cancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 10, MinBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	// Cancelling stops waiting for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.GetServerInfo(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestAPIErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tunnels/missing":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&ErrorResponse{Code: "tunnel_not_found", Message: "tunnel missing does not exist"})
+		case "/api/tunnels":
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&ErrorResponse{Code: "idempotency_key_reused", Message: "key was used for another request"})
+		case "/api/tunnels/limited/status":
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid API key"))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	// Not found, with the server's error body
+	_, err := client.UpdateTunnel(context.Background(), "missing", &TunnelRequest{})
+	assert.True(t, IsNotFound(err))
+	assert.False(t, IsUnauthorized(err))
+	var apiErr *APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Equal(t, "tunnel_not_found", apiErr.Code)
+		assert.Equal(t, "tunnel missing does not exist", apiErr.Message)
+	}
+	assert.EqualError(t, err, "update tunnel request failed: request failed with status 404 (tunnel_not_found): tunnel missing does not exist")
+
+	// Conflict
+	_, err = client.CreateTunnel(context.Background(), &TunnelRequest{IdempotencyKey: "key-1"})
+	assert.True(t, IsConflict(err))
+	assert.ErrorIs(t, err, ErrConflict)
+
+	// Unauthorized, with a body that is not an error document
+	_, err = client.GetServerInfo(context.Background())
+	assert.True(t, IsUnauthorized(err))
+	assert.False(t, IsNotFound(err))
+	assert.ErrorContains(t, err, "request failed with status 401: invalid API key")
+
+	// Rate limited for longer than the client backs off is left to the caller
+	start := time.Now()
+	_, err = client.GetTunnelStatus(context.Background(), "limited")
+	assert.True(t, IsRateLimited(err))
+	after, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, after)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Errors without a response match none of the sentinels
+	_, ok = RetryAfter(fmt.Errorf("request failed: %w", context.DeadlineExceeded))
+	assert.False(t, ok)
+	assert.False(t, IsNotFound(context.DeadlineExceeded))
+}
+
+func TestRetries_RateLimited(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(&ServerInfo{MaxTunnels: 1})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+
+	_, err := client.GetServerInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("-5", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
+
+func TestBackoff(t *testing.T) {
+	client := NewClient("http://localhost", "test-key")
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 10, MinBackoff: time.Second, MaxBackoff: 8 * time.Second})
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		backoff := client.backoff(attempt)
+		assert.GreaterOrEqual(t, backoff, want/2)
+		assert.LessOrEqual(t, backoff, want)
+	}
+}
+
+func TestNewClientWithCA(t *testing.T) {
+	// Create TLS test server
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&ServerInfo{MaxTunnels: 1})
+	}))
+	defer server.Close()
+
+	caBundle := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+
+	// Client trusting the server certificate succeeds
+	client, err := NewClientWithCA(server.URL, "test-key", caBundle)
+	assert.NoError(t, err)
+	_, err = client.GetServerInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{APIKey: "test-key", CABundle: caBundle}, client.Credentials())
+
+	// Client without the CA bundle rejects the certificate
+	_, err = NewClient(server.URL, "test-key").GetServerInfo(context.Background())
+	assert.Error(t, err)
+
+	// Invalid bundle is rejected up front
+	_, err = NewClientWithCA(server.URL, "test-key", []byte("not a certificate"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package api_client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors matched by errors.Is against the *APIError of a failed request
+var (
+	// ErrNotFound matches 404 responses, e.g. for a tunnel the server does not know
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized matches 401 and 403 responses, e.g. for a wrong API key
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrConflict matches 409 responses
+	ErrConflict = errors.New("conflict")
+	// ErrRateLimited matches 429 responses
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// APIError is an error status returned by the tunnel server
+type APIError struct {
+	StatusCode int
+	// Code is the error code from the server's ErrorResponse, if it sent one
+	Code string
+	// Message is the message from the server's ErrorResponse, or the raw body
+	// when it is not one
+	Message string
+	// RetryAfter is how long the server asked to wait before trying again, from
+	// its Retry-After header; zero when it did not ask
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("request failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Is reports whether the error has the status of one of the error sentinels
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// IsNotFound reports whether a request failed because the resource does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsUnauthorized reports whether the server rejected the client's credentials
+func IsUnauthorized(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
+
+// IsConflict reports whether a request conflicted with the server's state
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// IsRateLimited reports whether the server turned a request away as too frequent
+func IsRateLimited(err error) bool {
+	return errors.Is(err, ErrRateLimited)
+}
+
+// RetryAfter returns how long the server asked to wait before a failed request
+// is tried again, if it did
+func RetryAfter(err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter <= 0 {
+		return 0, false
+	}
+	return apiErr.RetryAfter, true
+}
+
+// newAPIError builds the error for a response with an error status
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && (errResp.Code != "" || errResp.Message != "") {
+		apiErr.Code = errResp.Code
+		apiErr.Message = errResp.Message
+	}
+	return apiErr
+}
+
+// parseRetryAfter parses a Retry-After header, which holds either seconds or an
+// HTTP date. Missing, invalid and past values give zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
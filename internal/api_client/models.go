@@ -6,16 +6,110 @@ type TunnelRequest struct {
 	IngressNamespace string            `json:"ingressNamespace"`
 	Hostname         string            `json:"hostname"`
 	Ports           []int             `json:"ports"`
+	// UDPPorts lists the ports of Ports the Service serves over UDP
+	UDPPorts        []int             `json:"udpPorts,omitempty"`
 	Annotations     map[string]string `json:"annotations"`
+	// PublicKey is the WireGuard public key of our end; the private key never leaves the cluster
+	PublicKey       string            `json:"publicKey"`
+	// Tuning carries the WireGuard settings requested for the Service, if any
+	Tuning          *TunnelTuning     `json:"tuning,omitempty"`
+	// Transports lists the transports the controller can run, for the server to pick from
+	Transports      []string          `json:"transports,omitempty"`
+	// SSHPublicKey is the SSH key our end of an SSH tunnel logs in with, in
+	// authorized_keys format; set when the ssh transport is offered
+	SSHPublicKey    string            `json:"sshPublicKey,omitempty"`
+	// IdempotencyKey is sent as the Idempotency-Key header of a create so a retried
+	// create returns the tunnel of the first attempt; it is not part of the body
+	IdempotencyKey  string            `json:"-"`
+}
+
+// TunnelTuning holds per-Service WireGuard settings. Zero values leave the
+// choice to the server.
+type TunnelTuning struct {
+	// MTU of the tunnel interfaces on both ends
+	MTU int `json:"mtu,omitempty"`
+	// PersistentKeepalive is the keepalive interval in seconds both ends send;
+	// nil leaves it to the server and 0 turns keepalives off
+	PersistentKeepalive *int `json:"persistentKeepalive,omitempty"`
+	// ListenPort is the UDP port our end listens on
+	ListenPort int `json:"listenPort,omitempty"`
 }
 
 // TunnelResponse represents the response from the server for a tunnel request
 type TunnelResponse struct {
-	TunnelID     string `json:"tunnelId"`
-	ExternalIP   string `json:"externalIp,omitempty"`
-	ExternalHost string `json:"externalHost,omitempty"`
-	Status       string `json:"status"`
-	WGConfig     string `json:"wgConfig,omitempty"`
+	TunnelID     string      `json:"tunnelId"`
+	ExternalIP   string      `json:"externalIp,omitempty"`
+	ExternalHost string      `json:"externalHost,omitempty"`
+	Status       string      `json:"status"`
+	// Transport names how the server provisioned the tunnel; empty means wireguard
+	Transport    string      `json:"transport,omitempty"`
+	Peer         *PeerConfig `json:"peer,omitempty"`
+	// SSH describes the server end of tunnels on the ssh transport
+	SSH          *SSHConfig  `json:"ssh,omitempty"`
+	// Mux describes the server end of tunnels on the tls transport
+	Mux          *MuxConfig  `json:"mux,omitempty"`
+}
+
+// PeerConfig describes the server end of a tunnel, from which the controller
+// renders its own WireGuard config
+type PeerConfig struct {
+	// PublicKey is the server's WireGuard public key
+	PublicKey string `json:"publicKey"`
+	// Endpoint is the host:port the server listens on
+	Endpoint string `json:"endpoint"`
+	// Addresses are assigned to our end of the tunnel
+	Addresses []string `json:"addresses"`
+	// AllowedIPs are routed to the server through the tunnel
+	AllowedIPs []string `json:"allowedIps"`
+	// PersistentKeepalive is the keepalive interval in seconds, 0 for off
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+	// MTU is the interface MTU the server uses for the tunnel, 0 if it has no preference
+	MTU int `json:"mtu,omitempty"`
+}
+
+// SSHConfig describes the SSH daemon an ssh transport tunnel logs in to and the
+// ports it forwards from the server
+type SSHConfig struct {
+	// Endpoint is the host:port of the server's SSH daemon
+	Endpoint string `json:"endpoint"`
+	// User is the account our end logs in as
+	User string `json:"user"`
+	// HostKey is the server's public host key in authorized_keys format
+	HostKey string `json:"hostKey"`
+	// BindAddress is the server address the forwards listen on; empty means all
+	BindAddress string `json:"bindAddress,omitempty"`
+	// Forwards map server ports to Service ports; empty forwards every Service
+	// port from the same server port
+	Forwards []SSHForward `json:"forwards,omitempty"`
+}
+
+// SSHForward is one remote port forward of an ssh transport tunnel
+type SSHForward struct {
+	// RemotePort is the port the server listens on
+	RemotePort int `json:"remotePort"`
+	// Port is the Service port connections are forwarded to
+	Port int `json:"port"`
+}
+
+// MuxConfig describes the endpoint a tls transport tunnel connects to. The
+// connection authenticates with the same API key as the API client.
+type MuxConfig struct {
+	// URL is the tunnel endpoint, wss:// for WebSocket or tls:// for raw TLS
+	URL string `json:"url"`
+	// Session identifies the tunnel on the endpoint; reconnecting with it resumes
+	// the tunnel without giving up its external address
+	Session string `json:"session"`
+}
+
+// RotateKeyRequest registers a new WireGuard public key for an existing tunnel
+type RotateKeyRequest struct {
+	// PublicKey is the new public key of our end
+	PublicKey string `json:"publicKey"`
+	// SSHPublicKey is the SSH key derived from the new key, set for ssh transport tunnels
+	SSHPublicKey string `json:"sshPublicKey,omitempty"`
+	// GracePeriodSeconds is how long the server keeps accepting the previous key,
+	// so the tunnel stays up while our end switches over
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
 }
 
 // TunnelStatus represents the current status of a tunnel
@@ -25,6 +119,21 @@ type TunnelStatus struct {
 	Error    string `json:"error,omitempty"`
 }
 
+// ServerInfo describes what a tunnel server supports and how loaded it is
+type ServerInfo struct {
+	Version       string   `json:"version,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
+	MaxTunnels    int      `json:"maxTunnels"`
+	ActiveTunnels int      `json:"activeTunnels"`
+}
+
+// ErrorResponse is the body the server sends with an error status
+type ErrorResponse struct {
+	// Code is a machine-readable error code such as tunnel_not_found
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 // Error types
 const (
 	StatusActive    = "active"
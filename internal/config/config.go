@@ -2,30 +2,159 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 // Config holds the configuration for the easy-tunnel-lb agent
 type Config struct {
-	ServerURL     string
-	APIKey        string
-	LogLevel      string
-	WatchInterval int
+	ServerURL             string
+	APIKey                string
+	LogLevel              string
+	WatchInterval         int
+	EnableTunnelServers   bool
+	FailoverThreshold     int
+	WebhookAddr           string
+	WebhookCertFile       string
+	WebhookKeyFile        string
+	DryRun                bool
+	Plan                  bool
+	TunnelMode            string
+	WireGuardBackend      string
+	Namespace             string
+	KeyRotationInterval   time.Duration
+	WireGuardConfigPolicy string
+	TunnelHealthInterval  time.Duration
+	TunnelStalePeriod     time.Duration
+	TrafficReportInterval time.Duration
+	APIMaxRetries         int
+	APIRetryBackoff       time.Duration
 }
 
+// Tunnel modes select how local WireGuard interfaces are laid out
+const (
+	// TunnelModePerTunnel runs one wg-quick interface per tunnel
+	TunnelModePerTunnel = "per-tunnel"
+	// TunnelModeShared runs one interface per tunnel server with a peer per tunnel
+	TunnelModeShared = "shared"
+)
+
+// WireGuard backends select how per-tunnel interfaces are configured
+const (
+	// WireGuardBackendAuto uses netlink when the kernel supports WireGuard and wg-quick otherwise
+	WireGuardBackendAuto = "auto"
+	// WireGuardBackendNetlink configures interfaces through netlink only
+	WireGuardBackendNetlink = "netlink"
+	// WireGuardBackendExec shells out to wg-quick
+	WireGuardBackendExec = "exec"
+	// WireGuardBackendUserspace runs WireGuard in-process and proxies tunnel connections to Services
+	WireGuardBackendUserspace = "userspace"
+)
+
+// WireGuard config policies select what happens to script hooks and DNS settings in tunnel configs
+const (
+	// WireGuardConfigPolicyStrip removes them before the config is applied
+	WireGuardConfigPolicyStrip = "strip"
+	// WireGuardConfigPolicyReject refuses configs that contain them
+	WireGuardConfigPolicyReject = "reject"
+)
+
 // LoadConfig loads configuration from environment variables
 func LoadConfig() (*Config, error) {
 	config := &Config{
-		ServerURL:     getEnvOrDefault("SERVER_URL", ""),
-		APIKey:        getEnvOrDefault("API_KEY", ""),
-		LogLevel:      getEnvOrDefault("LOG_LEVEL", "info"),
-		WatchInterval: 30, // Default 30 seconds
+		ServerURL:             getEnvOrDefault("SERVER_URL", ""),
+		APIKey:                getEnvOrDefault("API_KEY", ""),
+		LogLevel:              getEnvOrDefault("LOG_LEVEL", "info"),
+		WatchInterval:         30, // Default 30 seconds
+		EnableTunnelServers:   getEnvOrDefault("ENABLE_TUNNEL_SERVERS", "false") == "true",
+		WebhookAddr:           getEnvOrDefault("WEBHOOK_ADDR", ""),
+		WebhookCertFile:       getEnvOrDefault("WEBHOOK_CERT_FILE", "/etc/webhook/certs/tls.crt"),
+		WebhookKeyFile:        getEnvOrDefault("WEBHOOK_KEY_FILE", "/etc/webhook/certs/tls.key"),
+		DryRun:                getEnvOrDefault("DRY_RUN", "false") == "true",
+		Plan:                  getEnvOrDefault("PLAN", "false") == "true",
+		TunnelMode:            getEnvOrDefault("TUNNEL_MODE", TunnelModePerTunnel),
+		WireGuardBackend:      getEnvOrDefault("WIREGUARD_BACKEND", WireGuardBackendAuto),
+		Namespace:             getEnvOrDefault("POD_NAMESPACE", "default"),
+		WireGuardConfigPolicy: getEnvOrDefault("WIREGUARD_CONFIG_POLICY", WireGuardConfigPolicyStrip),
+	}
+
+	// A plan is always computed without side effects
+	if config.Plan {
+		config.DryRun = true
+	}
+
+	failoverThreshold, err := strconv.Atoi(getEnvOrDefault("FAILOVER_THRESHOLD", "3"))
+	if err != nil || failoverThreshold < 1 {
+		return nil, ErrInvalidFailoverThreshold
+	}
+	config.FailoverThreshold = failoverThreshold
+
+	keyRotationInterval, err := time.ParseDuration(getEnvOrDefault("KEY_ROTATION_INTERVAL", "0"))
+	if err != nil || keyRotationInterval < 0 {
+		return nil, ErrInvalidKeyRotationInterval
+	}
+	config.KeyRotationInterval = keyRotationInterval
+
+	tunnelHealthInterval, err := time.ParseDuration(getEnvOrDefault("TUNNEL_HEALTH_INTERVAL", "30s"))
+	if err != nil || tunnelHealthInterval <= 0 {
+		return nil, ErrInvalidTunnelHealthInterval
+	}
+	config.TunnelHealthInterval = tunnelHealthInterval
+
+	tunnelStalePeriod, err := time.ParseDuration(getEnvOrDefault("TUNNEL_STALE_PERIOD", "5m"))
+	if err != nil || tunnelStalePeriod < 0 {
+		return nil, ErrInvalidTunnelStalePeriod
+	}
+	config.TunnelStalePeriod = tunnelStalePeriod
+
+	trafficReportInterval, err := time.ParseDuration(getEnvOrDefault("TRAFFIC_REPORT_INTERVAL", "5m"))
+	if err != nil || trafficReportInterval < 0 {
+		return nil, ErrInvalidTrafficReportInterval
+	}
+	config.TrafficReportInterval = trafficReportInterval
+
+	apiMaxRetries, err := strconv.Atoi(getEnvOrDefault("API_MAX_RETRIES", "3"))
+	if err != nil || apiMaxRetries < 0 {
+		return nil, ErrInvalidAPIMaxRetries
+	}
+	config.APIMaxRetries = apiMaxRetries
+
+	apiRetryBackoff, err := time.ParseDuration(getEnvOrDefault("API_RETRY_BACKOFF", "500ms"))
+	if err != nil || apiRetryBackoff <= 0 {
+		return nil, ErrInvalidAPIRetryBackoff
+	}
+	config.APIRetryBackoff = apiRetryBackoff
+
+	if config.TunnelMode != TunnelModePerTunnel && config.TunnelMode != TunnelModeShared {
+		return nil, ErrInvalidTunnelMode
+	}
+
+	switch config.WireGuardBackend {
+	case WireGuardBackendAuto, WireGuardBackendNetlink, WireGuardBackendExec, WireGuardBackendUserspace:
+	default:
+		return nil, ErrInvalidWireGuardBackend
+	}
+
+	if config.WireGuardConfigPolicy != WireGuardConfigPolicyStrip && config.WireGuardConfigPolicy != WireGuardConfigPolicyReject {
+		return nil, ErrInvalidWireGuardConfigPolicy
+	}
+
+	// Shared interfaces are kernel interfaces
+	if config.TunnelMode == TunnelModeShared && config.WireGuardBackend == WireGuardBackendUserspace {
+		return nil, ErrUserspaceSharedMode
+	}
+
+	// Tunnels on a shared interface share its key
+	if config.TunnelMode == TunnelModeShared && config.KeyRotationInterval > 0 {
+		return nil, ErrSharedKeyRotation
 	}
 
-	if config.ServerURL == "" {
+	// With TunnelServer resources enabled the single server from the environment is optional
+	if config.ServerURL == "" && !config.EnableTunnelServers {
 		return nil, ErrMissingServerURL
 	}
 
-	if config.APIKey == "" {
+	if config.ServerURL != "" && config.APIKey == "" {
 		return nil, ErrMissingAPIKey
 	}
 
@@ -44,6 +173,18 @@ func getEnvOrDefault(key, defaultValue string) string {
 var (
 	ErrMissingAPIKey = ConfigError("API_KEY environment variable is required")
 	ErrMissingServerURL = ConfigError("SERVER_URL environment variable is required")
+	ErrInvalidFailoverThreshold = ConfigError("FAILOVER_THRESHOLD must be a positive integer")
+	ErrInvalidTunnelMode = ConfigError("TUNNEL_MODE must be per-tunnel or shared")
+	ErrInvalidWireGuardBackend = ConfigError("WIREGUARD_BACKEND must be auto, netlink, exec or userspace")
+	ErrUserspaceSharedMode = ConfigError("TUNNEL_MODE=shared cannot be used with WIREGUARD_BACKEND=userspace")
+	ErrInvalidKeyRotationInterval = ConfigError("KEY_ROTATION_INTERVAL must be a non-negative duration such as 720h")
+	ErrSharedKeyRotation = ConfigError("KEY_ROTATION_INTERVAL cannot be used with TUNNEL_MODE=shared")
+	ErrInvalidWireGuardConfigPolicy = ConfigError("WIREGUARD_CONFIG_POLICY must be strip or reject")
+	ErrInvalidTunnelHealthInterval = ConfigError("TUNNEL_HEALTH_INTERVAL must be a positive duration such as 30s")
+	ErrInvalidTunnelStalePeriod = ConfigError("TUNNEL_STALE_PERIOD must be a non-negative duration such as 5m")
+	ErrInvalidTrafficReportInterval = ConfigError("TRAFFIC_REPORT_INTERVAL must be a non-negative duration such as 5m")
+	ErrInvalidAPIMaxRetries = ConfigError("API_MAX_RETRIES must be a non-negative integer")
+	ErrInvalidAPIRetryBackoff = ConfigError("API_RETRY_BACKOFF must be a positive duration such as 500ms")
 )
 
 // ConfigError represents a configuration error
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,12 +24,397 @@ func TestLoadConfig(t *testing.T) {
 			},
 			expectError: false,
 			expected: &Config{
-				ServerURL:     "https://example.com",
-				APIKey:        "test-key",
-				LogLevel:      "debug",
-				WatchInterval: 30,
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "debug",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
 			},
 		},
+		{
+			name: "tunnel servers without default server",
+			envVars: map[string]string{
+				"ENABLE_TUNNEL_SERVERS": "true",
+			},
+			expectError: false,
+			expected: &Config{
+				LogLevel:              "info",
+				WatchInterval:         30,
+				EnableTunnelServers:   true,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "server URL without API key",
+			envVars: map[string]string{
+				"SERVER_URL":            "https://example.com",
+				"ENABLE_TUNNEL_SERVERS": "true",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "invalid failover threshold",
+			envVars: map[string]string{
+				"SERVER_URL":         "https://example.com",
+				"API_KEY":            "test-key",
+				"FAILOVER_THRESHOLD": "0",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "plan implies dry run",
+			envVars: map[string]string{
+				"SERVER_URL": "https://example.com",
+				"API_KEY":    "test-key",
+				"PLAN":       "true",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				DryRun:                true,
+				Plan:                  true,
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "shared tunnel mode",
+			envVars: map[string]string{
+				"SERVER_URL":  "https://example.com",
+				"API_KEY":     "test-key",
+				"TUNNEL_MODE": "shared",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModeShared,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "invalid tunnel mode",
+			envVars: map[string]string{
+				"SERVER_URL":  "https://example.com",
+				"API_KEY":     "test-key",
+				"TUNNEL_MODE": "mesh",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "exec wireguard backend",
+			envVars: map[string]string{
+				"SERVER_URL":        "https://example.com",
+				"API_KEY":           "test-key",
+				"WIREGUARD_BACKEND": "exec",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendExec,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "invalid wireguard backend",
+			envVars: map[string]string{
+				"SERVER_URL":        "https://example.com",
+				"API_KEY":           "test-key",
+				"WIREGUARD_BACKEND": "boringtun",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "userspace backend with shared mode",
+			envVars: map[string]string{
+				"SERVER_URL":        "https://example.com",
+				"API_KEY":           "test-key",
+				"TUNNEL_MODE":       "shared",
+				"WIREGUARD_BACKEND": "userspace",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "key rotation interval",
+			envVars: map[string]string{
+				"SERVER_URL":            "https://example.com",
+				"API_KEY":               "test-key",
+				"KEY_ROTATION_INTERVAL": "720h",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+				KeyRotationInterval:   720 * time.Hour,
+			},
+		},
+		{
+			name: "invalid key rotation interval",
+			envVars: map[string]string{
+				"SERVER_URL":            "https://example.com",
+				"API_KEY":               "test-key",
+				"KEY_ROTATION_INTERVAL": "30d",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "key rotation with shared mode",
+			envVars: map[string]string{
+				"SERVER_URL":            "https://example.com",
+				"API_KEY":               "test-key",
+				"TUNNEL_MODE":           "shared",
+				"KEY_ROTATION_INTERVAL": "720h",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "reject config policy",
+			envVars: map[string]string{
+				"SERVER_URL":              "https://example.com",
+				"API_KEY":                 "test-key",
+				"WIREGUARD_CONFIG_POLICY": "reject",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyReject,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "invalid config policy",
+			envVars: map[string]string{
+				"SERVER_URL":              "https://example.com",
+				"API_KEY":                 "test-key",
+				"WIREGUARD_CONFIG_POLICY": "allow",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "tunnel health monitoring",
+			envVars: map[string]string{
+				"SERVER_URL":             "https://example.com",
+				"API_KEY":                "test-key",
+				"TUNNEL_HEALTH_INTERVAL": "10s",
+				"TUNNEL_STALE_PERIOD":    "0",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  10 * time.Second,
+				TrafficReportInterval: 5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "invalid tunnel health interval",
+			envVars: map[string]string{
+				"SERVER_URL":             "https://example.com",
+				"API_KEY":                "test-key",
+				"TUNNEL_HEALTH_INTERVAL": "0s",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "invalid tunnel stale period",
+			envVars: map[string]string{
+				"SERVER_URL":          "https://example.com",
+				"API_KEY":             "test-key",
+				"TUNNEL_STALE_PERIOD": "-1m",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "traffic reports disabled",
+			envVars: map[string]string{
+				"SERVER_URL":              "https://example.com",
+				"API_KEY":                 "test-key",
+				"TRAFFIC_REPORT_INTERVAL": "0",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				APIMaxRetries:         3,
+				APIRetryBackoff:       500 * time.Millisecond,
+			},
+		},
+		{
+			name: "invalid traffic report interval",
+			envVars: map[string]string{
+				"SERVER_URL":              "https://example.com",
+				"API_KEY":                 "test-key",
+				"TRAFFIC_REPORT_INTERVAL": "often",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "API retries",
+			envVars: map[string]string{
+				"SERVER_URL":        "https://example.com",
+				"API_KEY":           "test-key",
+				"API_MAX_RETRIES":   "0",
+				"API_RETRY_BACKOFF": "2s",
+			},
+			expectError: false,
+			expected: &Config{
+				ServerURL:             "https://example.com",
+				APIKey:                "test-key",
+				LogLevel:              "info",
+				WatchInterval:         30,
+				FailoverThreshold:     3,
+				WebhookCertFile:       "/etc/webhook/certs/tls.crt",
+				WebhookKeyFile:        "/etc/webhook/certs/tls.key",
+				TunnelMode:            TunnelModePerTunnel,
+				WireGuardBackend:      WireGuardBackendAuto,
+				Namespace:             "default",
+				WireGuardConfigPolicy: WireGuardConfigPolicyStrip,
+				TunnelHealthInterval:  30 * time.Second,
+				TunnelStalePeriod:     5 * time.Minute,
+				TrafficReportInterval: 5 * time.Minute,
+				APIRetryBackoff:       2 * time.Second,
+			},
+		},
+		{
+			name: "invalid API retries",
+			envVars: map[string]string{
+				"SERVER_URL":      "https://example.com",
+				"API_KEY":         "test-key",
+				"API_MAX_RETRIES": "-1",
+			},
+			expectError: true,
+			expected:    nil,
+		},
+		{
+			name: "invalid API retry backoff",
+			envVars: map[string]string{
+				"SERVER_URL":        "https://example.com",
+				"API_KEY":           "test-key",
+				"API_RETRY_BACKOFF": "0s",
+			},
+			expectError: true,
+			expected:    nil,
+		},
 		{
 			name:        "missing API key",
 			envVars:     map[string]string{},
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TunnelHealthyCondition is the Service condition reporting whether its local
+// tunnels are passing traffic
+const TunnelHealthyCondition = "TunnelHealthy"
+
+// TunnelHealthReporter reports the liveness the tunnel manager observed for a tunnel
+type TunnelHealthReporter interface {
+	TunnelHealth(tunnelID string) (tunnel.Health, bool)
+}
+
+// SetTunnelHealth makes the reconciler publish the health of a Service's tunnels
+// as the TunnelHealthyCondition. Without a reporter no condition is written.
+func (r *ServiceReconciler) SetTunnelHealth(health TunnelHealthReporter) {
+	r.health = health
+}
+
+// reportHealth sets the Service's TunnelHealthyCondition from its local tunnels.
+// The condition is only written when it changes.
+func (r *ServiceReconciler) reportHealth(ctx context.Context, svc *v1.Service, tunnelIDs []string) error {
+	if r.health == nil {
+		return nil
+	}
+
+	condition := tunnelHealthCondition(r.health, tunnelIDs)
+	condition.ObservedGeneration = svc.Generation
+
+	if existing := meta.FindStatusCondition(svc.Status.Conditions, condition.Type); existing != nil &&
+		existing.Status == condition.Status &&
+		existing.Reason == condition.Reason &&
+		existing.Message == condition.Message &&
+		existing.ObservedGeneration == condition.ObservedGeneration {
+		return nil
+	}
+
+	if err := r.k8sClient.SetServiceCondition(ctx, svc, condition); err != nil {
+		return fmt.Errorf("failed to update service condition: %w", err)
+	}
+	return nil
+}
+
+// tunnelHealthCondition combines the health of several tunnels into one condition:
+// any unhealthy tunnel makes it False, any tunnel not yet known makes it Unknown
+func tunnelHealthCondition(reporter TunnelHealthReporter, tunnelIDs []string) metav1.Condition {
+	condition := metav1.Condition{
+		Type:   TunnelHealthyCondition,
+		Status: metav1.ConditionTrue,
+		Reason: tunnel.HealthReasonHandshakeRecent,
+	}
+
+	var unhealthy, unknown []string
+	monitored := false
+	for _, id := range tunnelIDs {
+		health, ok := reporter.TunnelHealth(id)
+		if !ok {
+			health = tunnel.Health{State: tunnel.HealthUnknown, Reason: tunnel.HealthReasonStarting}
+		}
+
+		switch health.State {
+		case tunnel.HealthUnhealthy:
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = health.Reason
+			unhealthy = append(unhealthy, describeHealth(id, health))
+		case tunnel.HealthUnknown:
+			if condition.Status == metav1.ConditionTrue {
+				condition.Status = metav1.ConditionUnknown
+				condition.Reason = health.Reason
+			}
+			unknown = append(unknown, describeHealth(id, health))
+		}
+		if health.Reason != tunnel.HealthReasonNotMonitored {
+			monitored = true
+		}
+	}
+	if condition.Status == metav1.ConditionTrue && !monitored {
+		condition.Reason = tunnel.HealthReasonNotMonitored
+	}
+
+	sort.Strings(unhealthy)
+	sort.Strings(unknown)
+	condition.Message = strings.Join(append(unhealthy, unknown...), "; ")
+	return condition
+}
+
+// describeHealth renders a tunnel's health for a condition message
+func describeHealth(tunnelID string, health tunnel.Health) string {
+	description := fmt.Sprintf("tunnel %s: %s", tunnelID, health.Reason)
+	if health.Message != "" {
+		description += ": " + health.Message
+	}
+	if health.Restarts > 0 {
+		description += fmt.Sprintf(" (%d restarts)", health.Restarts)
+	}
+	return description
+}
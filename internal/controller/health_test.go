@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeHealthReporter reports fixed tunnel health
+type fakeHealthReporter map[string]tunnel.Health
+
+func (f fakeHealthReporter) TunnelHealth(tunnelID string) (tunnel.Health, bool) {
+	health, ok := f[tunnelID]
+	return health, ok
+}
+
+func TestTunnelHealthCondition(t *testing.T) {
+	reporter := fakeHealthReporter{
+		"healthy":   {State: tunnel.HealthHealthy, Reason: tunnel.HealthReasonHandshakeRecent},
+		"idle":      {State: tunnel.HealthHealthy, Reason: tunnel.HealthReasonNotMonitored},
+		"starting":  {State: tunnel.HealthUnknown, Reason: tunnel.HealthReasonStarting, Message: "waiting for the first handshake"},
+		"unhealthy": {State: tunnel.HealthUnhealthy, Reason: tunnel.HealthReasonHandshakeStale, Message: "no handshake", Restarts: 2},
+	}
+
+	tests := []struct {
+		name      string
+		tunnelIDs []string
+		status    metav1.ConditionStatus
+		reason    string
+		message   string
+	}{
+		{"healthy", []string{"healthy", "idle"}, metav1.ConditionTrue, tunnel.HealthReasonHandshakeRecent, ""},
+		{"not monitored", []string{"idle"}, metav1.ConditionTrue, tunnel.HealthReasonNotMonitored, ""},
+		{"starting", []string{"healthy", "starting"}, metav1.ConditionUnknown, tunnel.HealthReasonStarting,
+			"tunnel starting: Starting: waiting for the first handshake"},
+		{"not reported yet", []string{"missing"}, metav1.ConditionUnknown, tunnel.HealthReasonStarting,
+			"tunnel missing: Starting"},
+		{"unhealthy wins", []string{"starting", "unhealthy", "healthy"}, metav1.ConditionFalse, tunnel.HealthReasonHandshakeStale,
+			"tunnel unhealthy: HandshakeStale: no handshake (2 restarts); tunnel starting: Starting: waiting for the first handshake"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := tunnelHealthCondition(reporter, tt.tunnelIDs)
+			assert.Equal(t, TunnelHealthyCondition, condition.Type)
+			assert.Equal(t, tt.status, condition.Status)
+			assert.Equal(t, tt.reason, condition.Reason)
+			assert.Equal(t, tt.message, condition.Message)
+		})
+	}
+}
+
+func TestServiceReconciler_ReportsTunnelHealth(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test-service",
+			Namespace:  "default",
+			Generation: 3,
+			Annotations: map[string]string{
+				TunnelIDAnnotation:       "test-tunnel",
+				AssignedServerAnnotation: DefaultServerName,
+			},
+		},
+	}
+
+	apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "test-tunnel", Peer: testPeer("test")}, nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "", "").Return(nil)
+	k8sMock.On("SetServiceCondition", mock.Anything, svc, metav1.Condition{
+		Type:               TunnelHealthyCondition,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: 3,
+		Reason:             tunnel.HealthReasonHandshakeStale,
+		Message:            "tunnel test-tunnel: HandshakeStale",
+	}).Return(nil).Once()
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetTunnelHealth(fakeHealthReporter{
+		"test-tunnel": {State: tunnel.HealthUnhealthy, Reason: tunnel.HealthReasonHandshakeStale},
+	})
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	// An unchanged condition is not written again
+	svc.Status.Conditions = []metav1.Condition{k8sMock.Calls[len(k8sMock.Calls)-1].Arguments.Get(2).(metav1.Condition)}
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	k8sMock.AssertExpectations(t)
+	k8sMock.AssertNumberOfCalls(t, "SetServiceCondition", 1)
+}
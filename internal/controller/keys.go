@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ErrSharedKeyRotation is returned when rotating a key that all tunnels on a server share
+var ErrSharedKeyRotation = fmt.Errorf("keys shared per tunnel server cannot be rotated per Service")
+
+// KeyStore hands out the WireGuard private key used for a Service's tunnel to a server
+// and keeps what the server assigned to the tunnel
+type KeyStore interface {
+	// PrivateKey returns the key for a Service's tunnel to a server, generating one if needed
+	PrivateKey(ctx context.Context, svc *v1.Service, server string) (string, error)
+	// Shared reports whether all Services on a server share one key, which then cannot be rotated
+	Shared() bool
+	// Replace stores a new key for a Service's tunnel to a server after a rotation
+	Replace(ctx context.Context, svc *v1.Service, server, privateKey string) error
+	// Record remembers the tunnel ID and peer parameters the server returned
+	Record(ctx context.Context, svc *v1.Service, server string, resp *api_client.TunnelResponse) error
+	// Recorded returns the tunnel ID and peer parameters last recorded, or nil if there are none
+	Recorded(ctx context.Context, svc *v1.Service, server string) (*api_client.TunnelResponse, error)
+	// CreationID returns the ID of the Service's current tunnel creation on a server,
+	// generating one if needed. It stays the same until the tunnel is forgotten.
+	CreationID(ctx context.Context, svc *v1.Service, server string) (string, error)
+	// Forget drops the key once the Service's tunnel to the server is gone
+	Forget(ctx context.Context, svc *v1.Service, server string) error
+}
+
+// MemoryKeyStore keeps generated keys in memory
+type MemoryKeyStore struct {
+	perServer bool
+
+	mu        sync.Mutex
+	keys      map[string]string
+	creations map[string]string
+}
+
+// NewMemoryKeyStore creates a key store with one key per Service and server
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys:      make(map[string]string),
+		creations: make(map[string]string),
+	}
+}
+
+// NewServerKeyStore creates a key store that shares one key between all Services
+// on a server, as tunnels on a shared interface must
+func NewServerKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		perServer: true,
+		keys:      make(map[string]string),
+		creations: make(map[string]string),
+	}
+}
+
+// PrivateKey returns the stored key or generates a new one
+func (s *MemoryKeyStore) PrivateKey(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.keyID(svc, server)
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+
+	key, err := tunnel.GeneratePrivateKey()
+	if err != nil {
+		return "", err
+	}
+	s.keys[id] = key
+	return key, nil
+}
+
+// Shared reports whether keys are shared per server
+func (s *MemoryKeyStore) Shared() bool {
+	return s.perServer
+}
+
+// Replace stores a rotated key
+func (s *MemoryKeyStore) Replace(ctx context.Context, svc *v1.Service, server, privateKey string) error {
+	if s.perServer {
+		return ErrSharedKeyRotation
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[s.keyID(svc, server)] = privateKey
+	return nil
+}
+
+// Record does nothing, the server's state is not kept in memory
+func (s *MemoryKeyStore) Record(ctx context.Context, svc *v1.Service, server string, resp *api_client.TunnelResponse) error {
+	return nil
+}
+
+// Recorded returns nil, the server's state is not kept in memory
+func (s *MemoryKeyStore) Recorded(ctx context.Context, svc *v1.Service, server string) (*api_client.TunnelResponse, error) {
+	return nil, nil
+}
+
+// CreationID returns the stored creation ID or generates a new one
+func (s *MemoryKeyStore) CreationID(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := svc.Namespace + "/" + svc.Name + "/" + server
+	if creation, ok := s.creations[id]; ok {
+		return creation, nil
+	}
+	creation, err := newCreationID()
+	if err != nil {
+		return "", err
+	}
+	s.creations[id] = creation
+	return creation, nil
+}
+
+// Forget drops a Service's key and creation ID; keys shared per server are kept
+func (s *MemoryKeyStore) Forget(ctx context.Context, svc *v1.Service, server string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.creations, svc.Namespace+"/"+svc.Name+"/"+server)
+	if !s.perServer {
+		delete(s.keys, s.keyID(svc, server))
+	}
+	return nil
+}
+
+// newCreationID generates a random creation ID
+func newCreationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate creation ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *MemoryKeyStore) keyID(svc *v1.Service, server string) string {
+	if s.perServer {
+		return server
+	}
+	return svc.Namespace + "/" + svc.Name + "/" + server
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMemoryKeyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryKeyStore()
+	web := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+	api := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"}}
+
+	key, err := store.PrivateKey(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key)
+
+	again, err := store.PrivateKey(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	other, err := store.PrivateKey(ctx, web, "west")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	other, err = store.PrivateKey(ctx, api, "east")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	assert.NoError(t, store.Forget(ctx, web, "east"))
+	fresh, err := store.PrivateKey(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, fresh)
+}
+
+func TestMemoryKeyStore_CreationID(t *testing.T) {
+	ctx := context.Background()
+	store := NewServerKeyStore()
+	web := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+
+	creation, err := store.CreationID(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, creation)
+
+	again, err := store.CreationID(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.Equal(t, creation, again)
+
+	// A tunnel created again after it was forgotten gets a new ID, even when keys
+	// are shared per server
+	assert.NoError(t, store.Forget(ctx, web, "east"))
+	fresh, err := store.CreationID(ctx, web, "east")
+	assert.NoError(t, err)
+	assert.NotEqual(t, creation, fresh)
+}
+
+func TestServerKeyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewServerKeyStore()
+	web := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+	api := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"}}
+
+	key, err := store.PrivateKey(ctx, web, "east")
+	assert.NoError(t, err)
+
+	shared, err := store.PrivateKey(ctx, api, "east")
+	assert.NoError(t, err)
+	assert.Equal(t, key, shared)
+
+	// The shared key outlives the Services using it
+	assert.NoError(t, store.Forget(ctx, web, "east"))
+	kept, err := store.PrivateKey(ctx, api, "east")
+	assert.NoError(t, err)
+	assert.Equal(t, key, kept)
+
+	other, err := store.PrivateKey(ctx, web, "west")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
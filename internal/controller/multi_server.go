@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// isMultiServer reports whether a Service asks to be published on several servers at once
+func isMultiServer(svc *v1.Service) bool {
+	return svc.Annotations[ServersAnnotation] != "" || svc.Annotations[ServerCountAnnotation] != ""
+}
+
+// parseTunnelIDs parses a TunnelsAnnotation value into a server name to tunnel ID map
+func parseTunnelIDs(value string) map[string]string {
+	tunnels := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		server, tunnelID, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || server == "" || tunnelID == "" {
+			continue
+		}
+		tunnels[server] = tunnelID
+	}
+	return tunnels
+}
+
+// formatTunnelIDs renders a server name to tunnel ID map as a TunnelsAnnotation value
+func formatTunnelIDs(tunnels map[string]string) string {
+	pairs := make([]string, 0, len(tunnels))
+	for server, tunnelID := range tunnels {
+		pairs = append(pairs, server+"="+tunnelID)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// localTunnelID names the local tunnel for a server's tunnel, since tunnel IDs
+// are only unique per server
+func localTunnelID(server, tunnelID string) string {
+	return server + "-" + tunnelID
+}
+
+// reconcileMultiServer provisions a Service on every server it resolves to and
+// publishes all external addresses. A failing server only removes its own
+// addresses; the error is returned after the status has been updated so the
+// Service is retried.
+func (r *ServiceReconciler) reconcileMultiServer(ctx context.Context, svc *v1.Service) error {
+	tuning, err := parseTuning(svc)
+	if err != nil {
+		return err
+	}
+
+	servers, err := r.servers.ResolveAll(svc)
+	if err != nil {
+		return fmt.Errorf("failed to resolve tunnel servers: %w", err)
+	}
+
+	// A Service switching from a single server first gives up its old tunnel
+	if svc.Annotations[TunnelIDAnnotation] != "" {
+		if err := r.removeSingleServerTunnel(ctx, svc); err != nil {
+			return err
+		}
+	}
+
+	existing := parseTunnelIDs(svc.Annotations[TunnelsAnnotation])
+	tunnels := map[string]string{}
+	rotate := r.rotationDue(svc)
+	rotated := rotate
+	var errs []error
+
+	// Remove tunnels from servers the Service is no longer published on
+	selected := map[string]bool{}
+	for _, server := range servers {
+		selected[server.Name] = true
+	}
+	for name, tunnelID := range existing {
+		if selected[name] {
+			continue
+		}
+		if err := r.removeServerTunnel(ctx, svc, name, tunnelID); err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", name, err))
+			tunnels[name] = tunnelID
+		}
+	}
+
+	ingress := []v1.LoadBalancerIngress{}
+	local := []string{}
+	effective := map[string]string{}
+
+	for _, server := range servers {
+		tunnelID := existing[server.Name]
+
+		resp, serverRotated, err := r.provisionServerTunnel(ctx, svc, server, tunnelID, rotate)
+		rotated = rotated && serverRotated
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", server.Name, err))
+			if tunnelID != "" {
+				tunnels[server.Name] = tunnelID
+			}
+			continue
+		}
+
+		tunnels[server.Name] = resp.TunnelID
+		local = append(local, localTunnelID(server.Name, resp.TunnelID))
+		if value := effectiveTuning(resp, tuning); value != "" {
+			effective[server.Name] = value
+		}
+		if resp.ExternalIP != "" {
+			ingress = append(ingress, v1.LoadBalancerIngress{IP: resp.ExternalIP})
+		}
+		if resp.ExternalHost != "" {
+			ingress = append(ingress, v1.LoadBalancerIngress{Hostname: resp.ExternalHost})
+		}
+	}
+
+	// A rotation only counts once every server has the new key
+	annotations := r.rotationAnnotations(svc, rotated && len(errs) == 0)
+	if value := formatTunnelIDs(tunnels); value != svc.Annotations[TunnelsAnnotation] {
+		annotations[TunnelsAnnotation] = value
+	}
+	if value := formatServerTuning(effective); reportsTuning(svc, tuning) && len(effective) > 0 && value != svc.Annotations[EffectiveTuningAnnotation] {
+		annotations[EffectiveTuningAnnotation] = value
+	}
+	if len(annotations) > 0 {
+		err := r.k8sClient.SetServiceAnnotations(ctx, svc, annotations)
+		if err != nil {
+			return fmt.Errorf("failed to record tunnels on service: %w", err)
+		}
+	}
+
+	if len(ingress) == 0 {
+		return fmt.Errorf("no tunnel server could publish the service: %w", errors.Join(errs...))
+	}
+
+	if err := r.k8sClient.SetServiceLoadBalancerIngress(ctx, svc, ingress); err != nil {
+		return fmt.Errorf("failed to update service loadbalancer: %w", err)
+	}
+
+	if err := r.reportHealth(ctx, svc, local); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		r.logger.WithFields(map[string]interface{}{
+			"service":   svc.Namespace + "/" + svc.Name,
+			"published": len(servers) - len(errs),
+			"requested": len(servers),
+		}).Warn("Service is published on fewer servers than requested")
+		return fmt.Errorf("service is degraded: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// provisionServerTunnel creates or updates a Service's tunnel on one server and its
+// local side, rotating the key of an existing tunnel when rotate is set. It reports
+// whether the key was rotated.
+func (r *ServiceReconciler) provisionServerTunnel(ctx context.Context, svc *v1.Service, server *Server, tunnelID string, rotate bool) (*api_client.TunnelResponse, bool, error) {
+	var resp *api_client.TunnelResponse
+
+	req, err := newTunnelRequest(svc)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Transports, err = r.requestTransports(svc, server)
+	if err != nil {
+		return nil, false, err
+	}
+	privateKey, err := r.tunnelKey(ctx, svc, server.Name, req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if tunnelID == "" {
+		tunnelID, err = r.recordedTunnelID(ctx, svc, server.Name)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var replaced string
+	if tunnelID != "" {
+		resp, err = server.Client.UpdateTunnel(ctx, tunnelID, req)
+		if api_client.IsNotFound(err) {
+			if err := r.replaceLostTunnel(ctx, svc, server.Name, tunnelID, localTunnelID(server.Name, tunnelID)); err != nil {
+				return nil, false, err
+			}
+			replaced, tunnelID = tunnelID, ""
+		} else if err != nil {
+			return nil, false, fmt.Errorf("failed to update tunnel: %w", err)
+		}
+	}
+	if tunnelID == "" {
+		req.IdempotencyKey, err = r.idempotencyKey(ctx, svc, server.Name, replaced)
+		if err != nil {
+			return nil, false, err
+		}
+		resp, err = server.Client.CreateTunnel(ctx, req)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create tunnel: %w", err)
+		}
+	}
+
+	rotated := rotate && tunnelID != ""
+	if rotated {
+		resp, privateKey, err = r.rotateKey(ctx, svc, server, resp.TunnelID, resp.Transport)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	resp, err = r.withRecordedPeer(ctx, svc, server.Name, resp)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := r.keys.Record(ctx, svc, server.Name, resp); err != nil {
+		return nil, false, fmt.Errorf("failed to record tunnel state: %w", err)
+	}
+
+	wgConfig, err := renderTunnelConfig(privateKey, resp, req.Tuning)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tunnelConfig := &tunnel.TunnelConfig{
+		TunnelID:  localTunnelID(server.Name, resp.TunnelID),
+		Transport: resp.Transport,
+		WGConfig:  wgConfig,
+		Server:    server.Name,
+		Service:   serviceHost(req),
+		Ports:     req.Ports,
+		UDPPorts:  req.UDPPorts,
+	}
+	if err := setTransportConfig(tunnelConfig, server, privateKey, resp); err != nil {
+		return nil, false, err
+	}
+
+	if tunnelID == "" {
+		if err := r.createLocalTunnel(ctx, svc, tunnelConfig); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if err := r.updateLocalTunnel(ctx, svc, tunnelConfig); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return resp, rotated, nil
+}
+
+// removeServerTunnel deletes a Service's tunnel from one server and its local side.
+// Tunnels on servers that are gone or failed are only torn down locally.
+func (r *ServiceReconciler) removeServerTunnel(ctx context.Context, svc *v1.Service, serverName, tunnelID string) error {
+	server, ok := r.servers.Get(serverName)
+	if ok && !server.Failed {
+		if err := server.Client.DeleteTunnel(ctx, tunnelID); err != nil && !api_client.IsNotFound(err) {
+			return fmt.Errorf("failed to delete tunnel from server: %w", err)
+		}
+	} else {
+		r.logger.WithFields(map[string]interface{}{
+			"server":    serverName,
+			"tunnel_id": tunnelID,
+		}).Warn("Leaving tunnel behind on unavailable server")
+	}
+
+	if err := r.deleteLocalTunnel(ctx, localTunnelID(serverName, tunnelID)); err != nil {
+		return err
+	}
+
+	if err := r.keys.Forget(ctx, svc, serverName); err != nil {
+		return fmt.Errorf("failed to forget tunnel key: %w", err)
+	}
+	return nil
+}
+
+// deleteMultiServer removes every tunnel recorded for a multi-server Service
+func (r *ServiceReconciler) deleteMultiServer(ctx context.Context, svc *v1.Service) error {
+	var errs []error
+	for name, tunnelID := range parseTunnelIDs(svc.Annotations[TunnelsAnnotation]) {
+		if err := r.removeServerTunnel(ctx, svc, name, tunnelID); err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeSingleServerTunnel tears down the tunnel of a Service that was published on a
+// single server before and drops TunnelIDAnnotation and AssignedServerAnnotation
+func (r *ServiceReconciler) removeSingleServerTunnel(ctx context.Context, svc *v1.Service) error {
+	tunnelID := svc.Annotations[TunnelIDAnnotation]
+	assigned := svc.Annotations[AssignedServerAnnotation]
+	r.logger.WithFields(map[string]interface{}{
+		"service":   svc.Namespace + "/" + svc.Name,
+		"server":    assigned,
+		"tunnel_id": tunnelID,
+	}).Info("Service moved to multiple servers, removing its single-server tunnel")
+
+	server, ok := r.servers.Get(assigned)
+	if ok && !server.Failed {
+		if err := server.Client.DeleteTunnel(ctx, tunnelID); err != nil && !api_client.IsNotFound(err) {
+			return fmt.Errorf("failed to delete tunnel from server: %w", err)
+		}
+	} else {
+		r.logger.WithFields(map[string]interface{}{
+			"server":    assigned,
+			"tunnel_id": tunnelID,
+		}).Warn("Leaving tunnel behind on unavailable server")
+	}
+
+	if err := r.deleteLocalTunnel(ctx, tunnelID); err != nil {
+		return err
+	}
+	if assigned != "" {
+		if err := r.keys.Forget(ctx, svc, assigned); err != nil {
+			return fmt.Errorf("failed to forget tunnel key: %w", err)
+		}
+	}
+
+	err := r.k8sClient.SetServiceAnnotations(ctx, svc, map[string]string{
+		TunnelIDAnnotation:       "",
+		AssignedServerAnnotation: "",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record tunnel on service: %w", err)
+	}
+	return nil
+}
+
+// removeMultiServerTunnels tears down the tunnels of a Service that was published on
+// several servers before and drops TunnelsAnnotation
+func (r *ServiceReconciler) removeMultiServerTunnels(ctx context.Context, svc *v1.Service) error {
+	r.logger.WithFields(map[string]interface{}{
+		"service": svc.Namespace + "/" + svc.Name,
+		"tunnels": svc.Annotations[TunnelsAnnotation],
+	}).Info("Service moved to a single server, removing its multi-server tunnels")
+
+	if err := r.deleteMultiServer(ctx, svc); err != nil {
+		return fmt.Errorf("failed to remove multi-server tunnels: %w", err)
+	}
+
+	err := r.k8sClient.SetServiceAnnotations(ctx, svc, map[string]string{
+		TunnelsAnnotation: "",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record tunnels on service: %w", err)
+	}
+	return nil
+}
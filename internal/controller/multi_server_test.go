@@ -0,0 +1,485 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newMultiServerService(annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-service",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{Port: 80},
+			},
+		},
+	}
+}
+
+func TestTunnelIDsRoundTrip(t *testing.T) {
+	tunnels := parseTunnelIDs("us=t2, eu=t1,broken,=x")
+	assert.Equal(t, map[string]string{"eu": "t1", "us": "t2"}, tunnels)
+	assert.Equal(t, "eu=t1,us=t2", formatTunnelIDs(tunnels))
+	assert.Empty(t, parseTunnelIDs(""))
+}
+
+func TestServerRegistry_ResolveAll(t *testing.T) {
+	registry := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	registry.servers = map[string]*registeredServer{
+		"eu-1": {server: &Server{Name: "eu-1", Labels: map[string]string{"region": "eu"}, Reachable: true}},
+		"eu-2": {server: &Server{Name: "eu-2", Labels: map[string]string{"region": "eu"}, Reachable: true}},
+		"eu-3": {server: &Server{Name: "eu-3", Labels: map[string]string{"region": "eu"}, Reachable: true}},
+		"us-1": {server: &Server{Name: "us-1", Labels: map[string]string{"region": "us"}, Reachable: false, Failed: true}},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+		expectError bool
+	}{
+		{
+			name:        "explicit list",
+			annotations: map[string]string{ServersAnnotation: "us-1, eu-2"},
+			expected:    []string{"us-1", "eu-2"},
+		},
+		{
+			name:        "explicit list with unknown server",
+			annotations: map[string]string{ServersAnnotation: "eu-1,ap-1"},
+			expectError: true,
+		},
+		{
+			name:        "count over reachable servers",
+			annotations: map[string]string{ServerCountAnnotation: "2"},
+			expected:    []string{"eu-1", "eu-2"},
+		},
+		{
+			name: "count prefers servers with existing tunnels",
+			annotations: map[string]string{
+				ServerCountAnnotation: "2",
+				TunnelsAnnotation:     "eu-3=t3",
+			},
+			expected: []string{"eu-3", "eu-1"},
+		},
+		{
+			name: "count larger than available degrades",
+			annotations: map[string]string{
+				ServerCountAnnotation:    "5",
+				ServerSelectorAnnotation: "region=eu",
+			},
+			expected: []string{"eu-1", "eu-2", "eu-3"},
+		},
+		{
+			name: "no reachable match",
+			annotations: map[string]string{
+				ServerCountAnnotation:    "1",
+				ServerSelectorAnnotation: "region=us",
+			},
+			expectError: true,
+		},
+		{
+			name:        "invalid count",
+			annotations: map[string]string{ServerCountAnnotation: "zero"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers, err := registry.ResolveAll(newMultiServerService(tt.annotations))
+
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			names := []string{}
+			for _, server := range servers {
+				names = append(names, server.Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestServiceReconciler_MultiServer(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	apClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+	servers.AddStaticServer("ap", apClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation: "eu,us",
+		TunnelsAnnotation: "ap=ap-tunnel,eu=eu-tunnel",
+	})
+
+	// The Service no longer lists ap, so its tunnel is removed
+	apClient.On("DeleteTunnel", mock.Anything, "ap-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "ap-ap-tunnel").Return(nil)
+
+	// The existing eu tunnel is updated, us is created
+	euClient.On("UpdateTunnel", mock.Anything, "eu-tunnel", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "eu-tunnel",
+			ExternalIP: "1.1.1.1",
+			Peer:       testPeer("eu"),
+		}, nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID: "eu-eu-tunnel",
+		WGConfig: testWGConfig("eu"),
+		Server:   "eu",
+		Service:  "test-service.default.svc",
+		Ports:    []int{80},
+	}).Return(tunnel.UpdateInPlace, nil)
+
+	usClient.On("CreateTunnel", mock.Anything, mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:     "us-tunnel",
+			ExternalIP:   "2.2.2.2",
+			ExternalHost: "us.example.com",
+			Peer:         testPeer("us"),
+		}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID: "us-us-tunnel",
+		WGConfig: testWGConfig("us"),
+		Server:   "us",
+		Service:  "test-service.default.svc",
+		Ports:    []int{80},
+	}).Return(nil)
+
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancerIngress", mock.Anything, svc, []v1.LoadBalancerIngress{
+		{IP: "1.1.1.1"},
+		{IP: "2.2.2.2"},
+		{Hostname: "us.example.com"},
+	}).Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	apClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_MultiServerPartialFailure(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation: "eu,us",
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	})
+
+	euClient.On("UpdateTunnel", mock.Anything, "eu-tunnel", mock.Anything).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "eu-tunnel",
+			ExternalIP: "1.1.1.1",
+			Peer:       testPeer("eu"),
+		}, nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+	usClient.On("UpdateTunnel", mock.Anything, "us-tunnel", mock.Anything).Return(nil, errors.New("server unavailable"))
+
+	// The us tunnel stays recorded, only its address is withdrawn
+	k8sMock.On("SetServiceLoadBalancerIngress", mock.Anything, svc, []v1.LoadBalancerIngress{
+		{IP: "1.1.1.1"},
+	}).Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "degraded")
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+}
+
+func TestServiceReconciler_MultiServerLostTunnel(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation: "eu,us",
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	})
+	svc.UID = "uid-test-service"
+
+	euClient.On("UpdateTunnel", mock.Anything, "eu-tunnel", mock.Anything).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "eu-tunnel",
+			ExternalIP: "1.1.1.1",
+			Peer:       testPeer("eu"),
+		}, nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+
+	// The us server lost its tunnel, which is replaced on that server only
+	usClient.On("UpdateTunnel", mock.Anything, "us-tunnel", mock.Anything).Return(
+		nil, &api_client.APIError{StatusCode: http.StatusNotFound, Code: "tunnel_not_found"})
+	tunnelMock.On("DeleteTunnel", mock.Anything, localTunnelID("us", "us-tunnel")).Return(nil)
+	usClient.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return req.IdempotencyKey == idempotencyKey(svc, "us", "us-tunnel", "")
+	})).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "us-tunnel-2",
+			ExternalIP: "2.2.2.2",
+			Peer:       testPeer("us"),
+		}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(config *tunnel.TunnelConfig) bool {
+		return config.TunnelID == localTunnelID("us", "us-tunnel-2")
+	})).Return(nil)
+
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, mock.MatchedBy(func(annotations map[string]string) bool {
+		return annotations[TunnelsAnnotation] == formatTunnelIDs(map[string]string{"eu": "eu-tunnel", "us": "us-tunnel-2"})
+	})).Return(nil)
+	k8sMock.On("SetServiceLoadBalancerIngress", mock.Anything, svc, []v1.LoadBalancerIngress{
+		{IP: "1.1.1.1"},
+		{IP: "2.2.2.2"},
+	}).Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_MultiServerRotationWithNewServer(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation:   "eu,us",
+		TunnelsAnnotation:   "eu=eu-tunnel",
+		RotateKeyAnnotation: "true",
+	})
+
+	euResp := &api_client.TunnelResponse{TunnelID: "eu-tunnel", ExternalIP: "1.1.1.1", Peer: testPeer("eu")}
+	euClient.On("UpdateTunnel", mock.Anything, "eu-tunnel", mock.Anything).Return(euResp, nil)
+	euClient.On("RotateKey", mock.Anything, "eu-tunnel", mock.Anything).Return(euResp, nil)
+	usClient.On("CreateTunnel", mock.Anything, mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "us-tunnel", ExternalIP: "2.2.2.2", Peer: testPeer("us")}, nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, mock.Anything).Return(nil)
+
+	// The new us tunnel was not rotated, so the request stays until it is
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancerIngress", mock.Anything, svc, []v1.LoadBalancerIngress{
+		{IP: "1.1.1.1"},
+		{IP: "2.2.2.2"},
+	}).Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(NewMemoryKeyStore())
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+}
+
+func TestServiceReconciler_SwitchToMultiServer(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation:        "eu,us",
+		TunnelIDAnnotation:       "single-tunnel",
+		AssignedServerAnnotation: "eu",
+	})
+
+	// The single-server tunnel is removed from its server and locally
+	euClient.On("DeleteTunnel", mock.Anything, "single-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "single-tunnel").Return(nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "",
+		AssignedServerAnnotation: "",
+	}).Return(nil)
+
+	euClient.On("CreateTunnel", mock.Anything, mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "eu-tunnel", ExternalIP: "1.1.1.1", Peer: testPeer("eu")}, nil)
+	usClient.On("CreateTunnel", mock.Anything, mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "us-tunnel", ExternalIP: "2.2.2.2", Peer: testPeer("us")}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, mock.Anything).Return(nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancerIngress", mock.Anything, svc, []v1.LoadBalancerIngress{
+		{IP: "1.1.1.1"},
+		{IP: "2.2.2.2"},
+	}).Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_SwitchToSingleServer(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServerAnnotation:  "eu",
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	})
+
+	// Every multi-server tunnel is removed, including the one on the server kept
+	euClient.On("DeleteTunnel", mock.Anything, "eu-tunnel").Return(nil)
+	usClient.On("DeleteTunnel", mock.Anything, "us-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, localTunnelID("eu", "eu-tunnel")).Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, localTunnelID("us", "us-tunnel")).Return(nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelsAnnotation: "",
+	}).Return(nil)
+
+	euClient.On("CreateTunnel", mock.Anything, mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "single-tunnel", ExternalIP: "1.1.1.1", Peer: testPeer("eu")}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(config *tunnel.TunnelConfig) bool {
+		return config.TunnelID == "single-tunnel"
+	})).Return(nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "single-tunnel",
+		AssignedServerAnnotation: "eu",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.1.1.1", "").Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_MultiServerAllFailed(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+
+	svc := newMultiServerService(map[string]string{
+		ServersAnnotation: "eu",
+	})
+
+	euClient.On("CreateTunnel", mock.Anything, mock.Anything).Return(nil, errors.New("server unavailable"))
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, &MockTunnelManager{}, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	// Nothing is published, so the status is left untouched
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.Error(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+}
+
+func TestServiceReconciler_HandleDeleteMultiServer(t *testing.T) {
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	euClient.On("DeleteTunnel", mock.Anything, "eu-tunnel").Return(nil)
+	usClient.On("DeleteTunnel", mock.Anything, "us-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "eu-eu-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "us-us-tunnel").Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(&MockK8sClient{}, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.HandleDelete(context.Background(), newMultiServerService(map[string]string{
+		ServersAnnotation: "eu,us",
+		TunnelsAnnotation: "eu=eu-tunnel,us=us-tunnel",
+	}))
+	assert.NoError(t, err)
+
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
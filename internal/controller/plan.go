@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PlannedAction is a change the reconciler would have made in dry-run mode
+type PlannedAction struct {
+	Service string      `json:"service"`
+	Target  string      `json:"target"`
+	Action  string      `json:"action"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Plan collects the actions computed while reconciling in dry-run mode
+type Plan struct {
+	logger *utils.Logger
+
+	mu      sync.Mutex
+	actions []PlannedAction
+}
+
+// NewPlan creates an empty Plan
+func NewPlan(logger *utils.Logger) *Plan {
+	return &Plan{
+		logger: logger,
+	}
+}
+
+// Begin starts planning a Service anew, dropping the actions recorded for it earlier.
+// The plan so holds the latest changes per Service however often Services are reconciled.
+func (p *Plan) Begin(service string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := p.actions[:0]
+	for _, action := range p.actions {
+		if action.Service != service {
+			kept = append(kept, action)
+		}
+	}
+	p.actions = kept
+}
+
+// Record adds an action to the plan and logs it
+func (p *Plan) Record(action PlannedAction) {
+	p.mu.Lock()
+	p.actions = append(p.actions, action)
+	p.mu.Unlock()
+
+	p.logger.WithFields(map[string]interface{}{
+		"service": action.Service,
+		"target":  action.Target,
+		"action":  action.Action,
+		"detail":  action.Detail,
+	}).Info("Dry run: skipping action")
+}
+
+// Actions returns the recorded actions in the order they were planned
+func (p *Plan) Actions() []PlannedAction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	actions := make([]PlannedAction, len(p.actions))
+	copy(actions, p.actions)
+	return actions
+}
+
+// Write prints the plan in a human readable form
+func (p *Plan) Write(w io.Writer) error {
+	actions := p.Actions()
+	if len(actions) == 0 {
+		_, err := fmt.Fprintln(w, "No changes planned.")
+		return err
+	}
+
+	for _, action := range actions {
+		detail := ""
+		if action.Detail != nil {
+			encoded, err := json.Marshal(action.Detail)
+			if err != nil {
+				return fmt.Errorf("failed to encode plan detail: %w", err)
+			}
+			detail = " " + string(encoded)
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s %s%s\n", action.Service, action.Target, action.Action, detail); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d change(s) planned.\n", len(actions))
+	return err
+}
+
+// planningAPIClient records tunnel server calls instead of making them
+type planningAPIClient struct {
+	plan    *Plan
+	service string
+	server  string
+}
+
+func (c *planningAPIClient) CreateTunnel(ctx context.Context, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "server/" + c.server, Action: "create-tunnel", Detail: req})
+	return &api_client.TunnelResponse{TunnelID: "planned-" + c.server, Peer: &api_client.PeerConfig{}}, nil
+}
+
+func (c *planningAPIClient) UpdateTunnel(ctx context.Context, tunnelID string, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "server/" + c.server, Action: "update-tunnel " + tunnelID, Detail: req})
+	return &api_client.TunnelResponse{TunnelID: tunnelID, Peer: &api_client.PeerConfig{}}, nil
+}
+
+func (c *planningAPIClient) RotateKey(ctx context.Context, tunnelID string, req *api_client.RotateKeyRequest) (*api_client.TunnelResponse, error) {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "server/" + c.server, Action: "rotate-key " + tunnelID, Detail: req})
+	return &api_client.TunnelResponse{TunnelID: tunnelID, Peer: &api_client.PeerConfig{}}, nil
+}
+
+func (c *planningAPIClient) DeleteTunnel(ctx context.Context, tunnelID string) error {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "server/" + c.server, Action: "delete-tunnel " + tunnelID})
+	return nil
+}
+
+// planningTunnelManager records local tunnel changes instead of applying them
+type planningTunnelManager struct {
+	plan    *Plan
+	service string
+}
+
+func (m *planningTunnelManager) CreateTunnel(ctx context.Context, config *tunnel.TunnelConfig) error {
+	m.plan.Record(PlannedAction{Service: m.service, Target: "local", Action: "create-tunnel " + config.TunnelID})
+	return nil
+}
+
+func (m *planningTunnelManager) UpdateTunnel(ctx context.Context, config *tunnel.TunnelConfig) (tunnel.UpdateMode, error) {
+	m.plan.Record(PlannedAction{Service: m.service, Target: "local", Action: "update-tunnel " + config.TunnelID})
+	return tunnel.UpdateUnchanged, nil
+}
+
+func (m *planningTunnelManager) DeleteTunnel(ctx context.Context, tunnelID string) error {
+	m.plan.Record(PlannedAction{Service: m.service, Target: "local", Action: "delete-tunnel " + tunnelID})
+	return nil
+}
+
+// planningK8sClient records Service writes instead of making them
+type planningK8sClient struct {
+	plan    *Plan
+	service string
+}
+
+func (c *planningK8sClient) SetServiceLoadBalancer(ctx context.Context, svc *v1.Service, externalIP, externalHost string) error {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "kubernetes", Action: "set-loadbalancer", Detail: map[string]string{
+		"ip":       externalIP,
+		"hostname": externalHost,
+	}})
+	return nil
+}
+
+func (c *planningK8sClient) SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "kubernetes", Action: "set-loadbalancer", Detail: ingress})
+	return nil
+}
+
+func (c *planningK8sClient) SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "kubernetes", Action: "set-annotations", Detail: annotations})
+	return nil
+}
+
+func (c *planningK8sClient) SetServiceCondition(ctx context.Context, svc *v1.Service, condition metav1.Condition) error {
+	c.plan.Record(PlannedAction{Service: c.service, Target: "kubernetes", Action: "set-condition", Detail: map[string]string{
+		"type":   condition.Type,
+		"status": string(condition.Status),
+		"reason": condition.Reason,
+	}})
+	return nil
+}
+
+// planningResolver hands out servers whose clients record into the plan
+type planningResolver struct {
+	ServerResolver
+	plan    *Plan
+	service string
+}
+
+func (r *planningResolver) wrap(server *Server) *Server {
+	planned := *server
+	planned.Client = &planningAPIClient{plan: r.plan, service: r.service, server: server.Name}
+	return &planned
+}
+
+func (r *planningResolver) Resolve(svc *v1.Service) (*Server, error) {
+	server, err := r.ServerResolver.Resolve(svc)
+	if err != nil {
+		return nil, err
+	}
+	return r.wrap(server), nil
+}
+
+func (r *planningResolver) ResolveAll(svc *v1.Service) ([]*Server, error) {
+	servers, err := r.ServerResolver.ResolveAll(svc)
+	if err != nil {
+		return nil, err
+	}
+	planned := make([]*Server, 0, len(servers))
+	for _, server := range servers {
+		planned = append(planned, r.wrap(server))
+	}
+	return planned, nil
+}
+
+func (r *planningResolver) Get(name string) (*Server, bool) {
+	server, ok := r.ServerResolver.Get(name)
+	if !ok {
+		return nil, false
+	}
+	return r.wrap(server), true
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceReconciler_DryRun(t *testing.T) {
+	// No expectations: any real call fails the test
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	plan := NewPlan(utils.NewLogger("test"))
+	reconciler.SetDryRun(plan)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				TunnelAnnotation: "true",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{Port: 80},
+			},
+		},
+	}
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	actions := plan.Actions()
+	assert.Len(t, actions, 4)
+	assert.Equal(t, "server/default", actions[0].Target)
+	assert.Equal(t, "create-tunnel", actions[0].Action)
+	assert.Equal(t, "set-annotations", actions[1].Action)
+	assert.Equal(t, map[string]string{
+		TunnelIDAnnotation:       "planned-default",
+		AssignedServerAnnotation: DefaultServerName,
+	}, actions[1].Detail)
+	assert.Equal(t, "local", actions[2].Target)
+	assert.Equal(t, "create-tunnel planned-default", actions[2].Action)
+	assert.Equal(t, "set-loadbalancer", actions[3].Action)
+	for _, action := range actions {
+		assert.Equal(t, "default/test-service", action.Service)
+	}
+
+	// The Service itself is left untouched
+	assert.Equal(t, map[string]string{TunnelAnnotation: "true"}, svc.Annotations)
+
+	// Reconciling again replaces the Service's plan rather than adding to it
+	err = reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+	assert.Equal(t, actions, plan.Actions())
+
+	// Deletes are planned too, replacing what was planned for the Service before
+	svc.Annotations[TunnelIDAnnotation] = "existing-tunnel"
+	err = reconciler.HandleDelete(context.Background(), svc)
+	assert.NoError(t, err)
+	actions = plan.Actions()
+	assert.Len(t, actions, 2)
+	assert.Equal(t, "delete-tunnel existing-tunnel", actions[0].Action)
+	assert.Equal(t, "delete-tunnel existing-tunnel", actions[1].Action)
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestPlan_Write(t *testing.T) {
+	plan := NewPlan(utils.NewLogger("test"))
+
+	var out bytes.Buffer
+	assert.NoError(t, plan.Write(&out))
+	assert.Equal(t, "No changes planned.\n", out.String())
+
+	plan.Record(PlannedAction{Service: "default/a", Target: "server/eu", Action: "delete-tunnel t1"})
+	plan.Record(PlannedAction{Service: "default/b", Target: "kubernetes", Action: "set-annotations", Detail: map[string]string{"k": "v"}})
+
+	out.Reset()
+	assert.NoError(t, plan.Write(&out))
+	assert.Equal(t, "default/a: server/eu delete-tunnel t1\n"+
+		"default/b: kubernetes set-annotations {\"k\":\"v\"}\n"+
+		"2 change(s) planned.\n", out.String())
+}
+
+func TestPlan_Begin(t *testing.T) {
+	plan := NewPlan(utils.NewLogger("test"))
+	plan.Record(PlannedAction{Service: "default/a", Target: "server/eu", Action: "delete-tunnel t1"})
+	plan.Record(PlannedAction{Service: "default/b", Target: "local", Action: "delete-tunnel t2"})
+	plan.Record(PlannedAction{Service: "default/a", Target: "local", Action: "delete-tunnel t1"})
+
+	plan.Begin("default/a")
+	assert.Equal(t, []PlannedAction{
+		{Service: "default/b", Target: "local", Action: "delete-tunnel t2"},
+	}, plan.Actions())
+}
+
+func TestServiceWatcher_ReconcileOnce(t *testing.T) {
+	k8sMock := &mockK8sClient{}
+	reconciler := NewServiceReconciler(k8sMock, &MockAPIClient{}, &MockTunnelManager{}, utils.NewLogger("test"))
+	plan := NewPlan(utils.NewLogger("test"))
+	reconciler.SetDryRun(plan)
+
+	k8sMock.On("ListServices", mock.Anything, "", mock.Anything).Return(&v1.ServiceList{Items: []v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "managed",
+				Namespace:   "default",
+				Annotations: map[string]string{TunnelAnnotation: "true"},
+			},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "unmanaged",
+				Namespace: "default",
+			},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		},
+	}}, nil)
+
+	watcher := NewServiceWatcher(k8sMock, reconciler, utils.NewLogger("test"))
+
+	err := watcher.ReconcileOnce(context.Background())
+	assert.NoError(t, err)
+
+	for _, action := range plan.Actions() {
+		assert.Equal(t, "default/managed", action.Service)
+	}
+	assert.NotEmpty(t, plan.Actions())
+	k8sMock.AssertExpectations(t)
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// KeyRotationGracePeriod is how long a server keeps accepting a rotated-out key,
+// covering the time our end needs to switch to the new one
+const KeyRotationGracePeriod = 5 * time.Minute
+
+// rotationDue reports whether a Service's tunnel keys should be rotated now
+func (r *ServiceReconciler) rotationDue(svc *v1.Service) bool {
+	if rotate, _ := strconv.ParseBool(svc.Annotations[RotateKeyAnnotation]); rotate {
+		return true
+	}
+	if r.keyRotationInterval <= 0 {
+		return false
+	}
+
+	// Without a recorded rotation the clock starts with this reconcile
+	rotatedAt, err := time.Parse(time.RFC3339, svc.Annotations[KeyRotatedAtAnnotation])
+	if err != nil {
+		return false
+	}
+	return r.now().Sub(rotatedAt) >= r.keyRotationInterval
+}
+
+// rotationAnnotations returns the annotation changes recording a rotation, or starting
+// the rotation clock of a Service that has none yet
+func (r *ServiceReconciler) rotationAnnotations(svc *v1.Service, rotated bool) map[string]string {
+	annotations := map[string]string{}
+	now := r.now().UTC().Format(time.RFC3339)
+
+	if rotated {
+		annotations[KeyRotatedAtAnnotation] = now
+		if _, ok := svc.Annotations[RotateKeyAnnotation]; ok {
+			annotations[RotateKeyAnnotation] = ""
+		}
+	} else if r.keyRotationInterval > 0 && svc.Annotations[KeyRotatedAtAnnotation] == "" {
+		annotations[KeyRotatedAtAnnotation] = now
+	}
+	return annotations
+}
+
+// rotateKey moves a tunnel to a new key without downtime. The server runs a peer for
+// the old and the new key during KeyRotationGracePeriod while our end switches over.
+// Tunnels on the ssh transport also register the SSH key derived from the new key.
+func (r *ServiceReconciler) rotateKey(ctx context.Context, svc *v1.Service, server *Server, tunnelID, transport string) (*api_client.TunnelResponse, string, error) {
+	if r.keys.Shared() {
+		return nil, "", ErrSharedKeyRotation
+	}
+
+	privateKey, err := tunnel.GeneratePrivateKey()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate tunnel key: %w", err)
+	}
+	publicKey, err := tunnel.PublicKey(privateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate tunnel key: %w", err)
+	}
+	var sshPublicKey string
+	if transport == tunnel.TransportSSH {
+		sshPublicKey, err = tunnel.SSHPublicKey(privateKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate tunnel key: %w", err)
+		}
+	}
+
+	resp, err := server.Client.RotateKey(ctx, tunnelID, &api_client.RotateKeyRequest{
+		PublicKey:          publicKey,
+		SSHPublicKey:       sshPublicKey,
+		GracePeriodSeconds: int(KeyRotationGracePeriod / time.Second),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to rotate tunnel key: %w", err)
+	}
+
+	// Only keep the new key once the server accepted it. Should storing it fail the
+	// old key still works during the grace period and the rotation is retried.
+	if err := r.keys.Replace(ctx, svc, server.Name, privateKey); err != nil {
+		return nil, "", fmt.Errorf("failed to store rotated tunnel key: %w", err)
+	}
+
+	r.logger.WithFields(map[string]interface{}{
+		"service":   svc.Namespace + "/" + svc.Name,
+		"server":    server.Name,
+		"tunnel_id": tunnelID,
+	}).Info("Rotated tunnel key")
+	return resp, privateKey, nil
+}
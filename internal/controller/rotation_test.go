@@ -0,0 +1,217 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var rotationNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newRotationService(annotations map[string]string) *v1.Service {
+	annotations[TunnelIDAnnotation] = "test-tunnel"
+	annotations[AssignedServerAnnotation] = DefaultServerName
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-service",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestServiceReconciler_RotateKey(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+	keys := NewMemoryKeyStore()
+
+	svc := newRotationService(map[string]string{RotateKeyAnnotation: "true"})
+	oldKey, err := keys.PrivateKey(context.Background(), svc, DefaultServerName)
+	assert.NoError(t, err)
+	oldPublicKey, err := tunnel.PublicKey(oldKey)
+	assert.NoError(t, err)
+
+	apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return req.PublicKey == oldPublicKey
+	})).Return(&api_client.TunnelResponse{TunnelID: "test-tunnel", Peer: testPeer("test")}, nil)
+	apiMock.On("RotateKey", mock.Anything, "test-tunnel", mock.MatchedBy(func(req *api_client.RotateKeyRequest) bool {
+		return req.PublicKey != oldPublicKey && req.GracePeriodSeconds == 300
+	})).Return(&api_client.TunnelResponse{TunnelID: "test-tunnel", ExternalIP: "1.2.3.4", Peer: testPeer("test")}, nil)
+
+	// The manual request is cleared and the rotation recorded
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		KeyRotatedAtAnnotation: "2024-06-01T12:00:00Z",
+		RotateKeyAnnotation:    "",
+	}).Return(nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(keys)
+	reconciler.now = func() time.Time { return rotationNow }
+
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	// The local tunnel switched to the new key, which is kept for later reconciles
+	newKey, err := keys.PrivateKey(context.Background(), svc, DefaultServerName)
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldKey, newKey)
+	config := tunnelMock.Calls[0].Arguments.Get(1).(*tunnel.TunnelConfig)
+	assert.Contains(t, config.WGConfig, "PrivateKey = "+newKey)
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_RotateKeyFailureKeepsKey(t *testing.T) {
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+	keys := NewMemoryKeyStore()
+
+	svc := newRotationService(map[string]string{RotateKeyAnnotation: "true"})
+	oldKey, err := keys.PrivateKey(context.Background(), svc, DefaultServerName)
+	assert.NoError(t, err)
+
+	apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "test-tunnel", Peer: testPeer("test")}, nil)
+	apiMock.On("RotateKey", mock.Anything, "test-tunnel", mock.Anything).Return(nil, errors.New("server unavailable"))
+
+	reconciler := NewServiceReconciler(&MockK8sClient{}, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(keys)
+
+	assert.Error(t, reconciler.Reconcile(context.Background(), svc))
+
+	// The server never saw the new key, so the old one stays in use
+	key, err := keys.PrivateKey(context.Background(), svc, DefaultServerName)
+	assert.NoError(t, err)
+	assert.Equal(t, oldKey, key)
+	tunnelMock.AssertNotCalled(t, "UpdateTunnel", mock.Anything, mock.Anything)
+}
+
+func TestServiceReconciler_RotateKeyOnCreate(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := newRotationService(map[string]string{RotateKeyAnnotation: "true"})
+	delete(svc.Annotations, TunnelIDAnnotation)
+
+	apiMock.On("CreateTunnel", mock.Anything, mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "test-tunnel", ExternalIP: "1.2.3.4", Peer: testPeer("test")}, nil)
+
+	// A new tunnel was not rotated, so the request stays until it is
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "test-tunnel",
+		AssignedServerAnnotation: DefaultServerName,
+	}).Return(nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, mock.Anything).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(NewMemoryKeyStore())
+	reconciler.now = func() time.Time { return rotationNow }
+
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+	apiMock.AssertNotCalled(t, "RotateKey", mock.Anything, mock.Anything, mock.Anything)
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_ScheduledRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		rotatedAt   string
+		wantRotate  bool
+		annotations map[string]string
+	}{
+		{
+			name:       "key is due",
+			rotatedAt:  rotationNow.Add(-31 * 24 * time.Hour).Format(time.RFC3339),
+			wantRotate: true,
+			annotations: map[string]string{
+				KeyRotatedAtAnnotation: "2024-06-01T12:00:00Z",
+			},
+		},
+		{
+			name:        "key is recent",
+			rotatedAt:   rotationNow.Add(-24 * time.Hour).Format(time.RFC3339),
+			wantRotate:  false,
+			annotations: nil,
+		},
+		{
+			name:       "clock starts without a recorded rotation",
+			rotatedAt:  "",
+			wantRotate: false,
+			annotations: map[string]string{
+				KeyRotatedAtAnnotation: "2024-06-01T12:00:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sMock := &MockK8sClient{}
+			apiMock := &MockAPIClient{}
+			tunnelMock := &MockTunnelManager{}
+
+			annotations := map[string]string{}
+			if tt.rotatedAt != "" {
+				annotations[KeyRotatedAtAnnotation] = tt.rotatedAt
+			}
+			svc := newRotationService(annotations)
+
+			resp := &api_client.TunnelResponse{TunnelID: "test-tunnel", Peer: testPeer("test")}
+			apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.Anything).Return(resp, nil)
+			if tt.wantRotate {
+				apiMock.On("RotateKey", mock.Anything, "test-tunnel", mock.Anything).Return(resp, nil)
+			}
+			if tt.annotations != nil {
+				k8sMock.On("SetServiceAnnotations", mock.Anything, svc, tt.annotations).Return(nil)
+			}
+			tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+			k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "", "").Return(nil)
+
+			reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+			reconciler.SetKeyRotationInterval(30 * 24 * time.Hour)
+			reconciler.now = func() time.Time { return rotationNow }
+
+			assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+			if !tt.wantRotate {
+				apiMock.AssertNotCalled(t, "RotateKey", mock.Anything, mock.Anything)
+			}
+
+			k8sMock.AssertExpectations(t)
+			apiMock.AssertExpectations(t)
+		})
+	}
+}
+
+func TestServiceReconciler_RotateSharedKey(t *testing.T) {
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := newRotationService(map[string]string{RotateKeyAnnotation: "true"})
+
+	apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.Anything).Return(
+		&api_client.TunnelResponse{TunnelID: "test-tunnel", Peer: testPeer("test")}, nil)
+
+	reconciler := NewServiceReconciler(&MockK8sClient{}, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(NewServerKeyStore())
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.ErrorIs(t, err, ErrSharedKeyRotation)
+	apiMock.AssertNotCalled(t, "RotateKey", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,345 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Fields of the Secrets holding tunnel state. Per-Service Secrets prefix them with
+// the server name, e.g. "eu.privateKey".
+const (
+	privateKeyField = "privateKey"
+	tunnelIDField   = "tunnelId"
+	peerField       = "peer"
+	creationIDField = "creationId"
+)
+
+// managedByLabel marks the Secrets created by the controller
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "easy-tunnel-lb"
+)
+
+// ErrSecretNotManaged is returned when a Secret the store would use was not created by the controller
+var ErrSecretNotManaged = fmt.Errorf("secret is not managed by easy-tunnel-lb")
+
+// SecretClient interface for Kubernetes operations on the Secrets holding tunnel state
+type SecretClient interface {
+	GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error)
+	CreateSecret(ctx context.Context, secret *v1.Secret) error
+	UpdateSecret(ctx context.Context, secret *v1.Secret) error
+	DeleteSecret(ctx context.Context, namespace, name string) error
+}
+
+// SecretKeyStore keeps tunnel keys and state in Secrets so a restarted controller
+// keeps its WireGuard identity. Every Service gets a Secret it owns, holding the
+// private key, tunnel ID and server-assigned peer parameters per server, so the
+// Secret is garbage collected with the Service.
+type SecretKeyStore struct {
+	client SecretClient
+	// namespace holds the Secrets of keys shared per server
+	namespace string
+	perServer bool
+	dryRun    bool
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+// NewSecretKeyStore creates a Secret-backed key store with one key per Service and server
+func NewSecretKeyStore(client SecretClient, namespace string) *SecretKeyStore {
+	return &SecretKeyStore{
+		client:    client,
+		namespace: namespace,
+		keys:      make(map[string]string),
+	}
+}
+
+// NewServerSecretKeyStore creates a Secret-backed key store that shares one key
+// between all Services on a server. The shared keys are kept in namespace.
+func NewServerSecretKeyStore(client SecretClient, namespace string) *SecretKeyStore {
+	store := NewSecretKeyStore(client, namespace)
+	store.perServer = true
+	return store
+}
+
+// SetDryRun stops the store from writing Secrets; keys are still loaded from them
+func (s *SecretKeyStore) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+// PrivateKey returns the stored key, generating and storing one if there is none
+func (s *SecretKeyStore) PrivateKey(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.keyID(svc, server)
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+
+	namespace, name, field, owner := s.keyLocation(svc, server)
+	secret, err := s.getSecret(ctx, namespace, name, owner)
+	if err != nil {
+		return "", err
+	}
+	if secret != nil && len(secret.Data[field]) > 0 {
+		key := string(secret.Data[field])
+		s.keys[id] = key
+		return key, nil
+	}
+
+	key, err := tunnel.GeneratePrivateKey()
+	if err != nil {
+		return "", err
+	}
+	err = s.apply(ctx, namespace, name, owner, func(data map[string][]byte) {
+		data[field] = []byte(key)
+	})
+	if err != nil {
+		return "", err
+	}
+	s.keys[id] = key
+	return key, nil
+}
+
+// Shared reports whether keys are shared per server
+func (s *SecretKeyStore) Shared() bool {
+	return s.perServer
+}
+
+// Replace stores a rotated key in the Service's Secret
+func (s *SecretKeyStore) Replace(ctx context.Context, svc *v1.Service, server, privateKey string) error {
+	if s.perServer {
+		return ErrSharedKeyRotation
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespace, name, field, owner := s.keyLocation(svc, server)
+	err := s.apply(ctx, namespace, name, owner, func(data map[string][]byte) {
+		data[field] = []byte(privateKey)
+	})
+	if err != nil {
+		return err
+	}
+	// A dry run keeps using the stored key
+	if !s.dryRun {
+		s.keys[s.keyID(svc, server)] = privateKey
+	}
+	return nil
+}
+
+// Record stores the tunnel ID and peer parameters in the Service's Secret
+func (s *SecretKeyStore) Record(ctx context.Context, svc *v1.Service, server string, resp *api_client.TunnelResponse) error {
+	var peer []byte
+	if resp.Peer != nil {
+		var err error
+		peer, err = json.Marshal(resp.Peer)
+		if err != nil {
+			return fmt.Errorf("failed to encode peer: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply(ctx, svc.Namespace, stateSecretName(svc), svc, func(data map[string][]byte) {
+		data[server+"."+tunnelIDField] = []byte(resp.TunnelID)
+		if peer != nil {
+			data[server+"."+peerField] = peer
+		} else {
+			delete(data, server+"."+peerField)
+		}
+	})
+}
+
+// Recorded returns the tunnel ID and peer parameters stored in the Service's Secret
+func (s *SecretKeyStore) Recorded(ctx context.Context, svc *v1.Service, server string) (*api_client.TunnelResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, err := s.getSecret(ctx, svc.Namespace, stateSecretName(svc), svc)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || len(secret.Data[server+"."+tunnelIDField]) == 0 {
+		return nil, nil
+	}
+
+	resp := &api_client.TunnelResponse{TunnelID: string(secret.Data[server+"."+tunnelIDField])}
+	if peer := secret.Data[server+"."+peerField]; len(peer) > 0 {
+		if err := json.Unmarshal(peer, &resp.Peer); err != nil {
+			return nil, fmt.Errorf("failed to decode peer: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// CreationID returns the creation ID stored in the Service's Secret, generating and
+// storing one if there is none
+func (s *SecretKeyStore) CreationID(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	field := server + "." + creationIDField
+	secret, err := s.getSecret(ctx, svc.Namespace, stateSecretName(svc), svc)
+	if err != nil {
+		return "", err
+	}
+	if secret != nil && len(secret.Data[field]) > 0 {
+		return string(secret.Data[field]), nil
+	}
+
+	creation, err := newCreationID()
+	if err != nil {
+		return "", err
+	}
+	err = s.apply(ctx, svc.Namespace, stateSecretName(svc), svc, func(data map[string][]byte) {
+		data[field] = []byte(creation)
+	})
+	if err != nil {
+		return "", err
+	}
+	return creation, nil
+}
+
+// Forget removes the server's entries from the Service's Secret and deletes it once
+// it is empty. Keys shared per server are kept.
+func (s *SecretKeyStore) Forget(ctx context.Context, svc *v1.Service, server string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.perServer {
+		delete(s.keys, s.keyID(svc, server))
+	}
+
+	return s.apply(ctx, svc.Namespace, stateSecretName(svc), svc, func(data map[string][]byte) {
+		delete(data, server+"."+privateKeyField)
+		delete(data, server+"."+tunnelIDField)
+		delete(data, server+"."+peerField)
+		delete(data, server+"."+creationIDField)
+	})
+}
+
+func (s *SecretKeyStore) keyID(svc *v1.Service, server string) string {
+	if s.perServer {
+		return server
+	}
+	return svc.Namespace + "/" + svc.Name + "/" + server
+}
+
+// keyLocation returns the Secret and field holding a key and the Service owning that Secret
+func (s *SecretKeyStore) keyLocation(svc *v1.Service, server string) (namespace, name, field string, owner *v1.Service) {
+	if s.perServer {
+		return s.namespace, "easy-tunnel-lb-" + server + "-key", privateKeyField, nil
+	}
+	return svc.Namespace, stateSecretName(svc), server + "." + privateKeyField, svc
+}
+
+// getSecret returns a Secret, or nil if it does not exist. Secrets the controller
+// did not create, or that belong to another Service, are refused.
+func (s *SecretKeyStore) getSecret(ctx context.Context, namespace, name string, owner *v1.Service) (*v1.Secret, error) {
+	secret, err := s.client.GetSecret(ctx, namespace, name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", namespace, name, err)
+	}
+	if !ownsSecret(secret, owner) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrSecretNotManaged, namespace, name)
+	}
+	return secret, nil
+}
+
+// ownsSecret reports whether secret was created by the controller, for owner if it is set
+func ownsSecret(secret *v1.Secret, owner *v1.Service) bool {
+	if secret.Labels[managedByLabel] != managedByValue {
+		return false
+	}
+	if owner == nil || owner.UID == "" {
+		return true
+	}
+	for _, ref := range secret.OwnerReferences {
+		if ref.Kind == "Service" && ref.UID == owner.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes a Secret's data, creating the Secret when needed and deleting it once
+// it is empty. Unchanged Secrets are not written.
+func (s *SecretKeyStore) apply(ctx context.Context, namespace, name string, owner *v1.Service, update func(data map[string][]byte)) error {
+	if s.dryRun {
+		return nil
+	}
+
+	secret, err := s.getSecret(ctx, namespace, name, owner)
+	if err != nil {
+		return err
+	}
+
+	data := map[string][]byte{}
+	if secret != nil {
+		for field, value := range secret.Data {
+			data[field] = value
+		}
+	}
+	update(data)
+
+	switch {
+	case secret == nil && len(data) == 0:
+		return nil
+	case secret == nil:
+		return s.client.CreateSecret(ctx, newStateSecret(namespace, name, owner, data))
+	case len(data) == 0:
+		return s.client.DeleteSecret(ctx, namespace, name)
+	case reflect.DeepEqual(data, secret.Data):
+		return nil
+	}
+
+	secret = secret.DeepCopy()
+	secret.Data = data
+	return s.client.UpdateSecret(ctx, secret)
+}
+
+// stateSecretName names the Secret holding a Service's tunnel state
+func stateSecretName(svc *v1.Service) string {
+	return svc.Name + "-tunnel-state"
+}
+
+// newStateSecret builds a Secret for tunnel state, owned by owner if it is set
+func newStateSecret(namespace, name string, owner *v1.Service, data map[string][]byte) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+	if owner != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}}
+	}
+	return secret
+}
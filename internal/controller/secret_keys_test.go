@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeSecretClient keeps Secrets in memory
+type fakeSecretClient struct {
+	secrets map[string]*v1.Secret
+	writes  int
+}
+
+func newFakeSecretClient() *fakeSecretClient {
+	return &fakeSecretClient{secrets: map[string]*v1.Secret{}}
+}
+
+func (c *fakeSecretClient) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	secret, ok := c.secrets[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return secret.DeepCopy(), nil
+}
+
+func (c *fakeSecretClient) CreateSecret(ctx context.Context, secret *v1.Secret) error {
+	c.writes++
+	c.secrets[secret.Namespace+"/"+secret.Name] = secret.DeepCopy()
+	return nil
+}
+
+func (c *fakeSecretClient) UpdateSecret(ctx context.Context, secret *v1.Secret) error {
+	c.writes++
+	c.secrets[secret.Namespace+"/"+secret.Name] = secret.DeepCopy()
+	return nil
+}
+
+func (c *fakeSecretClient) DeleteSecret(ctx context.Context, namespace, name string) error {
+	c.writes++
+	delete(c.secrets, namespace+"/"+name)
+	return nil
+}
+
+func newKeyedService(name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + name),
+		},
+	}
+}
+
+func TestSecretKeyStore_PersistsAcrossRestarts(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	svc := newKeyedService("web")
+
+	key, err := NewSecretKeyStore(client, "system").PrivateKey(ctx, svc, "eu")
+	assert.NoError(t, err)
+
+	secret := client.secrets["default/web-tunnel-state"]
+	if assert.NotNil(t, secret) {
+		assert.Equal(t, key, string(secret.Data["eu.privateKey"]))
+		assert.Equal(t, []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       "web",
+			UID:        "uid-web",
+		}}, secret.OwnerReferences)
+	}
+
+	// A new store, as after a restart, loads the same key
+	restarted, err := NewSecretKeyStore(client, "system").PrivateKey(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, key, restarted)
+
+	other, err := NewSecretKeyStore(client, "system").PrivateKey(ctx, svc, "us")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
+
+func TestSecretKeyStore_RecordAndForget(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	store := NewSecretKeyStore(client, "system")
+	svc := newKeyedService("web")
+
+	_, err := store.PrivateKey(ctx, svc, "eu")
+	assert.NoError(t, err)
+	_, err = store.PrivateKey(ctx, svc, "us")
+	assert.NoError(t, err)
+
+	resp := &api_client.TunnelResponse{TunnelID: "eu-tunnel", Peer: testPeer("eu")}
+	assert.NoError(t, store.Record(ctx, svc, "eu", resp))
+
+	secret := client.secrets["default/web-tunnel-state"]
+	assert.Equal(t, "eu-tunnel", string(secret.Data["eu.tunnelId"]))
+	var peer api_client.PeerConfig
+	assert.NoError(t, json.Unmarshal(secret.Data["eu.peer"], &peer))
+	assert.Equal(t, *testPeer("eu"), peer)
+
+	// Recording the same state again does not write
+	writes := client.writes
+	assert.NoError(t, store.Record(ctx, svc, "eu", resp))
+	assert.Equal(t, writes, client.writes)
+
+	// A restarted controller reads the state back
+	recorded, err := NewSecretKeyStore(client, "system").Recorded(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, resp, recorded)
+	recorded, err = store.Recorded(ctx, svc, "us")
+	assert.NoError(t, err)
+	assert.Nil(t, recorded)
+
+	assert.NoError(t, store.Forget(ctx, svc, "eu"))
+	secret = client.secrets["default/web-tunnel-state"]
+	assert.NotContains(t, secret.Data, "eu.privateKey")
+	assert.NotContains(t, secret.Data, "eu.tunnelId")
+	assert.NotContains(t, secret.Data, "eu.peer")
+	assert.Contains(t, secret.Data, "us.privateKey")
+
+	// The Secret goes away with its last server
+	assert.NoError(t, store.Forget(ctx, svc, "us"))
+	assert.NotContains(t, client.secrets, "default/web-tunnel-state")
+}
+
+func TestSecretKeyStore_CreationID(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	svc := newKeyedService("web")
+
+	creation, err := NewSecretKeyStore(client, "system").CreationID(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, creation)
+	assert.Equal(t, creation, string(client.secrets["default/web-tunnel-state"].Data["eu.creationId"]))
+
+	// A restarted controller retries a create under the same ID
+	store := NewSecretKeyStore(client, "system")
+	restarted, err := store.CreationID(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, creation, restarted)
+
+	// Once the tunnel is forgotten the next creation gets a new ID
+	assert.NoError(t, store.Forget(ctx, svc, "eu"))
+	assert.NotContains(t, client.secrets, "default/web-tunnel-state")
+	fresh, err := store.CreationID(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.NotEqual(t, creation, fresh)
+}
+
+func TestSecretKeyStore_RefusesUnmanagedSecrets(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	store := NewSecretKeyStore(client, "system")
+	svc := newKeyedService("web")
+
+	client.secrets["default/web-tunnel-state"] = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-tunnel-state", Namespace: "default"},
+		Data:       map[string][]byte{"eu.privateKey": []byte("foreign")},
+	}
+
+	_, err := store.PrivateKey(ctx, svc, "eu")
+	assert.ErrorIs(t, err, ErrSecretNotManaged)
+	assert.ErrorIs(t, store.Record(ctx, svc, "eu", &api_client.TunnelResponse{TunnelID: "eu-tunnel"}), ErrSecretNotManaged)
+	assert.ErrorIs(t, store.Forget(ctx, svc, "eu"), ErrSecretNotManaged)
+	assert.Equal(t, 0, client.writes)
+
+	// A Secret left behind by a deleted Service of the same name is not reused
+	other := newKeyedService("web")
+	other.UID = "uid-old-web"
+	_, err = NewSecretKeyStore(client, "system").PrivateKey(ctx, other, "us")
+	assert.ErrorIs(t, err, ErrSecretNotManaged)
+
+	delete(client.secrets, "default/web-tunnel-state")
+	_, err = NewSecretKeyStore(client, "system").PrivateKey(ctx, other, "us")
+	assert.NoError(t, err)
+	_, err = store.PrivateKey(ctx, svc, "eu")
+	assert.ErrorIs(t, err, ErrSecretNotManaged)
+}
+
+func TestServerSecretKeyStore(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	store := NewServerSecretKeyStore(client, "system")
+	web := newKeyedService("web")
+	api := newKeyedService("api")
+
+	key, err := store.PrivateKey(ctx, web, "eu")
+	assert.NoError(t, err)
+	shared, err := store.PrivateKey(ctx, api, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, key, shared)
+
+	secret := client.secrets["system/easy-tunnel-lb-eu-key"]
+	if assert.NotNil(t, secret) {
+		assert.Equal(t, key, string(secret.Data["privateKey"]))
+		assert.Empty(t, secret.OwnerReferences)
+	}
+
+	assert.NoError(t, store.Forget(ctx, web, "eu"))
+	assert.Contains(t, client.secrets, "system/easy-tunnel-lb-eu-key")
+
+	restarted, err := NewServerSecretKeyStore(client, "system").PrivateKey(ctx, api, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, key, restarted)
+}
+
+func TestSecretKeyStore_DryRun(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeSecretClient()
+	svc := newKeyedService("web")
+
+	existing, err := NewSecretKeyStore(client, "system").PrivateKey(ctx, svc, "eu")
+	assert.NoError(t, err)
+	writes := client.writes
+
+	store := NewSecretKeyStore(client, "system")
+	store.SetDryRun(true)
+
+	key, err := store.PrivateKey(ctx, svc, "eu")
+	assert.NoError(t, err)
+	assert.Equal(t, existing, key)
+
+	_, err = store.PrivateKey(ctx, svc, "us")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Record(ctx, svc, "eu", &api_client.TunnelResponse{TunnelID: "eu-tunnel"}))
+	assert.NoError(t, store.Forget(ctx, svc, "eu"))
+	assert.Equal(t, writes, client.writes)
+}
@@ -0,0 +1,554 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/k8s"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// DefaultServerName is the name given to the server configured through SERVER_URL/API_KEY
+	DefaultServerName = "default"
+	// DefaultFailureThreshold is the number of consecutive failed probes after which a server is considered down
+	DefaultFailureThreshold = 3
+)
+
+// ErrNoServerAvailable is returned when no tunnel server can handle a Service
+var ErrNoServerAvailable = fmt.Errorf("no tunnel server available")
+
+// TunnelServerClient interface for Kubernetes operations on TunnelServer resources
+type TunnelServerClient interface {
+	ListTunnelServers(ctx context.Context) ([]k8s.TunnelServer, error)
+	UpdateTunnelServerStatus(ctx context.Context, ts *k8s.TunnelServer) error
+	GetSecretValue(ctx context.Context, namespace, name, key string) ([]byte, error)
+}
+
+// ServerClient is an APIClient that can also report on the server itself
+type ServerClient interface {
+	APIClient
+	GetServerInfo(ctx context.Context) (*api_client.ServerInfo, error)
+}
+
+// ServerClientFactory builds an API client for a tunnel server
+type ServerClientFactory func(url, apiKey string, caBundle []byte) (ServerClient, error)
+
+// NewAPIServerClient is the ServerClientFactory backed by api_client.Client
+func NewAPIServerClient(url, apiKey string, caBundle []byte) (ServerClient, error) {
+	client, err := api_client.NewClientWithCA(url, apiKey, caBundle)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewAPIServerClientFactory returns a ServerClientFactory backed by api_client.Client
+// whose clients retry failed requests according to the policy
+func NewAPIServerClientFactory(retry api_client.RetryPolicy) ServerClientFactory {
+	return func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		client, err := api_client.NewClientWithCA(url, apiKey, caBundle)
+		if err != nil {
+			return nil, err
+		}
+		client.SetRetryPolicy(retry)
+		return client, nil
+	}
+}
+
+// Server is a tunnel server known to the controller
+type Server struct {
+	Name         string
+	Labels       map[string]string
+	Capabilities []string
+	// Transports limits the tunnel transports offered to the server, in order of preference
+	Transports []string
+	Client     APIClient
+	Reachable  bool
+	// Failed is set once the server has been unreachable for the registry's failure threshold
+	Failed bool
+}
+
+// ServerResolver selects the tunnel server that handles a Service
+type ServerResolver interface {
+	Resolve(svc *v1.Service) (*Server, error)
+	ResolveAll(svc *v1.Service) ([]*Server, error)
+	Get(name string) (*Server, bool)
+}
+
+// registeredServer tracks a Server together with what is needed to probe and rebuild it
+type registeredServer struct {
+	server      *Server
+	prober      ServerClient
+	fingerprint string
+	static      bool
+	failures    int
+}
+
+// ServerRegistry keeps an API client for every configured tunnel server
+type ServerRegistry struct {
+	k8sClient TunnelServerClient
+	newClient ServerClientFactory
+	logger    *utils.Logger
+
+	failureThreshold int
+	onHealthChange   func(server string)
+	dryRun           bool
+
+	mu      sync.RWMutex
+	servers map[string]*registeredServer
+}
+
+// NewServerRegistry creates a new ServerRegistry. k8sClient may be nil when only
+// static servers are used.
+func NewServerRegistry(k8sClient TunnelServerClient, newClient ServerClientFactory, logger *utils.Logger) *ServerRegistry {
+	return &ServerRegistry{
+		k8sClient:        k8sClient,
+		newClient:        newClient,
+		logger:           logger,
+		failureThreshold: DefaultFailureThreshold,
+		servers:          make(map[string]*registeredServer),
+	}
+}
+
+// SetFailureThreshold sets how many consecutive failed probes mark a server as failed
+func (r *ServerRegistry) SetFailureThreshold(threshold int) {
+	r.failureThreshold = threshold
+}
+
+// SetDryRun stops the registry from probing servers and writing TunnelServer status
+func (r *ServerRegistry) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+
+// OnHealthChange registers a callback invoked after a sync whenever a server
+// becomes failed or recovers
+func (r *ServerRegistry) OnHealthChange(handler func(server string)) {
+	r.onHealthChange = handler
+}
+
+// AddStaticServer registers a server that is not backed by a TunnelServer resource.
+// Static servers whose client can report on the server are probed on every sync
+// and fail over like any other server; others are always considered reachable.
+func (r *ServerRegistry) AddStaticServer(name string, client APIClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prober, _ := client.(ServerClient)
+	r.servers[name] = &registeredServer{
+		server: &Server{
+			Name:      name,
+			Client:    client,
+			Reachable: true,
+		},
+		prober: prober,
+		static: true,
+	}
+}
+
+// Get returns the server with the given name
+func (r *ServerRegistry) Get(name string) (*Server, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.servers[name]
+	if !ok {
+		return nil, false
+	}
+	return entry.server, true
+}
+
+// List returns all known servers sorted by name
+func (r *ServerRegistry) List() []*Server {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	servers := make([]*Server, 0, len(r.servers))
+	for _, entry := range r.servers {
+		servers = append(servers, entry.server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// Resolve picks the server for a Service. When StandbyServerAnnotation is set the
+// Service fails over to the standby once its primary server has failed, and only
+// returns to the primary after recovery if FailbackAnnotation is "true".
+func (r *ServerRegistry) Resolve(svc *v1.Service) (*Server, error) {
+	primary, err := r.resolvePrimary(svc)
+
+	standbyName := svc.Annotations[StandbyServerAnnotation]
+	if standbyName == "" {
+		return primary, err
+	}
+	standby, ok := r.Get(standbyName)
+	if !ok {
+		return nil, fmt.Errorf("standby tunnel server %q not found", standbyName)
+	}
+
+	if err != nil || primary.Failed {
+		if standby.Failed {
+			// Both are down, stay where we are rather than churning
+			if err != nil {
+				return nil, err
+			}
+			return primary, nil
+		}
+		return standby, nil
+	}
+
+	if svc.Annotations[AssignedServerAnnotation] == standby.Name && svc.Annotations[FailbackAnnotation] != "true" {
+		return standby, nil
+	}
+	return primary, nil
+}
+
+// resolvePrimary picks the primary server for a Service. A server named by ServerAnnotation is
+// used as is; otherwise servers matching ServerSelectorAnnotation that have not
+// failed are considered, preferring the server already recorded in
+// AssignedServerAnnotation. Without either annotation the default server is used
+// when configured, else the first server by name that has not failed.
+func (r *ServerRegistry) resolvePrimary(svc *v1.Service) (*Server, error) {
+	if name := svc.Annotations[ServerAnnotation]; name != "" {
+		server, ok := r.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("tunnel server %q not found", name)
+		}
+		return server, nil
+	}
+
+	selector := labels.Everything()
+	if expr, ok := svc.Annotations[ServerSelectorAnnotation]; ok {
+		parsed, err := labels.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server selector %q: %w", expr, err)
+		}
+		selector = parsed
+	} else if server, ok := r.Get(DefaultServerName); ok {
+		return server, nil
+	}
+
+	candidates := []*Server{}
+	for _, server := range r.List() {
+		if !server.Failed && selector.Matches(labels.Set(server.Labels)) {
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoServerAvailable
+	}
+
+	assigned := svc.Annotations[AssignedServerAnnotation]
+	for _, server := range candidates {
+		if server.Name == assigned {
+			return server, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+// ResolveAll picks the servers a multi-server Service is published on. Servers
+// listed in ServersAnnotation are used as is; otherwise up to ServerCountAnnotation
+// servers matching ServerSelectorAnnotation that have not failed are chosen, preferring those
+// the Service already has tunnels on. Fewer servers than requested are returned
+// when not enough are available.
+func (r *ServerRegistry) ResolveAll(svc *v1.Service) ([]*Server, error) {
+	if list := svc.Annotations[ServersAnnotation]; list != "" {
+		servers := []*Server{}
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			server, ok := r.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("tunnel server %q not found", name)
+			}
+			servers = append(servers, server)
+		}
+		if len(servers) == 0 {
+			return nil, ErrNoServerAvailable
+		}
+		return servers, nil
+	}
+
+	count, err := strconv.Atoi(svc.Annotations[ServerCountAnnotation])
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid server count %q", svc.Annotations[ServerCountAnnotation])
+	}
+
+	selector := labels.Everything()
+	if expr, ok := svc.Annotations[ServerSelectorAnnotation]; ok {
+		selector, err = labels.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server selector %q: %w", expr, err)
+		}
+	}
+
+	existing := parseTunnelIDs(svc.Annotations[TunnelsAnnotation])
+	preferred := []*Server{}
+	others := []*Server{}
+	for _, server := range r.List() {
+		if server.Failed || !selector.Matches(labels.Set(server.Labels)) {
+			continue
+		}
+		if _, ok := existing[server.Name]; ok {
+			preferred = append(preferred, server)
+		} else {
+			others = append(others, server)
+		}
+	}
+
+	servers := append(preferred, others...)
+	if len(servers) == 0 {
+		return nil, ErrNoServerAvailable
+	}
+	if len(servers) > count {
+		servers = servers[:count]
+	}
+	return servers, nil
+}
+
+// Run periodically syncs TunnelServer resources until ctx is cancelled
+func (r *ServerRegistry) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.Sync(ctx); err != nil {
+			r.logger.WithFields(map[string]interface{}{
+				"error": err.Error(),
+			}).Error("Failed to sync tunnel servers")
+		}
+	}, interval)
+}
+
+// Sync reloads TunnelServer resources, rebuilds clients whose connection details
+// changed, probes every server and writes the result back to its status. A
+// TunnelServer named like a static server is ignored. In dry-run mode servers
+// are not probed and keep their previous health.
+func (r *ServerRegistry) Sync(ctx context.Context) error {
+	var tunnelServers []k8s.TunnelServer
+	if r.k8sClient != nil {
+		list, err := r.k8sClient.ListTunnelServers(ctx)
+		if err != nil {
+			return err
+		}
+		tunnelServers = list
+	}
+
+	r.mu.RLock()
+	previous := make(map[string]*registeredServer, len(r.servers))
+	for name, entry := range r.servers {
+		previous[name] = entry
+	}
+	r.mu.RUnlock()
+
+	synced := make(map[string]*registeredServer, len(tunnelServers))
+	for name, entry := range previous {
+		if entry.static {
+			synced[name] = r.probeStatic(ctx, entry)
+		}
+	}
+
+	for i := range tunnelServers {
+		ts := &tunnelServers[i]
+		if _, ok := synced[ts.Name]; ok {
+			r.logger.WithFields(map[string]interface{}{
+				"server": ts.Name,
+			}).Warn("Ignoring tunnel server named like a statically configured server")
+			ts.Status.Reachable = false
+			ts.Status.Message = fmt.Sprintf("name %q is taken by a statically configured server", ts.Name)
+		} else {
+			entry, err := r.syncServer(ctx, ts, previous[ts.Name])
+			if err != nil {
+				r.logger.WithFields(map[string]interface{}{
+					"server": ts.Name,
+					"error":  err.Error(),
+				}).Warn("Tunnel server is not usable")
+			}
+			if entry != nil {
+				synced[ts.Name] = entry
+			}
+		}
+
+		if r.dryRun {
+			continue
+		}
+		if err := r.k8sClient.UpdateTunnelServerStatus(ctx, ts); err != nil {
+			r.logger.WithFields(map[string]interface{}{
+				"server": ts.Name,
+				"error":  err.Error(),
+			}).Error("Failed to update tunnel server status")
+		}
+	}
+
+	r.mu.Lock()
+	r.servers = synced
+	r.mu.Unlock()
+
+	for name, entry := range synced {
+		wasFailed := previous[name] != nil && previous[name].server.Failed
+		if entry.server.Failed == wasFailed {
+			continue
+		}
+
+		r.logger.WithFields(map[string]interface{}{
+			"server": name,
+			"failed": entry.server.Failed,
+		}).Warn("Tunnel server health changed")
+		if r.onHealthChange != nil {
+			r.onHealthChange(name)
+		}
+	}
+	return nil
+}
+
+// probeStatic probes a static server whose client can report on the server.
+// Failed probes count towards the failure threshold as for TunnelServer resources.
+func (r *ServerRegistry) probeStatic(ctx context.Context, previous *registeredServer) *registeredServer {
+	if previous.prober == nil || r.dryRun {
+		return previous
+	}
+
+	server := *previous.server
+	entry := *previous
+	entry.server = &server
+
+	if _, err := previous.prober.GetServerInfo(ctx); err != nil {
+		entry.failures++
+		server.Reachable = false
+		server.Failed = entry.failures >= r.failureThreshold
+		r.logger.WithFields(map[string]interface{}{
+			"server": server.Name,
+			"error":  err.Error(),
+		}).Warn("Tunnel server is not usable")
+		return &entry
+	}
+
+	entry.failures = 0
+	server.Reachable = true
+	server.Failed = false
+	return &entry
+}
+
+// syncServer builds (or reuses) the client for a TunnelServer, probes it and
+// records the outcome in ts.Status
+func (r *ServerRegistry) syncServer(ctx context.Context, ts *k8s.TunnelServer, previous *registeredServer) (*registeredServer, error) {
+	now := metav1.Now()
+	ts.Status.LastChecked = &now
+
+	ref := ts.Spec.CredentialsSecretRef
+	key := ref.Key
+	if key == "" {
+		key = k8s.DefaultCredentialsKey
+	}
+	apiKey, err := r.k8sClient.GetSecretValue(ctx, ref.Namespace, ref.Name, key)
+	if err != nil {
+		ts.Status.Reachable = false
+		ts.Status.Message = err.Error()
+		return r.failedEntry(previous), err
+	}
+
+	fingerprint := serverFingerprint(ts.Spec.URL, apiKey, ts.Spec.CABundle)
+
+	var client ServerClient
+	if previous != nil && !previous.static && previous.fingerprint == fingerprint {
+		client = previous.prober
+	} else {
+		client, err = r.newClient(ts.Spec.URL, string(apiKey), ts.Spec.CABundle)
+		if err != nil {
+			ts.Status.Reachable = false
+			ts.Status.Message = err.Error()
+			return r.failedEntry(previous), fmt.Errorf("failed to create client: %w", err)
+		}
+	}
+
+	server := &Server{
+		Name:         ts.Name,
+		Labels:       ts.Labels,
+		Capabilities: ts.Spec.Capabilities,
+		Transports:   ts.Spec.Transports,
+		Client:       client,
+	}
+	entry := &registeredServer{
+		server:      server,
+		prober:      client,
+		fingerprint: fingerprint,
+	}
+
+	// Nothing is sent to the server in dry-run mode, so its health is not known
+	// beyond what an earlier sync found
+	if r.dryRun {
+		if previous != nil && !previous.static {
+			entry.failures = previous.failures
+			server.Reachable = previous.server.Reachable
+			server.Failed = previous.server.Failed
+		}
+		return entry, nil
+	}
+
+	info, err := client.GetServerInfo(ctx)
+	if err != nil {
+		if previous != nil {
+			entry.failures = previous.failures
+		}
+		entry.failures++
+		server.Failed = entry.failures >= r.failureThreshold
+
+		ts.Status.Reachable = false
+		ts.Status.Message = err.Error()
+		return entry, err
+	}
+
+	server.Reachable = true
+	if len(server.Capabilities) == 0 {
+		server.Capabilities = info.Capabilities
+	}
+
+	ts.Status.Reachable = true
+	ts.Status.Message = ""
+	ts.Status.Capacity = k8s.TunnelServerCapacity{
+		MaxTunnels:    info.MaxTunnels,
+		ActiveTunnels: info.ActiveTunnels,
+	}
+	return entry, nil
+}
+
+// failedEntry keeps a previously synced server registered, but unreachable, when
+// its client cannot be rebuilt. The failure counts towards the failure threshold.
+func (r *ServerRegistry) failedEntry(previous *registeredServer) *registeredServer {
+	if previous == nil || previous.static {
+		return nil
+	}
+
+	server := *previous.server
+	server.Reachable = false
+	entry := *previous
+	entry.server = &server
+	entry.failures++
+	server.Failed = entry.failures >= r.failureThreshold
+	return &entry
+}
+
+// serverFingerprint identifies the connection details a client was built from
+func serverFingerprint(url string, apiKey, caBundle []byte) string {
+	h := sha256.New()
+	h.Write([]byte(url))
+	h.Write([]byte{0})
+	h.Write(apiKey)
+	h.Write([]byte{0})
+	h.Write(caBundle)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,567 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/k8s"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type MockTunnelServerClient struct {
+	mock.Mock
+}
+
+func (m *MockTunnelServerClient) ListTunnelServers(ctx context.Context) ([]k8s.TunnelServer, error) {
+	args := m.Called(ctx)
+	if list := args.Get(0); list != nil {
+		return list.([]k8s.TunnelServer), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockTunnelServerClient) UpdateTunnelServerStatus(ctx context.Context, ts *k8s.TunnelServer) error {
+	args := m.Called(ctx, ts)
+	return args.Error(0)
+}
+
+func (m *MockTunnelServerClient) GetSecretValue(ctx context.Context, namespace, name, key string) ([]byte, error) {
+	args := m.Called(ctx, namespace, name, key)
+	if value := args.Get(0); value != nil {
+		return value.([]byte), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+type MockServerClient struct {
+	MockAPIClient
+}
+
+func (m *MockServerClient) GetServerInfo(ctx context.Context) (*api_client.ServerInfo, error) {
+	args := m.Called(ctx)
+	if info := args.Get(0); info != nil {
+		return info.(*api_client.ServerInfo), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func newTestTunnelServer(name, url string, labels map[string]string) k8s.TunnelServer {
+	return k8s.TunnelServer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: k8s.TunnelServerSpec{
+			URL: url,
+			CredentialsSecretRef: k8s.SecretKeyReference{
+				Name:      name + "-credentials",
+				Namespace: "easy-tunnel-lb-system",
+			},
+		},
+	}
+}
+
+func TestServerRegistry_Sync(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	euClient := &MockServerClient{}
+	usClient := &MockServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", map[string]string{"region": "eu"}),
+		newTestTunnelServer("us", "https://us.example.com", map[string]string{"region": "us"}),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, "easy-tunnel-lb-system", "eu-credentials", k8s.DefaultCredentialsKey).
+		Return([]byte("eu-key"), nil)
+	k8sMock.On("GetSecretValue", mock.Anything, "easy-tunnel-lb-system", "us-credentials", k8s.DefaultCredentialsKey).
+		Return([]byte("us-key"), nil)
+
+	var statuses []k8s.TunnelServerStatus
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.AnythingOfType("*k8s.TunnelServer")).
+		Run(func(args mock.Arguments) {
+			statuses = append(statuses, args.Get(1).(*k8s.TunnelServer).Status)
+		}).Return(nil)
+
+	euClient.On("GetServerInfo", mock.Anything).Return(&api_client.ServerInfo{
+		Capabilities:  []string{"wireguard"},
+		MaxTunnels:    10,
+		ActiveTunnels: 2,
+	}, nil)
+	usClient.On("GetServerInfo", mock.Anything).Return(nil, errors.New("connection refused"))
+
+	built := map[string]int{}
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		built[url]++
+		switch url {
+		case "https://eu.example.com":
+			assert.Equal(t, "eu-key", apiKey)
+			return euClient, nil
+		default:
+			return usClient, nil
+		}
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+
+	err := registry.Sync(context.Background())
+	assert.NoError(t, err)
+
+	servers := registry.List()
+	assert.Len(t, servers, 2)
+	assert.Equal(t, "eu", servers[0].Name)
+	assert.True(t, servers[0].Reachable)
+	assert.Equal(t, []string{"wireguard"}, servers[0].Capabilities)
+	assert.Equal(t, "us", servers[1].Name)
+	assert.False(t, servers[1].Reachable)
+
+	assert.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Reachable)
+	assert.Equal(t, 10, statuses[0].Capacity.MaxTunnels)
+	assert.Equal(t, 2, statuses[0].Capacity.ActiveTunnels)
+	assert.False(t, statuses[1].Reachable)
+	assert.Equal(t, "connection refused", statuses[1].Message)
+
+	// A second sync with unchanged connection details reuses the clients
+	err = registry.Sync(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, built["https://eu.example.com"])
+	assert.Equal(t, 1, built["https://us.example.com"])
+
+	// Only reachable servers are resolved
+	server, err := registry.Resolve(&v1.Service{})
+	assert.NoError(t, err)
+	assert.Equal(t, "eu", server.Name)
+}
+
+func TestServerRegistry_SyncMissingCredentials(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", nil),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, "easy-tunnel-lb-system", "eu-credentials", k8s.DefaultCredentialsKey).
+		Return(nil, errors.New("secret not found"))
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.MatchedBy(func(ts *k8s.TunnelServer) bool {
+		return !ts.Status.Reachable && ts.Status.Message == "secret not found"
+	})).Return(nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		t.Fatal("client should not be built without credentials")
+		return nil, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+
+	err := registry.Sync(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, registry.List())
+
+	_, err = registry.Resolve(&v1.Service{})
+	assert.ErrorIs(t, err, ErrNoServerAvailable)
+
+	k8sMock.AssertExpectations(t)
+}
+
+func TestServerRegistry_StaticServer(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	apiMock := &MockAPIClient{}
+	euClient := &MockServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", nil),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return([]byte("eu-key"), nil)
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.Anything).Return(nil)
+	euClient.On("GetServerInfo", mock.Anything).Return(&api_client.ServerInfo{}, nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		return euClient, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+	registry.AddStaticServer(DefaultServerName, apiMock)
+
+	err := registry.Sync(context.Background())
+	assert.NoError(t, err)
+
+	// Static servers survive a sync and take precedence
+	assert.Len(t, registry.List(), 2)
+	server, err := registry.Resolve(&v1.Service{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultServerName, server.Name)
+	assert.Same(t, apiMock, server.Client)
+}
+
+func TestServerRegistry_Resolve(t *testing.T) {
+	registry := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	registry.servers = map[string]*registeredServer{
+		"eu-1": {server: &Server{Name: "eu-1", Labels: map[string]string{"region": "eu"}, Reachable: true}},
+		"eu-2": {server: &Server{Name: "eu-2", Labels: map[string]string{"region": "eu"}, Reachable: true}},
+		"eu-3": {server: &Server{Name: "eu-3", Labels: map[string]string{"region": "eu"}, Reachable: false, Failed: true}},
+		"eu-4": {server: &Server{Name: "eu-4", Labels: map[string]string{"region": "eu"}, Reachable: false}},
+		"us-1": {server: &Server{Name: "us-1", Labels: map[string]string{"region": "us"}, Reachable: true}},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:        "no annotations picks first reachable server",
+			annotations: map[string]string{},
+			expected:    "eu-1",
+		},
+		{
+			name:        "server by name",
+			annotations: map[string]string{ServerAnnotation: "us-1"},
+			expected:    "us-1",
+		},
+		{
+			name:        "server by name ignores failures",
+			annotations: map[string]string{ServerAnnotation: "eu-3"},
+			expected:    "eu-3",
+		},
+		{
+			name:        "unknown server name",
+			annotations: map[string]string{ServerAnnotation: "ap-1"},
+			expectError: true,
+		},
+		{
+			name:        "server by selector",
+			annotations: map[string]string{ServerSelectorAnnotation: "region=us"},
+			expected:    "us-1",
+		},
+		{
+			name: "selector keeps assigned server",
+			annotations: map[string]string{
+				ServerSelectorAnnotation: "region=eu",
+				AssignedServerAnnotation: "eu-2",
+			},
+			expected: "eu-2",
+		},
+		{
+			name: "selector keeps assigned server below the failure threshold",
+			annotations: map[string]string{
+				ServerSelectorAnnotation: "region=eu",
+				AssignedServerAnnotation: "eu-4",
+			},
+			expected: "eu-4",
+		},
+		{
+			name: "selector moves away from failed assigned server",
+			annotations: map[string]string{
+				ServerSelectorAnnotation: "region=eu",
+				AssignedServerAnnotation: "eu-3",
+			},
+			expected: "eu-1",
+		},
+		{
+			name:        "selector without matches",
+			annotations: map[string]string{ServerSelectorAnnotation: "region=ap"},
+			expectError: true,
+		},
+		{
+			name:        "invalid selector",
+			annotations: map[string]string{ServerSelectorAnnotation: "region in eu"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tt.annotations,
+				},
+			}
+
+			server, err := registry.Resolve(svc)
+
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, server.Name)
+			}
+		})
+	}
+}
+
+func TestServerRegistry_StaticServerNameCollision(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	apiMock := &MockAPIClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer(DefaultServerName, "https://other.example.com", nil),
+	}, nil)
+	var status *k8s.TunnelServer
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { status = args.Get(1).(*k8s.TunnelServer) }).
+		Return(nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		t.Fatal("no client should be built for a colliding TunnelServer")
+		return nil, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+	registry.AddStaticServer(DefaultServerName, apiMock)
+	assert.NoError(t, registry.Sync(context.Background()))
+
+	// The static server is kept and the TunnelServer reports the collision
+	server, ok := registry.Get(DefaultServerName)
+	assert.True(t, ok)
+	assert.Same(t, apiMock, server.Client)
+	if assert.NotNil(t, status) {
+		assert.False(t, status.Status.Reachable)
+		assert.Contains(t, status.Status.Message, "statically configured")
+	}
+}
+
+func TestServerRegistry_StaticServerFailover(t *testing.T) {
+	defaultClient := &MockServerClient{}
+
+	registry := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	registry.SetFailureThreshold(2)
+	registry.AddStaticServer(DefaultServerName, defaultClient)
+
+	changes := []string{}
+	registry.OnHealthChange(func(server string) {
+		changes = append(changes, server)
+	})
+
+	// Static servers are probed even without TunnelServer resources
+	defaultClient.On("GetServerInfo", mock.Anything).Return(nil, errors.New("timeout")).Twice()
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ := registry.Get(DefaultServerName)
+	assert.False(t, server.Reachable)
+	assert.False(t, server.Failed)
+
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ = registry.Get(DefaultServerName)
+	assert.True(t, server.Failed)
+	assert.Equal(t, []string{DefaultServerName}, changes)
+
+	defaultClient.On("GetServerInfo", mock.Anything).Return(&api_client.ServerInfo{}, nil).Once()
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ = registry.Get(DefaultServerName)
+	assert.True(t, server.Reachable)
+	assert.False(t, server.Failed)
+	assert.Same(t, defaultClient, server.Client)
+	defaultClient.AssertExpectations(t)
+}
+
+func TestServerRegistry_DryRunSkipsProbes(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	euClient := &MockServerClient{}
+	staticClient := &MockServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", nil),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return([]byte("eu-key"), nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		return euClient, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+	registry.SetDryRun(true)
+	registry.SetFailureThreshold(1)
+	registry.AddStaticServer("static", staticClient)
+
+	changes := []string{}
+	registry.OnHealthChange(func(server string) {
+		changes = append(changes, server)
+	})
+
+	assert.NoError(t, registry.Sync(context.Background()))
+
+	// Neither server is probed nor marked failed, and no status is written
+	eu, ok := registry.Get("eu")
+	assert.True(t, ok)
+	assert.False(t, eu.Failed)
+	static, _ := registry.Get("static")
+	assert.True(t, static.Reachable)
+	assert.False(t, static.Failed)
+	assert.Empty(t, changes)
+
+	server, err := registry.Resolve(&v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{ServerSelectorAnnotation: ""},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "eu", server.Name)
+
+	euClient.AssertNotCalled(t, "GetServerInfo", mock.Anything)
+	staticClient.AssertNotCalled(t, "GetServerInfo", mock.Anything)
+	k8sMock.AssertNotCalled(t, "UpdateTunnelServerStatus", mock.Anything, mock.Anything)
+}
+
+func TestServerRegistry_FailureThreshold(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	euClient := &MockServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", nil),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return([]byte("eu-key"), nil)
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.Anything).Return(nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		return euClient, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+	registry.SetFailureThreshold(2)
+
+	changes := []string{}
+	registry.OnHealthChange(func(server string) {
+		changes = append(changes, server)
+	})
+
+	// First failure only marks the server unreachable
+	euClient.On("GetServerInfo", mock.Anything).Return(nil, errors.New("timeout")).Twice()
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ := registry.Get("eu")
+	assert.False(t, server.Reachable)
+	assert.False(t, server.Failed)
+	assert.Empty(t, changes)
+
+	// Sustained failure marks it failed
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ = registry.Get("eu")
+	assert.True(t, server.Failed)
+	assert.Equal(t, []string{"eu"}, changes)
+
+	// A successful probe recovers it
+	euClient.On("GetServerInfo", mock.Anything).Return(&api_client.ServerInfo{}, nil).Once()
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, _ = registry.Get("eu")
+	assert.True(t, server.Reachable)
+	assert.False(t, server.Failed)
+	assert.Equal(t, []string{"eu", "eu"}, changes)
+}
+
+func TestServerRegistry_SyncKeepsServerOnSecretError(t *testing.T) {
+	k8sMock := &MockTunnelServerClient{}
+	euClient := &MockServerClient{}
+
+	k8sMock.On("ListTunnelServers", mock.Anything).Return([]k8s.TunnelServer{
+		newTestTunnelServer("eu", "https://eu.example.com", nil),
+	}, nil)
+	k8sMock.On("GetSecretValue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return([]byte("eu-key"), nil).Once()
+	k8sMock.On("GetSecretValue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, errors.New("etcd timeout"))
+	k8sMock.On("UpdateTunnelServerStatus", mock.Anything, mock.Anything).Return(nil)
+	euClient.On("GetServerInfo", mock.Anything).Return(&api_client.ServerInfo{}, nil)
+
+	factory := func(url, apiKey string, caBundle []byte) (ServerClient, error) {
+		return euClient, nil
+	}
+
+	registry := NewServerRegistry(k8sMock, factory, utils.NewLogger("test"))
+	registry.SetFailureThreshold(2)
+
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, ok := registry.Get("eu")
+	assert.True(t, ok)
+	assert.True(t, server.Reachable)
+
+	// A transient read error keeps the server registered, but unreachable
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, ok = registry.Get("eu")
+	assert.True(t, ok)
+	assert.False(t, server.Reachable)
+	assert.False(t, server.Failed)
+	assert.Same(t, euClient, server.Client)
+
+	// Sustained errors count towards the failure threshold
+	assert.NoError(t, registry.Sync(context.Background()))
+	server, ok = registry.Get("eu")
+	assert.True(t, ok)
+	assert.True(t, server.Failed)
+}
+
+func TestServerRegistry_ResolveStandby(t *testing.T) {
+	registry := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	primary := &Server{Name: "primary", Reachable: true}
+	standby := &Server{Name: "standby", Reachable: true}
+	registry.servers = map[string]*registeredServer{
+		"primary": {server: primary},
+		"standby": {server: standby},
+	}
+
+	tests := []struct {
+		name          string
+		primaryFailed bool
+		standbyFailed bool
+		annotations   map[string]string
+		expected      string
+	}{
+		{
+			name:        "healthy primary",
+			annotations: map[string]string{},
+			expected:    "primary",
+		},
+		{
+			name:          "failed primary fails over",
+			primaryFailed: true,
+			annotations:   map[string]string{},
+			expected:      "standby",
+		},
+		{
+			name:          "both failed stays on primary",
+			primaryFailed: true,
+			standbyFailed: true,
+			annotations:   map[string]string{},
+			expected:      "primary",
+		},
+		{
+			name:        "recovered primary without failback stays on standby",
+			annotations: map[string]string{AssignedServerAnnotation: "standby"},
+			expected:    "standby",
+		},
+		{
+			name: "recovered primary with failback",
+			annotations: map[string]string{
+				AssignedServerAnnotation: "standby",
+				FailbackAnnotation:       "true",
+			},
+			expected: "primary",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary.Failed = tt.primaryFailed
+			standby.Failed = tt.standbyFailed
+
+			annotations := map[string]string{
+				ServerAnnotation:        "primary",
+				StandbyServerAnnotation: "standby",
+			}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+
+			server, err := registry.Resolve(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: annotations,
+				},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, server.Name)
+		})
+	}
+}
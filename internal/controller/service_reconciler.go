@@ -2,98 +2,297 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
 	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
 	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // K8sClient interface for Kubernetes operations on Services
 type K8sClient interface {
 	SetServiceLoadBalancer(ctx context.Context, svc *v1.Service, externalIP, externalHost string) error
+	SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error
+	SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error
+	SetServiceCondition(ctx context.Context, svc *v1.Service, condition metav1.Condition) error
 }
 
 // APIClient interface for tunnel server operations
 type APIClient interface {
-	CreateTunnel(req *api_client.TunnelRequest) (*api_client.TunnelResponse, error)
-	UpdateTunnel(tunnelID string, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error)
-	DeleteTunnel(tunnelID string) error
+	CreateTunnel(ctx context.Context, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error)
+	UpdateTunnel(ctx context.Context, tunnelID string, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error)
+	RotateKey(ctx context.Context, tunnelID string, req *api_client.RotateKeyRequest) (*api_client.TunnelResponse, error)
+	DeleteTunnel(ctx context.Context, tunnelID string) error
 }
 
 // TunnelManager interface for local WireGuard tunnel operations
 type TunnelManager interface {
 	CreateTunnel(ctx context.Context, config *tunnel.TunnelConfig) error
-	UpdateTunnel(ctx context.Context, config *tunnel.TunnelConfig) error
+	UpdateTunnel(ctx context.Context, config *tunnel.TunnelConfig) (tunnel.UpdateMode, error)
 	DeleteTunnel(ctx context.Context, tunnelID string) error
 }
 
+// InterfaceNamer is an optional TunnelManager extension naming the local
+// interface that carries a tunnel
+type InterfaceNamer interface {
+	TunnelInterface(tunnelID string) (string, bool)
+}
+
 // ServiceReconciler handles the reconciliation of a Service resource
 type ServiceReconciler struct {
 	k8sClient  K8sClient
-	apiClient  APIClient
+	servers    ServerResolver
 	tunnelMgr  TunnelManager
+	keys       KeyStore
+	health     TunnelHealthReporter
 	logger     *utils.Logger
+	plan       *Plan
+	transports []string
+	// sharedInterface is set when every tunnel runs on one local interface
+	sharedInterface bool
+
+	keyRotationInterval time.Duration
+	now                 func() time.Time
 }
 
+// NewServiceReconciler creates a reconciler that sends every Service to a single tunnel server
 func NewServiceReconciler(k8sClient K8sClient, apiClient APIClient, tunnelMgr TunnelManager, logger *utils.Logger) *ServiceReconciler {
+	servers := NewServerRegistry(nil, nil, logger)
+	servers.AddStaticServer(DefaultServerName, apiClient)
+	return NewServiceReconcilerWithServers(k8sClient, servers, tunnelMgr, logger)
+}
+
+// NewServiceReconcilerWithServers creates a reconciler that resolves the tunnel server per Service
+func NewServiceReconcilerWithServers(k8sClient K8sClient, servers ServerResolver, tunnelMgr TunnelManager, logger *utils.Logger) *ServiceReconciler {
 	return &ServiceReconciler{
 		k8sClient: k8sClient,
-		apiClient: apiClient,
+		servers:   servers,
 		tunnelMgr: tunnelMgr,
+		keys:      NewMemoryKeyStore(),
 		logger:    logger,
+		now:       time.Now,
+	}
+}
+
+// SetKeyStore replaces where the tunnels' WireGuard private keys are kept
+func (r *ServiceReconciler) SetKeyStore(keys KeyStore) {
+	r.keys = keys
+}
+
+// SetKeyRotationInterval rotates every tunnel's key once it is older than interval.
+// Zero disables scheduled rotation; RotateKeyAnnotation still works.
+func (r *ServiceReconciler) SetKeyRotationInterval(interval time.Duration) {
+	r.keyRotationInterval = interval
+}
+
+// SetTransports sets the tunnel transports offered to servers in every request
+func (r *ServiceReconciler) SetTransports(transports []string) {
+	r.transports = transports
+}
+
+// SetSharedInterface tells the reconciler that all tunnels share one local
+// interface, whose settings a single Service cannot choose
+func (r *ServiceReconciler) SetSharedInterface(shared bool) {
+	r.sharedInterface = shared
+}
+
+// SetDryRun makes the reconciler record every server call, local tunnel change and
+// Service write into plan instead of performing it. A nil plan disables dry-run mode.
+func (r *ServiceReconciler) SetDryRun(plan *Plan) {
+	r.plan = plan
+}
+
+// planned returns a copy of the reconciler whose side effects are recorded into the
+// plan, replacing what was planned for the Service before
+func (r *ServiceReconciler) planned(svc *v1.Service) *ServiceReconciler {
+	service := svc.Namespace + "/" + svc.Name
+	r.plan.Begin(service)
+	return &ServiceReconciler{
+		k8sClient: &planningK8sClient{plan: r.plan, service: service},
+		servers:   &planningResolver{ServerResolver: r.servers, plan: r.plan, service: service},
+		tunnelMgr: &planningTunnelManager{plan: r.plan, service: service},
+		keys:      r.keys,
+		health:    r.health,
+		logger:    r.logger,
+
+		transports:      r.transports,
+		sharedInterface: r.sharedInterface,
+
+		keyRotationInterval: r.keyRotationInterval,
+		now:                 r.now,
 	}
 }
 
 // Reconcile ensures the tunnel is created/updated for the given service
 func (r *ServiceReconciler) Reconcile(ctx context.Context, svc *v1.Service) error {
+	if r.plan != nil {
+		return r.planned(svc).Reconcile(ctx, svc)
+	}
+
+	if r.sharedInterface {
+		if err := CheckSharedTuning(svc.Annotations); err != nil {
+			return err
+		}
+	}
+
+	if isMultiServer(svc) {
+		return r.reconcileMultiServer(ctx, svc)
+	}
+
+	// A Service switching from several servers first gives up its old tunnels
+	if svc.Annotations[TunnelsAnnotation] != "" {
+		if err := r.removeMultiServerTunnels(ctx, svc); err != nil {
+			return err
+		}
+	}
+
 	// Retrieve or create the tunnel
-	tunnelID := svc.Annotations["easy-tunnel-lb.quinnovator.com/tunnel-id"]
-	ports := []int{}
+	tunnelID := svc.Annotations[TunnelIDAnnotation]
+	req, err := newTunnelRequest(svc)
+	if err != nil {
+		return err
+	}
 
-	for _, sp := range svc.Spec.Ports {
-		ports = append(ports, int(sp.Port))
+	server, err := r.servers.Resolve(svc)
+	if err != nil {
+		return fmt.Errorf("failed to resolve tunnel server: %w", err)
 	}
 
-	req := &api_client.TunnelRequest{
-		IngressName:      svc.Name,
-		IngressNamespace: svc.Namespace,
-		Hostname:         "", // not relevant for service LB, but left in for API
-		Ports:            ports,
-		Annotations:      svc.Annotations,
+	req.Transports, err = r.requestTransports(svc, server)
+	if err != nil {
+		return err
+	}
+
+	// Move the tunnel if the Service now resolves to a different server
+	var replaced string
+	if assigned := svc.Annotations[AssignedServerAnnotation]; tunnelID != "" && assigned != "" && assigned != server.Name {
+		previous, ok := r.servers.Get(assigned)
+		if !ok || previous.Failed {
+			// The old server is gone or cannot be reached, so only tear down our side
+			r.logger.WithFields(map[string]interface{}{
+				"service":   svc.Namespace + "/" + svc.Name,
+				"from":      assigned,
+				"to":        server.Name,
+				"tunnel_id": tunnelID,
+			}).Warn("Moving tunnel, leaving it behind on the unavailable server")
+			if err := r.deleteLocalTunnel(ctx, tunnelID); err != nil {
+				return err
+			}
+		} else if err := r.deleteTunnel(ctx, previous, tunnelID); err != nil {
+			return fmt.Errorf("failed to move tunnel from server %s: %w", assigned, err)
+		}
+		if err := r.keys.Forget(ctx, svc, assigned); err != nil {
+			return fmt.Errorf("failed to forget tunnel key: %w", err)
+		}
+		replaced, tunnelID = tunnelID, ""
+	}
+
+	// A tunnel whose annotation was lost is found again through the recorded state
+	if tunnelID == "" && replaced == "" {
+		tunnelID, err = r.recordedTunnelID(ctx, svc, server.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	privateKey, err := r.tunnelKey(ctx, svc, server.Name, req)
+	if err != nil {
+		return err
 	}
 
 	var resp *api_client.TunnelResponse
-	var err error
 
+	if tunnelID != "" {
+		// update
+		resp, err = server.Client.UpdateTunnel(ctx, tunnelID, req)
+		if api_client.IsNotFound(err) {
+			// The server lost the tunnel, so replace it with a new one
+			if err := r.replaceLostTunnel(ctx, svc, server.Name, tunnelID, tunnelID); err != nil {
+				return err
+			}
+			replaced, tunnelID = tunnelID, ""
+		} else if err != nil {
+			return fmt.Errorf("failed to update tunnel: %w", err)
+		}
+	}
 	if tunnelID == "" {
 		// create
-		resp, err = r.apiClient.CreateTunnel(req)
+		req.IdempotencyKey, err = r.idempotencyKey(ctx, svc, server.Name, replaced)
+		if err != nil {
+			return err
+		}
+		resp, err = server.Client.CreateTunnel(ctx, req)
 		if err != nil {
 			return fmt.Errorf("failed to create tunnel: %w", err)
 		}
-	} else {
-		// update
-		resp, err = r.apiClient.UpdateTunnel(tunnelID, req)
+	}
+
+	// Rotate the key when the policy or the Service asks for it
+	rotated := r.rotationDue(svc) && tunnelID != ""
+	if rotated {
+		resp, privateKey, err = r.rotateKey(ctx, svc, server, resp.TunnelID, resp.Transport)
 		if err != nil {
-			return fmt.Errorf("failed to update tunnel: %w", err)
+			return err
 		}
 	}
 
+	// Record where the tunnel lives so later updates and deletes reach the same server
+	annotations := r.rotationAnnotations(svc, rotated)
+	if resp.TunnelID != svc.Annotations[TunnelIDAnnotation] || svc.Annotations[AssignedServerAnnotation] != server.Name {
+		annotations[TunnelIDAnnotation] = resp.TunnelID
+		annotations[AssignedServerAnnotation] = server.Name
+	}
+	if value := effectiveTuning(resp, req.Tuning); reportsTuning(svc, req.Tuning) && value != "" && value != svc.Annotations[EffectiveTuningAnnotation] {
+		annotations[EffectiveTuningAnnotation] = value
+	}
+	if len(annotations) > 0 {
+		err = r.k8sClient.SetServiceAnnotations(ctx, svc, annotations)
+		if err != nil {
+			return fmt.Errorf("failed to record tunnel on service: %w", err)
+		}
+	}
+
+	resp, err = r.withRecordedPeer(ctx, svc, server.Name, resp)
+	if err != nil {
+		return err
+	}
+	if err := r.keys.Record(ctx, svc, server.Name, resp); err != nil {
+		return fmt.Errorf("failed to record tunnel state: %w", err)
+	}
+
 	// Configure local WireGuard tunnel
+	wgConfig, err := renderTunnelConfig(privateKey, resp, req.Tuning)
+	if err != nil {
+		return err
+	}
+
 	tunnelConfig := &tunnel.TunnelConfig{
-		TunnelID: resp.TunnelID,
-		WGConfig: resp.WGConfig,
+		TunnelID:  resp.TunnelID,
+		Transport: resp.Transport,
+		WGConfig:  wgConfig,
+		Server:    server.Name,
+		Service:   serviceHost(req),
+		Ports:     req.Ports,
+		UDPPorts:  req.UDPPorts,
+	}
+	if err := setTransportConfig(tunnelConfig, server, privateKey, resp); err != nil {
+		return err
 	}
 
 	if tunnelID == "" {
-		if err := r.tunnelMgr.CreateTunnel(ctx, tunnelConfig); err != nil {
-			return fmt.Errorf("failed to create local wireguard tunnel: %w", err)
+		if err := r.createLocalTunnel(ctx, svc, tunnelConfig); err != nil {
+			return err
 		}
 	} else {
-		if err := r.tunnelMgr.UpdateTunnel(ctx, tunnelConfig); err != nil {
-			return fmt.Errorf("failed to update local wireguard tunnel: %w", err)
+		if err := r.updateLocalTunnel(ctx, svc, tunnelConfig); err != nil {
+			return err
 		}
 	}
 
@@ -103,22 +302,261 @@ func (r *ServiceReconciler) Reconcile(ctx context.Context, svc *v1.Service) erro
 		return fmt.Errorf("failed to update service loadbalancer: %w", err)
 	}
 
-	return nil
+	return r.reportHealth(ctx, svc, []string{resp.TunnelID})
 }
 
 // HandleDelete ensures the tunnel is removed when the Service is deleted
 func (r *ServiceReconciler) HandleDelete(ctx context.Context, svc *v1.Service) error {
-	tunnelID := svc.Annotations["easy-tunnel-lb.quinnovator.com/tunnel-id"]
+	if r.plan != nil {
+		return r.planned(svc).HandleDelete(ctx, svc)
+	}
+
+	if isMultiServer(svc) || svc.Annotations[TunnelsAnnotation] != "" {
+		return r.deleteMultiServer(ctx, svc)
+	}
+
+	tunnelID := svc.Annotations[TunnelIDAnnotation]
 	if tunnelID == "" {
 		return nil
 	}
 
-	if err := r.apiClient.DeleteTunnel(tunnelID); err != nil {
+	var server *Server
+	if assigned := svc.Annotations[AssignedServerAnnotation]; assigned != "" {
+		var ok bool
+		server, ok = r.servers.Get(assigned)
+		if !ok {
+			return fmt.Errorf("assigned tunnel server %q not found", assigned)
+		}
+	} else {
+		var err error
+		server, err = r.servers.Resolve(svc)
+		if err != nil {
+			return fmt.Errorf("failed to resolve tunnel server: %w", err)
+		}
+	}
+
+	if err := r.deleteTunnel(ctx, server, tunnelID); err != nil {
+		return err
+	}
+
+	if err := r.keys.Forget(ctx, svc, server.Name); err != nil {
+		return fmt.Errorf("failed to forget tunnel key: %w", err)
+	}
+	return nil
+}
+
+// recordedTunnelID returns the tunnel ID recorded for the Service on a server, so
+// a tunnel whose annotation was lost is updated rather than created again
+func (r *ServiceReconciler) recordedTunnelID(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	recorded, err := r.keys.Recorded(ctx, svc, server)
+	if err != nil {
+		return "", fmt.Errorf("failed to load tunnel state: %w", err)
+	}
+	if recorded == nil {
+		return "", nil
+	}
+
+	r.logger.WithFields(map[string]interface{}{
+		"service":   svc.Namespace + "/" + svc.Name,
+		"server":    server,
+		"tunnel_id": recorded.TunnelID,
+	}).Info("Using tunnel ID recorded in tunnel state")
+	return recorded.TunnelID, nil
+}
+
+// withRecordedPeer fills in the peer parameters recorded for a tunnel when the
+// server's response leaves them out
+func (r *ServiceReconciler) withRecordedPeer(ctx context.Context, svc *v1.Service, server string, resp *api_client.TunnelResponse) (*api_client.TunnelResponse, error) {
+	if resp.Peer != nil {
+		return resp, nil
+	}
+	recorded, err := r.keys.Recorded(ctx, svc, server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tunnel state: %w", err)
+	}
+	if recorded == nil || recorded.TunnelID != resp.TunnelID || recorded.Peer == nil {
+		return resp, nil
+	}
+
+	filled := *resp
+	filled.Peer = recorded.Peer
+	return &filled, nil
+}
+
+// replaceLostTunnel tears down the local side of a tunnel its server no longer
+// knows, before it is created anew. The local side may be gone as well.
+func (r *ServiceReconciler) replaceLostTunnel(ctx context.Context, svc *v1.Service, server, tunnelID, localID string) error {
+	r.logger.WithFields(map[string]interface{}{
+		"service":   svc.Namespace + "/" + svc.Name,
+		"server":    server,
+		"tunnel_id": tunnelID,
+	}).Warn("Tunnel not found on server, recreating it")
+
+	return r.deleteLocalTunnel(ctx, localID)
+}
+
+// createLocalTunnel brings up the local side of a tunnel and logs the interface
+// carrying it, since long tunnel IDs only show up shortened in interface names
+func (r *ServiceReconciler) createLocalTunnel(ctx context.Context, svc *v1.Service, config *tunnel.TunnelConfig) error {
+	if err := r.tunnelMgr.CreateTunnel(ctx, config); err != nil {
+		return fmt.Errorf("failed to create local wireguard tunnel: %w", err)
+	}
+
+	if name := r.localInterface(config); name != "" {
+		r.logger.WithFields(map[string]interface{}{
+			"service":   svc.Namespace + "/" + svc.Name,
+			"tunnel_id": config.TunnelID,
+			"interface": name,
+		}).Info("Created local tunnel")
+	}
+	return nil
+}
+
+// localInterface returns the name of the interface carrying a local tunnel, or ""
+// when the tunnel manager does not name interfaces
+func (r *ServiceReconciler) localInterface(config *tunnel.TunnelConfig) string {
+	namer, ok := r.tunnelMgr.(InterfaceNamer)
+	if !ok {
+		return ""
+	}
+	name, _ := namer.TunnelInterface(config.TunnelID)
+	return name
+}
+
+// updateLocalTunnel updates the local side of a tunnel and logs whether it was
+// synced in place or restarted. A local side that is missing, because the
+// controller restarted or creating it failed before, is brought up anew.
+func (r *ServiceReconciler) updateLocalTunnel(ctx context.Context, svc *v1.Service, config *tunnel.TunnelConfig) error {
+	mode, err := r.tunnelMgr.UpdateTunnel(ctx, config)
+	if errors.Is(err, tunnel.ErrTunnelNotFound) {
+		r.logger.WithFields(map[string]interface{}{
+			"service":   svc.Namespace + "/" + svc.Name,
+			"tunnel_id": config.TunnelID,
+		}).Info("Restoring local tunnel")
+		return r.createLocalTunnel(ctx, svc, config)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update local wireguard tunnel: %w", err)
+	}
+
+	if mode != tunnel.UpdateUnchanged {
+		r.logger.WithFields(map[string]interface{}{
+			"service":   svc.Namespace + "/" + svc.Name,
+			"tunnel_id": config.TunnelID,
+			"mode":      mode,
+		}).Info("Updated local tunnel")
+	}
+	return nil
+}
+
+// newTunnelRequest builds the server request describing a Service, failing when
+// its tuning annotations are invalid
+func newTunnelRequest(svc *v1.Service) (*api_client.TunnelRequest, error) {
+	tuning, err := parseTuning(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []int{}
+	var udpPorts []int
+
+	for _, sp := range svc.Spec.Ports {
+		ports = append(ports, int(sp.Port))
+		if sp.Protocol == v1.ProtocolUDP {
+			udpPorts = append(udpPorts, int(sp.Port))
+		}
+	}
+
+	return &api_client.TunnelRequest{
+		IngressName:      svc.Name,
+		IngressNamespace: svc.Namespace,
+		Hostname:         svc.Annotations[HostnameAnnotation],
+		Ports:            ports,
+		UDPPorts:         udpPorts,
+		Annotations:      svc.Annotations,
+		Tuning:           tuning,
+	}, nil
+}
+
+// idempotencyKey returns the key of the Service's next tunnel creation on a server.
+// The key store's creation ID changes once the tunnel is forgotten, so a tunnel
+// created again later does not reuse the key of the first one.
+func (r *ServiceReconciler) idempotencyKey(ctx context.Context, svc *v1.Service, server, replaced string) (string, error) {
+	creation, err := r.keys.CreationID(ctx, svc, server)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tunnel creation ID: %w", err)
+	}
+	return idempotencyKey(svc, server, replaced, creation), nil
+}
+
+// idempotencyKey identifies the creation of a Service's tunnel on a server, so
+// that a create retried after its response was lost returns the tunnel created
+// first. A tunnel that replaces another one gets a key of its own.
+func idempotencyKey(svc *v1.Service, server, replaced, creation string) string {
+	if svc.UID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(string(svc.UID) + "/" + server + "/" + replaced + "/" + creation))
+	return hex.EncodeToString(sum[:])
+}
+
+// tunnelKey returns the private key for a Service's tunnel to a server and puts
+// its public keys into the request
+func (r *ServiceReconciler) tunnelKey(ctx context.Context, svc *v1.Service, server string, req *api_client.TunnelRequest) (string, error) {
+	privateKey, err := r.keys.PrivateKey(ctx, svc, server)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tunnel key: %w", err)
+	}
+
+	publicKey, err := tunnel.PublicKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tunnel key: %w", err)
+	}
+
+	req.PublicKey = publicKey
+	if slices.Contains(req.Transports, tunnel.TransportSSH) {
+		req.SSHPublicKey, err = tunnel.SSHPublicKey(privateKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to get tunnel key: %w", err)
+		}
+	}
+	return privateKey, nil
+}
+
+// renderTunnelConfig renders our WireGuard config from the peer details the server
+// returned and the Service's tuning. Tunnels on other transports have none.
+func renderTunnelConfig(privateKey string, resp *api_client.TunnelResponse, tuning *api_client.TunnelTuning) (string, error) {
+	if resp.Transport != "" && resp.Transport != tunnel.TransportWireGuard {
+		return "", nil
+	}
+
+	peer, err := tunnelPeer(resp, tuning)
+	if err != nil {
+		return "", err
+	}
+	return tunnel.RenderConfig(privateKey, peer), nil
+}
+
+// serviceHost returns the in-cluster DNS name of the Service a request describes
+func serviceHost(req *api_client.TunnelRequest) string {
+	return fmt.Sprintf("%s.%s.svc", req.IngressName, req.IngressNamespace)
+}
+
+// deleteTunnel removes a tunnel from the given server and tears down its local side
+func (r *ServiceReconciler) deleteTunnel(ctx context.Context, server *Server, tunnelID string) error {
+	// A tunnel the server does not know is already gone
+	if err := server.Client.DeleteTunnel(ctx, tunnelID); err != nil && !api_client.IsNotFound(err) {
 		return fmt.Errorf("failed to delete tunnel from server: %w", err)
 	}
 
-	if err := r.tunnelMgr.DeleteTunnel(ctx, tunnelID); err != nil {
+	return r.deleteLocalTunnel(ctx, tunnelID)
+}
+
+// deleteLocalTunnel tears down the local side of a tunnel. A local side that is
+// already gone, as after a controller restart, counts as deleted.
+func (r *ServiceReconciler) deleteLocalTunnel(ctx context.Context, tunnelID string) error {
+	if err := r.tunnelMgr.DeleteTunnel(ctx, tunnelID); err != nil && !errors.Is(err, tunnel.ErrTunnelNotFound) {
 		return fmt.Errorf("failed to delete local wireguard tunnel: %w", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
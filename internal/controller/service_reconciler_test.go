@@ -2,7 +2,11 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
 	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
@@ -23,28 +27,51 @@ func (m *MockK8sClient) SetServiceLoadBalancer(ctx context.Context, svc *v1.Serv
 	return args.Error(0)
 }
 
+func (m *MockK8sClient) SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	args := m.Called(ctx, svc, ingress)
+	return args.Error(0)
+}
+
+func (m *MockK8sClient) SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error {
+	args := m.Called(ctx, svc, annotations)
+	return args.Error(0)
+}
+
+func (m *MockK8sClient) SetServiceCondition(ctx context.Context, svc *v1.Service, condition metav1.Condition) error {
+	args := m.Called(ctx, svc, condition)
+	return args.Error(0)
+}
+
 type MockAPIClient struct {
 	mock.Mock
 }
 
-func (m *MockAPIClient) CreateTunnel(req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
-	args := m.Called(req)
+func (m *MockAPIClient) CreateTunnel(ctx context.Context, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
+	args := m.Called(ctx, req)
+	if resp := args.Get(0); resp != nil {
+		return resp.(*api_client.TunnelResponse), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockAPIClient) UpdateTunnel(ctx context.Context, tunnelID string, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
+	args := m.Called(ctx, tunnelID, req)
 	if resp := args.Get(0); resp != nil {
 		return resp.(*api_client.TunnelResponse), args.Error(1)
 	}
 	return nil, args.Error(1)
 }
 
-func (m *MockAPIClient) UpdateTunnel(tunnelID string, req *api_client.TunnelRequest) (*api_client.TunnelResponse, error) {
-	args := m.Called(tunnelID, req)
+func (m *MockAPIClient) RotateKey(ctx context.Context, tunnelID string, req *api_client.RotateKeyRequest) (*api_client.TunnelResponse, error) {
+	args := m.Called(ctx, tunnelID, req)
 	if resp := args.Get(0); resp != nil {
 		return resp.(*api_client.TunnelResponse), args.Error(1)
 	}
 	return nil, args.Error(1)
 }
 
-func (m *MockAPIClient) DeleteTunnel(tunnelID string) error {
-	args := m.Called(tunnelID)
+func (m *MockAPIClient) DeleteTunnel(ctx context.Context, tunnelID string) error {
+	args := m.Called(ctx, tunnelID)
 	return args.Error(0)
 }
 
@@ -57,9 +84,9 @@ func (m *MockTunnelManager) CreateTunnel(ctx context.Context, config *tunnel.Tun
 	return args.Error(0)
 }
 
-func (m *MockTunnelManager) UpdateTunnel(ctx context.Context, config *tunnel.TunnelConfig) error {
+func (m *MockTunnelManager) UpdateTunnel(ctx context.Context, config *tunnel.TunnelConfig) (tunnel.UpdateMode, error) {
 	args := m.Called(ctx, config)
-	return args.Error(0)
+	return args.Get(0).(tunnel.UpdateMode), args.Error(1)
 }
 
 func (m *MockTunnelManager) DeleteTunnel(ctx context.Context, tunnelID string) error {
@@ -67,6 +94,64 @@ func (m *MockTunnelManager) DeleteTunnel(ctx context.Context, tunnelID string) e
 	return args.Error(0)
 }
 
+// Fixed key pair so rendered configs are predictable
+const (
+	testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	testPublicKey  = "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="
+)
+
+// testKeyStore hands out the fixed test key for every tunnel
+type testKeyStore struct{}
+
+func (testKeyStore) PrivateKey(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	return testPrivateKey, nil
+}
+
+func (testKeyStore) Shared() bool {
+	return false
+}
+
+func (testKeyStore) Replace(ctx context.Context, svc *v1.Service, server, privateKey string) error {
+	return nil
+}
+
+func (testKeyStore) Record(ctx context.Context, svc *v1.Service, server string, resp *api_client.TunnelResponse) error {
+	return nil
+}
+
+func (testKeyStore) Recorded(ctx context.Context, svc *v1.Service, server string) (*api_client.TunnelResponse, error) {
+	return nil, nil
+}
+
+func (testKeyStore) CreationID(ctx context.Context, svc *v1.Service, server string) (string, error) {
+	return "", nil
+}
+
+func (testKeyStore) Forget(ctx context.Context, svc *v1.Service, server string) error {
+	return nil
+}
+
+// testPeer returns the peer details a server named name would send back
+func testPeer(name string) *api_client.PeerConfig {
+	return &api_client.PeerConfig{
+		PublicKey:  testPublicKey,
+		Endpoint:   name + ".example.com:51820",
+		Addresses:  []string{"10.0.0.2/32"},
+		AllowedIPs: []string{"10.0.0.1/32"},
+	}
+}
+
+// testWGConfig returns the local config rendered from testPeer(name)
+func testWGConfig(name string) string {
+	peer := testPeer(name)
+	return tunnel.RenderConfig(testPrivateKey, &tunnel.Peer{
+		PublicKey:  peer.PublicKey,
+		Endpoint:   peer.Endpoint,
+		Addresses:  peer.Addresses,
+		AllowedIPs: peer.AllowedIPs,
+	})
+}
+
 func TestServiceReconciler_Reconcile(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -100,20 +185,29 @@ func TestServiceReconciler_Reconcile(t *testing.T) {
 					Annotations: map[string]string{
 						"some-annotation": "value",
 					},
+					PublicKey:        testPublicKey,
 				}
 				
 				resp := &api_client.TunnelResponse{
 					TunnelID:     "new-tunnel-id",
 					ExternalIP:   "1.2.3.4",
 					ExternalHost: "test.example.com",
-					WGConfig:     "test-config",
+					Peer:         testPeer("test"),
 				}
 				
-				api.On("CreateTunnel", expectedReq).Return(resp, nil)
+				api.On("CreateTunnel", mock.Anything, expectedReq).Return(resp, nil)
+				
+				k8s.On("SetServiceAnnotations", mock.Anything, mock.AnythingOfType("*v1.Service"), map[string]string{
+					TunnelIDAnnotation:       "new-tunnel-id",
+					AssignedServerAnnotation: DefaultServerName,
+				}).Return(nil)
 				
 				tm.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
 					TunnelID: "new-tunnel-id",
-					WGConfig: "test-config",
+					WGConfig: testWGConfig("test"),
+					Server:   DefaultServerName,
+					Service:  "test-service.default.svc",
+					Ports:    []int{80, 443},
 				}).Return(nil)
 				
 				k8s.On("SetServiceLoadBalancer", 
@@ -150,21 +244,30 @@ func TestServiceReconciler_Reconcile(t *testing.T) {
 					Annotations: map[string]string{
 						"easy-tunnel-lb.quinnovator.com/tunnel-id": "existing-tunnel-id",
 					},
+					PublicKey:        testPublicKey,
 				}
 				
 				resp := &api_client.TunnelResponse{
 					TunnelID:     "existing-tunnel-id",
 					ExternalIP:   "5.6.7.8",
 					ExternalHost: "test2.example.com",
-					WGConfig:     "updated-config",
+					Peer:         testPeer("updated"),
 				}
 				
-				api.On("UpdateTunnel", "existing-tunnel-id", expectedReq).Return(resp, nil)
+				api.On("UpdateTunnel", mock.Anything, "existing-tunnel-id", expectedReq).Return(resp, nil)
+				
+				k8s.On("SetServiceAnnotations", mock.Anything, mock.AnythingOfType("*v1.Service"), map[string]string{
+					TunnelIDAnnotation:       "existing-tunnel-id",
+					AssignedServerAnnotation: DefaultServerName,
+				}).Return(nil)
 				
 				tm.On("UpdateTunnel", mock.Anything, &tunnel.TunnelConfig{
 					TunnelID: "existing-tunnel-id",
-					WGConfig: "updated-config",
-				}).Return(nil)
+					WGConfig: testWGConfig("updated"),
+					Server:   DefaultServerName,
+					Service:  "test-service.default.svc",
+					Ports:    []int{80},
+				}).Return(tunnel.UpdateRestart, nil)
 				
 				k8s.On("SetServiceLoadBalancer", 
 					mock.Anything, 
@@ -175,6 +278,74 @@ func TestServiceReconciler_Reconcile(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "recreate tunnel the server lost",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					UID:       "uid-test-service",
+					Annotations: map[string]string{
+						TunnelIDAnnotation:       "lost-tunnel-id",
+						AssignedServerAnnotation: DefaultServerName,
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{
+						{Port: 80},
+					},
+				},
+			},
+			setup: func(k8s *MockK8sClient, api *MockAPIClient, tm *MockTunnelManager) {
+				api.On("UpdateTunnel", mock.Anything, "lost-tunnel-id", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+					nil, fmt.Errorf("update tunnel request failed: %w", &api_client.APIError{StatusCode: http.StatusNotFound}))
+
+				// The local side of the lost tunnel goes, and a new tunnel replaces it
+				tm.On("DeleteTunnel", mock.Anything, "lost-tunnel-id").Return(nil)
+
+				svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{UID: "uid-test-service"}}
+				api.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+					return req.IdempotencyKey == idempotencyKey(svc, DefaultServerName, "lost-tunnel-id", "")
+				})).Return(&api_client.TunnelResponse{
+					TunnelID:   "new-tunnel-id",
+					ExternalIP: "1.2.3.4",
+					Peer:       testPeer("test"),
+				}, nil)
+
+				k8s.On("SetServiceAnnotations", mock.Anything, mock.AnythingOfType("*v1.Service"), map[string]string{
+					TunnelIDAnnotation:       "new-tunnel-id",
+					AssignedServerAnnotation: DefaultServerName,
+				}).Return(nil)
+
+				tm.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+					TunnelID: "new-tunnel-id",
+					WGConfig: testWGConfig("test"),
+					Server:   DefaultServerName,
+					Service:  "test-service.default.svc",
+					Ports:    []int{80},
+				}).Return(nil)
+
+				k8s.On("SetServiceLoadBalancer", mock.Anything, mock.AnythingOfType("*v1.Service"), "1.2.3.4", "").Return(nil)
+			},
+			wantErr: false,
+		},
+		{
+			name: "update failing otherwise keeps the tunnel",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-service",
+					Namespace: "default",
+					Annotations: map[string]string{
+						TunnelIDAnnotation: "existing-tunnel-id",
+					},
+				},
+			},
+			setup: func(k8s *MockK8sClient, api *MockAPIClient, tm *MockTunnelManager) {
+				api.On("UpdateTunnel", mock.Anything, "existing-tunnel-id", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+					nil, &api_client.APIError{StatusCode: http.StatusUnauthorized, Message: "invalid API key"})
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -191,6 +362,7 @@ func TestServiceReconciler_Reconcile(t *testing.T) {
 				tunnelMock,
 				utils.NewLogger("test"),
 			)
+			reconciler.SetKeyStore(testKeyStore{})
 			
 			err := reconciler.Reconcile(context.Background(), tt.service)
 			
@@ -224,11 +396,55 @@ func TestServiceReconciler_HandleDelete(t *testing.T) {
 				},
 			},
 			setup: func(api *MockAPIClient, tm *MockTunnelManager) {
-				api.On("DeleteTunnel", "tunnel-to-delete").Return(nil)
+				api.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(nil)
 				tm.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(nil)
 			},
 			wantErr: false,
 		},
+		{
+			name: "tunnel already gone from server",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TunnelIDAnnotation: "tunnel-to-delete",
+					},
+				},
+			},
+			setup: func(api *MockAPIClient, tm *MockTunnelManager) {
+				api.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(&api_client.APIError{StatusCode: http.StatusNotFound})
+				tm.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(nil)
+			},
+			wantErr: false,
+		},
+		{
+			name: "server rejects delete",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TunnelIDAnnotation: "tunnel-to-delete",
+					},
+				},
+			},
+			setup: func(api *MockAPIClient, tm *MockTunnelManager) {
+				api.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(&api_client.APIError{StatusCode: http.StatusUnauthorized})
+			},
+			wantErr: true,
+		},
+		{
+			name: "local tunnel already gone",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TunnelIDAnnotation: "tunnel-to-delete",
+					},
+				},
+			},
+			setup: func(api *MockAPIClient, tm *MockTunnelManager) {
+				api.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(nil)
+				tm.On("DeleteTunnel", mock.Anything, "tunnel-to-delete").Return(fmt.Errorf("%w: tunnel-to-delete", tunnel.ErrTunnelNotFound))
+			},
+			wantErr: false,
+		},
 		{
 			name: "no tunnel ID - no action needed",
 			service: &v1.Service{
@@ -256,6 +472,7 @@ func TestServiceReconciler_HandleDelete(t *testing.T) {
 				tunnelMock,
 				utils.NewLogger("test"),
 			)
+			reconciler.SetKeyStore(testKeyStore{})
 			
 			err := reconciler.HandleDelete(context.Background(), tt.service)
 			
@@ -269,4 +486,452 @@ func TestServiceReconciler_HandleDelete(t *testing.T) {
 			tunnelMock.AssertExpectations(t)
 		})
 	}
-} 
\ No newline at end of file
+} 
+
+func TestServiceReconciler_ServerSelection(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServerAnnotation:         "us",
+				TunnelIDAnnotation:       "eu-tunnel",
+				AssignedServerAnnotation: "eu",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Port: 80},
+			},
+		},
+	}
+
+	// The tunnel moves from the previously assigned server to the requested one
+	euClient.On("DeleteTunnel", mock.Anything, "eu-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "eu-tunnel").Return(nil)
+
+	usClient.On("CreateTunnel", mock.Anything, mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "us-tunnel",
+			ExternalIP: "5.6.7.8",
+			Peer:       testPeer("us"),
+		}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID: "us-tunnel",
+		WGConfig: testWGConfig("us"),
+		Server:   "us",
+		Service:  "test-service.default.svc",
+		Ports:    []int{80},
+	}).Return(nil)
+
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "us-tunnel",
+		AssignedServerAnnotation: "us",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "5.6.7.8", "").Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_HandleDeleteAssignedServer(t *testing.T) {
+	euClient := &MockAPIClient{}
+	usClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("eu", euClient)
+	servers.AddStaticServer("us", usClient)
+
+	// The delete goes to the recorded server even though the selector now points elsewhere
+	usClient.On("DeleteTunnel", mock.Anything, "us-tunnel").Return(nil)
+	tunnelMock.On("DeleteTunnel", mock.Anything, "us-tunnel").Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(&MockK8sClient{}, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.HandleDelete(context.Background(), &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				ServerAnnotation:         "eu",
+				TunnelIDAnnotation:       "us-tunnel",
+				AssignedServerAnnotation: "us",
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	euClient.AssertExpectations(t)
+	usClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_Failover(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	primaryClient := &MockAPIClient{}
+	standbyClient := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	servers := NewServerRegistry(nil, nil, utils.NewLogger("test"))
+	servers.AddStaticServer("primary", primaryClient)
+	servers.AddStaticServer("standby", standbyClient)
+	primary, _ := servers.Get("primary")
+	primary.Failed = true
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServerAnnotation:         "primary",
+				StandbyServerAnnotation:  "standby",
+				TunnelIDAnnotation:       "primary-tunnel",
+				AssignedServerAnnotation: "primary",
+			},
+		},
+	}
+
+	// The failed primary is not contacted, only the local tunnel is swapped
+	tunnelMock.On("DeleteTunnel", mock.Anything, "primary-tunnel").Return(nil)
+
+	standbyClient.On("CreateTunnel", mock.Anything, mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "standby-tunnel",
+			ExternalIP: "9.9.9.9",
+			Peer:       testPeer("standby"),
+		}, nil)
+	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID: "standby-tunnel",
+		WGConfig: testWGConfig("standby"),
+		Server:   "standby",
+		Service:  "test-service.default.svc",
+		Ports:    []int{},
+	}).Return(nil)
+
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "standby-tunnel",
+		AssignedServerAnnotation: "standby",
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "9.9.9.9", "").Return(nil)
+
+	reconciler := NewServiceReconcilerWithServers(k8sMock, servers, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.NoError(t, err)
+
+	k8sMock.AssertExpectations(t)
+	primaryClient.AssertExpectations(t)
+	standbyClient.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_MissingPeer(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+		},
+	}
+
+	apiMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return req.PublicKey == testPublicKey
+	})).Return(&api_client.TunnelResponse{TunnelID: "test-tunnel"}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, mock.Anything).Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.ErrorContains(t, err, "no peer details")
+	tunnelMock.AssertNotCalled(t, "CreateTunnel", mock.Anything, mock.Anything)
+}
+
+// upBackend is a tunnel backend that only records which interfaces are up
+type upBackend struct {
+	up map[string]bool
+}
+
+func (b *upBackend) Up(ctx context.Context, name string, config *tunnel.TunnelConfig) error {
+	b.up[name] = true
+	return nil
+}
+
+func (b *upBackend) Down(ctx context.Context, name string) error {
+	delete(b.up, name)
+	return nil
+}
+
+func TestServiceReconciler_RestoreLocalTunnel(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+
+	// A restarted controller starts without local tunnels for annotated Services
+	backend := &upBackend{up: map[string]bool{}}
+	manager := tunnel.NewManagerWithBackend(backend)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				TunnelIDAnnotation:       "existing-tunnel-id",
+				AssignedServerAnnotation: DefaultServerName,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Port: 80}},
+		},
+	}
+
+	apiMock.On("UpdateTunnel", mock.Anything, "existing-tunnel-id", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "existing-tunnel-id",
+			ExternalIP: "1.2.3.4",
+			Peer:       testPeer("test"),
+		}, nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, manager, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	// The local side is brought back up, and later reconciles update it
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+		_, err := manager.GetTunnel("existing-tunnel-id")
+		assert.NoError(t, err)
+		assert.Len(t, backend.up, 1)
+	}
+
+	// The interface carrying the tunnel is reported under its shortened name
+	name := reconciler.localInterface(&tunnel.TunnelConfig{TunnelID: "existing-tunnel-id"})
+	assert.True(t, backend.up[name])
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_RecreateLostTunnelAfterRestart(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+
+	// Neither the server nor the restarted controller know the tunnel any more
+	backend := &upBackend{up: map[string]bool{}}
+	manager := tunnel.NewManagerWithBackend(backend)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			UID:       "uid-test-service",
+			Annotations: map[string]string{
+				TunnelIDAnnotation:       "lost-tunnel-id",
+				AssignedServerAnnotation: DefaultServerName,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Port: 80}},
+		},
+	}
+
+	apiMock.On("UpdateTunnel", mock.Anything, "lost-tunnel-id", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		nil, &api_client.APIError{StatusCode: http.StatusNotFound})
+	apiMock.On("CreateTunnel", mock.Anything, mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{
+			TunnelID:   "new-tunnel-id",
+			ExternalIP: "1.2.3.4",
+			Peer:       testPeer("test"),
+		}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "new-tunnel-id",
+		AssignedServerAnnotation: DefaultServerName,
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, manager, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+	_, err := manager.GetTunnel("new-tunnel-id")
+	assert.NoError(t, err)
+	assert.Len(t, backend.up, 1)
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_RecordedTunnelState(t *testing.T) {
+	ctx := context.Background()
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	backend := &upBackend{up: map[string]bool{}}
+	manager := tunnel.NewManagerWithBackend(backend)
+
+	// The tunnel annotation was lost, but the state Secret still knows the tunnel
+	svc := newKeyedService("test-service")
+	svc.Spec.Ports = []v1.ServicePort{{Port: 80}}
+	keys := NewSecretKeyStore(newFakeSecretClient(), "system")
+	assert.NoError(t, keys.Record(ctx, svc, DefaultServerName, &api_client.TunnelResponse{
+		TunnelID: "kept-tunnel-id",
+		Peer:     testPeer("test"),
+	}))
+
+	// The server's update leaves the peer out, so the recorded one is used
+	apiMock.On("UpdateTunnel", mock.Anything, "kept-tunnel-id", mock.AnythingOfType("*api_client.TunnelRequest")).Return(
+		&api_client.TunnelResponse{TunnelID: "kept-tunnel-id", ExternalIP: "1.2.3.4"}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "kept-tunnel-id",
+		AssignedServerAnnotation: DefaultServerName,
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, manager, utils.NewLogger("test"))
+	reconciler.SetKeyStore(keys)
+
+	assert.NoError(t, reconciler.Reconcile(ctx, svc))
+	_, err := manager.GetTunnel("kept-tunnel-id")
+	assert.NoError(t, err)
+	apiMock.AssertNotCalled(t, "CreateTunnel", mock.Anything, mock.Anything)
+
+	recorded, err := keys.Recorded(ctx, svc, DefaultServerName)
+	assert.NoError(t, err)
+	assert.Equal(t, testPeer("test"), recorded.Peer)
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_IdempotencyKey(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			UID:       "uid-test-service",
+		},
+	}
+
+	// Creates carry a key derived from the Service UID and server
+	apiMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return req.IdempotencyKey == idempotencyKey(svc, DefaultServerName, "", "")
+	})).Return(&api_client.TunnelResponse{TunnelID: "test-tunnel"}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, mock.Anything).Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	err := reconciler.Reconcile(context.Background(), svc)
+	assert.ErrorContains(t, err, "no peer details")
+	apiMock.AssertExpectations(t)
+
+	// Keys are stable, and differ between servers, replaced tunnels and creations
+	key := idempotencyKey(svc, "eu", "", "c1")
+	assert.NotEmpty(t, key)
+	assert.Equal(t, key, idempotencyKey(svc.DeepCopy(), "eu", "", "c1"))
+	assert.NotEqual(t, key, idempotencyKey(svc, "us", "", "c1"))
+	assert.NotEqual(t, key, idempotencyKey(svc, "eu", "old-tunnel", "c1"))
+	assert.NotEqual(t, key, idempotencyKey(svc, "eu", "", "c2"))
+	other := svc.DeepCopy()
+	other.UID = "uid-other-service"
+	assert.NotEqual(t, key, idempotencyKey(other, "eu", "", "c1"))
+
+	// Services without a UID send no key, so their creates are not retried
+	assert.Empty(t, idempotencyKey(&v1.Service{}, "eu", "", "c1"))
+}
+
+func TestServiceReconciler_Cancellation(t *testing.T) {
+	// A hung tunnel server holds requests until the test ends
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	k8sMock := &MockK8sClient{}
+	tunnelMock := &MockTunnelManager{}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "default"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+
+	reconciler := NewServiceReconciler(k8sMock, api_client.NewClient(server.URL, "test-key"), tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+
+	// Shutting down aborts the call in flight instead of waiting for the client timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := reconciler.Reconcile(ctx, svc)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	tunnelMock.AssertNotCalled(t, "CreateTunnel", mock.Anything, mock.Anything)
+}
+
+func TestServiceReconciler_Transport(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Port: 80}},
+		},
+	}
+
+	// The server picks from the offered transports and names the one it provisioned
+	apiMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return assert.ObjectsAreEqual([]string{"other", tunnel.TransportWireGuard}, req.Transports)
+	})).Return(&api_client.TunnelResponse{TunnelID: "new-tunnel-id", ExternalIP: "1.2.3.4", Transport: "other"}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "new-tunnel-id",
+		AssignedServerAnnotation: DefaultServerName,
+	}).Return(nil)
+
+	// The local side runs on that transport's backend, without a WireGuard config
+	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID:  "new-tunnel-id",
+		Transport: "other",
+		Server:    DefaultServerName,
+		Service:   "test-service.default.svc",
+		Ports:     []int{80},
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+	reconciler.SetTransports([]string{"other", tunnel.TransportWireGuard})
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
@@ -2,11 +2,15 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
 	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -16,16 +20,63 @@ import (
 )
 
 const (
+	// AnnotationPrefix is the prefix shared by all annotations owned by the controller
+	AnnotationPrefix = "easy-tunnel-lb.quinnovator.com/"
 	// TunnelAnnotation is the annotation key for enabling tunnel load balancing on a Service
 	TunnelAnnotation = "easy-tunnel-lb.quinnovator.com/enabled"
+	// TunnelIDAnnotation records the ID of the tunnel provisioned for a Service
+	TunnelIDAnnotation = "easy-tunnel-lb.quinnovator.com/tunnel-id"
+	// ServerAnnotation selects a tunnel server by name
+	ServerAnnotation = "easy-tunnel-lb.quinnovator.com/server"
+	// ServerSelectorAnnotation selects a tunnel server by a label selector over server labels
+	ServerSelectorAnnotation = "easy-tunnel-lb.quinnovator.com/server-selector"
+	// AssignedServerAnnotation records the tunnel server a Service's tunnel lives on
+	AssignedServerAnnotation = "easy-tunnel-lb.quinnovator.com/assigned-server"
+	// StandbyServerAnnotation names the tunnel server a Service fails over to when its primary is down
+	StandbyServerAnnotation = "easy-tunnel-lb.quinnovator.com/standby-server"
+	// FailbackAnnotation moves a failed-over Service back to its primary once it recovers when "true"
+	FailbackAnnotation = "easy-tunnel-lb.quinnovator.com/failback"
+	// ServersAnnotation publishes a Service on every listed tunnel server (comma separated)
+	ServersAnnotation = "easy-tunnel-lb.quinnovator.com/servers"
+	// ServerCountAnnotation publishes a Service on this many servers matching ServerSelectorAnnotation
+	ServerCountAnnotation = "easy-tunnel-lb.quinnovator.com/server-count"
+	// TunnelsAnnotation records the tunnel per server of a multi-server Service as server=tunnelID pairs
+	TunnelsAnnotation = "easy-tunnel-lb.quinnovator.com/tunnels"
+	// HostnameAnnotation requests an external hostname for the Service from the tunnel server
+	HostnameAnnotation = "easy-tunnel-lb.quinnovator.com/hostname"
+	// SourceRangesAnnotation restricts the client CIDRs the tunnel server accepts (comma separated)
+	SourceRangesAnnotation = "easy-tunnel-lb.quinnovator.com/source-ranges"
+	// RotateKeyAnnotation rotates the Service's tunnel keys on the next reconcile when "true"
+	RotateKeyAnnotation = "easy-tunnel-lb.quinnovator.com/rotate-key"
+	// KeyRotatedAtAnnotation records when the Service's tunnel keys were last rotated (RFC 3339)
+	KeyRotatedAtAnnotation = "easy-tunnel-lb.quinnovator.com/key-rotated-at"
+	// MTUAnnotation sets the MTU of the Service's tunnel interfaces
+	MTUAnnotation = "easy-tunnel-lb.quinnovator.com/mtu"
+	// PersistentKeepaliveAnnotation sets the keepalive interval of the Service's tunnels in seconds, 0 for off
+	PersistentKeepaliveAnnotation = "easy-tunnel-lb.quinnovator.com/persistent-keepalive"
+	// ListenPortAnnotation sets the UDP port the Service's local tunnel interface listens on
+	ListenPortAnnotation = "easy-tunnel-lb.quinnovator.com/listen-port"
+	// EffectiveTuningAnnotation records the MTU, keepalive and listen port the Service's tunnels run with
+	EffectiveTuningAnnotation = "easy-tunnel-lb.quinnovator.com/effective-tuning"
+	// TrafficAnnotation summarizes the bytes and connections the Service's local tunnels carried
+	TrafficAnnotation = "easy-tunnel-lb.quinnovator.com/traffic"
+	// TransportAnnotation selects the tunnel transport of the Service, e.g. "ssh" where UDP is blocked
+	TransportAnnotation = "easy-tunnel-lb.quinnovator.com/transport"
+	// AllowedPortsAnnotation on a Namespace limits the ports its Services may publish, e.g. "80,443,8000-8100"
+	AllowedPortsAnnotation = "easy-tunnel-lb.quinnovator.com/allowed-ports"
 )
 
+// tunnelIDIndex is the informer index of Services by tunnel ID
+const tunnelIDIndex = "tunnelID"
+
 // K8sServiceClient interface for Kubernetes operations on Services
 type K8sServiceClient interface {
 	ListServices(ctx context.Context, namespace string, opts metav1.ListOptions) (*v1.ServiceList, error)
 	WatchServices(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error)
 	GetService(ctx context.Context, namespace, name string) (*v1.Service, error)
 	SetServiceLoadBalancer(ctx context.Context, svc *v1.Service, externalIP, externalHost string) error
+	SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error
+	SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error
 }
 
 // ServiceWatcher watches Kubernetes Services for LoadBalancer type
@@ -34,6 +85,11 @@ type ServiceWatcher struct {
 	reconciler *ServiceReconciler
 	logger     *utils.Logger
 	workqueue  workqueue.RateLimitingInterface
+
+	// informer is set once its cache has synced; it is read by EnqueueAll, which
+	// health handlers call from their own goroutines
+	mu       sync.RWMutex
+	informer cache.SharedIndexInformer
 }
 
 // NewServiceWatcher creates a new ServiceWatcher
@@ -61,7 +117,7 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 		},
 		&v1.Service{},
 		0,
-		cache.Indexers{},
+		cache.Indexers{tunnelIDIndex: serviceTunnelIDs},
 	)
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -69,10 +125,13 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 			w.handleService(obj)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
+			if !serviceChanged(oldObj, newObj) {
+				return
+			}
 			w.handleService(newObj)
 		},
 		DeleteFunc: func(obj interface{}) {
-			w.handleServiceDelete(obj)
+			w.handleServiceDelete(ctx, obj)
 		},
 	})
 
@@ -82,18 +141,80 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to sync service informer cache")
 	}
 
-	go wait.Until(w.runWorker, time.Second, ctx.Done())
+	w.mu.Lock()
+	w.informer = informer
+	w.mu.Unlock()
+
+	go wait.UntilWithContext(ctx, w.runWorker, time.Second)
 
 	<-ctx.Done()
 	return nil
 }
 
-func (w *ServiceWatcher) runWorker() {
-	for w.processNextWorkItem() {
+// EnqueueAll queues every managed Service for reconciliation, e.g. after a
+// tunnel server failed or recovered. Services are only queued once the watcher
+// has started and synced its cache.
+func (w *ServiceWatcher) EnqueueAll() {
+	w.mu.RLock()
+	informer := w.informer
+	w.mu.RUnlock()
+
+	if informer == nil {
+		return
+	}
+	for _, obj := range informer.GetStore().List() {
+		w.handleService(obj)
+	}
+}
+
+// EnqueueTunnel queues the Service a tunnel belongs to, e.g. after the tunnel's
+// health changed
+func (w *ServiceWatcher) EnqueueTunnel(tunnelID string) {
+	w.mu.RLock()
+	informer := w.informer
+	w.mu.RUnlock()
+
+	if informer == nil {
+		return
+	}
+	objs, err := informer.GetIndexer().ByIndex(tunnelIDIndex, tunnelID)
+	if err != nil {
+		w.logger.WithFields(map[string]interface{}{
+			"tunnel_id": tunnelID,
+			"error":     err.Error(),
+		}).Error("Failed to look up service for tunnel")
+		return
+	}
+	for _, obj := range objs {
+		w.handleService(obj)
+	}
+}
+
+// serviceTunnelIDs indexes a Service by the IDs of the tunnels recorded on it
+func serviceTunnelIDs(obj interface{}) ([]string, error) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return nil, nil
+	}
+
+	ids := []string{}
+	if tunnelID := svc.Annotations[TunnelIDAnnotation]; tunnelID != "" {
+		ids = append(ids, tunnelID)
+	}
+	for _, tunnelID := range parseTunnelIDs(svc.Annotations[TunnelsAnnotation]) {
+		ids = append(ids, tunnelID)
+	}
+	return ids, nil
+}
+
+// runWorker reconciles queued Services until the queue shuts down. Server calls in
+// flight are cancelled with ctx.
+func (w *ServiceWatcher) runWorker(ctx context.Context) {
+	for w.processNextWorkItem(ctx) {
 	}
 }
 
-func (w *ServiceWatcher) processNextWorkItem() bool {
+func (w *ServiceWatcher) processNextWorkItem(ctx context.Context) bool {
 	obj, shutdown := w.workqueue.Get()
 	if shutdown {
 		return false
@@ -112,7 +233,7 @@ func (w *ServiceWatcher) processNextWorkItem() bool {
 			return fmt.Errorf("invalid resource key: %s", key)
 		}
 
-		svc, err := w.k8sClient.GetService(context.Background(), namespace, name)
+		svc, err := w.k8sClient.GetService(ctx, namespace, name)
 		if err != nil {
 			return fmt.Errorf("failed to get service: %w", err)
 		}
@@ -121,7 +242,7 @@ func (w *ServiceWatcher) processNextWorkItem() bool {
 			return nil
 		}
 
-		if err := w.reconciler.Reconcile(context.Background(), svc); err != nil {
+		if err := w.reconciler.Reconcile(ctx, svc); err != nil {
 			return fmt.Errorf("failed to reconcile service: %w", err)
 		}
 
@@ -133,6 +254,11 @@ func (w *ServiceWatcher) processNextWorkItem() bool {
 		w.logger.WithFields(map[string]interface{}{
 			"error": err.Error(),
 		}).Error("Error processing service")
+		if after, ok := api_client.RetryAfter(err); ok {
+			// Come back when the tunnel server asked to rather than on our own schedule
+			w.workqueue.AddAfter(obj, after)
+			return true
+		}
 		w.workqueue.AddRateLimited(obj)
 		return true
 	}
@@ -146,10 +272,7 @@ func (w *ServiceWatcher) handleService(obj interface{}) {
 		return
 	}
 	// We only care about LB-type services with our annotation
-	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
-		return
-	}
-	if _, found := svc.Annotations[TunnelAnnotation]; !found {
+	if !isManagedService(svc) {
 		return
 	}
 
@@ -163,7 +286,23 @@ func (w *ServiceWatcher) handleService(obj interface{}) {
 	w.workqueue.Add(key)
 }
 
-func (w *ServiceWatcher) handleServiceDelete(obj interface{}) {
+// serviceChanged reports whether an update touched anything the reconciler acts on.
+// Status-only updates, such as our own load balancer status writes, and traffic
+// reports are ignored.
+func serviceChanged(oldObj, newObj interface{}) bool {
+	oldSvc, ok := oldObj.(*v1.Service)
+	if !ok {
+		return true
+	}
+	newSvc, ok := newObj.(*v1.Service)
+	if !ok {
+		return true
+	}
+	return !equality.Semantic.DeepEqual(oldSvc.Spec, newSvc.Spec) ||
+		!equality.Semantic.DeepEqual(withoutTraffic(oldSvc.Annotations), withoutTraffic(newSvc.Annotations))
+}
+
+func (w *ServiceWatcher) handleServiceDelete(ctx context.Context, obj interface{}) {
 	svc, ok := obj.(*v1.Service)
 	if !ok {
 		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
@@ -179,13 +318,41 @@ func (w *ServiceWatcher) handleServiceDelete(obj interface{}) {
 	}
 
 	// Only handle if we had the annotation
-	if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
-		if _, found := svc.Annotations[TunnelAnnotation]; found {
-			if err := w.reconciler.HandleDelete(context.Background(), svc); err != nil {
-				w.logger.WithFields(map[string]interface{}{
-					"error": err.Error(),
-				}).Error("Error handling service deletion")
-			}
+	if isManagedService(svc) {
+		if err := w.reconciler.HandleDelete(ctx, svc); err != nil {
+			w.logger.WithFields(map[string]interface{}{
+				"error": err.Error(),
+			}).Error("Error handling service deletion")
+		}
+	}
+}
+
+// isManagedService reports whether a Service is a LoadBalancer with our annotation
+func isManagedService(svc *v1.Service) bool {
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return false
+	}
+	_, found := svc.Annotations[TunnelAnnotation]
+	return found
+}
+
+// ReconcileOnce lists all Services and reconciles every managed one a single time.
+// Combined with a dry-run reconciler this produces a plan without running the watcher.
+func (w *ServiceWatcher) ReconcileOnce(ctx context.Context) error {
+	list, err := w.k8sClient.ListServices(ctx, "", metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	var errs []error
+	for i := range list.Items {
+		svc := &list.Items[i]
+		if !isManagedService(svc) {
+			continue
+		}
+		if err := w.reconciler.Reconcile(ctx, svc); err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", svc.Namespace, svc.Name, err))
 		}
 	}
+	return errors.Join(errs...)
 }
\ No newline at end of file
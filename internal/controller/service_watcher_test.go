@@ -2,6 +2,8 @@ package controller
 
 import (
 	"context"
+	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 )
 
 type mockK8sClient struct {
@@ -48,9 +51,25 @@ func (m *mockK8sClient) SetServiceLoadBalancer(ctx context.Context, svc *v1.Serv
 	return args.Error(0)
 }
 
+func (m *mockK8sClient) SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	args := m.Called(ctx, svc, ingress)
+	return args.Error(0)
+}
+
+func (m *mockK8sClient) SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error {
+	args := m.Called(ctx, svc, annotations)
+	return args.Error(0)
+}
+
+func (m *mockK8sClient) SetServiceCondition(ctx context.Context, svc *v1.Service, condition metav1.Condition) error {
+	args := m.Called(ctx, svc, condition)
+	return args.Error(0)
+}
+
 type mockWatcher struct {
 	mock.Mock
 	resultChan chan watch.Event
+	stopOnce   sync.Once
 }
 
 func newMockWatcher() *mockWatcher {
@@ -59,8 +78,11 @@ func newMockWatcher() *mockWatcher {
 	}
 }
 
+// Stop may be called again when the reflector re-watches and gets the same watcher
 func (m *mockWatcher) Stop() {
-	close(m.resultChan)
+	m.stopOnce.Do(func() {
+		close(m.resultChan)
+	})
 }
 
 func (m *mockWatcher) ResultChan() <-chan watch.Event {
@@ -124,7 +146,7 @@ func TestServiceWatcher_HandleService(t *testing.T) {
 					Return(testSvc, nil)
 
 				// Mock for the Reconcile call
-				api.On("CreateTunnel", &api_client.TunnelRequest{
+				api.On("CreateTunnel", mock.Anything, &api_client.TunnelRequest{
 					IngressName:      "test-service",
 					IngressNamespace: "default",
 					Hostname:         "",
@@ -132,17 +154,26 @@ func TestServiceWatcher_HandleService(t *testing.T) {
 					Annotations: map[string]string{
 						TunnelAnnotation: "true",
 					},
+					PublicKey:        testPublicKey,
 				}).Return(
 					&api_client.TunnelResponse{
 						TunnelID:     "test-tunnel",
 						ExternalIP:   "1.2.3.4",
 						ExternalHost: "test.example.com",
-						WGConfig:     "test-config",
+						Peer:         testPeer("test"),
 					}, nil)
 
 				tm.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
 					TunnelID: "test-tunnel",
-					WGConfig: "test-config",
+					WGConfig: testWGConfig("test"),
+					Server:   DefaultServerName,
+					Service:  "test-service.default.svc",
+					Ports:    []int{80},
+				}).Return(nil)
+
+				k8s.On("SetServiceAnnotations", mock.Anything, testSvc, map[string]string{
+					TunnelIDAnnotation:       "test-tunnel",
+					AssignedServerAnnotation: DefaultServerName,
 				}).Return(nil)
 
 				k8s.On("SetServiceLoadBalancer", mock.Anything, testSvc, "1.2.3.4", "test.example.com").Return(nil)
@@ -210,6 +241,8 @@ func TestServiceWatcher_HandleService(t *testing.T) {
 			
 			reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
 			
+			reconciler.SetKeyStore(testKeyStore{})
+			
 			tt.setupMocks(k8sMock, apiMock, tunnelMock)
 			
 			watcher := NewServiceWatcher(k8sMock, reconciler, utils.NewLogger("test"))
@@ -265,7 +298,7 @@ func TestServiceWatcher_HandleDelete(t *testing.T) {
 			},
 			shouldProcess: true,
 			setupMocks: func(k8s *mockK8sClient, api *MockAPIClient, tm *MockTunnelManager) {
-				api.On("DeleteTunnel", "test-tunnel").Return(nil)
+				api.On("DeleteTunnel", mock.Anything, "test-tunnel").Return(nil)
 				tm.On("DeleteTunnel", mock.Anything, "test-tunnel").Return(nil)
 			},
 		},
@@ -298,12 +331,14 @@ func TestServiceWatcher_HandleDelete(t *testing.T) {
 			
 			reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
 			
+			reconciler.SetKeyStore(testKeyStore{})
+			
 			tt.setupMocks(k8sMock, apiMock, tunnelMock)
 			
 			watcher := NewServiceWatcher(k8sMock, reconciler, utils.NewLogger("test"))
 			
 			// Test handleServiceDelete
-			watcher.handleServiceDelete(tt.service)
+			watcher.handleServiceDelete(context.Background(), tt.service)
 			
 			if tt.shouldProcess {
 				apiMock.AssertExpectations(t)
@@ -313,6 +348,68 @@ func TestServiceWatcher_HandleDelete(t *testing.T) {
 	}
 }
 
+func TestServiceWatcher_RetryAfter(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				TunnelAnnotation:   "true",
+				TunnelIDAnnotation: "test-tunnel",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		requeued bool
+	}{
+		{
+			name:     "rate limited service waits for the server",
+			err:      &api_client.APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour},
+			requeued: false,
+		},
+		{
+			name:     "other errors are retried with backoff",
+			err:      &api_client.APIError{StatusCode: http.StatusInternalServerError},
+			requeued: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sMock := &mockK8sClient{}
+			apiMock := &MockAPIClient{}
+
+			k8sMock.On("GetService", mock.Anything, "default", "test-service").Return(svc, nil)
+			apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.Anything).Return(nil, tt.err)
+
+			reconciler := NewServiceReconciler(k8sMock, apiMock, &MockTunnelManager{}, utils.NewLogger("test"))
+			reconciler.SetKeyStore(testKeyStore{})
+			watcher := NewServiceWatcher(k8sMock, reconciler, utils.NewLogger("test"))
+			defer watcher.workqueue.ShutDown()
+
+			watcher.workqueue.Add("default/test-service")
+			assert.True(t, watcher.processNextWorkItem(context.Background()))
+
+			// The rate limiter brings the Service back within milliseconds, the
+			// server's Retry-After only after an hour
+			time.Sleep(100 * time.Millisecond)
+			if tt.requeued {
+				assert.Equal(t, 1, watcher.workqueue.Len())
+				assert.Equal(t, 1, watcher.workqueue.NumRequeues("default/test-service"))
+			} else {
+				assert.Equal(t, 0, watcher.workqueue.Len())
+				assert.Equal(t, 0, watcher.workqueue.NumRequeues("default/test-service"))
+			}
+		})
+	}
+}
+
 func TestServiceWatcher_Start(t *testing.T) {
 	k8sMock := &mockK8sClient{}
 	apiMock := &MockAPIClient{}
@@ -321,6 +418,8 @@ func TestServiceWatcher_Start(t *testing.T) {
 	
 	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
 	
+	reconciler.SetKeyStore(testKeyStore{})
+	
 	// Setup expectations
 	k8sMock.On("ListServices", mock.Anything, "", mock.Anything).
 		Return(&v1.ServiceList{Items: []v1.Service{}}, nil)
@@ -348,7 +447,7 @@ func TestServiceWatcher_Start(t *testing.T) {
 		Return(testSvc, nil)
 	
 	// Setup expectations for Reconcile
-	apiMock.On("CreateTunnel", &api_client.TunnelRequest{
+	apiMock.On("CreateTunnel", mock.Anything, &api_client.TunnelRequest{
 		IngressName:      "test-service",
 		IngressNamespace: "default",
 		Hostname:         "",
@@ -356,17 +455,26 @@ func TestServiceWatcher_Start(t *testing.T) {
 		Annotations: map[string]string{
 			TunnelAnnotation: "true",
 		},
+		PublicKey:        testPublicKey,
 	}).Return(
 		&api_client.TunnelResponse{
 			TunnelID:     "test-tunnel",
 			ExternalIP:   "1.2.3.4",
 			ExternalHost: "test.example.com",
-			WGConfig:     "test-config",
+			Peer:         testPeer("test"),
 		}, nil)
 	
 	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
 		TunnelID: "test-tunnel",
-		WGConfig: "test-config",
+		WGConfig: testWGConfig("test"),
+		Server:   DefaultServerName,
+		Service:  "test-service.default.svc",
+		Ports:    []int{80},
+	}).Return(nil)
+	
+	k8sMock.On("SetServiceAnnotations", mock.Anything, testSvc, map[string]string{
+		TunnelIDAnnotation:       "test-tunnel",
+		AssignedServerAnnotation: DefaultServerName,
 	}).Return(nil)
 	
 	k8sMock.On("SetServiceLoadBalancer", mock.Anything, testSvc, "1.2.3.4", "test.example.com").Return(nil)
@@ -400,4 +508,46 @@ func TestServiceWatcher_Start(t *testing.T) {
 	k8sMock.AssertExpectations(t)
 	apiMock.AssertExpectations(t)
 	tunnelMock.AssertExpectations(t)
-} 
\ No newline at end of file
+} 
+func TestServiceWatcher_EnqueueTunnel(t *testing.T) {
+	reconciler := NewServiceReconciler(&mockK8sClient{}, &MockAPIClient{}, &MockTunnelManager{}, utils.NewLogger("test"))
+	watcher := NewServiceWatcher(&mockK8sClient{}, reconciler, utils.NewLogger("test"))
+	defer watcher.workqueue.ShutDown()
+
+	newService := func(name string, annotations map[string]string) *v1.Service {
+		annotations[TunnelAnnotation] = "true"
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		}
+	}
+
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1.Service{}, 0, cache.Indexers{tunnelIDIndex: serviceTunnelIDs})
+	for _, svc := range []*v1.Service{
+		newService("single", map[string]string{TunnelIDAnnotation: "tunnel-a"}),
+		newService("multi", map[string]string{TunnelsAnnotation: "eu=tunnel-b,us=tunnel-c"}),
+		newService("other", map[string]string{TunnelIDAnnotation: "tunnel-d"}),
+	} {
+		assert.NoError(t, informer.GetIndexer().Add(svc))
+	}
+
+	// Nothing is queued before the watcher has synced
+	watcher.EnqueueTunnel("tunnel-a")
+	assert.Equal(t, 0, watcher.workqueue.Len())
+
+	watcher.informer = informer
+
+	watcher.EnqueueTunnel("tunnel-c")
+	assert.Equal(t, 1, watcher.workqueue.Len())
+	key, _ := watcher.workqueue.Get()
+	assert.Equal(t, "default/multi", key)
+	watcher.workqueue.Done(key)
+
+	watcher.EnqueueTunnel("tunnel-a")
+	key, _ = watcher.workqueue.Get()
+	assert.Equal(t, "default/single", key)
+	watcher.workqueue.Done(key)
+
+	watcher.EnqueueTunnel("unknown")
+	assert.Equal(t, 0, watcher.workqueue.Len())
+}
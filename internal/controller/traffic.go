@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// TrafficSource reports what every local tunnel carried, keyed by tunnel ID
+type TrafficSource interface {
+	ListTraffic(ctx context.Context) map[string]tunnel.Traffic
+}
+
+// TrafficReporter writes what the local tunnels of each managed Service carried
+// onto the Service as TrafficAnnotation
+type TrafficReporter struct {
+	k8sClient K8sServiceClient
+	source    TrafficSource
+	logger    *utils.Logger
+}
+
+// NewTrafficReporter creates a TrafficReporter
+func NewTrafficReporter(k8sClient K8sServiceClient, source TrafficSource, logger *utils.Logger) *TrafficReporter {
+	return &TrafficReporter{
+		k8sClient: k8sClient,
+		source:    source,
+		logger:    logger,
+	}
+}
+
+// Run reports the traffic of every Service each interval until ctx is done
+func (t *TrafficReporter) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := t.Report(ctx); err != nil {
+			t.logger.WithFields(map[string]interface{}{
+				"error": err.Error(),
+			}).Error("Failed to report tunnel traffic")
+		}
+	}, interval)
+}
+
+// Report collects the traffic of the local tunnels and writes it onto their
+// Services. Services are only written when their traffic changed.
+func (t *TrafficReporter) Report(ctx context.Context) error {
+	traffic := t.source.ListTraffic(ctx)
+
+	list, err := t.k8sClient.ListServices(ctx, "", metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	var errs []error
+	for i := range list.Items {
+		svc := &list.Items[i]
+		if !isManagedService(svc) {
+			continue
+		}
+
+		total, ok := serviceTraffic(svc, traffic)
+		if !ok {
+			continue
+		}
+		value := formatTraffic(total)
+		if value == svc.Annotations[TrafficAnnotation] {
+			continue
+		}
+		if err := t.k8sClient.SetServiceAnnotations(ctx, svc, map[string]string{TrafficAnnotation: value}); err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", svc.Namespace, svc.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serviceTraffic sums the traffic of a Service's tunnels that run locally. It
+// reports false when none of them does.
+func serviceTraffic(svc *v1.Service, traffic map[string]tunnel.Traffic) (tunnel.Traffic, bool) {
+	// Local tunnels of multi-server Services are named after their server
+	tunnelIDs := map[string]bool{}
+	if id := svc.Annotations[TunnelIDAnnotation]; id != "" {
+		tunnelIDs[id] = true
+	}
+	for server, id := range parseTunnelIDs(svc.Annotations[TunnelsAnnotation]) {
+		tunnelIDs[localTunnelID(server, id)] = true
+	}
+
+	var total tunnel.Traffic
+	found := false
+	for id := range tunnelIDs {
+		t, ok := traffic[id]
+		if !ok {
+			continue
+		}
+		found = true
+		total.ReceiveBytes += t.ReceiveBytes
+		total.TransmitBytes += t.TransmitBytes
+		total.Connections += t.Connections
+		if t.CollectedAt.After(total.CollectedAt) {
+			total.CollectedAt = t.CollectedAt
+		}
+	}
+	return total, found
+}
+
+// formatTraffic renders a Service's traffic for TrafficAnnotation. Nothing was
+// collected yet while CollectedAt is zero.
+func formatTraffic(traffic tunnel.Traffic) string {
+	value := fmt.Sprintf("rx-bytes=%d,tx-bytes=%d,connections=%d",
+		traffic.ReceiveBytes, traffic.TransmitBytes, traffic.Connections)
+	if !traffic.CollectedAt.IsZero() {
+		value += ",collected-at=" + traffic.CollectedAt.UTC().Format(time.RFC3339)
+	}
+	return value
+}
+
+// withoutTraffic returns annotations without TrafficAnnotation, which changes on
+// every report and needs no reconcile
+func withoutTraffic(annotations map[string]string) map[string]string {
+	if _, ok := annotations[TrafficAnnotation]; !ok {
+		return annotations
+	}
+	filtered := make(map[string]string, len(annotations)-1)
+	for key, value := range annotations {
+		if key != TrafficAnnotation {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
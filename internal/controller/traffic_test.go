@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeTrafficSource map[string]tunnel.Traffic
+
+func (f fakeTrafficSource) ListTraffic(ctx context.Context) map[string]tunnel.Traffic {
+	return f
+}
+
+// trafficService returns a managed Service with the given annotations
+func trafficService(name string, annotations map[string]string) v1.Service {
+	annotations[TunnelAnnotation] = "true"
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+}
+
+func TestTrafficReporter(t *testing.T) {
+	collectedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	source := fakeTrafficSource{
+		"t1":       {ReceiveBytes: 100, TransmitBytes: 2000, Connections: 3, CollectedAt: collectedAt},
+		"eu-1-eu1": {ReceiveBytes: 10, TransmitBytes: 20, Connections: 1, CollectedAt: collectedAt.Add(-time.Minute)},
+		"us-1-us1": {ReceiveBytes: 5, TransmitBytes: 7, Connections: 2, CollectedAt: collectedAt},
+		// The server's tunnel IDs alone do not name local tunnels
+		"eu1": {ReceiveBytes: 1000, TransmitBytes: 1000, CollectedAt: collectedAt},
+	}
+
+	list := &v1.ServiceList{Items: []v1.Service{
+		trafficService("single", map[string]string{TunnelIDAnnotation: "t1"}),
+		trafficService("multi", map[string]string{TunnelsAnnotation: "eu-1=eu1,us-1=us1"}),
+		trafficService("unchanged", map[string]string{
+			TunnelIDAnnotation: "t1",
+			TrafficAnnotation:  "rx-bytes=100,tx-bytes=2000,connections=3,collected-at=2024-06-01T12:00:00Z",
+		}),
+		trafficService("elsewhere", map[string]string{TunnelIDAnnotation: "remote"}),
+	}}
+
+	k8sMock := &mockK8sClient{}
+	k8sMock.On("ListServices", mock.Anything, "", metav1.ListOptions{}).Return(list, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, &list.Items[0], map[string]string{
+		TrafficAnnotation: "rx-bytes=100,tx-bytes=2000,connections=3,collected-at=2024-06-01T12:00:00Z",
+	}).Return(nil)
+	// Multi-server Services add up their tunnels
+	k8sMock.On("SetServiceAnnotations", mock.Anything, &list.Items[1], map[string]string{
+		TrafficAnnotation: "rx-bytes=15,tx-bytes=27,connections=3,collected-at=2024-06-01T12:00:00Z",
+	}).Return(nil)
+
+	reporter := NewTrafficReporter(k8sMock, source, utils.NewLogger("test"))
+	assert.NoError(t, reporter.Report(context.Background()))
+	k8sMock.AssertExpectations(t)
+	k8sMock.AssertNumberOfCalls(t, "SetServiceAnnotations", 2)
+}
+
+func TestFormatTraffic(t *testing.T) {
+	assert.Equal(t, "rx-bytes=0,tx-bytes=0,connections=0", formatTraffic(tunnel.Traffic{}))
+}
+
+func TestServiceChanged_TrafficAnnotation(t *testing.T) {
+	oldSvc := trafficService("test-service", map[string]string{TrafficAnnotation: "rx-bytes=1,tx-bytes=1,connections=0"})
+	newSvc := trafficService("test-service", map[string]string{TrafficAnnotation: "rx-bytes=2,tx-bytes=5,connections=0"})
+	assert.False(t, serviceChanged(&oldSvc, &newSvc))
+
+	newSvc.Annotations[ServerAnnotation] = "eu-1"
+	assert.True(t, serviceChanged(&oldSvc, &newSvc))
+}
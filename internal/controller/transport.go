@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// requestTransports returns the transports offered to a server for a Service: the
+// one TransportAnnotation asks for, else those the server is limited to, else every
+// transport the controller runs
+func (r *ServiceReconciler) requestTransports(svc *v1.Service, server *Server) ([]string, error) {
+	if transport := svc.Annotations[TransportAnnotation]; transport != "" {
+		if len(r.transports) > 0 && !slices.Contains(r.transports, transport) {
+			return nil, fmt.Errorf("transport %q is not supported by the controller (supported: %s)", transport, strings.Join(r.transports, ", "))
+		}
+		return []string{transport}, nil
+	}
+
+	if len(server.Transports) == 0 {
+		return r.transports, nil
+	}
+	if len(r.transports) == 0 {
+		return server.Transports, nil
+	}
+
+	// Keep the server's order of preference
+	transports := []string{}
+	for _, transport := range server.Transports {
+		if slices.Contains(r.transports, transport) {
+			transports = append(transports, transport)
+		}
+	}
+	if len(transports) == 0 {
+		return nil, fmt.Errorf("tunnel server %s allows no transport the controller supports (server: %s, controller: %s)",
+			server.Name, strings.Join(server.Transports, ", "), strings.Join(r.transports, ", "))
+	}
+	return transports, nil
+}
+
+// credentialSource is an APIClient that shares its credentials with tunnel
+// transports connecting to the same server
+type credentialSource interface {
+	Credentials() api_client.Credentials
+}
+
+// setTransportConfig adds the settings of the transport the server provisioned a
+// tunnel on to its local config
+func setTransportConfig(config *tunnel.TunnelConfig, server *Server, privateKey string, resp *api_client.TunnelResponse) error {
+	sshConfig, err := sshTunnelConfig(privateKey, resp)
+	if err != nil {
+		return err
+	}
+	muxConfig, err := muxTunnelConfig(server, resp)
+	if err != nil {
+		return err
+	}
+
+	config.SSH = sshConfig
+	config.Mux = muxConfig
+	return nil
+}
+
+// sshTunnelConfig returns the SSH settings of a tunnel the server provisioned on the
+// ssh transport, authenticating with the tunnel's key. Other transports have none.
+func sshTunnelConfig(privateKey string, resp *api_client.TunnelResponse) (*tunnel.SSHConfig, error) {
+	if resp.Transport != tunnel.TransportSSH {
+		return nil, nil
+	}
+	if resp.SSH == nil {
+		return nil, fmt.Errorf("server returned no ssh details for tunnel %s", resp.TunnelID)
+	}
+
+	forwards := make([]tunnel.SSHForward, 0, len(resp.SSH.Forwards))
+	for _, forward := range resp.SSH.Forwards {
+		forwards = append(forwards, tunnel.SSHForward{RemotePort: forward.RemotePort, Port: forward.Port})
+	}
+
+	return &tunnel.SSHConfig{
+		Endpoint:    resp.SSH.Endpoint,
+		User:        resp.SSH.User,
+		HostKey:     resp.SSH.HostKey,
+		PrivateKey:  privateKey,
+		BindAddress: resp.SSH.BindAddress,
+		Forwards:    forwards,
+	}, nil
+}
+
+// muxTunnelConfig returns the endpoint of a tunnel the server provisioned on the
+// tls transport, authenticating with the server's API credentials. Other
+// transports have none.
+func muxTunnelConfig(server *Server, resp *api_client.TunnelResponse) (*tunnel.MuxConfig, error) {
+	if resp.Transport != tunnel.TransportTLS {
+		return nil, nil
+	}
+	if resp.Mux == nil {
+		return nil, fmt.Errorf("server returned no tls endpoint for tunnel %s", resp.TunnelID)
+	}
+
+	source, ok := server.Client.(credentialSource)
+	if !ok {
+		return nil, fmt.Errorf("tunnel server %s has no credentials for tls tunnels", server.Name)
+	}
+	credentials := source.Credentials()
+
+	return &tunnel.MuxConfig{
+		URL:      resp.Mux.URL,
+		Session:  resp.Mux.Session,
+		APIKey:   credentials.APIKey,
+		CABundle: credentials.CABundle,
+	}, nil
+}
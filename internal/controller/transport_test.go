@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRequestTransports(t *testing.T) {
+	supported := []string{tunnel.TransportWireGuard, tunnel.TransportSSH}
+
+	tests := []struct {
+		name        string
+		supported   []string
+		annotation  string
+		server      []string
+		want        []string
+		expectError string
+	}{
+		{
+			name:      "everything the controller runs",
+			supported: supported,
+			want:      supported,
+		},
+		{
+			name:       "service annotation",
+			supported:  supported,
+			annotation: tunnel.TransportSSH,
+			server:     []string{tunnel.TransportWireGuard},
+			want:       []string{tunnel.TransportSSH},
+		},
+		{
+			name:        "unsupported service annotation",
+			supported:   []string{tunnel.TransportWireGuard},
+			annotation:  tunnel.TransportSSH,
+			expectError: `transport "ssh" is not supported by the controller (supported: wireguard)`,
+		},
+		{
+			name:      "server preference",
+			supported: supported,
+			server:    []string{"other", tunnel.TransportSSH, tunnel.TransportWireGuard},
+			want:      []string{tunnel.TransportSSH, tunnel.TransportWireGuard},
+		},
+		{
+			name:        "no common transport",
+			supported:   []string{tunnel.TransportWireGuard},
+			server:      []string{tunnel.TransportSSH},
+			expectError: "tunnel server vps allows no transport the controller supports (server: ssh, controller: wireguard)",
+		},
+		{
+			name:   "server only",
+			server: []string{tunnel.TransportSSH},
+			want:   []string{tunnel.TransportSSH},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+			if tt.annotation != "" {
+				svc.Annotations[TransportAnnotation] = tt.annotation
+			}
+
+			reconciler := &ServiceReconciler{transports: tt.supported}
+			transports, err := reconciler.requestTransports(svc, &Server{Name: "vps", Transports: tt.server})
+			if tt.expectError != "" {
+				assert.EqualError(t, err, tt.expectError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, transports)
+		})
+	}
+}
+
+func TestSSHTunnelConfig(t *testing.T) {
+	config, err := sshTunnelConfig(testPrivateKey, &api_client.TunnelResponse{TunnelID: "t1"})
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	_, err = sshTunnelConfig(testPrivateKey, &api_client.TunnelResponse{TunnelID: "t1", Transport: tunnel.TransportSSH})
+	assert.EqualError(t, err, "server returned no ssh details for tunnel t1")
+
+	config, err = sshTunnelConfig(testPrivateKey, &api_client.TunnelResponse{
+		TunnelID:  "t1",
+		Transport: tunnel.TransportSSH,
+		SSH: &api_client.SSHConfig{
+			Endpoint: "203.0.113.1:22",
+			User:     "tunnel",
+			HostKey:  "ssh-ed25519 AAAA",
+			Forwards: []api_client.SSHForward{{RemotePort: 8080, Port: 80}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &tunnel.SSHConfig{
+		Endpoint:   "203.0.113.1:22",
+		User:       "tunnel",
+		HostKey:    "ssh-ed25519 AAAA",
+		PrivateKey: testPrivateKey,
+		Forwards:   []tunnel.SSHForward{{RemotePort: 8080, Port: 80}},
+	}, config)
+}
+
+func TestServiceReconciler_SSHTransport(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				TransportAnnotation: tunnel.TransportSSH,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Port: 80}},
+		},
+	}
+
+	sshPublicKey, err := tunnel.SSHPublicKey(testPrivateKey)
+	require.NoError(t, err)
+
+	// Only the annotated transport is offered, with the SSH key to authorize
+	apiMock.On("CreateTunnel", mock.Anything, mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return assert.ObjectsAreEqual([]string{tunnel.TransportSSH}, req.Transports) && req.SSHPublicKey == sshPublicKey
+	})).Return(&api_client.TunnelResponse{
+		TunnelID:   "new-tunnel-id",
+		ExternalIP: "1.2.3.4",
+		Transport:  tunnel.TransportSSH,
+		SSH: &api_client.SSHConfig{
+			Endpoint: "1.2.3.4:22",
+			User:     "tunnel",
+			HostKey:  "ssh-ed25519 AAAA",
+		},
+	}, nil)
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		TunnelIDAnnotation:       "new-tunnel-id",
+		AssignedServerAnnotation: DefaultServerName,
+	}).Return(nil)
+
+	tunnelMock.On("CreateTunnel", mock.Anything, &tunnel.TunnelConfig{
+		TunnelID:  "new-tunnel-id",
+		Transport: tunnel.TransportSSH,
+		Server:    DefaultServerName,
+		Service:   "test-service.default.svc",
+		Ports:     []int{80},
+		SSH: &tunnel.SSHConfig{
+			Endpoint:   "1.2.3.4:22",
+			User:       "tunnel",
+			HostKey:    "ssh-ed25519 AAAA",
+			PrivateKey: testPrivateKey,
+			Forwards:   []tunnel.SSHForward{},
+		},
+	}).Return(nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetKeyStore(testKeyStore{})
+	reconciler.SetTransports([]string{tunnel.TransportWireGuard, tunnel.TransportSSH})
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+// credentialedAPIClient is an APIClient sharing its credentials like api_client.Client
+type credentialedAPIClient struct {
+	*MockAPIClient
+	credentials api_client.Credentials
+}
+
+func (c *credentialedAPIClient) Credentials() api_client.Credentials {
+	return c.credentials
+}
+
+func TestMuxTunnelConfig(t *testing.T) {
+	resp := &api_client.TunnelResponse{
+		TunnelID:  "t1",
+		Transport: tunnel.TransportTLS,
+		Mux:       &api_client.MuxConfig{URL: "wss://vps.example.com/connect", Session: "s1"},
+	}
+	credentials := api_client.Credentials{APIKey: "key", CABundle: []byte("ca")}
+	server := &Server{Name: "vps", Client: &credentialedAPIClient{MockAPIClient: &MockAPIClient{}, credentials: credentials}}
+
+	config, err := muxTunnelConfig(server, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, &tunnel.MuxConfig{
+		URL:      "wss://vps.example.com/connect",
+		Session:  "s1",
+		APIKey:   "key",
+		CABundle: []byte("ca"),
+	}, config)
+
+	_, err = muxTunnelConfig(&Server{Name: "vps", Client: &MockAPIClient{}}, resp)
+	assert.EqualError(t, err, "tunnel server vps has no credentials for tls tunnels")
+
+	_, err = muxTunnelConfig(server, &api_client.TunnelResponse{TunnelID: "t1", Transport: tunnel.TransportTLS})
+	assert.EqualError(t, err, "server returned no tls endpoint for tunnel t1")
+
+	config, err = muxTunnelConfig(server, &api_client.TunnelResponse{TunnelID: "t1"})
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewTunnelRequest_UDPPorts(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Port: 53, Protocol: v1.ProtocolUDP},
+				{Port: 53, Protocol: v1.ProtocolTCP},
+				{Port: 8053},
+			},
+		},
+	}
+
+	req, err := newTunnelRequest(svc)
+	require.NoError(t, err)
+	assert.Equal(t, []int{53, 53, 8053}, req.Ports)
+	assert.Equal(t, []int{53}, req.UDPPorts)
+}
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// maxPersistentKeepalive is the largest keepalive interval WireGuard accepts
+const maxPersistentKeepalive = 65535
+
+// parseTuning reads a Service's WireGuard tuning annotations. It returns nil when
+// the Service sets none, leaving every choice to the server.
+func parseTuning(svc *v1.Service) (*api_client.TunnelTuning, error) {
+	tuning := &api_client.TunnelTuning{}
+	set := false
+
+	if value, ok := svc.Annotations[MTUAnnotation]; ok {
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu < tunnel.MinMTU || mtu > tunnel.MaxMTU {
+			return nil, fmt.Errorf("invalid %s %q: must be between %d and %d", MTUAnnotation, value, tunnel.MinMTU, tunnel.MaxMTU)
+		}
+		tuning.MTU = mtu
+		set = true
+	}
+
+	if value, ok := svc.Annotations[PersistentKeepaliveAnnotation]; ok {
+		keepalive, err := strconv.Atoi(value)
+		if err != nil || keepalive < 0 || keepalive > maxPersistentKeepalive {
+			return nil, fmt.Errorf("invalid %s %q: must be between 0 and %d seconds", PersistentKeepaliveAnnotation, value, maxPersistentKeepalive)
+		}
+		tuning.PersistentKeepalive = &keepalive
+		set = true
+	}
+
+	if value, ok := svc.Annotations[ListenPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s %q: must be a port between 1 and 65535", ListenPortAnnotation, value)
+		}
+		// Every server gets its own interface, and they cannot share a port
+		if isMultiServer(svc) {
+			return nil, fmt.Errorf("%s cannot be used on a Service published on several servers", ListenPortAnnotation)
+		}
+		tuning.ListenPort = port
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+	return tuning, nil
+}
+
+// interfaceTuningAnnotations set up the local interface rather than one tunnel
+var interfaceTuningAnnotations = []string{MTUAnnotation, ListenPortAnnotation}
+
+// CheckSharedTuning fails when annotations choose interface settings, which tunnels
+// on a shared interface cannot honour: the interface keeps those of its first tunnel
+func CheckSharedTuning(annotations map[string]string) error {
+	for _, key := range interfaceTuningAnnotations {
+		if _, ok := annotations[key]; ok {
+			return fmt.Errorf("%s cannot be used with TUNNEL_MODE=shared, all tunnels share one interface", key)
+		}
+	}
+	return nil
+}
+
+// tunnelPeer combines the peer details the server returned with the Service's
+// tuning, where the Service's choice wins
+func tunnelPeer(resp *api_client.TunnelResponse, tuning *api_client.TunnelTuning) (*tunnel.Peer, error) {
+	if resp.Peer == nil {
+		return nil, fmt.Errorf("server returned no peer details for tunnel %s", resp.TunnelID)
+	}
+
+	peer := &tunnel.Peer{
+		PublicKey:           resp.Peer.PublicKey,
+		Endpoint:            resp.Peer.Endpoint,
+		Addresses:           resp.Peer.Addresses,
+		AllowedIPs:          resp.Peer.AllowedIPs,
+		PersistentKeepalive: resp.Peer.PersistentKeepalive,
+		MTU:                 resp.Peer.MTU,
+	}
+	if tuning != nil {
+		if tuning.MTU != 0 {
+			peer.MTU = tuning.MTU
+		}
+		if tuning.PersistentKeepalive != nil {
+			peer.PersistentKeepalive = *tuning.PersistentKeepalive
+		}
+		peer.ListenPort = tuning.ListenPort
+	}
+	return peer, nil
+}
+
+// formatTuning renders the settings a tunnel runs with for EffectiveTuningAnnotation
+func formatTuning(peer *tunnel.Peer) string {
+	mtu := "auto"
+	if peer.MTU != 0 {
+		mtu = strconv.Itoa(peer.MTU)
+	}
+	keepalive := "off"
+	if peer.PersistentKeepalive != 0 {
+		keepalive = strconv.Itoa(peer.PersistentKeepalive)
+	}
+	listenPort := "auto"
+	if peer.ListenPort != 0 {
+		listenPort = strconv.Itoa(peer.ListenPort)
+	}
+	return fmt.Sprintf("mtu=%s,persistent-keepalive=%s,listen-port=%s", mtu, keepalive, listenPort)
+}
+
+// formatServerTuning renders the settings of a multi-server Service's tunnels,
+// one server name: settings entry per server
+func formatServerTuning(effective map[string]string) string {
+	entries := make([]string, 0, len(effective))
+	for server, tuning := range effective {
+		entries = append(entries, server+":"+tuning)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ";")
+}
+
+// reportsTuning reports whether a Service gets EffectiveTuningAnnotation: once it
+// sets any tuning annotation, the annotation is kept up to date from then on
+func reportsTuning(svc *v1.Service, tuning *api_client.TunnelTuning) bool {
+	_, reported := svc.Annotations[EffectiveTuningAnnotation]
+	return tuning != nil || reported
+}
+
+// effectiveTuning renders the settings a tunnel runs with, or "" when the server
+// returned no peer details to run it with
+func effectiveTuning(resp *api_client.TunnelResponse, tuning *api_client.TunnelTuning) string {
+	peer, err := tunnelPeer(resp, tuning)
+	if err != nil {
+		return ""
+	}
+	return formatTuning(peer)
+}
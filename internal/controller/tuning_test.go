@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/api_client"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTuningService(annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-service",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestParseTuning(t *testing.T) {
+	keepalive := 0
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *api_client.TunnelTuning
+		wantErr     string
+	}{
+		{
+			name:        "no tuning",
+			annotations: map[string]string{TunnelAnnotation: "true"},
+		},
+		{
+			name: "all settings",
+			annotations: map[string]string{
+				MTUAnnotation:                 "1380",
+				PersistentKeepaliveAnnotation: "0",
+				ListenPortAnnotation:          "51821",
+			},
+			want: &api_client.TunnelTuning{MTU: 1380, PersistentKeepalive: &keepalive, ListenPort: 51821},
+		},
+		{
+			name:        "MTU too small",
+			annotations: map[string]string{MTUAnnotation: "500"},
+			wantErr:     "must be between 576 and 65535",
+		},
+		{
+			name:        "keepalive not a number",
+			annotations: map[string]string{PersistentKeepaliveAnnotation: "25s"},
+			wantErr:     "must be between 0 and 65535 seconds",
+		},
+		{
+			name:        "listen port out of range",
+			annotations: map[string]string{ListenPortAnnotation: "0"},
+			wantErr:     "must be a port between 1 and 65535",
+		},
+		{
+			name: "listen port on several servers",
+			annotations: map[string]string{
+				ServersAnnotation:    "eu,us",
+				ListenPortAnnotation: "51821",
+			},
+			wantErr: "cannot be used on a Service published on several servers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tuning, err := parseTuning(newTuningService(tt.annotations))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tuning)
+		})
+	}
+}
+
+func TestFormatTuning(t *testing.T) {
+	assert.Equal(t, "mtu=auto,persistent-keepalive=off,listen-port=auto", formatTuning(&tunnel.Peer{}))
+	assert.Equal(t, "mtu=1420,persistent-keepalive=25,listen-port=51820",
+		formatTuning(&tunnel.Peer{MTU: 1420, PersistentKeepalive: 25, ListenPort: 51820}))
+	assert.Equal(t, "eu:mtu=1420,persistent-keepalive=25,listen-port=auto;us:mtu=auto,persistent-keepalive=25,listen-port=auto",
+		formatServerTuning(map[string]string{
+			"us": "mtu=auto,persistent-keepalive=25,listen-port=auto",
+			"eu": "mtu=1420,persistent-keepalive=25,listen-port=auto",
+		}))
+}
+
+func TestServiceReconciler_Tuning(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	svc := newTuningService(map[string]string{
+		TunnelAnnotation:              "true",
+		TunnelIDAnnotation:            "test-tunnel",
+		AssignedServerAnnotation:      DefaultServerName,
+		MTUAnnotation:                 "1380",
+		PersistentKeepaliveAnnotation: "0",
+		ListenPortAnnotation:          "51821",
+	})
+
+	// The server is asked for the Service's settings
+	peer := testPeer("test")
+	peer.MTU = 1420
+	peer.PersistentKeepalive = 25
+	apiMock.On("UpdateTunnel", mock.Anything, "test-tunnel", mock.MatchedBy(func(req *api_client.TunnelRequest) bool {
+		return req.Tuning != nil && req.Tuning.MTU == 1380 && req.Tuning.ListenPort == 51821 &&
+			req.Tuning.PersistentKeepalive != nil && *req.Tuning.PersistentKeepalive == 0
+	})).Return(&api_client.TunnelResponse{TunnelID: "test-tunnel", ExternalIP: "1.2.3.4", Peer: peer}, nil)
+
+	// The Service's choices win over the server's and are reported back
+	k8sMock.On("SetServiceAnnotations", mock.Anything, svc, map[string]string{
+		EffectiveTuningAnnotation: "mtu=1380,persistent-keepalive=off,listen-port=51821",
+	}).Return(nil)
+	tunnelMock.On("UpdateTunnel", mock.Anything, mock.Anything).Return(tunnel.UpdateInPlace, nil)
+	k8sMock.On("SetServiceLoadBalancer", mock.Anything, svc, "1.2.3.4", "").Return(nil)
+
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	assert.NoError(t, reconciler.Reconcile(context.Background(), svc))
+
+	config := tunnelMock.Calls[0].Arguments.Get(1).(*tunnel.TunnelConfig)
+	assert.Contains(t, config.WGConfig, "MTU = 1380\n")
+	assert.Contains(t, config.WGConfig, "ListenPort = 51821\n")
+	assert.NotContains(t, config.WGConfig, "PersistentKeepalive")
+
+	k8sMock.AssertExpectations(t)
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_InvalidTuning(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	// Nothing reaches the server or the local tunnels
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	err := reconciler.Reconcile(context.Background(), newTuningService(map[string]string{
+		TunnelAnnotation: "true",
+		MTUAnnotation:    "jumbo",
+	}))
+	assert.ErrorContains(t, err, MTUAnnotation)
+
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
+
+func TestServiceReconciler_SharedInterfaceTuning(t *testing.T) {
+	k8sMock := &MockK8sClient{}
+	apiMock := &MockAPIClient{}
+	tunnelMock := &MockTunnelManager{}
+
+	// A shared interface keeps the MTU and port of its first tunnel, so a Service
+	// cannot choose them
+	reconciler := NewServiceReconciler(k8sMock, apiMock, tunnelMock, utils.NewLogger("test"))
+	reconciler.SetSharedInterface(true)
+	for _, key := range []string{MTUAnnotation, ListenPortAnnotation} {
+		err := reconciler.Reconcile(context.Background(), newTuningService(map[string]string{
+			TunnelAnnotation: "true",
+			key:              "1400",
+		}))
+		assert.ErrorContains(t, err, key)
+	}
+
+	apiMock.AssertExpectations(t)
+	tunnelMock.AssertExpectations(t)
+}
@@ -2,11 +2,15 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	kubernetes "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -14,6 +18,7 @@ import (
 // Client wraps the Kubernetes client-go functionality
 type Client struct {
 	clientset *kubernetes.Clientset
+	dynamic   dynamic.Interface
 }
 
 // NewClient creates a new Kubernetes client
@@ -28,8 +33,14 @@ func NewClient() (*Client, error) {
 		return nil, fmt.Errorf("failed to create clientset: %w", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
 	return &Client{
 		clientset: clientset,
+		dynamic:   dynamicClient,
 	}, nil
 }
 
@@ -52,10 +63,23 @@ func (c *Client) GetService(ctx context.Context, namespace, name string) (*v1.Se
 	return svc, nil
 }
 
-// UpdateServiceStatus updates the status of the given Service
+// GetNamespace retrieves a specific Namespace
+func (c *Client) GetNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	return c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+// UpdateServiceStatus updates the status of the given Service. The Service takes
+// the new resource version, so further status updates in the same reconcile do
+// not conflict.
 func (c *Client) UpdateServiceStatus(ctx context.Context, svc *v1.Service) error {
-	_, err := c.clientset.CoreV1().Services(svc.Namespace).UpdateStatus(ctx, svc, metav1.UpdateOptions{})
-	return err
+	updated, err := c.clientset.CoreV1().Services(svc.Namespace).UpdateStatus(ctx, svc, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	svc.Status = updated.Status
+	svc.ResourceVersion = updated.ResourceVersion
+	return nil
 }
 
 // SetServiceLoadBalancer updates the given Service's status.loadBalancer with an external IP or external hostname
@@ -73,10 +97,85 @@ func (c *Client) SetServiceLoadBalancer(ctx context.Context, svc *v1.Service, ex
 		})
 	}
 
-	svc.Status.LoadBalancer.Ingress = loadBalancerIngress
+	return c.SetServiceLoadBalancerIngress(ctx, svc, loadBalancerIngress)
+}
+
+// SetServiceLoadBalancerIngress replaces the given Service's status.loadBalancer.ingress
+func (c *Client) SetServiceLoadBalancerIngress(ctx context.Context, svc *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	svc.Status.LoadBalancer.Ingress = ingress
 
 	if err := c.UpdateServiceStatus(ctx, svc); err != nil {
 		return fmt.Errorf("failed to update service loadbalancer status: %w", err)
 	}
 	return nil
-} 
\ No newline at end of file
+}
+
+// SetServiceCondition adds or replaces a condition in the Service's status.conditions
+func (c *Client) SetServiceCondition(ctx context.Context, svc *v1.Service, condition metav1.Condition) error {
+	meta.SetStatusCondition(&svc.Status.Conditions, condition)
+
+	if err := c.UpdateServiceStatus(ctx, svc); err != nil {
+		return fmt.Errorf("failed to update service conditions: %w", err)
+	}
+	return nil
+}
+
+// SetServiceAnnotations merges the given annotations into the Service's metadata.
+// An empty value removes the annotation.
+func (c *Client) SetServiceAnnotations(ctx context.Context, svc *v1.Service, annotations map[string]string) error {
+	values := make(map[string]interface{}, len(annotations))
+	for k, v := range annotations {
+		if v == "" {
+			values[k] = nil
+		} else {
+			values[k] = v
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": values,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode annotation patch: %w", err)
+	}
+
+	updated, err := c.clientset.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update service annotations: %w", err)
+	}
+
+	svc.Annotations = updated.Annotations
+	svc.ResourceVersion = updated.ResourceVersion
+	return nil
+}
+
+// GetSecret retrieves a specific Secret
+func (c *Client) GetSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	return c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// CreateSecret creates the given Secret
+func (c *Client) CreateSecret(ctx context.Context, secret *v1.Secret) error {
+	if _, err := c.clientset.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	return nil
+}
+
+// UpdateSecret replaces the given Secret
+func (c *Client) UpdateSecret(ctx context.Context, secret *v1.Secret) error {
+	if _, err := c.clientset.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	return nil
+}
+
+// DeleteSecret deletes a specific Secret
+func (c *Client) DeleteSecret(ctx context.Context, namespace, name string) error {
+	if err := c.clientset.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("failed to delete secret %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
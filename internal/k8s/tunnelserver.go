@@ -0,0 +1,110 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// TunnelServerGVR identifies the cluster-scoped TunnelServer custom resource
+var TunnelServerGVR = schema.GroupVersionResource{
+	Group:    "easy-tunnel-lb.quinnovator.com",
+	Version:  "v1alpha1",
+	Resource: "tunnelservers",
+}
+
+// TunnelServer describes a VPS running the server-side agent
+type TunnelServer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TunnelServerSpec   `json:"spec"`
+	Status TunnelServerStatus `json:"status,omitempty"`
+}
+
+// TunnelServerSpec holds the connection details for a tunnel server
+type TunnelServerSpec struct {
+	URL                  string             `json:"url"`
+	CredentialsSecretRef SecretKeyReference `json:"credentialsSecretRef"`
+	CABundle             []byte             `json:"caBundle,omitempty"`
+	Capabilities         []string           `json:"capabilities,omitempty"`
+	// Transports limits the tunnel transports offered to the server, in order of preference
+	Transports []string `json:"transports,omitempty"`
+}
+
+// SecretKeyReference points at a single key of a Secret
+type SecretKeyReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+}
+
+// TunnelServerStatus reports the observed state of a tunnel server
+type TunnelServerStatus struct {
+	Reachable   bool                 `json:"reachable"`
+	LastChecked *metav1.Time         `json:"lastChecked,omitempty"`
+	Message     string               `json:"message,omitempty"`
+	Capacity    TunnelServerCapacity `json:"capacity,omitempty"`
+}
+
+// TunnelServerCapacity reports how many tunnels a server can still accept
+type TunnelServerCapacity struct {
+	MaxTunnels    int `json:"maxTunnels"`
+	ActiveTunnels int `json:"activeTunnels"`
+}
+
+// DefaultCredentialsKey is the Secret key used when a SecretKeyReference omits one
+const DefaultCredentialsKey = "apiKey"
+
+// ListTunnelServers lists all TunnelServer resources in the cluster
+func (c *Client) ListTunnelServers(ctx context.Context) ([]TunnelServer, error) {
+	list, err := c.dynamic.Resource(TunnelServerGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel servers: %w", err)
+	}
+
+	servers := make([]TunnelServer, 0, len(list.Items))
+	for _, item := range list.Items {
+		var ts TunnelServer
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &ts); err != nil {
+			return nil, fmt.Errorf("failed to decode tunnel server %s: %w", item.GetName(), err)
+		}
+		servers = append(servers, ts)
+	}
+	return servers, nil
+}
+
+// UpdateTunnelServerStatus writes the status subresource of the given TunnelServer
+func (c *Client) UpdateTunnelServerStatus(ctx context.Context, ts *TunnelServer) error {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ts)
+	if err != nil {
+		return fmt.Errorf("failed to encode tunnel server %s: %w", ts.Name, err)
+	}
+
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetAPIVersion(TunnelServerGVR.GroupVersion().String())
+	u.SetKind("TunnelServer")
+
+	if _, err := c.dynamic.Resource(TunnelServerGVR).UpdateStatus(ctx, u, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update tunnel server status: %w", err)
+	}
+	return nil
+}
+
+// GetSecretValue reads a single key from a Secret
+func (c *Client) GetSecretValue(ctx context.Context, namespace, name, key string) ([]byte, error) {
+	secret, err := c.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", namespace, name, err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+	}
+	return value, nil
+}
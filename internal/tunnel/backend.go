@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backend brings WireGuard interfaces up and down on the host
+type Backend interface {
+	// Up creates the interface, or reconfigures it if it exists, from a tunnel's config
+	Up(ctx context.Context, name string, config *TunnelConfig) error
+	// Down removes the interface
+	Down(ctx context.Context, name string) error
+}
+
+// ErrWireGuardUnsupported is returned when the kernel offers no WireGuard support
+var ErrWireGuardUnsupported = errors.New("wireguard is not supported by the kernel")
+
+// BackendError reports which step of configuring an interface failed
+type BackendError struct {
+	Interface string
+	Op        string
+	Err       error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Interface, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// DetectBackend returns the netlink backend when the kernel supports WireGuard
+// and falls back to wg-quick otherwise
+func DetectBackend() Backend {
+	backend, err := NewNetlinkBackend()
+	if err != nil {
+		return NewExecBackend()
+	}
+	return backend
+}
+
+// reconnect calls connect until it succeeds, waiting between attempts with an
+// exponential backoff from minBackoff up to maxBackoff. It gives up and returns
+// false once ctx is done.
+func reconnect(ctx context.Context, minBackoff, maxBackoff time.Duration, connect func() error) bool {
+	backoff := minBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		if err := connect(); err == nil {
+			return true
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
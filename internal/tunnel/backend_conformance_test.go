@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceHarness sets up one backend for the conformance suite
+type conformanceHarness struct {
+	// newBackend returns a fresh backend, or skips the test where it cannot run
+	newBackend func(t *testing.T) Backend
+	// config returns a valid tunnel config for the backend routing allowedIPs to peerKey
+	config func(peerKey, allowedIPs string) *TunnelConfig
+}
+
+// wireGuardConformanceConfig is the config shared by the WireGuard backends
+func wireGuardConformanceConfig(peerKey, allowedIPs string) *TunnelConfig {
+	return &TunnelConfig{
+		Transport: TransportWireGuard,
+		WGConfig: RenderConfig(testKey('a'), &Peer{
+			PublicKey:  peerKey,
+			Endpoint:   "203.0.113.1:51820",
+			Addresses:  []string{"10.99.0.2/32"},
+			AllowedIPs: strings.Split(allowedIPs, ","),
+		}),
+		Service: "127.0.0.1",
+	}
+}
+
+// testBackendConformance checks the behavior every registered backend must share:
+// interfaces come up and go down idempotently, Up reconfigures a running interface,
+// and the optional Stats and Sync work on what Up created.
+func testBackendConformance(t *testing.T, harness conformanceHarness) {
+	ctx := context.Background()
+	peerKey := testKey('b')
+
+	// up brings an interface up and takes it down again after the test
+	up := func(t *testing.T, backend Backend, name, allowedIPs string) {
+		require.NoError(t, backend.Up(ctx, name, harness.config(peerKey, allowedIPs)))
+		t.Cleanup(func() { backend.Down(ctx, name) })
+	}
+
+	t.Run("up and down", func(t *testing.T) {
+		backend := harness.newBackend(t)
+		up(t, backend, "wg-conform-1", "10.99.1.0/24")
+		assert.NoError(t, backend.Down(ctx, "wg-conform-1"))
+	})
+
+	t.Run("down is idempotent", func(t *testing.T) {
+		backend := harness.newBackend(t)
+		assert.NoError(t, backend.Down(ctx, "wg-conform-2"))
+
+		up(t, backend, "wg-conform-2", "10.99.2.0/24")
+		assert.NoError(t, backend.Down(ctx, "wg-conform-2"))
+		assert.NoError(t, backend.Down(ctx, "wg-conform-2"))
+	})
+
+	t.Run("up reconfigures a running interface", func(t *testing.T) {
+		backend := harness.newBackend(t)
+		up(t, backend, "wg-conform-3", "10.99.3.0/24")
+		assert.NoError(t, backend.Up(ctx, "wg-conform-3", harness.config(peerKey, "10.99.3.0/24,10.99.4.0/24")))
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		backend := harness.newBackend(t)
+		stats, ok := backend.(StatsBackend)
+		if !ok {
+			t.Skip("backend does not report peer counters")
+		}
+
+		up(t, backend, "wg-conform-5", "10.99.5.0/24")
+		peers, err := stats.Stats(ctx, "wg-conform-5")
+		assert.NoError(t, err)
+		if assert.Len(t, peers, 1) {
+			assert.Equal(t, peerKey, peers[0].PublicKey)
+			assert.True(t, peers[0].LastHandshake.IsZero())
+		}
+
+		_, err = stats.Stats(ctx, "wg-conform-none")
+		var backendErr *BackendError
+		assert.True(t, errors.As(err, &backendErr), "expected a BackendError, got %v", err)
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		backend := harness.newBackend(t)
+		syncer, ok := backend.(SyncBackend)
+		if !ok {
+			t.Skip("backend cannot reconfigure in place")
+		}
+
+		up(t, backend, "wg-conform-6", "10.99.6.0/24")
+		old := harness.config(peerKey, "10.99.6.0/24")
+		new := harness.config(peerKey, "10.99.6.0/24,10.99.7.0/24")
+		err := syncer.Sync(ctx, "wg-conform-6", old, new)
+		if errors.Is(err, ErrRestartRequired) {
+			t.Fatal("a new allowed IP must be synced in place")
+		}
+		assert.NoError(t, err)
+	})
+}
+
+// fakeWGCommands mocks wg-quick and wg like the real tools: interfaces exist
+// between up and down, and wg show reports their peer
+func fakeWGCommands(t *testing.T, peerKey string) {
+	interfaces := map[string]bool{}
+	scriptCommands(t, func(commandLine string) helperResult {
+		args := strings.Fields(commandLine)
+		switch {
+		case args[0] == "wg-quick":
+			name := strings.TrimSuffix(filepath.Base(args[2]), ".conf")
+			if args[1] == "up" && interfaces[name] {
+				return helperResult{stderr: fmt.Sprintf("wg-quick: `%s' already exists", name), exit: 1}
+			}
+			if args[1] == "down" && !interfaces[name] {
+				return helperResult{stderr: fmt.Sprintf("wg-quick: `%s' is not a WireGuard interface", name), exit: 1}
+			}
+			interfaces[name] = args[1] == "up"
+		case args[0] == "wg" && !interfaces[args[2]]:
+			return helperResult{stderr: "Unable to access interface: No such device", exit: 1}
+		case args[0] == "wg" && args[1] == "show":
+			return helperResult{stdout: "private\tpublic\t51820\toff\n" + peerKey + "\t(none)\t203.0.113.1:51820\t10.99.0.0/16\t0\t0\t0\toff\n"}
+		}
+		return helperResult{}
+	})
+}
+
+func TestExecBackendConformance(t *testing.T) {
+	testBackendConformance(t, conformanceHarness{
+		newBackend: func(t *testing.T) Backend {
+			fakeWGCommands(t, testKey('b'))
+			return NewExecBackend()
+		},
+		config: wireGuardConformanceConfig,
+	})
+}
+
+func TestUserspaceBackendConformance(t *testing.T) {
+	testBackendConformance(t, conformanceHarness{
+		newBackend: func(t *testing.T) Backend {
+			return NewUserspaceBackend()
+		},
+		config: wireGuardConformanceConfig,
+	})
+}
+
+// The netlink backend changes the host's interfaces and routes, so it only runs
+// when asked for with EASY_TUNNEL_LB_NETLINK_TESTS=1 on a host that supports it
+func TestNetlinkBackendConformance(t *testing.T) {
+	testBackendConformance(t, conformanceHarness{
+		newBackend: func(t *testing.T) Backend {
+			if os.Getenv("EASY_TUNNEL_LB_NETLINK_TESTS") != "1" {
+				t.Skip("set EASY_TUNNEL_LB_NETLINK_TESTS=1 to run against the kernel")
+			}
+			backend, err := NewNetlinkBackend()
+			if err != nil {
+				t.Skipf("netlink backend unavailable: %v", err)
+			}
+			return backend
+		},
+		config: wireGuardConformanceConfig,
+	})
+}
@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// wgQuickTimeout bounds a single wg-quick, wg or ip run; they normally finish within a second
+const wgQuickTimeout = 30 * time.Second
+
+// wg-quick messages telling that an interface is already in the wanted state
+const (
+	wgQuickAlreadyExists = "already exists"
+	wgQuickNotWireGuard  = "is not a WireGuard interface"
+)
+
+// ExecBackend configures interfaces by running wg-quick with a config file
+type ExecBackend struct {
+	timeout time.Duration
+}
+
+// NewExecBackend creates a wg-quick backend
+func NewExecBackend() *ExecBackend {
+	return &ExecBackend{
+		timeout: wgQuickTimeout,
+	}
+}
+
+// Up writes the config and runs wg-quick up. An interface left behind, for
+// example by a previous controller, is brought down and up again with the new config.
+func (b *ExecBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	configPath := b.configPath(name)
+	if err := os.WriteFile(configPath, []byte(config.WGConfig), 0600); err != nil {
+		return &BackendError{Interface: name, Op: "write config", Err: err}
+	}
+
+	err := b.wgQuick(ctx, "up", configPath)
+	if err != nil && strings.Contains(err.Error(), wgQuickAlreadyExists) {
+		if err := b.wgQuick(ctx, "down", configPath); err != nil {
+			return &BackendError{Interface: name, Op: "wg-quick down", Err: err}
+		}
+		err = b.wgQuick(ctx, "up", configPath)
+	}
+	if err != nil {
+		return &BackendError{Interface: name, Op: "wg-quick up", Err: err}
+	}
+	return nil
+}
+
+// Down runs wg-quick down and removes the config. An interface that is already
+// gone is not an error.
+func (b *ExecBackend) Down(ctx context.Context, name string) error {
+	configPath := b.configPath(name)
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		// Without its config wg-quick never brought the interface up
+		return nil
+	}
+
+	err := b.wgQuick(ctx, "down", configPath)
+	if err != nil && !strings.Contains(err.Error(), wgQuickNotWireGuard) {
+		return &BackendError{Interface: name, Op: "wg-quick down", Err: err}
+	}
+
+	if err := os.Remove(configPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &BackendError{Interface: name, Op: "remove config", Err: err}
+	}
+
+	return nil
+}
+
+// Sync applies peer, endpoint and allowed IP changes to a running interface with
+// wg syncconf and adds or removes the routes wg-quick created for allowed IPs.
+// Changes to settings only wg-quick applies need a restart.
+func (b *ExecBackend) Sync(ctx context.Context, name string, old, new *TunnelConfig) error {
+	oldParsed, err := ParseConfig(old.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+	newParsed, err := ParseConfig(new.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	added, removed := routeChanges(oldParsed, newParsed)
+	if !sameWGQuickSettings(oldParsed, newParsed) || newParsed.Interface.Table != "" ||
+		slices.ContainsFunc(added, isDefaultRoute) || slices.ContainsFunc(removed, isDefaultRoute) {
+		return ErrRestartRequired
+	}
+
+	// wg-quick down reads the config, so it has to match the running interface
+	configPath := b.configPath(name)
+	if err := os.WriteFile(configPath, []byte(new.WGConfig), 0600); err != nil {
+		return &BackendError{Interface: name, Op: "write config", Err: err}
+	}
+
+	syncFile, err := writeSecretFile(wgSettings(newParsed).String())
+	if err != nil {
+		return &BackendError{Interface: name, Op: "write config", Err: err}
+	}
+	defer os.Remove(syncFile)
+
+	if err := b.run(ctx, "wg", "syncconf", name, syncFile); err != nil {
+		return &BackendError{Interface: name, Op: "wg syncconf", Err: err}
+	}
+
+	for _, cidr := range added {
+		if err := b.run(ctx, "ip", "route", "replace", cidr, "dev", name); err != nil {
+			return &BackendError{Interface: name, Op: "add route", Err: err}
+		}
+	}
+	for _, cidr := range removed {
+		if err := b.run(ctx, "ip", "route", "del", cidr, "dev", name); err != nil {
+			return &BackendError{Interface: name, Op: "delete route", Err: err}
+		}
+	}
+	return nil
+}
+
+// sameWGQuickSettings reports whether two configs agree on everything wg syncconf
+// cannot change: the interface settings other than the key and listen port
+func sameWGQuickSettings(old, new *Config) bool {
+	oldInterface, newInterface := old.Interface, new.Interface
+	oldInterface.PrivateKey, newInterface.PrivateKey = "", ""
+	oldInterface.ListenPort, newInterface.ListenPort = 0, 0
+	oldInterface.Addresses, newInterface.Addresses = nil, nil
+	return reflect.DeepEqual(oldInterface, newInterface)
+}
+
+// wgSettings returns the part of a config wg understands, without wg-quick's
+// addresses, MTU, DNS, routing table and hooks
+func wgSettings(config *Config) *Config {
+	return &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: config.Interface.PrivateKey,
+			ListenPort: config.Interface.ListenPort,
+			FwMark:     config.Interface.FwMark,
+		},
+		Peers: config.Peers,
+	}
+}
+
+// wgQuick runs a wg-quick action on a config file
+func (b *ExecBackend) wgQuick(ctx context.Context, action, configPath string) error {
+	return b.run(ctx, "wg-quick", action, configPath)
+}
+
+// run runs a command to completion, killing it when it takes longer than the
+// backend's timeout or ctx is done. Errors include what it wrote to stderr.
+func (b *ExecBackend) run(ctx context.Context, command string, args ...string) error {
+	_, err := b.output(ctx, command, args...)
+	return err
+}
+
+// output is run returning what the command wrote to stdout
+func (b *ExecBackend) output(ctx context.Context, command string, args ...string) ([]byte, error) {
+	return timedOutput(ctx, b.timeout, command, args...)
+}
+
+// timedOutput runs a command to completion and returns what it wrote to stdout,
+// killing it when it takes longer than timeout or ctx is done. Errors include
+// what it wrote to stderr.
+func timedOutput(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := execCommand(command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+
+	if err != nil {
+		if output := strings.TrimSpace(stderr.String()); output != "" {
+			return nil, fmt.Errorf("%w: %s", err, output)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// configPath returns the config file path; wg-quick names the interface after it
+func (b *ExecBackend) configPath(name string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s.conf", name))
+}
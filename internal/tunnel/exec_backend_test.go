@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helperResult is what a mocked command prints and how it exits
+type helperResult struct {
+	stdout string
+	stderr string
+	exit   int
+	sleep  time.Duration
+}
+
+// scriptCommands mocks exec.Command with commands behaving as script says and
+// records every command line run
+func scriptCommands(t *testing.T, script func(commandLine string) helperResult) *[]string {
+	commands := []string{}
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		commandLine := strings.Join(append([]string{command}, args...), " ")
+		commands = append(commands, commandLine)
+
+		result := script(commandLine)
+		cmd := mockCmd(command, args...)
+		cmd.Env = append(cmd.Env,
+			"HELPER_STDOUT="+result.stdout,
+			"HELPER_STDERR="+result.stderr,
+			"HELPER_EXIT="+strconv.Itoa(result.exit),
+			"HELPER_SLEEP="+result.sleep.String(),
+		)
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+	return &commands
+}
+
+// newTestExecBackend returns a backend and the config path of the named interface,
+// removed after the test
+func newTestExecBackend(t *testing.T, name string) (*ExecBackend, string) {
+	backend := NewExecBackend()
+	configPath := backend.configPath(name)
+	t.Cleanup(func() { os.Remove(configPath) })
+	return backend, configPath
+}
+
+func TestExecBackendUp(t *testing.T) {
+	commands := scriptCommands(t, func(string) helperResult { return helperResult{} })
+	backend, configPath := newTestExecBackend(t, "wg-exec-up")
+
+	config := &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")}
+	assert.NoError(t, backend.Up(context.Background(), "wg-exec-up", config))
+	assert.Equal(t, []string{"wg-quick up " + configPath}, *commands)
+
+	written, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, config.WGConfig, string(written))
+}
+
+func TestExecBackendUpFailure(t *testing.T) {
+	scriptCommands(t, func(string) helperResult {
+		return helperResult{stderr: "RTNETLINK answers: Operation not permitted\n", exit: 1}
+	})
+	backend, _ := newTestExecBackend(t, "wg-exec-fail")
+
+	err := backend.Up(context.Background(), "wg-exec-fail", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")})
+	var backendErr *BackendError
+	assert.ErrorAs(t, err, &backendErr)
+	assert.Equal(t, "wg-quick up", backendErr.Op)
+	assert.ErrorContains(t, err, "exit status 1: RTNETLINK answers: Operation not permitted")
+}
+
+func TestExecBackendUpExisting(t *testing.T) {
+	ups := 0
+	commands := scriptCommands(t, func(commandLine string) helperResult {
+		if strings.HasPrefix(commandLine, "wg-quick up") {
+			ups++
+			if ups == 1 {
+				return helperResult{stderr: "wg-quick: `wg-exec-again' already exists", exit: 1}
+			}
+		}
+		return helperResult{}
+	})
+	backend, configPath := newTestExecBackend(t, "wg-exec-again")
+
+	// A leftover interface is restarted with the new config
+	assert.NoError(t, backend.Up(context.Background(), "wg-exec-again", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	assert.Equal(t, []string{
+		"wg-quick up " + configPath,
+		"wg-quick down " + configPath,
+		"wg-quick up " + configPath,
+	}, *commands)
+}
+
+func TestExecBackendDown(t *testing.T) {
+	var result helperResult
+	commands := scriptCommands(t, func(string) helperResult { return result })
+	backend, configPath := newTestExecBackend(t, "wg-exec-down")
+	ctx := context.Background()
+
+	// Never brought up
+	assert.NoError(t, backend.Down(ctx, "wg-exec-down"))
+	assert.Empty(t, *commands)
+
+	// Brought up and down
+	assert.NoError(t, backend.Up(ctx, "wg-exec-down", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	assert.NoError(t, backend.Down(ctx, "wg-exec-down"))
+	assert.Equal(t, "wg-quick down "+configPath, (*commands)[1])
+	assert.NoFileExists(t, configPath)
+
+	// The interface disappeared behind our back
+	assert.NoError(t, backend.Up(ctx, "wg-exec-down", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	result = helperResult{stderr: "wg-quick: `wg-exec-down' is not a WireGuard interface", exit: 1}
+	assert.NoError(t, backend.Down(ctx, "wg-exec-down"))
+	assert.NoFileExists(t, configPath)
+
+	// Other failures are reported and keep the config for a retry
+	result = helperResult{}
+	assert.NoError(t, backend.Up(ctx, "wg-exec-down", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	result = helperResult{stderr: "RTNETLINK answers: Device or resource busy", exit: 1}
+	err := backend.Down(ctx, "wg-exec-down")
+	assert.ErrorContains(t, err, "wg-quick down wg-exec-down: exit status 1: RTNETLINK answers: Device or resource busy")
+	assert.FileExists(t, configPath)
+}
+
+func TestExecBackendTimeout(t *testing.T) {
+	scriptCommands(t, func(string) helperResult { return helperResult{sleep: time.Minute} })
+	backend, _ := newTestExecBackend(t, "wg-exec-hang")
+	backend.timeout = 100 * time.Millisecond
+
+	started := time.Now()
+	err := backend.Up(context.Background(), "wg-exec-hang", &TunnelConfig{WGConfig: testTunnelConfig("10.0.0.2/32")})
+	assert.ErrorContains(t, err, "wg-quick up wg-exec-hang: timed out after 100ms")
+	assert.Less(t, time.Since(started), 10*time.Second)
+}
+
+func TestExecBackendStats(t *testing.T) {
+	result := helperResult{stdout: testKey('a') + "\t" + testKey('p') + "\t51820\toff\n" +
+		testKey('b') + "\t(none)\t203.0.113.1:51820\t10.0.0.1/32\t1717243200\t1024\t2048\t25\n"}
+	commands := scriptCommands(t, func(string) helperResult { return result })
+	backend, _ := newTestExecBackend(t, "wg-exec-stats")
+
+	stats, err := backend.Stats(context.Background(), "wg-exec-stats")
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerStats{
+		{PublicKey: testKey('b'), LastHandshake: time.Unix(1717243200, 0), ReceiveBytes: 1024, TransmitBytes: 2048},
+	}, stats)
+	assert.Equal(t, []string{"wg show wg-exec-stats dump"}, *commands)
+
+	// A hung wg is killed after the timeout
+	result = helperResult{sleep: time.Minute}
+	backend.timeout = 100 * time.Millisecond
+	started := time.Now()
+	_, err = backend.Stats(context.Background(), "wg-exec-stats")
+	assert.ErrorContains(t, err, "wg show wg-exec-stats: timed out after 100ms")
+	assert.Less(t, time.Since(started), 10*time.Second)
+}
@@ -0,0 +1,313 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// HealthState summarizes whether a tunnel is passing traffic
+type HealthState string
+
+const (
+	// HealthUnknown means the tunnel has not been checked since it started
+	HealthUnknown HealthState = "Unknown"
+	// HealthHealthy means the tunnel had a recent handshake or received traffic
+	HealthHealthy HealthState = "Healthy"
+	// HealthUnhealthy means the tunnel has been silent for longer than the stale period
+	HealthUnhealthy HealthState = "Unhealthy"
+)
+
+// Reasons explaining a tunnel's health
+const (
+	HealthReasonStarting         = "Starting"
+	HealthReasonNotMonitored     = "NotMonitored"
+	HealthReasonHandshakeRecent  = "HandshakeRecent"
+	HealthReasonHandshakeStale   = "HandshakeStale"
+	HealthReasonStatsUnavailable = "StatsUnavailable"
+)
+
+// Restart backoff for unhealthy tunnels, doubling from the minimum with every
+// restart that did not bring the tunnel back
+const (
+	minRestartBackoff = 30 * time.Second
+	maxRestartBackoff = 10 * time.Minute
+)
+
+// Health is the last observed liveness of a tunnel
+type Health struct {
+	State   HealthState
+	Reason  string
+	Message string
+	// LastHandshake is the most recent handshake with any of the tunnel's peers
+	LastHandshake time.Time
+	ReceiveBytes  uint64
+	TransmitBytes uint64
+	// Restarts counts the restarts since the tunnel was last healthy
+	Restarts  int
+	CheckedAt time.Time
+}
+
+// HealthHandler is called whenever a tunnel's health state or reason changes
+type HealthHandler func(tunnelID string, health Health)
+
+// tunnelHealth is the monitor's bookkeeping for one tunnel
+type tunnelHealth struct {
+	health Health
+	// since is when the tunnel was last (re)started, giving it a stale period to connect
+	since time.Time
+	// lastProgress is when the tunnel last had a new handshake or received bytes
+	lastProgress time.Time
+	nextRestart  time.Time
+}
+
+// restartBackoff returns how long to wait before restarting a tunnel again
+func restartBackoff(restarts int) time.Duration {
+	backoff := minRestartBackoff
+	for i := 1; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	return backoff
+}
+
+// SetHealthHandler registers a function told about tunnel health changes
+func (m *Manager) SetHealthHandler(handler HealthHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onHealth = handler
+}
+
+// TunnelHealth returns the last observed health of a tunnel
+func (m *Manager) TunnelHealth(tunnelID string) (Health, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.health[tunnelID]
+	if !ok {
+		return Health{}, false
+	}
+	return state.health, true
+}
+
+// Monitor checks every tunnel's peer counters each interval until ctx is done.
+// A tunnel that neither completed a handshake nor received traffic for stalePeriod
+// is marked unhealthy and restarted, backing off while restarts do not help.
+// Tunnels on backends that cannot read counters are not monitored.
+func (m *Manager) Monitor(ctx context.Context, interval, stalePeriod time.Duration) {
+	if !m.backends.monitored() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.checkHealth(ctx, stalePeriod)
+		}
+	}
+}
+
+// healthProbe is what reading a tunnel's peers for a health check found
+type healthProbe struct {
+	// unmonitored explains why the tunnel's silence says nothing, if it does not
+	unmonitored string
+	peers       []PeerStats
+	err         error
+}
+
+// checkHealth updates the health of every tunnel and restarts stale ones. Tunnels
+// are probed and restarted without holding the manager lock, so tunnels can be
+// created, updated and deleted during a check.
+func (m *Manager) checkHealth(ctx context.Context, stalePeriod time.Duration) {
+	m.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(m.tunnels))
+	for _, tunnel := range m.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	m.mu.RUnlock()
+
+	changed := map[string]Health{}
+	for _, tunnel := range tunnels {
+		probe, ok := tunnel.probe(ctx)
+		if !ok {
+			continue
+		}
+
+		m.mu.Lock()
+		state, ok := m.health[tunnel.id]
+		if !ok || m.tunnels[tunnel.id] != tunnel {
+			// Deleted or replaced since the snapshot
+			m.mu.Unlock()
+			continue
+		}
+		previous := state.health
+		restart := m.observe(state, probe, stalePeriod)
+		m.mu.Unlock()
+
+		if restart {
+			m.restart(ctx, tunnel, state)
+		}
+
+		m.mu.RLock()
+		if state.health.State != previous.State || state.health.Reason != previous.Reason {
+			changed[tunnel.id] = state.health
+		}
+		m.mu.RUnlock()
+	}
+
+	m.mu.RLock()
+	handler := m.onHealth
+	m.mu.RUnlock()
+
+	// Call the handler without the lock so it may use the manager
+	if handler != nil {
+		for id, health := range changed {
+			handler(id, health)
+		}
+	}
+}
+
+// observe updates a tunnel's health from a probe and reports whether the tunnel
+// is stale and due for a restart. The caller holds m.mu.
+func (m *Manager) observe(state *tunnelHealth, probe healthProbe, stalePeriod time.Duration) bool {
+	now := m.now()
+	health := &state.health
+	health.CheckedAt = now
+
+	if probe.unmonitored != "" {
+		health.State = HealthHealthy
+		health.Reason = HealthReasonNotMonitored
+		health.Message = probe.unmonitored
+		return false
+	}
+
+	err := probe.err
+	if err == nil {
+		var lastHandshake time.Time
+		var rx, tx uint64
+		for _, peer := range probe.peers {
+			if peer.LastHandshake.After(lastHandshake) {
+				lastHandshake = peer.LastHandshake
+			}
+			rx += peer.ReceiveBytes
+			tx += peer.TransmitBytes
+		}
+
+		if lastHandshake.After(health.LastHandshake) || rx > health.ReceiveBytes {
+			state.lastProgress = now
+		}
+		health.LastHandshake = lastHandshake
+		health.ReceiveBytes = rx
+		health.TransmitBytes = tx
+	}
+
+	progressed := !state.lastProgress.IsZero() && !state.lastProgress.Before(state.since)
+	switch {
+	case err == nil && progressed && now.Sub(state.lastProgress) <= stalePeriod:
+		health.State = HealthHealthy
+		health.Reason = HealthReasonHandshakeRecent
+		health.Message = ""
+		health.Restarts = 0
+		state.nextRestart = time.Time{}
+		return false
+	case err == nil && !progressed && now.Sub(state.since) <= stalePeriod:
+		// Still connecting after a start; a restarted tunnel stays unhealthy until it recovers
+		if health.Restarts == 0 {
+			health.State = HealthUnknown
+			health.Reason = HealthReasonStarting
+			health.Message = "waiting for the first handshake"
+		}
+		return false
+	}
+
+	health.State = HealthUnhealthy
+	if err != nil {
+		health.Reason = HealthReasonStatsUnavailable
+		health.Message = err.Error()
+	} else {
+		health.Reason = HealthReasonHandshakeStale
+		health.Message = fmt.Sprintf("no handshake or traffic for more than %s", stalePeriod)
+	}
+
+	if now.Before(state.nextRestart) {
+		return false
+	}
+
+	health.Restarts++
+	state.since = now
+	state.nextRestart = now.Add(restartBackoff(health.Restarts))
+	return true
+}
+
+// restart restarts a stale tunnel and accounts for the traffic it carried before
+// its counters start from zero again
+func (m *Manager) restart(ctx context.Context, tunnel *Tunnel, state *tunnelHealth) {
+	counters, counted, stopped, err := tunnel.restart(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if traffic, ok := m.traffic[tunnel.id]; ok && m.tunnels[tunnel.id] == tunnel {
+		if counted {
+			traffic.add(counters, m.now())
+		}
+		if stopped {
+			m.resetTraffic(tunnel.id)
+		}
+	}
+	if err != nil {
+		state.health.Message += fmt.Sprintf("; restart failed: %v", err)
+	}
+}
+
+// probe reads the tunnel's peers for a health check. It reports false when the
+// tunnel was deleted meanwhile.
+func (t *Tunnel) probe(ctx context.Context) (healthProbe, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.removed {
+		return healthProbe{}, false
+	}
+
+	stats, ok := t.backend.(StatsBackend)
+	if !ok {
+		return healthProbe{unmonitored: "the tunnel's backend does not report peer counters"}, true
+	}
+
+	// Without keepalives an idle tunnel never handshakes, so silence means nothing
+	if !t.keepsAlive() {
+		return healthProbe{unmonitored: "no peer has a persistent keepalive"}, true
+	}
+
+	peers, err := stats.Stats(ctx, t.InterfaceName())
+	return healthProbe{peers: peers, err: err}, true
+}
+
+// restart brings the tunnel's interface down and up again. It returns the
+// traffic counters from right before, if they could be read, and whether the
+// interface was brought down.
+func (t *Tunnel) restart(ctx context.Context) (counters TrafficCounters, counted, stopped bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.removed {
+		return TrafficCounters{}, false, false, nil
+	}
+
+	counters, readErr := readTraffic(ctx, t)
+	counted = readErr == nil
+	if !t.down {
+		if err := t.Stop(ctx); err != nil {
+			return counters, counted, false, err
+		}
+	}
+	_, err = t.bringUp(ctx)
+	return counters, counted, true, err
+}
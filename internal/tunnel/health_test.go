@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStatsBackend is a fakeBackend whose peer counters are set by the test
+type fakeStatsBackend struct {
+	fakeBackend
+	ups   int
+	stats []PeerStats
+	err   error
+}
+
+func (b *fakeStatsBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	b.ups++
+	return b.fakeBackend.Up(ctx, name, config)
+}
+
+func (b *fakeStatsBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	return b.stats, b.err
+}
+
+// keepaliveTunnelConfig renders a config whose peer sends persistent keepalives
+func keepaliveTunnelConfig() string {
+	return RenderConfig(testKey('a'), &Peer{
+		PublicKey:           testKey('b'),
+		Endpoint:            "203.0.113.1:51820",
+		Addresses:           []string{"10.0.0.2/32"},
+		AllowedIPs:          []string{"10.0.0.1/32"},
+		PersistentKeepalive: 25,
+	})
+}
+
+func TestTunnelManagerHealth(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	stale := 3 * time.Minute
+
+	backend := &fakeStatsBackend{fakeBackend: fakeBackend{up: map[string]string{}}}
+	manager := NewManagerWithBackend(backend)
+	manager.now = func() time.Time { return now }
+
+	changes := []Health{}
+	manager.SetHealthHandler(func(tunnelID string, health Health) {
+		assert.Equal(t, "test-tunnel", tunnelID)
+		changes = append(changes, health)
+	})
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: keepaliveTunnelConfig()}))
+	health, ok := manager.TunnelHealth("test-tunnel")
+	assert.True(t, ok)
+	assert.Equal(t, HealthUnknown, health.State)
+
+	// Still connecting within the stale period
+	now = now.Add(time.Minute)
+	manager.checkHealth(ctx, stale)
+	assert.Empty(t, changes)
+
+	// A handshake makes the tunnel healthy
+	now = now.Add(30 * time.Second)
+	backend.stats = []PeerStats{{PublicKey: testKey('b'), LastHandshake: now, ReceiveBytes: 100, TransmitBytes: 200}}
+	manager.checkHealth(ctx, stale)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, HealthHealthy, changes[0].State)
+	assert.Equal(t, HealthReasonHandshakeRecent, changes[0].Reason)
+	assert.Equal(t, uint64(100), changes[0].ReceiveBytes)
+
+	// Incoming traffic keeps it healthy without a new handshake
+	now = now.Add(2 * time.Minute)
+	backend.stats[0].ReceiveBytes = 500
+	manager.checkHealth(ctx, stale)
+	now = now.Add(2 * time.Minute)
+	manager.checkHealth(ctx, stale)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, 1, backend.ups)
+
+	// Silence beyond the stale period restarts the tunnel
+	now = now.Add(2 * time.Minute)
+	manager.checkHealth(ctx, stale)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, HealthUnhealthy, changes[1].State)
+	assert.Equal(t, HealthReasonHandshakeStale, changes[1].Reason)
+	assert.Equal(t, 1, changes[1].Restarts)
+	assert.Equal(t, 2, backend.ups)
+
+	// The restarted tunnel gets a stale period to reconnect, then a longer backoff
+	now = now.Add(stale)
+	manager.checkHealth(ctx, stale)
+	assert.Equal(t, 2, backend.ups)
+	now = now.Add(time.Second)
+	manager.checkHealth(ctx, stale)
+	assert.Equal(t, 3, backend.ups)
+	health, _ = manager.TunnelHealth("test-tunnel")
+	assert.Equal(t, 2, health.Restarts)
+	assert.Len(t, changes, 2)
+
+	// Recovery resets the restart count
+	now = now.Add(time.Minute)
+	backend.stats = []PeerStats{{PublicKey: testKey('b'), LastHandshake: now, ReceiveBytes: 10}}
+	manager.checkHealth(ctx, stale)
+	assert.Len(t, changes, 3)
+	assert.Equal(t, HealthHealthy, changes[2].State)
+	assert.Equal(t, 0, changes[2].Restarts)
+
+	// Health goes with the tunnel
+	assert.NoError(t, manager.DeleteTunnel(ctx, "test-tunnel"))
+	_, ok = manager.TunnelHealth("test-tunnel")
+	assert.False(t, ok)
+}
+
+func TestTunnelManagerHealthStatsError(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	backend := &fakeStatsBackend{fakeBackend: fakeBackend{up: map[string]string{}}, err: errors.New("no such device")}
+	manager := NewManagerWithBackend(backend)
+	manager.now = func() time.Time { return now }
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: keepaliveTunnelConfig()}))
+	manager.checkHealth(ctx, time.Minute)
+
+	health, _ := manager.TunnelHealth("test-tunnel")
+	assert.Equal(t, HealthUnhealthy, health.State)
+	assert.Equal(t, HealthReasonStatsUnavailable, health.Reason)
+	assert.Contains(t, health.Message, "no such device")
+	assert.Equal(t, 2, backend.ups)
+}
+
+func TestTunnelManagerHealthWithoutKeepalive(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeStatsBackend{fakeBackend: fakeBackend{up: map[string]string{}}}
+	manager := NewManagerWithBackend(backend)
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	manager.now = func() time.Time { return time.Now().Add(time.Hour) }
+	manager.checkHealth(ctx, time.Minute)
+
+	health, _ := manager.TunnelHealth("test-tunnel")
+	assert.Equal(t, HealthHealthy, health.State)
+	assert.Equal(t, HealthReasonNotMonitored, health.Reason)
+	assert.Equal(t, 1, backend.ups)
+}
+
+// blockingStatsBackend is a fakeStatsBackend whose first Stats call hangs until released
+type blockingStatsBackend struct {
+	fakeStatsBackend
+	probing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStatsBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	select {
+	case b.probing <- struct{}{}:
+		<-b.release
+	default:
+	}
+	return b.fakeStatsBackend.Stats(ctx, name)
+}
+
+func TestTunnelManagerHealthDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingStatsBackend{
+		fakeStatsBackend: fakeStatsBackend{fakeBackend: fakeBackend{up: map[string]string{}}},
+		probing:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	manager := NewManagerWithBackend(backend)
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: keepaliveTunnelConfig()}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.checkHealth(ctx, time.Minute)
+	}()
+	<-backend.probing
+
+	// A hung probe does not hold up changes to the tunnels
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "other-tunnel", WGConfig: testTunnelConfig("10.0.0.3/32")}))
+	assert.NoError(t, manager.DeleteTunnel(ctx, "other-tunnel"))
+
+	close(backend.release)
+	<-done
+	health, ok := manager.TunnelHealth("test-tunnel")
+	assert.True(t, ok)
+	assert.Equal(t, HealthUnknown, health.State)
+}
+
+func TestRestartBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, restartBackoff(1))
+	assert.Equal(t, time.Minute, restartBackoff(2))
+	assert.Equal(t, 2*time.Minute, restartBackoff(3))
+	assert.Equal(t, maxRestartBackoff, restartBackoff(20))
+}
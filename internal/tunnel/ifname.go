@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// maxInterfaceNameLen is the longest interface name Linux accepts (IFNAMSIZ - 1)
+const maxInterfaceNameLen = 15
+
+// interfaceHashLen is the number of hex digits identifying a shortened name
+const interfaceHashLen = 6
+
+// Interface name prefixes for per-tunnel and shared interfaces
+const (
+	tunnelInterfacePrefix = "wg-"
+	sharedInterfacePrefix = "wgs-"
+)
+
+// interfaceName derives the interface name for an ID. IDs that fit and only use
+// characters wg-quick accepts are used as they are; others are shortened to a
+// readable head and a hash of the whole ID, so the same ID always gets the same name.
+// IDs shaped like a shortened name are shortened too, so a plain name never takes
+// the shortened name of another ID and names do not depend on which ID came first.
+func interfaceName(prefix, id string) string {
+	if len(prefix)+len(id) <= maxInterfaceNameLen && validInterfaceID(id) && !hashedInterfaceID(id) {
+		return prefix + id
+	}
+	return hashedInterfaceName(prefix, id, 0)
+}
+
+// hashedInterfaceID reports whether an ID has the shape of a shortened name: a hash,
+// optionally following a head and a dash
+func hashedInterfaceID(id string) bool {
+	if len(id) < interfaceHashLen {
+		return false
+	}
+	head, hash := id[:len(id)-interfaceHashLen], id[len(id)-interfaceHashLen:]
+	if head != "" && !strings.HasSuffix(head, "-") {
+		return false
+	}
+	return strings.Trim(hash, "0123456789abcdef") == ""
+}
+
+// hashedInterfaceName returns the shortened name for an ID. Later attempts hash in
+// the attempt number to move away from a name another ID already has, which only
+// happens when the hashes of two IDs collide.
+func hashedInterfaceName(prefix, id string, attempt int) string {
+	input := id
+	if attempt > 0 {
+		input += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(input))
+	hash := hex.EncodeToString(sum[:])[:interfaceHashLen]
+
+	head := sanitizeInterfaceID(id)
+	if keep := maxInterfaceNameLen - len(prefix) - len(hash) - 1; len(head) > keep {
+		head = head[:keep]
+	}
+	head = strings.TrimRight(head, "-")
+	if head == "" {
+		return prefix + hash
+	}
+	return prefix + head + "-" + hash
+}
+
+// validInterfaceID reports whether an ID only uses characters wg-quick accepts in
+// interface names
+func validInterfaceID(id string) bool {
+	return id != "" && sanitizeInterfaceID(id) == id
+}
+
+// sanitizeInterfaceID drops the characters wg-quick does not accept in interface names
+func sanitizeInterfaceID(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("_=+.-", r):
+			return r
+		}
+		return -1
+	}, id)
+}
+
+// interfaceNames hands out collision-free interface names and remembers which ID
+// holds which name
+type interfaceNames struct {
+	prefix string
+	byID   map[string]string
+	owners map[string]string
+}
+
+func newInterfaceNames(prefix string) *interfaceNames {
+	return &interfaceNames{
+		prefix: prefix,
+		byID:   make(map[string]string),
+		owners: make(map[string]string),
+	}
+}
+
+// assign returns the name held by an ID, choosing one if it has none yet
+func (n *interfaceNames) assign(id string) string {
+	if name, ok := n.byID[id]; ok {
+		return name
+	}
+
+	name := interfaceName(n.prefix, id)
+	for attempt := 1; n.owners[name] != ""; attempt++ {
+		name = hashedInterfaceName(n.prefix, id, attempt)
+	}
+
+	n.byID[id] = name
+	n.owners[name] = id
+	return name
+}
+
+// release frees the name held by an ID
+func (n *interfaceNames) release(id string) {
+	if name, ok := n.byID[id]; ok {
+		delete(n.owners, name)
+		delete(n.byID, id)
+	}
+}
+
+// mapping returns a copy of the names held, keyed by ID
+func (n *interfaceNames) mapping() map[string]string {
+	mapping := make(map[string]string, len(n.byID))
+	for id, name := range n.byID {
+		mapping[id] = name
+	}
+	return mapping
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceName(t *testing.T) {
+	// Short IDs keep their readable names
+	assert.Equal(t, "wg-test-tunnel", interfaceName(tunnelInterfacePrefix, "test-tunnel"))
+	assert.Equal(t, "wgs-eu", interfaceName(sharedInterfacePrefix, "eu"))
+
+	ids := []string{
+		"3f2a9c1e-7b4d-4e8a-9f6b-2c1d0e5a7b8c",
+		"3f2a9c1e-7b4d-4e8a-9f6b-2c1d0e5a7b8d",
+		"tunnel/with spaces",
+		"----------------",
+	}
+	names := map[string]bool{}
+	for _, id := range ids {
+		for _, prefix := range []string{tunnelInterfacePrefix, sharedInterfacePrefix} {
+			name := interfaceName(prefix, id)
+			assert.LessOrEqual(t, len(name), maxInterfaceNameLen, name)
+			assert.True(t, strings.HasPrefix(name, prefix), name)
+			assert.True(t, validInterfaceID(name), name)
+			assert.Equal(t, name, interfaceName(prefix, id), "names are stable")
+			assert.False(t, names[name], "names are distinct")
+			names[name] = true
+		}
+	}
+	assert.True(t, strings.HasPrefix(interfaceName(tunnelInterfacePrefix, ids[0]), "wg-3f2a9-"))
+}
+
+func TestInterfaceNamesCollision(t *testing.T) {
+	long := "a-very-long-tunnel-id"
+	shortened := interfaceName(tunnelInterfacePrefix, long)
+
+	// An ID shaped like the shortened name is shortened as well, so it cannot take
+	// the name whichever ID comes first
+	squatter := strings.TrimPrefix(shortened, tunnelInterfacePrefix)
+	assert.NotEqual(t, shortened, interfaceName(tunnelInterfacePrefix, squatter))
+
+	names := newInterfaceNames(tunnelInterfacePrefix)
+	squatterName := names.assign(squatter)
+	assert.Equal(t, shortened, names.assign(long))
+	assert.LessOrEqual(t, len(squatterName), maxInterfaceNameLen)
+	assert.Equal(t, shortened, names.assign(long), "assigned names are kept")
+	assert.Equal(t, map[string]string{squatter: squatterName, long: shortened}, names.mapping())
+
+	reversed := newInterfaceNames(tunnelInterfacePrefix)
+	assert.Equal(t, shortened, reversed.assign(long))
+	assert.Equal(t, squatterName, reversed.assign(squatter))
+
+	// Colliding hashes move the later ID to another name
+	taken := newInterfaceNames(tunnelInterfacePrefix)
+	taken.owners[shortened] = "other"
+	name := taken.assign(long)
+	assert.NotEqual(t, shortened, name)
+	assert.LessOrEqual(t, len(name), maxInterfaceNameLen)
+
+	// Released names can be handed out again
+	names.release(squatter)
+	names.release(long)
+	assert.Empty(t, names.mapping())
+	assert.Equal(t, shortened, names.assign(long))
+}
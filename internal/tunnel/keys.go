@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyInfo separates the SSH key derived from a tunnel key from any other use of it
+const sshKeyInfo = "easy-tunnel-lb ssh tunnel key"
+
+// GeneratePrivateKey returns a new base64 encoded WireGuard private key
+func GeneratePrivateKey() (string, error) {
+	key := make([]byte, wgKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate private key: %w", err)
+	}
+
+	// Clamp the scalar as Curve25519 requires
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// PublicKey derives the base64 encoded public key of a private key
+func PublicKey(privateKey string) (string, error) {
+	key, err := parseKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+
+	public, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// SSHSigner derives the Ed25519 key SSH tunnels authenticate with from the
+// tunnel's private key, so they are stored and rotated together
+func SSHSigner(privateKey string) (ssh.Signer, error) {
+	key, err := parseKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(sshKeyInfo)), seed); err != nil {
+		return nil, fmt.Errorf("failed to derive ssh key: %w", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive ssh key: %w", err)
+	}
+	return signer, nil
+}
+
+// SSHPublicKey returns the SSH public key of a private key in authorized_keys format
+func SSHPublicKey(privateKey string) (string, error) {
+	signer, err := SSHSigner(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPublicKey(t *testing.T) {
+	// Example key pair from wg(8)
+	public, err := PublicKey("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=")
+	assert.NoError(t, err)
+	assert.Equal(t, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=", public)
+
+	_, err = PublicKey("not-a-key")
+	assert.Error(t, err)
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	first, err := GeneratePrivateKey()
+	assert.NoError(t, err)
+	second, err := GeneratePrivateKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	key, err := parseKey(first)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), key[0]&7)
+	assert.Equal(t, byte(64), key[31]&192)
+}
+
+func TestSSHPublicKey(t *testing.T) {
+	first, err := SSHPublicKey(testKey('a'))
+	require.NoError(t, err)
+	again, err := SSHPublicKey(testKey('a'))
+	require.NoError(t, err)
+	other, err := SSHPublicKey(testKey('b'))
+	require.NoError(t, err)
+
+	assert.Equal(t, first, again)
+	assert.NotEqual(t, first, other)
+	assert.True(t, strings.HasPrefix(first, "ssh-ed25519 "))
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(first))
+	require.NoError(t, err)
+	signer, err := SSHSigner(testKey('a'))
+	require.NoError(t, err)
+	assert.Equal(t, signer.PublicKey().Marshal(), parsed.Marshal())
+
+	_, err = SSHPublicKey("not a key")
+	assert.Error(t, err)
+}
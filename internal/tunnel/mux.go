@@ -0,0 +1,456 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame types of the multiplexing protocol. Every frame is a 9 byte header - type,
+// stream ID and payload length - followed by the payload.
+const (
+	// muxFrameOpen opens a stream; the payload is the network (muxNetworkTCP or
+	// muxNetworkUDP) and the 2 byte Service port
+	muxFrameOpen byte = iota + 1
+	// muxFrameData carries stream bytes, or one datagram on UDP streams
+	muxFrameData
+	// muxFrameWindow grants the peer a 4 byte number of bytes more to send on a stream
+	muxFrameWindow
+	// muxFrameClose closes a stream in both directions
+	muxFrameClose
+	// muxFramePing asks the peer for a muxFramePong with the same payload
+	muxFramePing
+	muxFramePong
+)
+
+// Networks of multiplexed streams
+const (
+	muxNetworkTCP byte = 1
+	muxNetworkUDP byte = 2
+)
+
+const (
+	muxHeaderLen = 9
+	// muxMaxPayload bounds a frame's payload, and with it a datagram
+	muxMaxPayload = 64 << 10
+	// muxWindow is how many bytes a stream may have in flight unread; a receiver
+	// grants more as its side reads
+	muxWindow = 256 << 10
+	// muxAcceptBacklog is how many opened streams may wait to be accepted
+	muxAcceptBacklog = 64
+)
+
+// errMuxClosed is returned for operations on a closed session or stream
+var errMuxClosed = errors.New("multiplexed connection closed")
+
+// muxSession multiplexes TCP and UDP streams over one reliable connection. Both
+// ends can open streams; each stream has its own flow control window, so a slow
+// Service only stalls its own streams.
+type muxSession struct {
+	conn io.ReadWriteCloser
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	accept chan *muxStream
+	pongs  chan struct{}
+	done   chan struct{}
+}
+
+// newMuxSession starts multiplexing over conn. Streams opened by the client have
+// odd IDs and those opened by the server even ones.
+func newMuxSession(conn io.ReadWriteCloser, client bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		nextID:  2,
+		accept:  make(chan *muxStream, muxAcceptBacklog),
+		pongs:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a stream to a Service port of the peer
+func (s *muxSession) Open(network byte, port int) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	stream := newMuxStream(s, s.nextID, network, port)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.mu.Unlock()
+
+	payload := []byte{network, 0, 0}
+	binary.BigEndian.PutUint16(payload[1:], uint16(port))
+	if err := s.writeFrame(muxFrameOpen, stream.id, payload); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream the peer opens
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Ping checks that the peer still answers
+func (s *muxSession) Ping(ctx context.Context) error {
+	// Drop a late answer to an earlier ping
+	select {
+	case <-s.pongs:
+	default:
+	}
+
+	if err := s.writeFrame(muxFramePing, 0, nil); err != nil {
+		return err
+	}
+	select {
+	case <-s.pongs:
+		return nil
+	case <-s.done:
+		return s.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the connection and every stream on it
+func (s *muxSession) Close() error {
+	s.shutdown(errMuxClosed)
+	return nil
+}
+
+// Done is closed once the session is closed
+func (s *muxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session closed, or nil while it is open
+func (s *muxSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// shutdown closes the session for a reason, once
+func (s *muxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.closeLocal()
+	}
+	close(s.done)
+}
+
+// writeFrame writes one frame; frames of concurrent writers do not interleave
+func (s *muxSession) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderLen:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop dispatches the peer's frames until the connection fails
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.shutdown(err)
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > muxMaxPayload {
+			s.shutdown(fmt.Errorf("frame of %d bytes exceeds the maximum of %d", length, muxMaxPayload))
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		if err := s.handleFrame(frameType, id, payload); err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+// handleFrame applies one frame from the peer; errors are protocol violations
+func (s *muxSession) handleFrame(frameType byte, id uint32, payload []byte) error {
+	switch frameType {
+	case muxFrameOpen:
+		if len(payload) != 3 || (payload[0] != muxNetworkTCP && payload[0] != muxNetworkUDP) {
+			return fmt.Errorf("invalid open frame for stream %d", id)
+		}
+		stream := newMuxStream(s, id, payload[0], int(binary.BigEndian.Uint16(payload[1:])))
+		s.mu.Lock()
+		_, exists := s.streams[id]
+		if !exists {
+			s.streams[id] = stream
+		}
+		s.mu.Unlock()
+		if exists {
+			return fmt.Errorf("stream %d opened twice", id)
+		}
+
+		select {
+		case s.accept <- stream:
+		default:
+			// Nobody is accepting; refuse the stream without blocking the read loop
+			go stream.Close()
+		}
+	case muxFrameData:
+		if stream := s.stream(id); stream != nil {
+			return stream.receive(payload)
+		}
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("invalid window frame for stream %d", id)
+		}
+		if stream := s.stream(id); stream != nil {
+			stream.grant(int(binary.BigEndian.Uint32(payload)))
+		}
+	case muxFrameClose:
+		if stream := s.stream(id); stream != nil {
+			s.remove(id)
+			stream.closeLocal()
+		}
+	case muxFramePing:
+		go s.writeFrame(muxFramePong, 0, payload)
+	case muxFramePong:
+		select {
+		case s.pongs <- struct{}{}:
+		default:
+		}
+	default:
+		return fmt.Errorf("unknown frame type %d", frameType)
+	}
+	return nil
+}
+
+// stream returns an open stream by ID
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// remove forgets a stream
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// muxStream is one TCP connection or UDP flow multiplexed over a session. On UDP
+// streams every Read and Write is one datagram.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	network byte
+	port    int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// received holds data the peer sent that was not read yet; one entry per datagram
+	received [][]byte
+	buffered int
+	// unacked counts bytes read since the peer was last granted more window
+	unacked int
+	// window is how many more bytes the peer accepts
+	window int
+	closed bool
+}
+
+func newMuxStream(session *muxSession, id uint32, network byte, port int) *muxStream {
+	stream := &muxStream{
+		session: session,
+		id:      id,
+		network: network,
+		port:    port,
+		window:  muxWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// Read reads stream bytes, or one datagram on UDP streams
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.received) == 0 && !st.closed {
+		st.cond.Wait()
+	}
+	if len(st.received) == 0 {
+		st.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	var n, consumed int
+	if st.network == muxNetworkUDP {
+		n = copy(p, st.received[0])
+		consumed = len(st.received[0])
+		st.received = st.received[1:]
+	} else {
+		n = copy(p, st.received[0])
+		consumed = n
+		if n == len(st.received[0]) {
+			st.received = st.received[1:]
+		} else {
+			st.received[0] = st.received[0][n:]
+		}
+	}
+	st.buffered -= consumed
+	st.unacked += consumed
+
+	// Grant the window back in batches rather than per read
+	var grant int
+	if st.unacked >= muxWindow/2 {
+		grant = st.unacked
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(grant))
+		st.session.writeFrame(muxFrameWindow, st.id, payload)
+	}
+	return n, nil
+}
+
+// Write sends stream bytes, waiting for the peer's window. On UDP streams p is
+// one datagram, dropped when the peer's window is full.
+func (st *muxStream) Write(p []byte) (int, error) {
+	if st.network == muxNetworkUDP {
+		if len(p) > muxMaxPayload {
+			return 0, fmt.Errorf("datagram of %d bytes exceeds the maximum of %d", len(p), muxMaxPayload)
+		}
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, errMuxClosed
+		}
+		if st.window < len(p) {
+			st.mu.Unlock()
+			return len(p), nil
+		}
+		st.window -= len(p)
+		st.mu.Unlock()
+		if err := st.session.writeFrame(muxFrameData, st.id, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		for st.window == 0 && !st.closed {
+			st.cond.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return written, errMuxClosed
+		}
+		chunk := min(len(p)-written, st.window, muxMaxPayload)
+		st.window -= chunk
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxFrameData, st.id, p[written:written+chunk]); err != nil {
+			return written, err
+		}
+		written += chunk
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions
+func (st *muxStream) Close() error {
+	if !st.closeLocal() {
+		return nil
+	}
+	st.session.remove(st.id)
+	return st.session.writeFrame(muxFrameClose, st.id, nil)
+}
+
+// closeLocal marks the stream closed and wakes blocked readers and writers. It
+// reports whether the stream was open.
+func (st *muxStream) closeLocal() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return false
+	}
+	st.closed = true
+	st.cond.Broadcast()
+	return true
+}
+
+// receive queues data from the peer, failing when the peer overran its window
+func (st *muxStream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	if st.buffered+len(payload) > muxWindow {
+		return fmt.Errorf("stream %d overran its flow control window", st.id)
+	}
+	st.received = append(st.received, payload)
+	st.buffered += len(payload)
+	st.cond.Broadcast()
+	return nil
+}
+
+// grant lets the stream send n more bytes
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.window += n
+	st.cond.Broadcast()
+}
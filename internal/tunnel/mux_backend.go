@@ -0,0 +1,407 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TransportTLS carries tunnels as multiplexed TCP and UDP streams over a single
+// outbound TLS or WebSocket connection, for networks that only allow HTTPS
+const TransportTLS = "tls"
+
+// Defaults of the multiplexing backend
+const (
+	// muxConnectTimeout bounds dialing, the TLS handshake and the upgrade
+	muxConnectTimeout = 15 * time.Second
+	// muxKeepaliveInterval is how often an idle connection is pinged
+	muxKeepaliveInterval = 30 * time.Second
+	// muxMinBackoff and muxMaxBackoff bound the wait between reconnects
+	muxMinBackoff = time.Second
+	muxMaxBackoff = time.Minute
+	// muxUDPIdleTimeout closes UDP flows nothing was sent on for this long
+	muxUDPIdleTimeout = 2 * time.Minute
+)
+
+// Headers of the connection upgrade
+const (
+	// muxUpgrade is the Upgrade token of raw TLS connections
+	muxUpgrade = "easy-tunnel-lb-mux/1"
+	// muxSessionHeader names the tunnel the connection carries
+	muxSessionHeader = "X-Easy-Tunnel-Lb-Session"
+	// muxResumeHeader is "true" on reconnects, asking the server to hand the
+	// session's external address to the new connection
+	muxResumeHeader = "X-Easy-Tunnel-Lb-Resume"
+)
+
+// MuxConfig describes the server end of a tunnel on TransportTLS
+type MuxConfig struct {
+	// URL is the server's tunnel endpoint: wss:// for WebSocket or tls:// for raw TLS
+	URL string
+	// Session identifies the tunnel on the server; a reconnect with it resumes the
+	// tunnel and keeps its external address
+	Session string
+	// APIKey authenticates to the server the same way as the API client
+	APIKey string
+	// CABundle is a PEM encoded CA bundle trusted in addition to the system roots
+	CABundle []byte
+}
+
+// MuxBackend keeps one TLS or WebSocket connection to the tunnel server per
+// tunnel. The server opens a stream over it for every connection or UDP flow
+// reaching the tunnel's external address, and the backend proxies the stream to
+// the Service. Lost connections are resumed with exponential backoff until the
+// tunnel goes down.
+type MuxBackend struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	connectTimeout time.Duration
+	keepalive      time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	udpIdleTimeout time.Duration
+
+	mu      sync.Mutex
+	tunnels map[string]*muxTunnel
+}
+
+// muxTunnel is the connection of one tunnel, kept open until it goes down
+type muxTunnel struct {
+	backend  *MuxBackend
+	config   *TunnelConfig
+	endpoint *url.URL
+	tls      *tls.Config
+	traffic  trafficCounter
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewMuxBackend creates a TLS/WebSocket tunnel backend
+func NewMuxBackend() *MuxBackend {
+	dialer := &net.Dialer{}
+	return &MuxBackend{
+		dial:           dialer.DialContext,
+		connectTimeout: muxConnectTimeout,
+		keepalive:      muxKeepaliveInterval,
+		minBackoff:     muxMinBackoff,
+		maxBackoff:     muxMaxBackoff,
+		udpIdleTimeout: muxUDPIdleTimeout,
+		tunnels:        make(map[string]*muxTunnel),
+	}
+}
+
+// Up connects to the server, replacing any running connection with a different
+// config. Later connection losses are resumed in the background.
+func (b *MuxBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	tunnel, err := b.newTunnel(config)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	b.mu.Lock()
+	running, ok := b.tunnels[name]
+	b.mu.Unlock()
+	if ok && sameTunnelConfig(running.config, config) {
+		return nil
+	}
+	if err := b.Down(ctx, name); err != nil {
+		return err
+	}
+
+	session, err := tunnel.connect(ctx, false)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "connect", Err: err}
+	}
+
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	tunnel.cancel = cancel
+	tunnel.done = make(chan struct{})
+	go tunnel.run(tunnelCtx, session)
+
+	b.mu.Lock()
+	b.tunnels[name] = tunnel
+	b.mu.Unlock()
+	return nil
+}
+
+// Down closes the tunnel's connection and stops reconnecting
+func (b *MuxBackend) Down(ctx context.Context, name string) error {
+	b.mu.Lock()
+	tunnel, ok := b.tunnels[name]
+	delete(b.tunnels, name)
+	b.mu.Unlock()
+
+	if ok {
+		tunnel.cancel()
+		<-tunnel.done
+	}
+	return nil
+}
+
+// newTunnel validates a tunnel's config and prepares its TLS settings
+func (b *MuxBackend) newTunnel(config *TunnelConfig) (*muxTunnel, error) {
+	settings := config.Mux
+	if settings == nil {
+		return nil, errors.New("tls tunnel settings are missing")
+	}
+
+	endpoint, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel endpoint: %w", err)
+	}
+	if endpoint.Scheme != "wss" && endpoint.Scheme != "tls" {
+		return nil, fmt.Errorf("tunnel endpoint %q must be a wss:// or tls:// URL", settings.URL)
+	}
+	if endpoint.Hostname() == "" {
+		return nil, fmt.Errorf("tunnel endpoint %q has no host", settings.URL)
+	}
+	if settings.Session == "" || settings.APIKey == "" {
+		return nil, errors.New("tunnel session and api key are required")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: endpoint.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(settings.CABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(settings.CABundle) {
+			return nil, errors.New("failed to parse CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &muxTunnel{
+		backend:  b,
+		config:   config,
+		endpoint: endpoint,
+		tls:      tlsConfig,
+	}, nil
+}
+
+// connect opens the TLS connection, upgrades it for the tunnel's session and
+// starts multiplexing over it
+func (t *muxTunnel) connect(ctx context.Context, resume bool) (*muxSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.backend.connectTimeout)
+	defer cancel()
+
+	address := t.endpoint.Host
+	if t.endpoint.Port() == "" {
+		address = net.JoinHostPort(t.endpoint.Hostname(), "443")
+	}
+	raw, err := t.backend.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The upgrade has no context of its own
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+
+	conn := tls.Client(raw, t.tls)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+t.config.Mux.APIKey)
+	header.Set(muxSessionHeader, t.config.Mux.Session)
+	header.Set(muxResumeHeader, strconv.FormatBool(resume))
+
+	var stream io.ReadWriteCloser
+	if t.endpoint.Scheme == "wss" {
+		stream, err = upgradeWebSocket(conn, t.endpoint, header)
+	} else {
+		stream, err = upgradeMux(conn, t.endpoint, header)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newMuxSession(stream, true), nil
+}
+
+// upgradeWebSocket opens a binary WebSocket on a TLS connection
+func upgradeWebSocket(conn net.Conn, endpoint *url.URL, header http.Header) (io.ReadWriteCloser, error) {
+	config, err := websocket.NewConfig(endpoint.String(), "https://"+endpoint.Host)
+	if err != nil {
+		return nil, err
+	}
+	config.Header = header
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, fmt.Errorf("websocket upgrade failed: %w", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// upgradeMux asks the server to switch a TLS connection to the multiplexing protocol
+func upgradeMux(conn net.Conn, endpoint *url.URL, header http.Header) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://"+endpoint.Host+endpoint.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", muxUpgrade)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upgrade refused with status %d", resp.StatusCode)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads through the reader that consumed the upgrade response, which
+// may already hold the first frames
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// run serves the connection and resumes it whenever it is lost, until ctx is done
+func (t *muxTunnel) run(ctx context.Context, session *muxSession) {
+	defer close(t.done)
+
+	for {
+		t.serve(ctx, session)
+
+		reconnected := reconnect(ctx, t.backend.minBackoff, t.backend.maxBackoff, func() error {
+			var err error
+			session, err = t.connect(ctx, true)
+			return err
+		})
+		if !reconnected {
+			return
+		}
+	}
+}
+
+// serve proxies the streams the server opens until the connection is lost or ctx is done
+func (t *muxTunnel) serve(ctx context.Context, session *muxSession) {
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go t.proxy(stream)
+		}
+	}()
+
+	ticker := time.NewTicker(t.backend.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			session.Close()
+			return
+		case <-session.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, t.backend.connectTimeout)
+			err := session.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				session.Close()
+				return
+			}
+		}
+	}
+}
+
+// proxy connects a stream to its Service port. Streams to ports the tunnel does
+// not publish are refused.
+func (t *muxTunnel) proxy(stream *muxStream) {
+	defer stream.Close()
+
+	network, ports := "tcp", t.config.Ports
+	if stream.network == muxNetworkUDP {
+		network, ports = "udp", t.config.UDPPorts
+	}
+	if !slices.Contains(ports, stream.port) {
+		return
+	}
+
+	upstream, err := t.backend.dial(context.Background(), network, net.JoinHostPort(t.config.Service, strconv.Itoa(stream.port)))
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	if stream.network == muxNetworkUDP {
+		relayDatagrams(t.traffic.count(stream), upstream, t.backend.udpIdleTimeout)
+	} else {
+		pipe(t.traffic.count(stream), upstream)
+	}
+}
+
+// relayDatagrams copies datagrams between a UDP stream and the Service until
+// either side closes or the flow is idle for idleTimeout
+func relayDatagrams(stream io.ReadWriter, conn net.Conn, idleTimeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := make([]byte, muxMaxPayload)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				break
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		buf := make([]byte, muxMaxPayload)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if _, err := stream.Write(buf[:n]); err != nil {
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		done <- struct{}{}
+	}()
+	<-done
+}
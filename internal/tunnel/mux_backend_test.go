@@ -0,0 +1,340 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	testMuxAPIKey  = "test-api-key"
+	testMuxSession = "session-1"
+)
+
+// testMuxServer is an in-process tunnel server accepting tunnel connections over
+// WebSocket and raw TLS upgrades
+type testMuxServer struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	sessions []*muxSession
+	resumes  []string
+}
+
+func newTestMuxServer(t *testing.T) *testMuxServer {
+	s := &testMuxServer{}
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	t.Cleanup(func() {
+		s.dropConnections()
+		s.server.Close()
+	})
+	return s
+}
+
+func (s *testMuxServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testMuxAPIKey {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get(muxSessionHeader) != testMuxSession {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	s.resumes = append(s.resumes, r.Header.Get(muxResumeHeader))
+	s.mu.Unlock()
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				<-s.attach(ws).Done()
+			},
+		}.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Header.Get("Upgrade") != muxUpgrade {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", muxUpgrade)
+	rw.Flush()
+	s.attach(&bufferedConn{Conn: conn, reader: rw.Reader})
+}
+
+// attach starts the server end of a session on an upgraded connection
+func (s *testMuxServer) attach(conn io.ReadWriteCloser) *muxSession {
+	session := newMuxSession(conn, false)
+	s.mu.Lock()
+	s.sessions = append(s.sessions, session)
+	s.mu.Unlock()
+	return session
+}
+
+// session returns the latest connected session
+func (s *testMuxServer) session() *muxSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) == 0 {
+		return nil
+	}
+	return s.sessions[len(s.sessions)-1]
+}
+
+// resumeHeaders returns the resume header of every connection so far
+func (s *testMuxServer) resumeHeaders() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.resumes...)
+}
+
+// dropConnections closes every tunnel connection, as a network outage would
+func (s *testMuxServer) dropConnections() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = nil
+	s.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// endpoint returns the server's tunnel URL for a scheme
+func (s *testMuxServer) endpoint(scheme string) string {
+	return scheme + "://" + strings.TrimPrefix(s.server.URL, "https://") + "/api/tunnels/connect"
+}
+
+// caBundle returns the PEM encoded certificate of the server
+func (s *testMuxServer) caBundle() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+}
+
+// newUDPEchoServer starts a UDP server that echoes datagrams and returns its port
+func newUDPEchoServer(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestMuxBackend returns a multiplexing backend that reconnects quickly
+func newTestMuxBackend() *MuxBackend {
+	backend := NewMuxBackend()
+	backend.connectTimeout = 5 * time.Second
+	backend.minBackoff = 10 * time.Millisecond
+	backend.maxBackoff = 50 * time.Millisecond
+	return backend
+}
+
+// muxTunnelConfig returns a tunnel config for the server publishing the TCP and UDP ports
+func muxTunnelConfig(server *testMuxServer, scheme string, tcpPort, udpPort int) *TunnelConfig {
+	return &TunnelConfig{
+		TunnelID:  "tunnel-tls",
+		Transport: TransportTLS,
+		Service:   "127.0.0.1",
+		Ports:     []int{tcpPort},
+		UDPPorts:  []int{udpPort},
+		Mux: &MuxConfig{
+			URL:      server.endpoint(scheme),
+			Session:  testMuxSession,
+			APIKey:   testMuxAPIKey,
+			CABundle: server.caBundle(),
+		},
+	}
+}
+
+// roundTrip opens a stream from the server and reports whether the Service echoes over it
+func roundTrip(server *testMuxServer, network byte, port int) bool {
+	session := server.session()
+	if session == nil {
+		return false
+	}
+	stream, err := session.Open(network, port)
+	if err != nil {
+		return false
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		return false
+	}
+	reply := make([]byte, muxMaxPayload)
+	read := make(chan string, 1)
+	go func() {
+		n, _ := stream.Read(reply)
+		read <- string(reply[:n])
+	}()
+	select {
+	case got := <-read:
+		return got == "ping"
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func TestMuxBackend(t *testing.T) {
+	for _, scheme := range []string{"wss", "tls"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+			server := newTestMuxServer(t)
+			tcpPort := newEchoServer(t)
+			udpPort := newUDPEchoServer(t)
+
+			backend := newTestMuxBackend()
+			require.NoError(t, backend.Up(ctx, "et-tls", muxTunnelConfig(server, scheme, tcpPort, udpPort)))
+			t.Cleanup(func() { backend.Down(ctx, "et-tls") })
+
+			assert.True(t, roundTrip(server, muxNetworkTCP, tcpPort), "tcp stream should reach the Service")
+			assert.True(t, roundTrip(server, muxNetworkUDP, udpPort), "udp stream should reach the Service")
+			// Ports the tunnel does not publish are refused
+			assert.False(t, roundTrip(server, muxNetworkTCP, udpPort))
+			assert.False(t, roundTrip(server, muxNetworkUDP, tcpPort))
+			// Refused streams are not counted
+			require.Eventually(t, func() bool {
+				traffic, err := backend.Traffic(ctx, "et-tls")
+				return err == nil && traffic == TrafficCounters{ReceiveBytes: 8, TransmitBytes: 8, Connections: 2}
+			}, time.Second, 10*time.Millisecond)
+
+			// The same config keeps the running connection
+			require.NoError(t, backend.Up(ctx, "et-tls", muxTunnelConfig(server, scheme, tcpPort, udpPort)))
+			assert.Equal(t, []string{"false"}, server.resumeHeaders())
+
+			// A lost connection is resumed with the same session
+			server.dropConnections()
+			require.Eventually(t, func() bool {
+				return roundTrip(server, muxNetworkTCP, tcpPort)
+			}, 5*time.Second, 20*time.Millisecond)
+			assert.Equal(t, []string{"false", "true"}, server.resumeHeaders())
+
+			require.NoError(t, backend.Down(ctx, "et-tls"))
+			require.Eventually(t, func() bool {
+				session := server.session()
+				if session == nil {
+					return true
+				}
+				select {
+				case <-session.Done():
+					return true
+				default:
+					return false
+				}
+			}, 5*time.Second, 20*time.Millisecond)
+			assert.NoError(t, backend.Down(ctx, "et-tls"))
+		})
+	}
+}
+
+func TestMuxBackendErrors(t *testing.T) {
+	ctx := context.Background()
+	server := newTestMuxServer(t)
+
+	tests := []struct {
+		name   string
+		modify func(config *TunnelConfig)
+		op     string
+		want   string
+	}{
+		{
+			name:   "missing settings",
+			modify: func(config *TunnelConfig) { config.Mux = nil },
+			op:     "parse config",
+			want:   "tls tunnel settings are missing",
+		},
+		{
+			name:   "plain http endpoint",
+			modify: func(config *TunnelConfig) { config.Mux.URL = "http://203.0.113.1/connect" },
+			op:     "parse config",
+			want:   "must be a wss:// or tls:// URL",
+		},
+		{
+			name:   "missing session",
+			modify: func(config *TunnelConfig) { config.Mux.Session = "" },
+			op:     "parse config",
+			want:   "session and api key are required",
+		},
+		{
+			name:   "untrusted certificate",
+			modify: func(config *TunnelConfig) { config.Mux.CABundle = nil },
+			op:     "connect",
+			want:   "certificate",
+		},
+		{
+			name:   "wrong api key over tls",
+			modify: func(config *TunnelConfig) { config.Mux.APIKey = "wrong" },
+			op:     "connect",
+			want:   "upgrade refused with status 401",
+		},
+		{
+			name: "wrong api key over websocket",
+			modify: func(config *TunnelConfig) {
+				config.Mux.URL = server.endpoint("wss")
+				config.Mux.APIKey = "wrong"
+			},
+			op:   "connect",
+			want: "websocket upgrade failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := muxTunnelConfig(server, "tls", 80, 53)
+			tt.modify(config)
+
+			err := newTestMuxBackend().Up(ctx, "et-tls", config)
+			var backendErr *BackendError
+			require.True(t, errors.As(err, &backendErr), "expected a BackendError, got %v", err)
+			assert.Equal(t, tt.op, backendErr.Op)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestMuxBackendConformance(t *testing.T) {
+	server := newTestMuxServer(t)
+
+	testBackendConformance(t, conformanceHarness{
+		newBackend: func(t *testing.T) Backend {
+			return newTestMuxBackend()
+		},
+		// Every allowed IP publishes a port, so reconfiguring adds one
+		config: func(peerKey, allowedIPs string) *TunnelConfig {
+			config := muxTunnelConfig(server, "tls", 8000, 5300)
+			for i := range strings.Split(allowedIPs, ",")[1:] {
+				config.Ports = append(config.Ports, 8001+i)
+			}
+			return config
+		},
+	})
+}
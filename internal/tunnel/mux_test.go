@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMuxPair returns the client and server end of a session over an in-memory connection
+func newMuxPair(t *testing.T) (*muxSession, *muxSession) {
+	clientConn, serverConn := net.Pipe()
+	client := newMuxSession(clientConn, true)
+	server := newMuxSession(serverConn, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStream(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	opened, err := server.Open(muxNetworkTCP, 8080)
+	require.NoError(t, err)
+	accepted, err := client.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, muxNetworkTCP, accepted.network)
+	assert.Equal(t, 8080, accepted.port)
+	assert.Equal(t, uint32(2), opened.id)
+
+	_, err = opened.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := accepted.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hel", string(buf[:n]))
+	n, err = accepted.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "lo", string(buf[:n]))
+
+	// Closing one end ends the stream on both
+	require.NoError(t, accepted.Close())
+	_, err = opened.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	require.Eventually(t, func() bool {
+		_, err := opened.Write([]byte("late"))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMuxStreamFlowControl(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	opened, err := server.Open(muxNetworkTCP, 8080)
+	require.NoError(t, err)
+	accepted, err := client.Accept()
+	require.NoError(t, err)
+
+	// A writer stops at the window until the reader catches up
+	written := make(chan int, 1)
+	go func() {
+		n, _ := opened.Write(make([]byte, 2*muxWindow))
+		written <- n
+	}()
+
+	require.Eventually(t, func() bool {
+		opened.mu.Lock()
+		defer opened.mu.Unlock()
+		return opened.window == 0
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-written:
+		t.Fatal("write should block while the window is exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other streams keep flowing meanwhile
+	other, err := server.Open(muxNetworkTCP, 9090)
+	require.NoError(t, err)
+	otherAccepted, err := client.Accept()
+	require.NoError(t, err)
+	_, err = other.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(otherAccepted, buf)
+	require.NoError(t, err)
+
+	received, err := io.ReadFull(accepted, make([]byte, 2*muxWindow))
+	require.NoError(t, err)
+	assert.Equal(t, 2*muxWindow, received)
+	assert.Equal(t, 2*muxWindow, <-written)
+}
+
+func TestMuxDatagrams(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	opened, err := server.Open(muxNetworkUDP, 53)
+	require.NoError(t, err)
+	accepted, err := client.Accept()
+	require.NoError(t, err)
+
+	// Every read returns one whole datagram
+	for _, datagram := range []string{"first", "second"} {
+		_, err := opened.Write([]byte(datagram))
+		require.NoError(t, err)
+	}
+	buf := make([]byte, muxMaxPayload)
+	n, err := accepted.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buf[:n]))
+	n, err = accepted.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(buf[:n]))
+
+	// Datagrams beyond the window are dropped instead of blocking
+	opened.mu.Lock()
+	opened.window = 3
+	opened.mu.Unlock()
+	n, err = opened.Write([]byte("dropped"))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+
+	_, err = opened.Write(make([]byte, muxMaxPayload+1))
+	assert.Error(t, err)
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	require.NoError(t, client.Ping(context.Background()))
+
+	opened, err := server.Open(muxNetworkTCP, 8080)
+	require.NoError(t, err)
+	_, err = client.Accept()
+	require.NoError(t, err)
+
+	client.Close()
+	<-server.Done()
+	_, err = opened.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	_, err = server.Open(muxNetworkTCP, 8080)
+	assert.Error(t, err)
+	_, err = client.Accept()
+	assert.Error(t, err)
+}
@@ -0,0 +1,443 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// wgGenlName and wgGenlVersion identify the WireGuard generic netlink family
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+)
+
+// NetlinkBackend configures interfaces through rtnetlink and the WireGuard
+// generic netlink API without any userspace tools
+type NetlinkBackend struct {
+	family uint16
+}
+
+// NewNetlinkBackend creates a netlink backend, failing with ErrWireGuardUnsupported
+// when the kernel does not expose the WireGuard netlink family
+func NewNetlinkBackend() (*NetlinkBackend, error) {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWireGuardUnsupported, err)
+	}
+	return &NetlinkBackend{family: family.ID}, nil
+}
+
+// Up creates the interface if needed and replaces its keys, peers, addresses and routes
+func (b *NetlinkBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	parsed, err := ParseConfig(config.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+	return b.apply(name, parsed, nil)
+}
+
+// apply configures the interface, creating it if needed. With old set the peers
+// are changed relative to it rather than replaced.
+func (b *NetlinkBackend) apply(name string, parsed, old *Config) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return &BackendError{Interface: name, Op: "get link", Err: err}
+		}
+		if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			if errors.Is(err, unix.EOPNOTSUPP) {
+				err = ErrWireGuardUnsupported
+			}
+			return &BackendError{Interface: name, Op: "create link", Err: err}
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return &BackendError{Interface: name, Op: "get link", Err: err}
+		}
+	}
+
+	if err := b.configureDevice(name, parsed, old); err != nil {
+		return &BackendError{Interface: name, Op: "configure device", Err: err}
+	}
+
+	if parsed.Interface.MTU != 0 && link.Attrs().MTU != parsed.Interface.MTU {
+		if err := netlink.LinkSetMTU(link, parsed.Interface.MTU); err != nil {
+			return &BackendError{Interface: name, Op: "set MTU", Err: err}
+		}
+	}
+
+	if err := syncAddresses(link, parsed.Interface.Addresses); err != nil {
+		return &BackendError{Interface: name, Op: "set addresses", Err: err}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return &BackendError{Interface: name, Op: "set link up", Err: err}
+	}
+
+	for _, peer := range parsed.Peers {
+		for _, cidr := range peer.AllowedIPs {
+			if isDefaultRoute(cidr) {
+				continue
+			}
+			_, dst, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return &BackendError{Interface: name, Op: "add route", Err: err}
+			}
+			route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+			if err := netlink.RouteReplace(route); err != nil {
+				return &BackendError{Interface: name, Op: "add route", Err: err}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sync reconfigures the running interface like wg syncconf: only added or changed
+// peers are set and dropped ones removed, so the sessions of the others survive.
+// Routes of dropped allowed IPs are removed.
+func (b *NetlinkBackend) Sync(ctx context.Context, name string, old, new *TunnelConfig) error {
+	oldParsed, err := ParseConfig(old.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+	newParsed, err := ParseConfig(new.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	if err := b.apply(name, newParsed, oldParsed); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "get link", Err: err}
+	}
+	_, removed := routeChanges(oldParsed, newParsed)
+	for _, cidr := range removed {
+		if isDefaultRoute(cidr) {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return &BackendError{Interface: name, Op: "delete route", Err: err}
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return &BackendError{Interface: name, Op: "delete route", Err: err}
+		}
+	}
+	return nil
+}
+
+// Down deletes the interface; routes and addresses go with it
+func (b *NetlinkBackend) Down(ctx context.Context, name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return &BackendError{Interface: name, Op: "get link", Err: err}
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return &BackendError{Interface: name, Op: "delete link", Err: err}
+	}
+	return nil
+}
+
+// Stats reads the peer counters with WG_CMD_GET_DEVICE
+func (b *NetlinkBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	req := nl.NewNetlinkRequest(int(b.family), unix.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{Command: unix.WG_CMD_GET_DEVICE, Version: wgGenlVersion})
+	req.AddData(nl.NewRtAttr(unix.WGDEVICE_A_IFNAME, nl.ZeroTerminated(name)))
+
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "get device", Err: err}
+	}
+	stats, err := parseDeviceStats(msgs)
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "get device", Err: err}
+	}
+	return stats, nil
+}
+
+// configureDevice sends WG_CMD_SET_DEVICE for a config, see deviceAttrs
+func (b *NetlinkBackend) configureDevice(name string, config, old *Config) error {
+	attrs, err := deviceAttrs(name, config, old)
+	if err != nil {
+		return err
+	}
+
+	req := nl.NewNetlinkRequest(int(b.family), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: unix.WG_CMD_SET_DEVICE, Version: wgGenlVersion})
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+
+	_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+// deviceAttrs builds the WG_CMD_SET_DEVICE attributes for a config. Without old all
+// peers are replaced, which drops their sessions; with old only added or changed
+// peers are set and dropped ones removed.
+func deviceAttrs(name string, config, old *Config) ([]*nl.RtAttr, error) {
+	privateKey, err := parseKey(config.Interface.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(unix.WGDEVICE_A_IFNAME, nl.ZeroTerminated(name)),
+		nl.NewRtAttr(unix.WGDEVICE_A_PRIVATE_KEY, privateKey),
+		nl.NewRtAttr(unix.WGDEVICE_A_LISTEN_PORT, nl.Uint16Attr(uint16(config.Interface.ListenPort))),
+	}
+
+	set, removed := config.Peers, []string(nil)
+	if old == nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.WGDEVICE_A_FLAGS, nl.Uint32Attr(unix.WGDEVICE_F_REPLACE_PEERS)))
+	} else {
+		set, removed = peerChanges(old, config)
+		if len(set) == 0 && len(removed) == 0 {
+			return attrs, nil
+		}
+	}
+
+	peers := nl.NewRtAttr(unix.WGDEVICE_A_PEERS|int(nl.NLA_F_NESTED), nil)
+	for i, peer := range set {
+		peerAttr := peers.AddRtAttr(i|int(nl.NLA_F_NESTED), nil)
+
+		publicKey, err := parseKey(peer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: invalid public key: %w", i, err)
+		}
+		peerAttr.AddRtAttr(unix.WGPEER_A_PUBLIC_KEY, publicKey)
+		peerAttr.AddRtAttr(unix.WGPEER_A_FLAGS, nl.Uint32Attr(unix.WGPEER_F_REPLACE_ALLOWEDIPS))
+
+		if peer.PresharedKey != "" {
+			presharedKey, err := parseKey(peer.PresharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid preshared key: %w", i, err)
+			}
+			peerAttr.AddRtAttr(unix.WGPEER_A_PRESHARED_KEY, presharedKey)
+		}
+
+		if peer.Endpoint != "" {
+			endpoint, err := encodeEndpoint(peer.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid endpoint: %w", i, err)
+			}
+			peerAttr.AddRtAttr(unix.WGPEER_A_ENDPOINT, endpoint)
+		}
+
+		peerAttr.AddRtAttr(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, nl.Uint16Attr(uint16(peer.PersistentKeepalive)))
+
+		allowedIPs := peerAttr.AddRtAttr(unix.WGPEER_A_ALLOWEDIPS|int(nl.NLA_F_NESTED), nil)
+		for j, cidr := range peer.AllowedIPs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid allowed IP: %w", i, err)
+			}
+			ones, _ := ipNet.Mask.Size()
+
+			family, addr := uint16(unix.AF_INET), ip.To4()
+			if addr == nil {
+				family, addr = unix.AF_INET6, ip.To16()
+			}
+
+			allowedIP := allowedIPs.AddRtAttr(j|int(nl.NLA_F_NESTED), nil)
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_FAMILY, nl.Uint16Attr(family))
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_IPADDR, addr)
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_CIDR_MASK, nl.Uint8Attr(uint8(ones)))
+		}
+	}
+	for i, publicKey := range removed {
+		key, err := parseKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("removed peer %d: invalid public key: %w", i, err)
+		}
+		peerAttr := peers.AddRtAttr((len(set)+i)|int(nl.NLA_F_NESTED), nil)
+		peerAttr.AddRtAttr(unix.WGPEER_A_PUBLIC_KEY, key)
+		peerAttr.AddRtAttr(unix.WGPEER_A_FLAGS, nl.Uint32Attr(unix.WGPEER_F_REMOVE_ME))
+	}
+	attrs = append(attrs, peers)
+
+	return attrs, nil
+}
+
+// peerChanges returns the peers of config that are new or differ from old, and the
+// public keys of the peers only old has
+func peerChanges(old, config *Config) (set []PeerConfig, removed []string) {
+	previous := make(map[string]PeerConfig, len(old.Peers))
+	for _, peer := range old.Peers {
+		previous[peer.PublicKey] = peer
+	}
+
+	kept := make(map[string]bool, len(config.Peers))
+	for _, peer := range config.Peers {
+		kept[peer.PublicKey] = true
+		if prev, ok := previous[peer.PublicKey]; !ok || !reflect.DeepEqual(prev, peer) {
+			set = append(set, peer)
+		}
+	}
+	for _, peer := range old.Peers {
+		if !kept[peer.PublicKey] {
+			removed = append(removed, peer.PublicKey)
+		}
+	}
+	return set, removed
+}
+
+// encodeEndpoint resolves host:port into the sockaddr_in/sockaddr_in6 the kernel expects
+func encodeEndpoint(endpoint string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addrs[0]
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		// struct sockaddr_in: family, port (network order), address, padding
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(port))
+		copy(b[4:8], ip4)
+		return b, nil
+	}
+
+	// struct sockaddr_in6: family, port (network order), flow info, address, scope id
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	copy(b[8:24], ip.To16())
+	return b, nil
+}
+
+// syncAddresses makes the link's addresses exactly the configured ones
+func syncAddresses(link netlink.Link, addresses []string) error {
+	wanted := map[string]bool{}
+	for _, address := range addresses {
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return err
+		}
+		wanted[addr.IPNet.String()] = true
+	}
+
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for i := range existing {
+		if !wanted[existing[i].IPNet.String()] {
+			if err := netlink.AddrDel(link, &existing[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseDeviceStats collects the peer counters from WG_CMD_GET_DEVICE replies. Large
+// devices are split over several messages, which may repeat a peer.
+func parseDeviceStats(msgs [][]byte) ([]PeerStats, error) {
+	stats := []PeerStats{}
+	index := map[string]int{}
+
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofGenlmsg {
+			return nil, fmt.Errorf("short generic netlink message")
+		}
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, attr := range attrs {
+			if attr.Attr.Type&nl.NLA_TYPE_MASK != unix.WGDEVICE_A_PEERS {
+				continue
+			}
+			peers, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, peerAttr := range peers {
+				peer, err := parsePeerStats(peerAttr.Value)
+				if err != nil {
+					return nil, err
+				}
+				if i, ok := index[peer.PublicKey]; ok {
+					stats[i] = peer
+					continue
+				}
+				index[peer.PublicKey] = len(stats)
+				stats = append(stats, peer)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// parsePeerStats reads the key, handshake time and transfer counters of a peer
+func parsePeerStats(b []byte) (PeerStats, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return PeerStats{}, err
+	}
+
+	var peer PeerStats
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nl.NLA_TYPE_MASK {
+		case unix.WGPEER_A_PUBLIC_KEY:
+			peer.PublicKey = base64.StdEncoding.EncodeToString(attr.Value)
+		case unix.WGPEER_A_LAST_HANDSHAKE_TIME:
+			// struct __kernel_timespec
+			if len(attr.Value) < 16 {
+				return PeerStats{}, fmt.Errorf("short handshake time")
+			}
+			sec := int64(binary.NativeEndian.Uint64(attr.Value[0:8]))
+			nsec := int64(binary.NativeEndian.Uint64(attr.Value[8:16]))
+			peer.LastHandshake = handshakeTime(sec, nsec)
+		case unix.WGPEER_A_RX_BYTES:
+			peer.ReceiveBytes = binary.NativeEndian.Uint64(attr.Value)
+		case unix.WGPEER_A_TX_BYTES:
+			peer.TransmitBytes = binary.NativeEndian.Uint64(attr.Value)
+		}
+	}
+	if peer.PublicKey == "" {
+		return PeerStats{}, fmt.Errorf("peer without public key")
+	}
+	return peer, nil
+}
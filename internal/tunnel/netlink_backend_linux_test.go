@@ -0,0 +1,174 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// parseAttrs parses serialized attributes keyed by type without the nested flag
+func parseAttrs(t *testing.T, b []byte) map[uint16][]byte {
+	attrs, err := nl.ParseRouteAttr(b)
+	assert.NoError(t, err)
+
+	parsed := map[uint16][]byte{}
+	for _, attr := range attrs {
+		parsed[attr.Attr.Type&nl.NLA_TYPE_MASK] = attr.Value
+	}
+	return parsed
+}
+
+func TestDeviceAttrs(t *testing.T) {
+	config := &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: testKey('a'),
+			ListenPort: 51820,
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:           testKey('b'),
+				Endpoint:            "203.0.113.1:51821",
+				AllowedIPs:          []string{"10.0.0.0/24"},
+				PersistentKeepalive: 25,
+			},
+		},
+	}
+
+	attrs, err := deviceAttrs("wg-test", config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, attrs, 5)
+
+	assert.Equal(t, uint16(unix.WGDEVICE_A_IFNAME), attrs[0].Type)
+	assert.Equal(t, nl.ZeroTerminated("wg-test"), attrs[0].Data)
+	assert.Equal(t, []byte(strings.Repeat("a", wgKeyLen)), attrs[1].Data)
+	assert.Equal(t, nl.Uint16Attr(51820), attrs[2].Data)
+	assert.Equal(t, nl.Uint32Attr(unix.WGDEVICE_F_REPLACE_PEERS), attrs[3].Data)
+	assert.Equal(t, uint16(unix.WGDEVICE_A_PEERS)|nl.NLA_F_NESTED, attrs[4].Type)
+
+	peers := parseAttrs(t, attrs[4].Serialize()[unix.SizeofRtAttr:])
+	assert.Len(t, peers, 1)
+	peer := parseAttrs(t, peers[0])
+	assert.Equal(t, []byte(strings.Repeat("b", wgKeyLen)), peer[unix.WGPEER_A_PUBLIC_KEY])
+	assert.Equal(t, nl.Uint32Attr(unix.WGPEER_F_REPLACE_ALLOWEDIPS), peer[unix.WGPEER_A_FLAGS])
+	assert.Equal(t, nl.Uint16Attr(25), peer[unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL])
+	assert.Len(t, peer[unix.WGPEER_A_ENDPOINT], unix.SizeofSockaddrInet4)
+
+	allowedIPs := parseAttrs(t, peer[unix.WGPEER_A_ALLOWEDIPS])
+	allowedIP := parseAttrs(t, allowedIPs[0])
+	assert.Equal(t, nl.Uint16Attr(unix.AF_INET), allowedIP[unix.WGALLOWEDIP_A_FAMILY])
+	assert.Equal(t, []byte{10, 0, 0, 0}, allowedIP[unix.WGALLOWEDIP_A_IPADDR])
+	assert.Equal(t, nl.Uint8Attr(24), allowedIP[unix.WGALLOWEDIP_A_CIDR_MASK])
+}
+
+func TestDeviceAttrsSync(t *testing.T) {
+	kept := PeerConfig{PublicKey: testKey('b'), AllowedIPs: []string{"10.0.0.0/24"}}
+	changed := PeerConfig{PublicKey: testKey('c'), AllowedIPs: []string{"10.1.0.0/24"}}
+	dropped := PeerConfig{PublicKey: testKey('d'), AllowedIPs: []string{"10.2.0.0/24"}}
+	added := PeerConfig{PublicKey: testKey('e'), AllowedIPs: []string{"10.3.0.0/24"}}
+
+	old := &Config{
+		Interface: InterfaceConfig{PrivateKey: testKey('a')},
+		Peers:     []PeerConfig{kept, changed, dropped},
+	}
+	changed.AllowedIPs = []string{"10.1.0.0/16"}
+	config := &Config{
+		Interface: InterfaceConfig{PrivateKey: testKey('a')},
+		Peers:     []PeerConfig{kept, changed, added},
+	}
+
+	// Peers are not replaced, so the kept peer's session survives
+	attrs, err := deviceAttrs("wg-test", config, old)
+	assert.NoError(t, err)
+	assert.Len(t, attrs, 4)
+	assert.Equal(t, uint16(unix.WGDEVICE_A_PEERS)|nl.NLA_F_NESTED, attrs[3].Type)
+
+	peers, err := nl.ParseRouteAttr(attrs[3].Serialize()[unix.SizeofRtAttr:])
+	assert.NoError(t, err)
+	assert.Len(t, peers, 3)
+	keys := []string{}
+	flags := [][]byte{}
+	for _, peerAttr := range peers {
+		peer := parseAttrs(t, peerAttr.Value)
+		keys = append(keys, string(peer[unix.WGPEER_A_PUBLIC_KEY][:1]))
+		flags = append(flags, peer[unix.WGPEER_A_FLAGS])
+	}
+	assert.Equal(t, []string{"c", "e", "d"}, keys)
+	assert.Equal(t, nl.Uint32Attr(unix.WGPEER_F_REPLACE_ALLOWEDIPS), flags[0])
+	assert.Equal(t, nl.Uint32Attr(unix.WGPEER_F_REPLACE_ALLOWEDIPS), flags[1])
+	assert.Equal(t, nl.Uint32Attr(unix.WGPEER_F_REMOVE_ME), flags[2])
+
+	// Nothing to change leaves the peers alone
+	attrs, err = deviceAttrs("wg-test", config, config)
+	assert.NoError(t, err)
+	assert.Len(t, attrs, 3)
+}
+
+func TestDeviceAttrsInvalid(t *testing.T) {
+	_, err := deviceAttrs("wg-test", &Config{Interface: InterfaceConfig{PrivateKey: "short"}}, nil)
+	assert.Error(t, err)
+
+	_, err = deviceAttrs("wg-test", &Config{
+		Interface: InterfaceConfig{PrivateKey: testKey('a')},
+		Peers:     []PeerConfig{{PublicKey: testKey('b'), AllowedIPs: []string{"10.0.0.300/24"}}},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestEncodeEndpoint(t *testing.T) {
+	b, err := encodeEndpoint("203.0.113.1:51820")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(unix.AF_INET), binary.NativeEndian.Uint16(b[0:2]))
+	assert.Equal(t, uint16(51820), binary.BigEndian.Uint16(b[2:4]))
+	assert.Equal(t, []byte{203, 0, 113, 1}, b[4:8])
+
+	b, err = encodeEndpoint("[2001:db8::1]:51820")
+	assert.NoError(t, err)
+	assert.Len(t, b, unix.SizeofSockaddrInet6)
+	assert.Equal(t, uint16(unix.AF_INET6), binary.NativeEndian.Uint16(b[0:2]))
+
+	_, err = encodeEndpoint("203.0.113.1")
+	assert.Error(t, err)
+	_, err = encodeEndpoint("203.0.113.1:99999")
+	assert.Error(t, err)
+}
+
+func TestParseDeviceStats(t *testing.T) {
+	timespec := make([]byte, 16)
+	binary.NativeEndian.PutUint64(timespec[0:8], 1717243200)
+	binary.NativeEndian.PutUint64(timespec[8:16], 500)
+
+	message := func(peers ...*nl.RtAttr) []byte {
+		attr := nl.NewRtAttr(unix.WGDEVICE_A_PEERS|int(nl.NLA_F_NESTED), nil)
+		for _, peer := range peers {
+			attr.AddChild(peer)
+		}
+		genl := &nl.Genlmsg{Command: unix.WG_CMD_GET_DEVICE, Version: wgGenlVersion}
+		return append(genl.Serialize(), attr.Serialize()...)
+	}
+	peer := func(key byte, rx uint64) *nl.RtAttr {
+		attr := nl.NewRtAttr(int(nl.NLA_F_NESTED), nil)
+		attr.AddRtAttr(unix.WGPEER_A_PUBLIC_KEY, []byte(strings.Repeat(string(key), wgKeyLen)))
+		attr.AddRtAttr(unix.WGPEER_A_LAST_HANDSHAKE_TIME, timespec)
+		attr.AddRtAttr(unix.WGPEER_A_RX_BYTES, nl.Uint64Attr(rx))
+		attr.AddRtAttr(unix.WGPEER_A_TX_BYTES, nl.Uint64Attr(2048))
+		return attr
+	}
+
+	// A peer repeated in a later message is only reported once
+	stats, err := parseDeviceStats([][]byte{message(peer('b', 1024)), message(peer('b', 1024), peer('c', 10))})
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerStats{
+		{PublicKey: testKey('b'), LastHandshake: time.Unix(1717243200, 500), ReceiveBytes: 1024, TransmitBytes: 2048},
+		{PublicKey: testKey('c'), LastHandshake: time.Unix(1717243200, 500), ReceiveBytes: 10, TransmitBytes: 2048},
+	}, stats)
+
+	_, err = parseDeviceStats([][]byte{{1}})
+	assert.Error(t, err)
+}
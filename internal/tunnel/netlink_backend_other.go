@@ -0,0 +1,33 @@
+//go:build !linux
+
+package tunnel
+
+import "context"
+
+// NetlinkBackend is only available on Linux
+type NetlinkBackend struct{}
+
+// NewNetlinkBackend always fails outside of Linux
+func NewNetlinkBackend() (*NetlinkBackend, error) {
+	return nil, ErrWireGuardUnsupported
+}
+
+// Up always fails outside of Linux
+func (b *NetlinkBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	return ErrWireGuardUnsupported
+}
+
+// Down always fails outside of Linux
+func (b *NetlinkBackend) Down(ctx context.Context, name string) error {
+	return ErrWireGuardUnsupported
+}
+
+// Sync always fails outside of Linux
+func (b *NetlinkBackend) Sync(ctx context.Context, name string, old, new *TunnelConfig) error {
+	return ErrWireGuardUnsupported
+}
+
+// Stats always fails outside of Linux
+func (b *NetlinkBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	return nil, ErrWireGuardUnsupported
+}
@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TransportWireGuard runs tunnels from a wg-quick config. Tunnels that name no
+// transport use it.
+const TransportWireGuard = "wireguard"
+
+// ErrUnknownTransport is returned for tunnels whose transport has no registered backend
+var ErrUnknownTransport = errors.New("unknown tunnel transport")
+
+// Registry maps the transports a tunnel server may provision to the backends running them
+type Registry struct {
+	mu       sync.RWMutex
+	backends map[string]Backend
+}
+
+// NewRegistry creates an empty backend registry
+func NewRegistry() *Registry {
+	return &Registry{
+		backends: make(map[string]Backend),
+	}
+}
+
+// Register adds the backend running a transport
+func (r *Registry) Register(transport string, backend Backend) error {
+	if transport == "" {
+		return fmt.Errorf("transport name must not be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.backends[transport]; exists {
+		return fmt.Errorf("transport %s is already registered", transport)
+	}
+	r.backends[transport] = backend
+	return nil
+}
+
+// Backend returns the backend running a transport; "" means TransportWireGuard
+func (r *Registry) Backend(transport string) (Backend, error) {
+	if transport == "" {
+		transport = TransportWireGuard
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	backend, ok := r.backends[transport]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTransport, transport)
+	}
+	return backend, nil
+}
+
+// Transports returns the registered transports in name order
+func (r *Registry) Transports() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	transports := make([]string, 0, len(r.backends))
+	for transport := range r.backends {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	return transports
+}
+
+// monitored reports whether any registered backend can read peer counters
+func (r *Registry) monitored() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, backend := range r.backends {
+		if _, ok := backend.(StatsBackend); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// transportOf returns the transport a tunnel config asks for
+func transportOf(config *TunnelConfig) string {
+	if config.Transport == "" {
+		return TransportWireGuard
+	}
+	return config.Transport
+}
@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	wireguard := &fakeBackend{up: map[string]string{}}
+	other := &fakeBackend{up: map[string]string{}}
+
+	assert.NoError(t, registry.Register(TransportWireGuard, wireguard))
+	assert.NoError(t, registry.Register("other", other))
+	assert.Error(t, registry.Register("other", other))
+	assert.Error(t, registry.Register("", other))
+	assert.Equal(t, []string{"other", TransportWireGuard}, registry.Transports())
+
+	// No transport means WireGuard
+	backend, err := registry.Backend("")
+	assert.NoError(t, err)
+	assert.Same(t, wireguard, backend)
+	backend, err = registry.Backend("other")
+	assert.NoError(t, err)
+	assert.Same(t, other, backend)
+
+	_, err = registry.Backend("carrier-pigeon")
+	assert.ErrorIs(t, err, ErrUnknownTransport)
+}
+
+func TestTunnelManagerTransports(t *testing.T) {
+	ctx := context.Background()
+	wireguard := &fakeBackend{up: map[string]string{}}
+	other := &fakeBackend{up: map[string]string{}}
+	registry := NewRegistry()
+	registry.Register(TransportWireGuard, wireguard)
+	registry.Register("other", other)
+	manager := NewManagerWithRegistry(registry)
+
+	// Each tunnel runs on the backend of its transport
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "t2", Transport: "other", WGConfig: "opaque"}))
+	assert.Equal(t, map[string]string{"wg-t1": testTunnelConfig("10.0.0.2/32")}, wireguard.up)
+	assert.Equal(t, map[string]string{"wg-t2": "opaque"}, other.up)
+
+	err := manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "t3", Transport: "carrier-pigeon"})
+	assert.ErrorIs(t, err, ErrUnknownTransport)
+	_, err = manager.GetTunnel("t3")
+	assert.Error(t, err)
+
+	// A tunnel moving to another transport is restarted on the new backend
+	mode, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", Transport: "other", WGConfig: "opaque"})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+	assert.Empty(t, wireguard.up)
+	assert.Equal(t, map[string]string{"wg-t1": "opaque", "wg-t2": "opaque"}, other.up)
+
+	_, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", Transport: "carrier-pigeon"})
+	assert.ErrorIs(t, err, ErrUnknownTransport)
+	assert.Equal(t, []string{"other", TransportWireGuard}, manager.Transports())
+}
@@ -0,0 +1,315 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipLinkExists is what ip prints when an interface of the name is already there
+const ipLinkExists = "File exists"
+
+// SharedInterface is a single WireGuard interface carrying every tunnel to one server.
+// Each tunnel contributes addresses, peers and allowed IPs; changes are applied with
+// `wg set` and `ip` so traffic of other tunnels on the interface is not disturbed.
+type SharedInterface struct {
+	name       string
+	privateKey string
+	tunnels    map[string]*Config
+}
+
+// newSharedInterface creates an interface that is brought up with its first tunnel
+func newSharedInterface(name string) *SharedInterface {
+	return &SharedInterface{
+		name:    name,
+		tunnels: make(map[string]*Config),
+	}
+}
+
+// Name returns the network interface name
+func (s *SharedInterface) Name() string {
+	return s.name
+}
+
+// TunnelIDs returns the IDs of the tunnels on this interface
+func (s *SharedInterface) TunnelIDs() []string {
+	ids := make([]string, 0, len(s.tunnels))
+	for id := range s.tunnels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// apply adds or replaces a tunnel's addresses and peers on the interface
+func (s *SharedInterface) apply(ctx context.Context, tunnelID string, config *Config) error {
+	if len(s.tunnels) == 0 {
+		if err := s.create(ctx, config); err != nil {
+			return err
+		}
+	} else if config.Interface.PrivateKey != s.privateKey {
+		return fmt.Errorf("tunnel %s uses a different private key than interface %s", tunnelID, s.name)
+	}
+
+	old := s.tunnels[tunnelID]
+	s.tunnels[tunnelID] = config
+	if err := s.sync(ctx, old, config); err != nil {
+		if old != nil {
+			s.tunnels[tunnelID] = old
+		} else {
+			delete(s.tunnels, tunnelID)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove takes a tunnel's addresses and peers off the interface, deleting the
+// interface once no tunnels are left
+func (s *SharedInterface) remove(ctx context.Context, tunnelID string) error {
+	old, ok := s.tunnels[tunnelID]
+	if !ok {
+		return fmt.Errorf("tunnel %s not found on interface %s", tunnelID, s.name)
+	}
+
+	delete(s.tunnels, tunnelID)
+	if len(s.tunnels) == 0 {
+		return runCommand(ctx, "ip", "link", "del", "dev", s.name)
+	}
+
+	if err := s.sync(ctx, old, nil); err != nil {
+		s.tunnels[tunnelID] = old
+		return err
+	}
+	return nil
+}
+
+// create brings the interface up with the private key, listen port and MTU of its
+// first tunnel. An interface left behind, for example by a previous controller, is
+// deleted and created anew; its tunnels are added again as they are reconciled.
+func (s *SharedInterface) create(ctx context.Context, config *Config) error {
+	err := runCommand(ctx, "ip", "link", "add", "dev", s.name, "type", "wireguard")
+	if err != nil && strings.Contains(err.Error(), ipLinkExists) {
+		if err := runCommand(ctx, "ip", "link", "del", "dev", s.name); err != nil {
+			return err
+		}
+		err = runCommand(ctx, "ip", "link", "add", "dev", s.name, "type", "wireguard")
+	}
+	if err != nil {
+		return err
+	}
+
+	keyFile, err := writeSecretFile(config.Interface.PrivateKey)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyFile)
+
+	args := []string{"set", s.name, "private-key", keyFile}
+	if config.Interface.ListenPort != 0 {
+		args = append(args, "listen-port", strconv.Itoa(config.Interface.ListenPort))
+	}
+	if err := runCommand(ctx, "wg", args...); err != nil {
+		return err
+	}
+
+	if config.Interface.MTU != 0 {
+		if err := runCommand(ctx, "ip", "link", "set", "mtu", strconv.Itoa(config.Interface.MTU), "dev", s.name); err != nil {
+			return err
+		}
+	}
+
+	if err := runCommand(ctx, "ip", "link", "set", "up", "dev", s.name); err != nil {
+		return err
+	}
+
+	s.privateKey = config.Interface.PrivateKey
+	return nil
+}
+
+// sync reconciles the interface after a tunnel changed from old to new (either may be nil)
+func (s *SharedInterface) sync(ctx context.Context, old, new *Config) error {
+	// Addresses: add what is now wanted, drop what no tunnel uses anymore
+	wantedAddrs := s.addresses()
+	if new != nil {
+		for _, addr := range new.Interface.Addresses {
+			if old == nil || !contains(old.Interface.Addresses, addr) {
+				if err := runCommand(ctx, "ip", "address", "replace", addr, "dev", s.name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if old != nil {
+		for _, addr := range old.Interface.Addresses {
+			if !wantedAddrs[addr] {
+				if err := runCommand(ctx, "ip", "address", "del", addr, "dev", s.name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Peers: a server appears as the same peer for every tunnel, so each affected
+	// peer is rewritten with the union of allowed IPs of all tunnels using it
+	affected := map[string]bool{}
+	for _, config := range []*Config{old, new} {
+		if config == nil {
+			continue
+		}
+		for _, peer := range config.Peers {
+			affected[peer.PublicKey] = true
+		}
+	}
+	publicKeys := make([]string, 0, len(affected))
+	for key := range affected {
+		publicKeys = append(publicKeys, key)
+	}
+	sort.Strings(publicKeys)
+
+	for _, key := range publicKeys {
+		if err := s.syncPeer(ctx, key, new); err != nil {
+			return err
+		}
+	}
+
+	// Routes follow the allowed IPs
+	wantedRoutes := s.routes()
+	if new != nil {
+		for _, peer := range new.Peers {
+			for _, cidr := range peer.AllowedIPs {
+				if isDefaultRoute(cidr) {
+					continue
+				}
+				if err := runCommand(ctx, "ip", "route", "replace", cidr, "dev", s.name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if old != nil {
+		for _, peer := range old.Peers {
+			for _, cidr := range peer.AllowedIPs {
+				if isDefaultRoute(cidr) || wantedRoutes[cidr] {
+					continue
+				}
+				if err := runCommand(ctx, "ip", "route", "del", cidr, "dev", s.name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// syncPeer programs a single peer from the current set of tunnels. Endpoint,
+// keepalive and preshared key are taken from preferred when it has the peer.
+func (s *SharedInterface) syncPeer(ctx context.Context, publicKey string, preferred *Config) error {
+	var settings *PeerConfig
+	allowedIPs := []string{}
+	seen := map[string]bool{}
+
+	for _, id := range s.TunnelIDs() {
+		for i, peer := range s.tunnels[id].Peers {
+			if peer.PublicKey != publicKey {
+				continue
+			}
+			if settings == nil || s.tunnels[id] == preferred {
+				settings = &s.tunnels[id].Peers[i]
+			}
+			for _, cidr := range peer.AllowedIPs {
+				if !seen[cidr] {
+					seen[cidr] = true
+					allowedIPs = append(allowedIPs, cidr)
+				}
+			}
+		}
+	}
+
+	if settings == nil {
+		return runCommand(ctx, "wg", "set", s.name, "peer", publicKey, "remove")
+	}
+
+	args := []string{"set", s.name, "peer", publicKey, "allowed-ips", strings.Join(allowedIPs, ",")}
+	if settings.Endpoint != "" {
+		args = append(args, "endpoint", settings.Endpoint)
+	}
+	if settings.PersistentKeepalive != 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(settings.PersistentKeepalive))
+	}
+	if settings.PresharedKey != "" {
+		pskFile, err := writeSecretFile(settings.PresharedKey)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(pskFile)
+		args = append(args, "preshared-key", pskFile)
+	}
+	return runCommand(ctx, "wg", args...)
+}
+
+// addresses returns every interface address used by the current tunnels
+func (s *SharedInterface) addresses() map[string]bool {
+	addrs := map[string]bool{}
+	for _, config := range s.tunnels {
+		for _, addr := range config.Interface.Addresses {
+			addrs[addr] = true
+		}
+	}
+	return addrs
+}
+
+// routes returns every allowed IP routed through the interface by the current tunnels
+func (s *SharedInterface) routes() map[string]bool {
+	routes := map[string]bool{}
+	for _, config := range s.tunnels {
+		for _, peer := range config.Peers {
+			for _, cidr := range peer.AllowedIPs {
+				routes[cidr] = true
+			}
+		}
+	}
+	return routes
+}
+
+// isDefaultRoute reports whether a CIDR would replace the default route, which a
+// shared interface must never do
+func isDefaultRoute(cidr string) bool {
+	return cidr == "0.0.0.0/0" || cidr == "::/0"
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSecretFile writes a key to a private temporary file for `wg set`
+func writeSecretFile(secret string) (string, error) {
+	f, err := os.CreateTemp("", "wg-key-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(secret); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write key file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// runCommand runs a command to completion, killing it when it takes longer than
+// wgQuickTimeout or ctx is done. Errors include what it wrote to stderr.
+func runCommand(ctx context.Context, name string, args ...string) error {
+	if _, err := timedOutput(ctx, wgQuickTimeout, name, args...); err != nil {
+		return fmt.Errorf("%s %s failed: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
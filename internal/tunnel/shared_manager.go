@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// defaultSharedServer is used for tunnels that do not name their server
+const defaultSharedServer = "default"
+
+// SharedManager runs every tunnel to a server as a peer on one WireGuard
+// interface per server instead of one interface per tunnel
+type SharedManager struct {
+	mu         sync.Mutex
+	interfaces map[string]*SharedInterface
+	servers    map[string]string
+	names      *interfaceNames
+	policy     ConfigPolicy
+}
+
+// NewSharedManager creates a new shared interface tunnel manager
+func NewSharedManager() *SharedManager {
+	return &SharedManager{
+		interfaces: make(map[string]*SharedInterface),
+		servers:    make(map[string]string),
+		names:      newInterfaceNames(sharedInterfacePrefix),
+	}
+}
+
+// SetConfigPolicy sets what happens to script hooks and DNS settings in tunnel
+// configs; they are stripped by default
+func (m *SharedManager) SetConfigPolicy(policy ConfigPolicy) {
+	m.policy = policy
+}
+
+// CreateTunnel adds a tunnel to its server's shared interface, creating the interface if needed
+func (m *SharedManager) CreateTunnel(ctx context.Context, config *TunnelConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.servers[config.TunnelID]; exists {
+		return fmt.Errorf("tunnel %s already exists", config.TunnelID)
+	}
+
+	// Shared interfaces only carry WireGuard peers
+	if transportOf(config) != TransportWireGuard {
+		return fmt.Errorf("failed to create tunnel: %w %q in shared mode", ErrUnknownTransport, config.Transport)
+	}
+
+	parsed, err := LoadConfig(config.WGConfig, m.policy)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel config: %w", err)
+	}
+
+	server := config.Server
+	if server == "" {
+		server = defaultSharedServer
+	}
+
+	iface, exists := m.interfaces[server]
+	if !exists {
+		iface = newSharedInterface(m.names.assign(server))
+	}
+
+	if err := iface.apply(ctx, config.TunnelID, parsed); err != nil {
+		if !exists {
+			m.names.release(server)
+		}
+		return fmt.Errorf("failed to add tunnel to %s: %w", iface.Name(), err)
+	}
+
+	m.interfaces[server] = iface
+	m.servers[config.TunnelID] = server
+	return nil
+}
+
+// UpdateTunnel replaces a tunnel's peers and addresses on its shared interface
+func (m *SharedManager) UpdateTunnel(ctx context.Context, config *TunnelConfig) (UpdateMode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server, exists := m.servers[config.TunnelID]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrTunnelNotFound, config.TunnelID)
+	}
+	if transportOf(config) != TransportWireGuard {
+		return "", fmt.Errorf("failed to update tunnel: %w %q in shared mode", ErrUnknownTransport, config.Transport)
+	}
+
+	parsed, err := LoadConfig(config.WGConfig, m.policy)
+	if err != nil {
+		return "", fmt.Errorf("invalid tunnel config: %w", err)
+	}
+
+	// Shared interfaces are never restarted for a single tunnel
+	iface := m.interfaces[server]
+	if err := iface.apply(ctx, config.TunnelID, parsed); err != nil {
+		return "", fmt.Errorf("failed to update tunnel on %s: %w", iface.Name(), err)
+	}
+
+	return UpdateInPlace, nil
+}
+
+// DeleteTunnel removes a tunnel from its shared interface, deleting the
+// interface along with its last tunnel
+func (m *SharedManager) DeleteTunnel(ctx context.Context, tunnelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server, exists := m.servers[tunnelID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelID)
+	}
+
+	iface := m.interfaces[server]
+	if err := iface.remove(ctx, tunnelID); err != nil {
+		return fmt.Errorf("failed to remove tunnel from %s: %w", iface.Name(), err)
+	}
+
+	delete(m.servers, tunnelID)
+	if len(iface.tunnels) == 0 {
+		delete(m.interfaces, server)
+		m.names.release(server)
+	}
+	return nil
+}
+
+// Transports returns the transports shared interfaces carry, which is only WireGuard
+func (m *SharedManager) Transports() []string {
+	return []string{TransportWireGuard}
+}
+
+// ListInterfaces returns the tunnel IDs carried by each shared interface, keyed by interface name
+func (m *SharedManager) ListInterfaces() map[string][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	interfaces := make(map[string][]string, len(m.interfaces))
+	for _, iface := range m.interfaces {
+		interfaces[iface.Name()] = iface.TunnelIDs()
+	}
+	return interfaces
+}
+
+// TunnelInterface returns the name of the shared interface carrying a tunnel
+func (m *SharedManager) TunnelInterface(tunnelID string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server, ok := m.servers[tunnelID]
+	if !ok {
+		return "", false
+	}
+	name, ok := m.names.byID[server]
+	return name, ok
+}
+
+// InterfaceNames returns the shared interface name of every server, keyed by server name
+func (m *SharedManager) InterfaceNames() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.names.mapping()
+}
@@ -0,0 +1,216 @@
+package tunnel
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordCommands mocks exec.Command and records every command line run
+func recordCommands(t *testing.T) *[]string {
+	commands := []string{}
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		commands = append(commands, strings.Join(append([]string{command}, args...), " "))
+		return mockCmd(command, args...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+	return &commands
+}
+
+func sharedTestConfig(address, allowedIPs string) string {
+	return `[Interface]
+PrivateKey = ` + testKey('c') + `
+Address = ` + address + `
+
+[Peer]
+PublicKey = ` + testKey('s') + `
+Endpoint = 203.0.113.1:51820
+AllowedIPs = ` + allowedIPs + `
+PersistentKeepalive = 25
+`
+}
+
+func TestSharedManager(t *testing.T) {
+	commands := recordCommands(t)
+	ctx := context.Background()
+	manager := NewSharedManager()
+
+	// The first tunnel creates the interface
+	err := manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ip link add dev wgs-eu type wireguard", (*commands)[0])
+	assert.True(t, strings.HasPrefix((*commands)[1], "wg set wgs-eu private-key "))
+	assert.Equal(t, []string{
+		"ip link set up dev wgs-eu",
+		"ip address replace 10.0.0.2/32 dev wgs-eu",
+		"wg set wgs-eu peer "+testKey('s')+" allowed-ips 10.1.0.0/24 endpoint 203.0.113.1:51820 persistent-keepalive 25",
+		"ip route replace 10.1.0.0/24 dev wgs-eu",
+	}, (*commands)[2:])
+
+	// The second tunnel only extends the existing peer
+	*commands = (*commands)[:0]
+	err = manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t2",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.3/32", "10.2.0.0/24"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"ip address replace 10.0.0.3/32 dev wgs-eu",
+		"wg set wgs-eu peer "+testKey('s')+" allowed-ips 10.1.0.0/24,10.2.0.0/24 endpoint 203.0.113.1:51820 persistent-keepalive 25",
+		"ip route replace 10.2.0.0/24 dev wgs-eu",
+	}, *commands)
+	assert.Equal(t, map[string][]string{"wgs-eu": {"t1", "t2"}}, manager.ListInterfaces())
+
+	// Removing a tunnel leaves the other one in place
+	*commands = (*commands)[:0]
+	err = manager.DeleteTunnel(ctx, "t1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"ip address del 10.0.0.2/32 dev wgs-eu",
+		"wg set wgs-eu peer "+testKey('s')+" allowed-ips 10.2.0.0/24 endpoint 203.0.113.1:51820 persistent-keepalive 25",
+		"ip route del 10.1.0.0/24 dev wgs-eu",
+	}, *commands)
+
+	// The last tunnel takes the interface with it
+	*commands = (*commands)[:0]
+	err = manager.DeleteTunnel(ctx, "t2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ip link del dev wgs-eu"}, *commands)
+	assert.Empty(t, manager.ListInterfaces())
+}
+
+func TestSharedManagerSeparateServers(t *testing.T) {
+	recordCommands(t)
+	ctx := context.Background()
+	manager := NewSharedManager()
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"),
+	}))
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t2",
+		WGConfig: sharedTestConfig("10.0.0.3/32", "10.2.0.0/24"),
+	}))
+
+	assert.Equal(t, map[string][]string{
+		"wgs-eu":      {"t1"},
+		"wgs-default": {"t2"},
+	}, manager.ListInterfaces())
+
+	// Long server names get shortened interface names
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t3",
+		Server:   "europe-west-frankfurt",
+		WGConfig: sharedTestConfig("10.0.0.4/32", "10.3.0.0/24"),
+	}))
+	names := manager.InterfaceNames()
+	assert.Equal(t, "wgs-default", names["default"])
+	assert.LessOrEqual(t, len(names["europe-west-frankfurt"]), maxInterfaceNameLen)
+	assert.Equal(t, []string{"t3"}, manager.ListInterfaces()[names["europe-west-frankfurt"]])
+
+	name, ok := manager.TunnelInterface("t3")
+	assert.True(t, ok)
+	assert.Equal(t, names["europe-west-frankfurt"], name)
+	_, ok = manager.TunnelInterface("missing")
+	assert.False(t, ok)
+}
+
+func TestSharedManagerTuning(t *testing.T) {
+	commands := recordCommands(t)
+	manager := NewSharedManager()
+
+	// The first tunnel's MTU and listen port apply to the whole interface
+	config := strings.Replace(sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"), "[Peer]", "ListenPort = 51821\nMTU = 1380\n\n[Peer]", 1)
+	assert.NoError(t, manager.CreateTunnel(context.Background(), &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: config,
+	}))
+	assert.True(t, strings.HasSuffix((*commands)[1], " listen-port 51821"))
+	assert.Equal(t, "ip link set mtu 1380 dev wgs-eu", (*commands)[2])
+	assert.Equal(t, "ip link set up dev wgs-eu", (*commands)[3])
+}
+
+func TestSharedManagerErrors(t *testing.T) {
+	recordCommands(t)
+	ctx := context.Background()
+	manager := NewSharedManager()
+
+	// Unknown tunnels
+	_, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "non-existent"})
+	assert.ErrorIs(t, err, ErrTunnelNotFound)
+	assert.ErrorIs(t, manager.DeleteTunnel(ctx, "non-existent"), ErrTunnelNotFound)
+
+	// Unparseable config
+	assert.Error(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: "garbage"}))
+
+	config := &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"),
+	}
+	assert.NoError(t, manager.CreateTunnel(ctx, config))
+	assert.Error(t, manager.CreateTunnel(ctx, config))
+
+	// A tunnel cannot bring its own private key to a shared interface
+	err = manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t2",
+		Server:   "eu",
+		WGConfig: strings.Replace(sharedTestConfig("10.0.0.3/32", "10.2.0.0/24"), testKey('c'), testKey('o'), 1),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, map[string][]string{"wgs-eu": {"t1"}}, manager.ListInterfaces())
+}
+
+func TestSharedManagerReplacesLeftoverInterface(t *testing.T) {
+	added := false
+	commands := scriptCommands(t, func(commandLine string) helperResult {
+		if commandLine == "ip link add dev wgs-eu type wireguard" && !added {
+			added = true
+			return helperResult{stderr: "RTNETLINK answers: File exists", exit: 2}
+		}
+		return helperResult{}
+	})
+	manager := NewSharedManager()
+
+	// The interface of a previous controller is deleted before it is created again
+	err := manager.CreateTunnel(context.Background(), &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"ip link add dev wgs-eu type wireguard",
+		"ip link del dev wgs-eu",
+		"ip link add dev wgs-eu type wireguard",
+	}, (*commands)[:3])
+}
+
+func TestSharedManagerCommandTimeout(t *testing.T) {
+	scriptCommands(t, func(string) helperResult { return helperResult{sleep: time.Minute} })
+	manager := NewSharedManager()
+
+	// A hanging command is killed once ctx is done rather than holding the manager
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := manager.CreateTunnel(ctx, &TunnelConfig{
+		TunnelID: "t1",
+		Server:   "eu",
+		WGConfig: sharedTestConfig("10.0.0.2/32", "10.1.0.0/24"),
+	})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
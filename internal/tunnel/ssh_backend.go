@@ -0,0 +1,331 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TransportSSH runs tunnels as SSH remote port forwards from the tunnel server,
+// for sites where UDP is blocked and WireGuard cannot connect
+const TransportSSH = "ssh"
+
+// Defaults of the SSH backend
+const (
+	// sshConnectTimeout bounds dialing, the handshake and setting up the forwards
+	sshConnectTimeout = 15 * time.Second
+	// sshKeepaliveInterval is how often an idle connection is checked
+	sshKeepaliveInterval = 30 * time.Second
+	// sshMinBackoff and sshMaxBackoff bound the wait between reconnects
+	sshMinBackoff = time.Second
+	sshMaxBackoff = time.Minute
+	// sshDefaultBindAddress makes forwards listen on every address of the server
+	sshDefaultBindAddress = "0.0.0.0"
+)
+
+// SSHConfig describes the server end of an SSH tunnel
+type SSHConfig struct {
+	// Endpoint is the host:port of the server's SSH daemon
+	Endpoint string
+	// User is the account the tunnel logs in as
+	User string
+	// HostKey is the server's public host key in authorized_keys format
+	HostKey string
+	// PrivateKey is the tunnel's private key, from which SSHSigner derives the SSH key
+	PrivateKey string
+	// BindAddress is the server address the forwards listen on; empty means all
+	BindAddress string
+	// Forwards map server ports to Service ports; empty forwards every port of the
+	// tunnel from the same server port
+	Forwards []SSHForward
+}
+
+// SSHForward is one remote port forward of an SSH tunnel
+type SSHForward struct {
+	// RemotePort is the port the server listens on
+	RemotePort int
+	// Port is the Service port connections are proxied to
+	Port int
+}
+
+// SSHBackend keeps an SSH connection to the tunnel server per tunnel and serves a
+// tcpip-forward remote port forward for every Service port over it. Connections
+// the server forwards are proxied to the Service; lost connections are
+// re-established with exponential backoff until the tunnel goes down.
+type SSHBackend struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	connectTimeout time.Duration
+	keepalive      time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*sshSession
+}
+
+// sshSession is the SSH connection of one tunnel, kept open until it goes down
+type sshSession struct {
+	backend  *SSHBackend
+	config   *TunnelConfig
+	client   *ssh.ClientConfig
+	forwards []SSHForward
+	traffic  trafficCounter
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSSHBackend creates an SSH tunnel backend
+func NewSSHBackend() *SSHBackend {
+	dialer := &net.Dialer{}
+	return &SSHBackend{
+		dial:           dialer.DialContext,
+		connectTimeout: sshConnectTimeout,
+		keepalive:      sshKeepaliveInterval,
+		minBackoff:     sshMinBackoff,
+		maxBackoff:     sshMaxBackoff,
+		sessions:       make(map[string]*sshSession),
+	}
+}
+
+// Up connects to the server and sets up the tunnel's forwards, replacing any
+// running connection with a different config. Later connection losses are
+// retried in the background.
+func (b *SSHBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	session, err := b.newSession(config)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	b.mu.Lock()
+	running, ok := b.sessions[name]
+	b.mu.Unlock()
+	if ok && sameTunnelConfig(running.config, config) {
+		return nil
+	}
+	if err := b.Down(ctx, name); err != nil {
+		return err
+	}
+
+	client, listeners, err := session.connect(ctx)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "connect", Err: err}
+	}
+
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	session.cancel = cancel
+	session.done = make(chan struct{})
+	go session.run(sessionCtx, client, listeners)
+
+	b.mu.Lock()
+	b.sessions[name] = session
+	b.mu.Unlock()
+	return nil
+}
+
+// Down closes the tunnel's connection and stops reconnecting
+func (b *SSHBackend) Down(ctx context.Context, name string) error {
+	b.mu.Lock()
+	session, ok := b.sessions[name]
+	delete(b.sessions, name)
+	b.mu.Unlock()
+
+	if ok {
+		session.cancel()
+		<-session.done
+	}
+	return nil
+}
+
+// newSession validates a tunnel's SSH config and prepares its connection settings
+func (b *SSHBackend) newSession(config *TunnelConfig) (*sshSession, error) {
+	settings := config.SSH
+	if settings == nil {
+		return nil, errors.New("ssh settings are missing")
+	}
+	if settings.Endpoint == "" || settings.User == "" {
+		return nil, errors.New("ssh endpoint and user are required")
+	}
+	if _, _, err := net.SplitHostPort(settings.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid ssh endpoint: %w", err)
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(settings.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %w", err)
+	}
+	signer, err := SSHSigner(settings.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	forwards := settings.Forwards
+	if len(forwards) == 0 {
+		for _, port := range config.Ports {
+			forwards = append(forwards, SSHForward{RemotePort: port, Port: port})
+		}
+	}
+	if len(forwards) == 0 {
+		return nil, errors.New("tunnel has no ports to forward")
+	}
+	for _, forward := range forwards {
+		if forward.RemotePort < 1 || forward.RemotePort > 65535 || forward.Port < 1 || forward.Port > 65535 {
+			return nil, fmt.Errorf("invalid forward %d -> %d", forward.RemotePort, forward.Port)
+		}
+	}
+
+	return &sshSession{
+		backend: b,
+		config:  config,
+		client: &ssh.ClientConfig{
+			User:            settings.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+		},
+		forwards: forwards,
+	}, nil
+}
+
+// connect opens the SSH connection and asks the server to listen on every forwarded port
+func (s *sshSession) connect(ctx context.Context) (*ssh.Client, []net.Listener, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.backend.connectTimeout)
+	defer cancel()
+
+	endpoint := s.config.SSH.Endpoint
+	conn, err := s.backend.dial(ctx, "tcp", endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The handshake and forward requests have no context of their own
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, endpoint, s.client)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	client := ssh.NewClient(clientConn, channels, requests)
+
+	bindAddress := s.config.SSH.BindAddress
+	if bindAddress == "" {
+		bindAddress = sshDefaultBindAddress
+	}
+
+	listeners := make([]net.Listener, 0, len(s.forwards))
+	for _, forward := range s.forwards {
+		listener, err := client.Listen("tcp", net.JoinHostPort(bindAddress, strconv.Itoa(forward.RemotePort)))
+		if err != nil {
+			client.Close()
+			return nil, nil, fmt.Errorf("failed to forward server port %d: %w", forward.RemotePort, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return client, listeners, nil
+}
+
+// run serves the connection and reconnects whenever it is lost, until ctx is done
+func (s *sshSession) run(ctx context.Context, client *ssh.Client, listeners []net.Listener) {
+	defer close(s.done)
+
+	for {
+		s.serve(ctx, client, listeners)
+
+		reconnected := reconnect(ctx, s.backend.minBackoff, s.backend.maxBackoff, func() error {
+			var err error
+			client, listeners, err = s.connect(ctx)
+			return err
+		})
+		if !reconnected {
+			return
+		}
+	}
+}
+
+// serve proxies forwarded connections to the Service until the connection is lost
+// or ctx is done
+func (s *sshSession) serve(ctx context.Context, client *ssh.Client, listeners []net.Listener) {
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		target := net.JoinHostPort(s.config.Service, strconv.Itoa(s.forwards[i].Port))
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			s.accept(listener, target)
+		}(listener)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(s.backend.keepalive)
+	defer ticker.Stop()
+
+	for alive := true; alive; {
+		select {
+		case <-ctx.Done():
+			alive = false
+		case <-closed:
+			alive = false
+		case <-ticker.C:
+			alive = s.keepalive(client)
+		}
+	}
+
+	client.Close()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	wg.Wait()
+}
+
+// keepalive reports whether the server still answers requests on the connection
+func (s *sshSession) keepalive(client *ssh.Client) bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	select {
+	case err := <-replied:
+		return err == nil
+	case <-time.After(s.backend.connectTimeout):
+		return false
+	}
+}
+
+// accept proxies forwarded connections until the listener is closed
+func (s *sshSession) accept(listener net.Listener, target string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.proxy(conn, target)
+	}
+}
+
+// proxy copies a forwarded connection to and from the target until either side closes
+func (s *sshSession) proxy(conn net.Conn, target string) {
+	defer conn.Close()
+
+	upstream, err := s.backend.dial(context.Background(), "tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	pipe(s.traffic.count(conn), upstream)
+}
@@ -0,0 +1,468 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an in-process SSH server that serves tcpip-forward requests
+// like sshd with GatewayPorts set to clientspecified
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  string
+
+	mu     sync.Mutex
+	conns  []*ssh.ServerConn
+	logins int
+}
+
+// newTestSSHServer starts a server accepting the SSH key of the tunnel key privateKey
+func newTestSSHServer(t *testing.T, privateKey string) *testSSHServer {
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	require.NoError(t, err)
+	clientSigner, err := SSHSigner(privateKey)
+	require.NoError(t, err)
+
+	server := &testSSHServer{
+		hostKey: string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+	}
+	server.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() != "tunnel" || !bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	server.config.AddHostKey(hostSigner)
+
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.listener.Close()
+		server.dropConnections()
+	})
+
+	go server.serve()
+	return server
+}
+
+// endpoint returns the host:port the server listens on
+func (s *testSSHServer) endpoint() string {
+	return s.listener.Addr().String()
+}
+
+// loginCount returns how many connections have authenticated so far
+func (s *testSSHServer) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// dropConnections closes every client connection, as a server restart would
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves one client: its forward requests open listeners that hand every
+// accepted connection back over a forwarded-tcpip channel
+func (s *testSSHServer) handle(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.logins++
+	s.mu.Unlock()
+
+	go func() {
+		for channel := range channels {
+			channel.Reject(ssh.Prohibited, "only remote forwards are served")
+		}
+	}()
+
+	forwards := map[string]net.Listener{}
+	defer func() {
+		for _, listener := range forwards {
+			listener.Close()
+		}
+	}()
+
+	for req := range requests {
+		var forward struct {
+			Addr string
+			Port uint32
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			address := net.JoinHostPort(forward.Addr, strconv.Itoa(int(forward.Port)))
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			forwards[address] = listener
+			req.Reply(true, nil)
+			go forwardConnections(serverConn, listener, forward.Addr, forward.Port)
+		case "cancel-tcpip-forward":
+			if err := ssh.Unmarshal(req.Payload, &forward); err == nil {
+				address := net.JoinHostPort(forward.Addr, strconv.Itoa(int(forward.Port)))
+				if listener, ok := forwards[address]; ok {
+					listener.Close()
+					delete(forwards, address)
+				}
+			}
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// forwardConnections opens a forwarded-tcpip channel for every connection to a forwarded port
+func forwardConnections(serverConn *ssh.ServerConn, listener net.Listener, addr string, port uint32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		payload := ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{addr, port, origin.IP.String(), uint32(origin.Port)})
+
+		channel, requests, err := serverConn.OpenChannel("forwarded-tcpip", payload)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			defer conn.Close()
+			defer channel.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(channel, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, channel)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// newEchoServer starts a TCP server that echoes what it receives and returns its port
+func newEchoServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// freeTCPPort returns a TCP port that was free a moment ago
+func freeTCPPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// newTestSSHBackend returns an SSH backend that reconnects quickly
+func newTestSSHBackend() *SSHBackend {
+	backend := NewSSHBackend()
+	backend.connectTimeout = 5 * time.Second
+	backend.minBackoff = 10 * time.Millisecond
+	backend.maxBackoff = 50 * time.Millisecond
+	return backend
+}
+
+// sshTunnelConfig returns an SSH tunnel config for the server forwarding remotePort to port
+func sshTunnelConfig(server *testSSHServer, privateKey string, remotePort, port int) *TunnelConfig {
+	return &TunnelConfig{
+		TunnelID:  "tunnel-ssh",
+		Transport: TransportSSH,
+		Service:   "127.0.0.1",
+		Ports:     []int{port},
+		SSH: &SSHConfig{
+			Endpoint:    server.endpoint(),
+			User:        "tunnel",
+			HostKey:     server.hostKey,
+			PrivateKey:  privateKey,
+			BindAddress: "127.0.0.1",
+			Forwards:    []SSHForward{{RemotePort: remotePort, Port: port}},
+		},
+	}
+}
+
+// echoes reports whether a connection to the forwarded port reaches the echo server
+func echoes(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return false
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return false
+	}
+	return string(reply) == "ping"
+}
+
+func TestSSHBackend(t *testing.T) {
+	ctx := context.Background()
+	privateKey := testKey('a')
+	server := newTestSSHServer(t, privateKey)
+	servicePort := newEchoServer(t)
+	remotePort := freeTCPPort(t)
+
+	backend := newTestSSHBackend()
+	config := sshTunnelConfig(server, privateKey, remotePort, servicePort)
+	require.NoError(t, backend.Up(ctx, "et-ssh", config))
+	t.Cleanup(func() { backend.Down(ctx, "et-ssh") })
+
+	assert.True(t, echoes(remotePort), "forwarded port should reach the Service")
+	require.Eventually(t, func() bool {
+		traffic, err := backend.Traffic(ctx, "et-ssh")
+		return err == nil && traffic == TrafficCounters{ReceiveBytes: 4, TransmitBytes: 4, Connections: 1}
+	}, time.Second, 10*time.Millisecond)
+
+	// The same config keeps the running connection
+	require.NoError(t, backend.Up(ctx, "et-ssh", sshTunnelConfig(server, privateKey, remotePort, servicePort)))
+	assert.Equal(t, 1, server.loginCount())
+
+	// A lost connection is re-established and the forward comes back
+	server.dropConnections()
+	require.Eventually(t, func() bool {
+		return server.loginCount() == 2 && echoes(remotePort)
+	}, 5*time.Second, 20*time.Millisecond)
+	// Traffic is counted across reconnects
+	traffic, err := backend.Traffic(ctx, "et-ssh")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, traffic.Connections, uint64(2))
+
+	// A new forward replaces the connection
+	newRemotePort := freeTCPPort(t)
+	require.NoError(t, backend.Up(ctx, "et-ssh", sshTunnelConfig(server, privateKey, newRemotePort, servicePort)))
+	assert.True(t, echoes(newRemotePort))
+	assert.Equal(t, 3, server.loginCount())
+
+	require.NoError(t, backend.Down(ctx, "et-ssh"))
+	require.Eventually(t, func() bool {
+		return !echoes(newRemotePort)
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.NoError(t, backend.Down(ctx, "et-ssh"))
+	_, err = backend.Traffic(ctx, "et-ssh")
+	assert.Error(t, err)
+}
+
+func TestSSHBackendReconnectBackoff(t *testing.T) {
+	ctx := context.Background()
+	privateKey := testKey('a')
+	server := newTestSSHServer(t, privateKey)
+	servicePort := newEchoServer(t)
+	remotePort := freeTCPPort(t)
+
+	// Dials fail while the server is unreachable, then succeed again
+	backend := newTestSSHBackend()
+	var mu sync.Mutex
+	var dials []time.Time
+	unreachable := false
+	dialer := &net.Dialer{}
+	backend.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != server.endpoint() {
+			return dialer.DialContext(ctx, network, address)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		dials = append(dials, time.Now())
+		if unreachable && len(dials) < 6 {
+			return nil, errors.New("connection refused")
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	require.NoError(t, backend.Up(ctx, "et-ssh", sshTunnelConfig(server, privateKey, remotePort, servicePort)))
+	t.Cleanup(func() { backend.Down(ctx, "et-ssh") })
+
+	mu.Lock()
+	unreachable = true
+	mu.Unlock()
+	server.dropConnections()
+
+	require.Eventually(t, func() bool {
+		return server.loginCount() == 2 && echoes(remotePort)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, dials, 6)
+	// The waits between failed attempts grow up to the maximum backoff
+	for i := 2; i < len(dials); i++ {
+		assert.GreaterOrEqual(t, dials[i].Sub(dials[i-1]), min(backend.minBackoff<<(i-1), backend.maxBackoff))
+	}
+}
+
+func TestSSHBackendErrors(t *testing.T) {
+	ctx := context.Background()
+	privateKey := testKey('a')
+	server := newTestSSHServer(t, privateKey)
+	servicePort := newEchoServer(t)
+
+	tests := []struct {
+		name   string
+		modify func(config *TunnelConfig)
+		op     string
+		want   string
+	}{
+		{
+			name:   "missing ssh settings",
+			modify: func(config *TunnelConfig) { config.SSH = nil },
+			op:     "parse config",
+			want:   "ssh settings are missing",
+		},
+		{
+			name:   "invalid host key",
+			modify: func(config *TunnelConfig) { config.SSH.HostKey = "not a key" },
+			op:     "parse config",
+			want:   "invalid host key",
+		},
+		{
+			name: "no ports",
+			modify: func(config *TunnelConfig) {
+				config.Ports = nil
+				config.SSH.Forwards = nil
+			},
+			op:   "parse config",
+			want: "no ports to forward",
+		},
+		{
+			name: "unexpected host key",
+			modify: func(config *TunnelConfig) {
+				config.SSH.HostKey = newTestSSHServer(t, privateKey).hostKey
+			},
+			op:   "connect",
+			want: "host key mismatch",
+		},
+		{
+			name:   "unknown client key",
+			modify: func(config *TunnelConfig) { config.SSH.PrivateKey = testKey('b') },
+			op:     "connect",
+			want:   "unable to authenticate",
+		},
+		{
+			name: "forward refused",
+			modify: func(config *TunnelConfig) {
+				busy, err := net.Listen("tcp", "127.0.0.1:0")
+				require.NoError(t, err)
+				t.Cleanup(func() { busy.Close() })
+				config.SSH.Forwards[0].RemotePort = busy.Addr().(*net.TCPAddr).Port
+			},
+			op:   "connect",
+			want: "failed to forward server port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := sshTunnelConfig(server, privateKey, freeTCPPort(t), servicePort)
+			tt.modify(config)
+
+			err := newTestSSHBackend().Up(ctx, "et-ssh", config)
+			var backendErr *BackendError
+			require.True(t, errors.As(err, &backendErr), "expected a BackendError, got %v", err)
+			assert.Equal(t, tt.op, backendErr.Op)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestSSHBackendConformance(t *testing.T) {
+	privateKey := testKey('a')
+	server := newTestSSHServer(t, privateKey)
+	servicePort := newEchoServer(t)
+
+	testBackendConformance(t, conformanceHarness{
+		newBackend: func(t *testing.T) Backend {
+			return newTestSSHBackend()
+		},
+		// Every allowed IP gets a forward, so reconfiguring adds one
+		config: func(peerKey, allowedIPs string) *TunnelConfig {
+			config := sshTunnelConfig(server, privateKey, freeTCPPort(t), servicePort)
+			for range strings.Split(allowedIPs, ",")[1:] {
+				config.SSH.Forwards = append(config.SSH.Forwards, SSHForward{RemotePort: freeTCPPort(t), Port: servicePort})
+			}
+			config.TunnelID = fmt.Sprintf("tunnel-ssh-%s", allowedIPs)
+			return config
+		},
+	})
+}
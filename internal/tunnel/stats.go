@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerStats are the counters WireGuard keeps for a peer
+type PeerStats struct {
+	PublicKey string
+	// LastHandshake is zero until the first handshake completed
+	LastHandshake time.Time
+	ReceiveBytes  uint64
+	TransmitBytes uint64
+}
+
+// StatsBackend is a Backend that can read the peer counters of its interfaces
+type StatsBackend interface {
+	Backend
+	// Stats returns the counters of every peer on the interface
+	Stats(ctx context.Context, name string) ([]PeerStats, error)
+}
+
+// Stats reads the peer counters with wg show
+func (b *ExecBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	out, err := b.output(ctx, "wg", "show", name, "dump")
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "wg show", Err: err}
+	}
+	stats, err := parseWGDump(string(out))
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "wg show", Err: err}
+	}
+	return stats, nil
+}
+
+// Stats reads the peer counters from the userspace device
+func (b *UserspaceBackend) Stats(ctx context.Context, name string) ([]PeerStats, error) {
+	b.mu.Lock()
+	dev, ok := b.devices[name]
+	b.mu.Unlock()
+	if !ok {
+		return nil, &BackendError{Interface: name, Op: "get device", Err: fmt.Errorf("device not found")}
+	}
+
+	uapi, err := dev.device.IpcGet()
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "get device", Err: err}
+	}
+	stats, err := parseUAPIStats(uapi)
+	if err != nil {
+		return nil, &BackendError{Interface: name, Op: "get device", Err: err}
+	}
+	return stats, nil
+}
+
+// parseWGDump parses the peer lines of `wg show <interface> dump`. The first line
+// describes the interface; every other line is a tab separated peer:
+// public-key, preshared-key, endpoint, allowed-ips, latest-handshake, rx, tx, keepalive.
+func parseWGDump(output string) ([]PeerStats, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	stats := []PeerStats{}
+	for i, line := range lines {
+		if i == 0 || line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("line %d: expected 8 fields, got %d", i+1, len(fields))
+		}
+
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid latest handshake %q", i+1, fields[4])
+		}
+		rx, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid transfer %q", i+1, fields[5])
+		}
+		tx, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid transfer %q", i+1, fields[6])
+		}
+
+		stats = append(stats, PeerStats{
+			PublicKey:     fields[0],
+			LastHandshake: handshakeTime(handshake, 0),
+			ReceiveBytes:  rx,
+			TransmitBytes: tx,
+		})
+	}
+	return stats, nil
+}
+
+// parseUAPIStats parses the peers of a WireGuard cross-platform configuration
+// protocol get response
+func parseUAPIStats(uapi string) ([]PeerStats, error) {
+	stats := []PeerStats{}
+	var sec, nsec int64
+
+	for _, line := range strings.Split(uapi, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+
+		if key == "public_key" {
+			publicKey, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key %q", value)
+			}
+			stats = append(stats, PeerStats{PublicKey: base64.StdEncoding.EncodeToString(publicKey)})
+			sec, nsec = 0, 0
+			continue
+		}
+		if len(stats) == 0 {
+			continue
+		}
+
+		peer := &stats[len(stats)-1]
+		var err error
+		switch key {
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+			peer.LastHandshake = handshakeTime(sec, nsec)
+		case "last_handshake_time_nsec":
+			nsec, err = strconv.ParseInt(value, 10, 64)
+			peer.LastHandshake = handshakeTime(sec, nsec)
+		case "rx_bytes":
+			peer.ReceiveBytes, err = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TransmitBytes, err = strconv.ParseUint(value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	return stats, nil
+}
+
+// handshakeTime converts a handshake timestamp, where zero means no handshake yet
+func handshakeTime(sec, nsec int64) time.Time {
+	if sec == 0 && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, nsec)
+}
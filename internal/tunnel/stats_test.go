@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWGDump(t *testing.T) {
+	dump := strings.Join([]string{
+		testKey('a') + "\t" + testKey('p') + "\t51820\toff",
+		testKey('b') + "\t(none)\t203.0.113.1:51820\t10.0.0.1/32\t1717243200\t1024\t2048\t25",
+		testKey('c') + "\t(none)\t(none)\t(none)\t0\t0\t0\toff",
+	}, "\n") + "\n"
+
+	stats, err := parseWGDump(dump)
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerStats{
+		{PublicKey: testKey('b'), LastHandshake: time.Unix(1717243200, 0), ReceiveBytes: 1024, TransmitBytes: 2048},
+		{PublicKey: testKey('c')},
+	}, stats)
+
+	_, err = parseWGDump("interface\n" + testKey('b') + "\tshort\n")
+	assert.Error(t, err)
+}
+
+func TestParseUAPIStats(t *testing.T) {
+	uapi := `private_key=` + hex.EncodeToString([]byte(strings.Repeat("a", wgKeyLen))) + `
+listen_port=51820
+public_key=` + hex.EncodeToString([]byte(strings.Repeat("b", wgKeyLen))) + `
+endpoint=203.0.113.1:51820
+last_handshake_time_sec=1717243200
+last_handshake_time_nsec=500
+tx_bytes=2048
+rx_bytes=1024
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.1/32
+public_key=` + hex.EncodeToString([]byte(strings.Repeat("c", wgKeyLen))) + `
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+errno=0
+`
+
+	stats, err := parseUAPIStats(uapi)
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerStats{
+		{PublicKey: testKey('b'), LastHandshake: time.Unix(1717243200, 500), ReceiveBytes: 1024, TransmitBytes: 2048},
+		{PublicKey: testKey('c')},
+	}, stats)
+
+	_, err = parseUAPIStats("public_key=zz\n")
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+)
+
+// UpdateMode tells how a tunnel update was applied
+type UpdateMode string
+
+const (
+	// UpdateUnchanged means the new config matched the running one
+	UpdateUnchanged UpdateMode = "Unchanged"
+	// UpdateInPlace means the running interface was reconfigured without dropping connections
+	UpdateInPlace UpdateMode = "InPlace"
+	// UpdateRestart means the interface was brought down and up again
+	UpdateRestart UpdateMode = "Restart"
+)
+
+// ErrRestartRequired is returned by SyncBackend.Sync for changes it cannot apply in place
+var ErrRestartRequired = errors.New("change requires restarting the interface")
+
+// SyncBackend is a Backend that can reconfigure a running interface in place
+type SyncBackend interface {
+	Backend
+	// Sync changes a running interface from the old to the new config; both assign
+	// the same addresses. Peers, endpoints and allowed IPs change without dropping
+	// established connections.
+	Sync(ctx context.Context, name string, old, new *TunnelConfig) error
+}
+
+// sameTunnelConfig reports whether two configs describe the same running tunnel
+func sameTunnelConfig(old, new *TunnelConfig) bool {
+	return old.WGConfig == new.WGConfig &&
+		old.Server == new.Server &&
+		old.Service == new.Service &&
+		slices.Equal(old.Ports, new.Ports) &&
+		slices.Equal(old.UDPPorts, new.UDPPorts) &&
+		reflect.DeepEqual(old.SSH, new.SSH) &&
+		reflect.DeepEqual(old.Mux, new.Mux)
+}
+
+// sameAddresses reports whether two configs assign the same interface addresses
+func sameAddresses(old, new *Config) bool {
+	oldAddrs := slices.Clone(old.Interface.Addresses)
+	newAddrs := slices.Clone(new.Interface.Addresses)
+	slices.Sort(oldAddrs)
+	slices.Sort(newAddrs)
+	return slices.Equal(oldAddrs, newAddrs)
+}
+
+// allowedIPs returns the allowed IPs of every peer of a config
+func allowedIPs(config *Config) []string {
+	cidrs := []string{}
+	for _, peer := range config.Peers {
+		for _, cidr := range peer.AllowedIPs {
+			if !slices.Contains(cidrs, cidr) {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	}
+	return cidrs
+}
+
+// routeChanges returns the allowed IPs routed by new but not old, and those no longer routed
+func routeChanges(old, new *Config) (added, removed []string) {
+	oldCIDRs := allowedIPs(old)
+	newCIDRs := allowedIPs(new)
+	for _, cidr := range newCIDRs {
+		if !slices.Contains(oldCIDRs, cidr) {
+			added = append(added, cidr)
+		}
+	}
+	for _, cidr := range oldCIDRs {
+		if !slices.Contains(newCIDRs, cidr) {
+			removed = append(removed, cidr)
+		}
+	}
+	return added, removed
+}
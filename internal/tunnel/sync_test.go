@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSyncBackend is a fakeBackend that can also sync, failing with syncErr
+type fakeSyncBackend struct {
+	fakeBackend
+	synced  []string
+	syncErr error
+}
+
+func (b *fakeSyncBackend) Sync(ctx context.Context, name string, old, new *TunnelConfig) error {
+	if b.syncErr != nil {
+		return b.syncErr
+	}
+	b.synced = append(b.synced, name)
+	b.up[name] = new.WGConfig
+	return nil
+}
+
+// withAllowedIPs replaces the allowed IPs of a testTunnelConfig
+func withAllowedIPs(config, allowedIPs string) string {
+	return strings.Replace(config, "AllowedIPs = 10.0.0.1/32", "AllowedIPs = "+allowedIPs, 1)
+}
+
+func TestTunnelUpdateModes(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeSyncBackend{fakeBackend: fakeBackend{up: map[string]string{}}}
+	manager := NewManagerWithBackend(backend)
+
+	config := &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.2/32"), Ports: []int{80}}
+	assert.NoError(t, manager.CreateTunnel(ctx, config))
+
+	// The same config changes nothing
+	mode, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.2/32"), Ports: []int{80}})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateUnchanged, mode)
+	assert.Empty(t, backend.synced)
+
+	// New ports and allowed IPs are synced in place
+	synced := &TunnelConfig{TunnelID: "t1", WGConfig: withAllowedIPs(testTunnelConfig("10.0.0.2/32"), "10.0.0.1/32, 10.1.0.0/24"), Ports: []int{80, 443}}
+	mode, err = manager.UpdateTunnel(ctx, synced)
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateInPlace, mode)
+	assert.Equal(t, []string{"wg-t1"}, backend.synced)
+	tunnel, _ := manager.GetTunnel("t1")
+	assert.Equal(t, synced, tunnel.config)
+
+	// A new address needs a restart
+	mode, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+	assert.Len(t, backend.synced, 1)
+	assert.Equal(t, testTunnelConfig("10.0.0.3/32"), backend.up["wg-t1"])
+
+	// So does a change the backend cannot sync
+	backend.syncErr = ErrRestartRequired
+	mode, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32"), Ports: []int{8080}})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+
+	// A failed sync keeps the running config
+	backend.syncErr = errors.New("netlink: device busy")
+	_, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.ErrorContains(t, err, "failed to sync interface: netlink: device busy")
+	tunnel, _ = manager.GetTunnel("t1")
+	assert.Equal(t, []int{8080}, tunnel.config.Ports)
+}
+
+func TestTunnelUpdateRetriesFailedRestart(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{up: map[string]string{}}
+	manager := NewManagerWithBackend(backend)
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.2/32")}))
+
+	// The restart brings the interface down, but not up again
+	backend.fail = errors.New("device busy")
+	restarted := &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32")}
+	_, err := manager.UpdateTunnel(ctx, restarted)
+	assert.Error(t, err)
+	assert.Empty(t, backend.up)
+
+	// The same config again is not mistaken for a running tunnel
+	backend.fail = nil
+	mode, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+	assert.Equal(t, map[string]string{"wg-t1": testTunnelConfig("10.0.0.3/32")}, backend.up)
+
+	mode, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "t1", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateUnchanged, mode)
+}
+
+func TestExecBackendSync(t *testing.T) {
+	commands := scriptCommands(t, func(string) helperResult { return helperResult{} })
+	backend, configPath := newTestExecBackend(t, "wg-exec-sync")
+	ctx := context.Background()
+
+	old := &TunnelConfig{WGConfig: withAllowedIPs(testTunnelConfig("10.0.0.2/32"), "10.0.0.1/32, 10.1.0.0/24")}
+	new := &TunnelConfig{WGConfig: withAllowedIPs(testTunnelConfig("10.0.0.2/32"), "10.0.0.1/32, 10.2.0.0/24")}
+	assert.NoError(t, backend.Sync(ctx, "wg-exec-sync", old, new))
+
+	// Peers go through wg syncconf and routes follow the allowed IPs
+	assert.Len(t, *commands, 3)
+	assert.True(t, strings.HasPrefix((*commands)[0], "wg syncconf wg-exec-sync "))
+	assert.Equal(t, []string{
+		"ip route replace 10.2.0.0/24 dev wg-exec-sync",
+		"ip route del 10.1.0.0/24 dev wg-exec-sync",
+	}, (*commands)[1:])
+
+	// The config file follows, so wg-quick down later matches the interface
+	written, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, new.WGConfig, string(written))
+
+	// Settings only wg-quick applies need a restart
+	*commands = (*commands)[:0]
+	mtu := &TunnelConfig{WGConfig: strings.Replace(new.WGConfig, "[Peer]", "MTU = 1280\n\n[Peer]", 1)}
+	assert.ErrorIs(t, backend.Sync(ctx, "wg-exec-sync", new, mtu), ErrRestartRequired)
+	everything := &TunnelConfig{WGConfig: withAllowedIPs(testTunnelConfig("10.0.0.2/32"), "0.0.0.0/0")}
+	assert.ErrorIs(t, backend.Sync(ctx, "wg-exec-sync", new, everything), ErrRestartRequired)
+	assert.Empty(t, *commands)
+}
+
+func TestWGSettings(t *testing.T) {
+	parsed, err := ParseConfig(strings.Replace(testTunnelConfig("10.0.0.2/32"), "[Peer]", "MTU = 1280\nDNS = 1.1.1.1\n\n[Peer]", 1))
+	assert.NoError(t, err)
+
+	settings := wgSettings(parsed).String()
+	assert.NotContains(t, settings, "Address")
+	assert.NotContains(t, settings, "MTU")
+	assert.NotContains(t, settings, "DNS")
+	assert.Contains(t, settings, "PrivateKey = "+testKey('a'))
+	assert.Contains(t, settings, "PublicKey = "+testKey('b'))
+}
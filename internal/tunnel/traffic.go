@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficCounters are what a backend carried for an interface since it came up.
+// Receive counts traffic from the tunnel server, transmit traffic to it.
+type TrafficCounters struct {
+	ReceiveBytes  uint64
+	TransmitBytes uint64
+	// Connections counts proxied connections and UDP flows; backends that route
+	// packets instead of proxying them leave it zero
+	Connections uint64
+}
+
+// TrafficBackend is a Backend that counts the traffic of its interfaces. The
+// counters of backends that only implement StatsBackend are the sum of their peers.
+type TrafficBackend interface {
+	Backend
+	// Traffic returns the counters of the interface
+	Traffic(ctx context.Context, name string) (TrafficCounters, error)
+}
+
+// Traffic is what a tunnel carried since it was created, across restarts
+type Traffic struct {
+	ReceiveBytes  uint64
+	TransmitBytes uint64
+	Connections   uint64
+	// CollectedAt is when the tunnel's counters were last read
+	CollectedAt time.Time
+}
+
+// tunnelTraffic is the manager's accounting for one tunnel
+type tunnelTraffic struct {
+	traffic Traffic
+	// last are the backend counters the traffic was last collected from
+	last TrafficCounters
+}
+
+// add accounts for the counters read from the backend. Counters start from zero
+// again whenever the backend brings the interface up anew, which shows as a drop.
+func (t *tunnelTraffic) add(counters TrafficCounters, now time.Time) {
+	if counters.ReceiveBytes < t.last.ReceiveBytes ||
+		counters.TransmitBytes < t.last.TransmitBytes ||
+		counters.Connections < t.last.Connections {
+		t.last = TrafficCounters{}
+	}
+
+	t.traffic.ReceiveBytes += counters.ReceiveBytes - t.last.ReceiveBytes
+	t.traffic.TransmitBytes += counters.TransmitBytes - t.last.TransmitBytes
+	t.traffic.Connections += counters.Connections - t.last.Connections
+	t.traffic.CollectedAt = now
+	t.last = counters
+}
+
+// ListTraffic reads every tunnel's counters and returns what each tunnel carried
+// since it was created, keyed by tunnel ID. Tunnels whose counters cannot be read
+// keep the traffic collected last.
+func (m *Manager) ListTraffic(ctx context.Context) map[string]Traffic {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	traffic := make(map[string]Traffic, len(m.tunnels))
+	for id, tunnel := range m.tunnels {
+		m.collectTraffic(ctx, tunnel)
+		traffic[id] = m.traffic[id].traffic
+	}
+	return traffic
+}
+
+// TunnelTraffic returns what a tunnel carried as of the last collection
+func (m *Manager) TunnelTraffic(tunnelID string) (Traffic, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.traffic[tunnelID]
+	if !ok {
+		return Traffic{}, false
+	}
+	return state.traffic, true
+}
+
+// collectTraffic adds a tunnel's current counters to its traffic. The caller
+// holds m.mu.
+func (m *Manager) collectTraffic(ctx context.Context, tunnel *Tunnel) {
+	state, ok := m.traffic[tunnel.id]
+	if !ok {
+		return
+	}
+	counters, err := readTraffic(ctx, tunnel)
+	if err != nil {
+		return
+	}
+	state.add(counters, m.now())
+}
+
+// resetTraffic notes that a tunnel was restarted and its counters start from zero.
+// Its traffic should have been collected right before. The caller holds m.mu.
+func (m *Manager) resetTraffic(tunnelID string) {
+	if state, ok := m.traffic[tunnelID]; ok {
+		state.last = TrafficCounters{}
+	}
+}
+
+// readTraffic reads a tunnel's counters from its backend
+func readTraffic(ctx context.Context, tunnel *Tunnel) (TrafficCounters, error) {
+	switch backend := tunnel.backend.(type) {
+	case TrafficBackend:
+		return backend.Traffic(ctx, tunnel.InterfaceName())
+	case StatsBackend:
+		peers, err := backend.Stats(ctx, tunnel.InterfaceName())
+		if err != nil {
+			return TrafficCounters{}, err
+		}
+		return peerTraffic(peers), nil
+	}
+	return TrafficCounters{}, fmt.Errorf("backend of tunnel %s does not count traffic", tunnel.id)
+}
+
+// peerTraffic sums the transfer counters of an interface's peers
+func peerTraffic(peers []PeerStats) TrafficCounters {
+	var counters TrafficCounters
+	for _, peer := range peers {
+		counters.ReceiveBytes += peer.ReceiveBytes
+		counters.TransmitBytes += peer.TransmitBytes
+	}
+	return counters
+}
+
+// trafficCounter counts the traffic a proxying backend carries for an interface
+type trafficCounter struct {
+	receiveBytes  atomic.Uint64
+	transmitBytes atomic.Uint64
+	connections   atomic.Uint64
+}
+
+// counters returns the current counts
+func (c *trafficCounter) counters() TrafficCounters {
+	return TrafficCounters{
+		ReceiveBytes:  c.receiveBytes.Load(),
+		TransmitBytes: c.transmitBytes.Load(),
+		Connections:   c.connections.Load(),
+	}
+}
+
+// count returns the tunnel side of a new proxied connection, counting what is
+// read from it as received and what is written to it as transmitted
+func (c *trafficCounter) count(conn io.ReadWriter) io.ReadWriter {
+	c.connections.Add(1)
+	return &countedConn{ReadWriter: conn, counter: c}
+}
+
+// countedConn is the tunnel side of a proxied connection
+type countedConn struct {
+	io.ReadWriter
+	counter *trafficCounter
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.counter.receiveBytes.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.counter.transmitBytes.Add(uint64(n))
+	return n, err
+}
+
+// Traffic reads the transfer counters of the device's peers and counts the
+// connections proxied to the Service
+func (b *UserspaceBackend) Traffic(ctx context.Context, name string) (TrafficCounters, error) {
+	peers, err := b.Stats(ctx, name)
+	if err != nil {
+		return TrafficCounters{}, err
+	}
+	counters := peerTraffic(peers)
+
+	b.mu.Lock()
+	dev, ok := b.devices[name]
+	b.mu.Unlock()
+	if ok {
+		counters.Connections = dev.traffic.connections.Load()
+	}
+	return counters, nil
+}
+
+// Traffic returns what the tunnel's forwarded connections carried, across reconnects
+func (b *SSHBackend) Traffic(ctx context.Context, name string) (TrafficCounters, error) {
+	b.mu.Lock()
+	session, ok := b.sessions[name]
+	b.mu.Unlock()
+	if !ok {
+		return TrafficCounters{}, &BackendError{Interface: name, Op: "read counters", Err: fmt.Errorf("session not found")}
+	}
+	return session.traffic.counters(), nil
+}
+
+// Traffic returns what the tunnel's streams carried, across resumed connections
+func (b *MuxBackend) Traffic(ctx context.Context, name string) (TrafficCounters, error) {
+	b.mu.Lock()
+	tunnel, ok := b.tunnels[name]
+	b.mu.Unlock()
+	if !ok {
+		return TrafficCounters{}, &BackendError{Interface: name, Op: "read counters", Err: fmt.Errorf("tunnel not found")}
+	}
+	return tunnel.traffic.counters(), nil
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTrafficBackend is a fakeBackend whose counters are set by the test
+type fakeTrafficBackend struct {
+	fakeBackend
+	counters TrafficCounters
+	err      error
+}
+
+func (b *fakeTrafficBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	// A new interface counts from zero
+	b.counters = TrafficCounters{}
+	return b.fakeBackend.Up(ctx, name, config)
+}
+
+func (b *fakeTrafficBackend) Traffic(ctx context.Context, name string) (TrafficCounters, error) {
+	return b.counters, b.err
+}
+
+func TestTunnelManagerTraffic(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	backend := &fakeTrafficBackend{fakeBackend: fakeBackend{up: map[string]string{}}}
+	manager := NewManagerWithBackend(backend)
+	manager.now = func() time.Time { return now }
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	traffic, ok := manager.TunnelTraffic("test-tunnel")
+	assert.True(t, ok)
+	assert.Equal(t, Traffic{}, traffic)
+
+	backend.counters = TrafficCounters{ReceiveBytes: 100, TransmitBytes: 1000, Connections: 2}
+	assert.Equal(t, map[string]Traffic{
+		"test-tunnel": {ReceiveBytes: 100, TransmitBytes: 1000, Connections: 2, CollectedAt: now},
+	}, manager.ListTraffic(ctx))
+
+	// Traffic until a restart is kept and the restarted interface is added to it
+	backend.counters = TrafficCounters{ReceiveBytes: 150, TransmitBytes: 1200, Connections: 3}
+	mode, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+	backend.counters = TrafficCounters{ReceiveBytes: 10, TransmitBytes: 20, Connections: 1}
+	now = now.Add(time.Minute)
+	assert.Equal(t, Traffic{ReceiveBytes: 160, TransmitBytes: 1220, Connections: 4, CollectedAt: now}, manager.ListTraffic(ctx)["test-tunnel"])
+
+	// Unreadable counters keep the last collected traffic
+	backend.err = errors.New("device not found")
+	now = now.Add(time.Minute)
+	traffic = manager.ListTraffic(ctx)["test-tunnel"]
+	assert.Equal(t, uint64(160), traffic.ReceiveBytes)
+	assert.Equal(t, now.Add(-time.Minute), traffic.CollectedAt)
+
+	assert.NoError(t, manager.DeleteTunnel(ctx, "test-tunnel"))
+	_, ok = manager.TunnelTraffic("test-tunnel")
+	assert.False(t, ok)
+	assert.Empty(t, manager.ListTraffic(ctx))
+}
+
+func TestTunnelManagerTrafficFromPeers(t *testing.T) {
+	ctx := context.Background()
+
+	backend := &fakeStatsBackend{fakeBackend: fakeBackend{up: map[string]string{}}}
+	manager := NewManagerWithBackend(backend)
+
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	backend.stats = []PeerStats{
+		{PublicKey: testKey('b'), ReceiveBytes: 100, TransmitBytes: 200},
+		{PublicKey: testKey('c'), ReceiveBytes: 10, TransmitBytes: 20},
+	}
+	traffic := manager.ListTraffic(ctx)["test-tunnel"]
+	assert.Equal(t, uint64(110), traffic.ReceiveBytes)
+	assert.Equal(t, uint64(220), traffic.TransmitBytes)
+
+	// Counters that drop without a restart the manager made, e.g. a peer that was
+	// replaced, count from zero
+	backend.stats = []PeerStats{{PublicKey: testKey('b'), ReceiveBytes: 5, TransmitBytes: 5}}
+	traffic = manager.ListTraffic(ctx)["test-tunnel"]
+	assert.Equal(t, uint64(115), traffic.ReceiveBytes)
+	assert.Equal(t, uint64(225), traffic.TransmitBytes)
+	assert.Zero(t, traffic.Connections)
+}
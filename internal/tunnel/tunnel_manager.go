@@ -2,29 +2,87 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // TunnelConfig represents the configuration for a tunnel
 type TunnelConfig struct {
 	TunnelID string
-	WGConfig string
+	// Transport names the registered backend running the tunnel; empty means TransportWireGuard
+	Transport string
+	WGConfig  string
+	// Server is the name of the tunnel server the tunnel connects to
+	Server string
+	// Service is the in-cluster host the userspace backend proxies tunnel connections to
+	Service string
+	// Ports are the TCP ports accepted through the tunnel and proxied to Service
+	Ports []int
+	// UDPPorts are the UDP ports of Service, carried by transports that proxy datagrams
+	UDPPorts []int
+	// SSH holds the server's SSH details for tunnels on TransportSSH
+	SSH *SSHConfig
+	// Mux holds the server's endpoint details for tunnels on TransportTLS
+	Mux *MuxConfig
 }
 
+// ErrTunnelNotFound is returned for tunnels a manager does not run, e.g. after the
+// controller restarted
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
 // Manager manages the lifecycle of tunnels
 type Manager struct {
 	mu      sync.RWMutex
 	tunnels map[string]*Tunnel
+	names    *interfaceNames
+	backends *Registry
+	policy   ConfigPolicy
+
+	health   map[string]*tunnelHealth
+	onHealth HealthHandler
+	traffic  map[string]*tunnelTraffic
+	now      func() time.Time
 }
 
-// NewManager creates a new tunnel manager
+// NewManager creates a new tunnel manager that runs tunnels with wg-quick
 func NewManager() *Manager {
+	return NewManagerWithBackend(NewExecBackend())
+}
+
+// NewManagerWithBackend creates a new tunnel manager running WireGuard tunnels
+// with the given backend
+func NewManagerWithBackend(backend Backend) *Manager {
+	backends := NewRegistry()
+	backends.Register(TransportWireGuard, backend)
+	return NewManagerWithRegistry(backends)
+}
+
+// NewManagerWithRegistry creates a new tunnel manager that runs every tunnel with
+// the backend registered for its transport
+func NewManagerWithRegistry(backends *Registry) *Manager {
 	return &Manager{
-		tunnels: make(map[string]*Tunnel),
+		tunnels:  make(map[string]*Tunnel),
+		names:    newInterfaceNames(tunnelInterfacePrefix),
+		backends: backends,
+		health:   make(map[string]*tunnelHealth),
+		traffic:  make(map[string]*tunnelTraffic),
+		now:      time.Now,
 	}
 }
 
+// Transports returns the transports the manager can run tunnels with
+func (m *Manager) Transports() []string {
+	return m.backends.Transports()
+}
+
+// SetConfigPolicy sets what happens to script hooks and DNS settings in tunnel
+// configs; they are stripped by default
+func (m *Manager) SetConfigPolicy(policy ConfigPolicy) {
+	m.policy = policy
+}
+
 // CreateTunnel creates and starts a new tunnel
 func (m *Manager) CreateTunnel(ctx context.Context, config *TunnelConfig) error {
 	m.mu.Lock()
@@ -34,34 +92,74 @@ func (m *Manager) CreateTunnel(ctx context.Context, config *TunnelConfig) error
 		return fmt.Errorf("tunnel %s already exists", config.TunnelID)
 	}
 
-	tunnel, err := NewTunnel(config)
+	backend, err := m.backends.Backend(config.Transport)
 	if err != nil {
 		return fmt.Errorf("failed to create tunnel: %w", err)
 	}
 
+	tunnel, err := NewTunnel(config, backend)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel: %w", err)
+	}
+	tunnel.policy = m.policy
+	tunnel.name = m.names.assign(config.TunnelID)
+
 	if err := tunnel.Start(ctx); err != nil {
+		m.names.release(config.TunnelID)
 		return fmt.Errorf("failed to start tunnel: %w", err)
 	}
 
 	m.tunnels[config.TunnelID] = tunnel
+	m.health[config.TunnelID] = &tunnelHealth{
+		health: Health{State: HealthUnknown, Reason: HealthReasonStarting},
+		since:  m.now(),
+	}
+	m.traffic[config.TunnelID] = &tunnelTraffic{}
 	return nil
 }
 
-// UpdateTunnel updates an existing tunnel's configuration
-func (m *Manager) UpdateTunnel(ctx context.Context, config *TunnelConfig) error {
+// UpdateTunnel updates an existing tunnel's configuration and reports whether it
+// was synced in place or restarted
+func (m *Manager) UpdateTunnel(ctx context.Context, config *TunnelConfig) (UpdateMode, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	tunnel, exists := m.tunnels[config.TunnelID]
 	if !exists {
-		return fmt.Errorf("tunnel %s not found", config.TunnelID)
+		return "", fmt.Errorf("%w: %s", ErrTunnelNotFound, config.TunnelID)
 	}
 
-	if err := tunnel.Update(ctx, config); err != nil {
-		return fmt.Errorf("failed to update tunnel: %w", err)
+	backend, err := m.backends.Backend(config.Transport)
+	if err != nil {
+		return "", fmt.Errorf("failed to update tunnel: %w", err)
 	}
 
-	return nil
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+
+	// Count what the tunnel carried before a restart zeroes its counters
+	m.collectTraffic(ctx, tunnel)
+
+	changed := tunnel.config.WGConfig != config.WGConfig || transportOf(tunnel.config) != transportOf(config)
+	var mode UpdateMode
+	if transportOf(tunnel.config) != transportOf(config) {
+		// Another transport means another backend; the old one takes its interface down
+		mode, err = tunnel.Replace(ctx, config, backend)
+	} else {
+		mode, err = tunnel.Update(ctx, config)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to update tunnel: %w", err)
+	}
+	if mode == UpdateRestart {
+		m.resetTraffic(config.TunnelID)
+	}
+
+	// A new config gets a fresh stale period to connect
+	if state, ok := m.health[config.TunnelID]; ok && changed {
+		state.since = m.now()
+	}
+	return mode, nil
 }
 
 // DeleteTunnel stops and removes a tunnel
@@ -71,14 +169,24 @@ func (m *Manager) DeleteTunnel(ctx context.Context, tunnelID string) error {
 
 	tunnel, exists := m.tunnels[tunnelID]
 	if !exists {
-		return fmt.Errorf("tunnel %s not found", tunnelID)
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelID)
 	}
 
-	if err := tunnel.Stop(ctx); err != nil {
-		return fmt.Errorf("failed to stop tunnel: %w", err)
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+
+	// A tunnel left down by a failed restart has no interface to stop
+	if !tunnel.down {
+		if err := tunnel.Stop(ctx); err != nil {
+			return fmt.Errorf("failed to stop tunnel: %w", err)
+		}
 	}
+	tunnel.removed = true
 
 	delete(m.tunnels, tunnelID)
+	delete(m.health, tunnelID)
+	delete(m.traffic, tunnelID)
+	m.names.release(tunnelID)
 	return nil
 }
 
@@ -89,7 +197,7 @@ func (m *Manager) GetTunnel(tunnelID string) (*Tunnel, error) {
 
 	tunnel, exists := m.tunnels[tunnelID]
 	if !exists {
-		return nil, fmt.Errorf("tunnel %s not found", tunnelID)
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelID)
 	}
 
 	return tunnel, nil
@@ -106,4 +214,21 @@ func (m *Manager) ListTunnels() []*Tunnel {
 	}
 
 	return tunnels
-} 
\ No newline at end of file
+}
+
+// TunnelInterface returns the name of the interface carrying a tunnel
+func (m *Manager) TunnelInterface(tunnelID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name, ok := m.names.byID[tunnelID]
+	return name, ok
+}
+
+// InterfaceNames returns the interface name of every tunnel, keyed by tunnel ID
+func (m *Manager) InterfaceNames() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.names.mapping()
+}
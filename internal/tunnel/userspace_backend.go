@@ -0,0 +1,462 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// userspaceMTU matches the default MTU wg-quick picks for IPv4 and IPv6 peers,
+// used unless the config sets one
+const userspaceMTU = 1420
+
+// userspaceUDPIdleTimeout closes UDP flows nothing was sent on for this long
+const userspaceUDPIdleTimeout = 2 * time.Minute
+
+// UserspaceBackend runs WireGuard in-process on a Go network stack. Connections
+// and UDP datagrams arriving through the tunnel on the tunnel's ports are proxied
+// to its Service, so no kernel interface, capabilities or host changes are needed.
+type UserspaceBackend struct {
+	dial           func(ctx context.Context, network, address string) (net.Conn, error)
+	udpIdleTimeout time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*userspaceDevice
+}
+
+// userspaceDevice is a running userspace WireGuard device and its proxies
+type userspaceDevice struct {
+	device *device.Device
+	tnet   *netstack.Net
+	mtu    int
+	// listeners proxy each tunnel port to the Service
+	listeners map[int]net.Listener
+	// udpListeners relay each tunnel UDP port to the Service
+	udpListeners map[int]net.PacketConn
+	wg           sync.WaitGroup
+	traffic      trafficCounter
+}
+
+// NewUserspaceBackend creates a userspace WireGuard backend
+func NewUserspaceBackend() *UserspaceBackend {
+	dialer := &net.Dialer{}
+	return &UserspaceBackend{
+		dial:           dialer.DialContext,
+		udpIdleTimeout: userspaceUDPIdleTimeout,
+		devices:        make(map[string]*userspaceDevice),
+	}
+}
+
+// Up starts a userspace device for the tunnel, replacing any running one
+func (b *UserspaceBackend) Up(ctx context.Context, name string, config *TunnelConfig) error {
+	parsed, err := ParseConfig(config.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	if err := b.Down(ctx, name); err != nil {
+		return err
+	}
+
+	addrs := make([]netip.Addr, 0, len(parsed.Interface.Addresses))
+	for _, address := range parsed.Interface.Addresses {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return &BackendError{Interface: name, Op: "parse address", Err: err}
+		}
+		addrs = append(addrs, prefix.Addr())
+	}
+
+	uapi, err := uapiConfig(parsed)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "configure device", Err: err}
+	}
+
+	mtu := deviceMTU(parsed)
+	tunDevice, tnet, err := netstack.CreateNetTUN(addrs, nil, mtu)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "create netstack", Err: err}
+	}
+
+	dev := &userspaceDevice{
+		device:       device.NewDevice(tunDevice, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "")),
+		tnet:         tnet,
+		mtu:          mtu,
+		listeners:    make(map[int]net.Listener),
+		udpListeners: make(map[int]net.PacketConn),
+	}
+	if err := dev.device.IpcSet(uapi); err != nil {
+		dev.close()
+		return &BackendError{Interface: name, Op: "configure device", Err: err}
+	}
+	if err := dev.device.Up(); err != nil {
+		dev.close()
+		return &BackendError{Interface: name, Op: "set device up", Err: err}
+	}
+
+	for _, port := range config.Ports {
+		if err := b.listen(dev, config.Service, port); err != nil {
+			dev.close()
+			return &BackendError{Interface: name, Op: "listen on port " + strconv.Itoa(port), Err: err}
+		}
+	}
+	for _, port := range config.UDPPorts {
+		if err := b.listenUDP(dev, config.Service, port); err != nil {
+			dev.close()
+			return &BackendError{Interface: name, Op: "listen on UDP port " + strconv.Itoa(port), Err: err}
+		}
+	}
+
+	b.mu.Lock()
+	b.devices[name] = dev
+	b.mu.Unlock()
+	return nil
+}
+
+// Sync updates the peers and proxies of the running device in place; connections
+// on ports that stay published keep running. A new MTU needs a restart.
+func (b *UserspaceBackend) Sync(ctx context.Context, name string, old, new *TunnelConfig) error {
+	oldParsed, err := ParseConfig(old.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+	newParsed, err := ParseConfig(new.WGConfig)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "parse config", Err: err}
+	}
+
+	b.mu.Lock()
+	dev, ok := b.devices[name]
+	b.mu.Unlock()
+	if !ok || dev.mtu != deviceMTU(newParsed) {
+		return ErrRestartRequired
+	}
+
+	uapi, err := uapiSync(oldParsed, newParsed)
+	if err != nil {
+		return &BackendError{Interface: name, Op: "configure device", Err: err}
+	}
+	if err := dev.device.IpcSet(uapi); err != nil {
+		return &BackendError{Interface: name, Op: "configure device", Err: err}
+	}
+
+	// Stop proxying ports that are gone, or all of them when the Service moved
+	for port, listener := range dev.listeners {
+		if old.Service != new.Service || !slices.Contains(new.Ports, port) {
+			listener.Close()
+			delete(dev.listeners, port)
+		}
+	}
+	for _, port := range new.Ports {
+		if _, ok := dev.listeners[port]; ok {
+			continue
+		}
+		if err := b.listen(dev, new.Service, port); err != nil {
+			return &BackendError{Interface: name, Op: "listen on port " + strconv.Itoa(port), Err: err}
+		}
+	}
+
+	for port, listener := range dev.udpListeners {
+		if old.Service != new.Service || !slices.Contains(new.UDPPorts, port) {
+			listener.Close()
+			delete(dev.udpListeners, port)
+		}
+	}
+	for _, port := range new.UDPPorts {
+		if _, ok := dev.udpListeners[port]; ok {
+			continue
+		}
+		if err := b.listenUDP(dev, new.Service, port); err != nil {
+			return &BackendError{Interface: name, Op: "listen on UDP port " + strconv.Itoa(port), Err: err}
+		}
+	}
+	return nil
+}
+
+// listen proxies connections arriving through the tunnel on a port to the Service
+func (b *UserspaceBackend) listen(dev *userspaceDevice, service string, port int) error {
+	listener, err := dev.tnet.ListenTCP(&net.TCPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	dev.listeners[port] = listener
+
+	target := net.JoinHostPort(service, strconv.Itoa(port))
+	dev.wg.Add(1)
+	go func() {
+		defer dev.wg.Done()
+		b.serve(listener, target, &dev.traffic)
+	}()
+	return nil
+}
+
+// listenUDP relays datagrams arriving through the tunnel on a port to the Service
+func (b *UserspaceBackend) listenUDP(dev *userspaceDevice, service string, port int) error {
+	listener, err := dev.tnet.ListenUDP(&net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	dev.udpListeners[port] = listener
+
+	target := net.JoinHostPort(service, strconv.Itoa(port))
+	dev.wg.Add(1)
+	go func() {
+		defer dev.wg.Done()
+		b.serveUDP(listener, target, &dev.traffic)
+	}()
+	return nil
+}
+
+// deviceMTU returns the MTU a config asks for, or the default
+func deviceMTU(config *Config) int {
+	if config.Interface.MTU != 0 {
+		return config.Interface.MTU
+	}
+	return userspaceMTU
+}
+
+// Down stops the tunnel's device and its proxies
+func (b *UserspaceBackend) Down(ctx context.Context, name string) error {
+	b.mu.Lock()
+	dev, ok := b.devices[name]
+	delete(b.devices, name)
+	b.mu.Unlock()
+
+	if ok {
+		dev.close()
+	}
+	return nil
+}
+
+// serve accepts tunnel connections until the listener is closed
+func (b *UserspaceBackend) serve(listener net.Listener, target string, traffic *trafficCounter) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.proxy(conn, target, traffic)
+	}
+}
+
+// serveUDP reads tunnel datagrams until the listener is closed. Every client
+// address gets its own flow to the target, which ends once it is idle.
+func (b *UserspaceBackend) serveUDP(listener net.PacketConn, target string, traffic *trafficCounter) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	flows := make(map[string]net.Conn)
+	defer func() {
+		mu.Lock()
+		for _, upstream := range flows {
+			upstream.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		traffic.receiveBytes.Add(uint64(n))
+
+		key := addr.String()
+		mu.Lock()
+		upstream, ok := flows[key]
+		mu.Unlock()
+		if !ok {
+			upstream, err = b.dial(context.Background(), "udp", target)
+			if err != nil {
+				continue
+			}
+			traffic.connections.Add(1)
+			mu.Lock()
+			flows[key] = upstream
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.relayReplies(listener, addr, upstream, traffic)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+				upstream.Close()
+			}()
+		}
+
+		upstream.SetReadDeadline(time.Now().Add(b.udpIdleTimeout))
+		upstream.Write(buf[:n])
+	}
+}
+
+// relayReplies sends the target's datagrams back through the tunnel to the
+// client until the flow is idle for udpIdleTimeout or closed
+func (b *UserspaceBackend) relayReplies(listener net.PacketConn, client net.Addr, upstream net.Conn, traffic *trafficCounter) {
+	upstream.SetReadDeadline(time.Now().Add(b.udpIdleTimeout))
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := listener.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+		traffic.transmitBytes.Add(uint64(n))
+		upstream.SetReadDeadline(time.Now().Add(b.udpIdleTimeout))
+	}
+}
+
+// proxy copies a tunnel connection to and from the target until either side closes
+func (b *UserspaceBackend) proxy(conn net.Conn, target string, traffic *trafficCounter) {
+	defer conn.Close()
+
+	upstream, err := b.dial(context.Background(), "tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	pipe(traffic.count(conn), upstream)
+}
+
+// pipe copies between two connections until either side closes
+func pipe(a, b io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// close shuts down the listeners and the device
+func (d *userspaceDevice) close() {
+	for _, listener := range d.listeners {
+		listener.Close()
+	}
+	for _, listener := range d.udpListeners {
+		listener.Close()
+	}
+	d.wg.Wait()
+	d.device.Close()
+}
+
+// uapiConfig renders a config in the WireGuard cross-platform configuration protocol
+func uapiConfig(config *Config) (string, error) {
+	var b strings.Builder
+
+	privateKey, err := parseKey(config.Interface.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(privateKey))
+	if config.Interface.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", config.Interface.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	for i, peer := range config.Peers {
+		if err := writeUAPIPeer(&b, i, peer); err != nil {
+			return "", err
+		}
+	}
+
+	return b.String(), nil
+}
+
+// uapiSync renders the changes from old to new in the WireGuard cross-platform
+// configuration protocol. Unlike uapiConfig it keeps peers that stay, so their
+// sessions survive.
+func uapiSync(old, new *Config) (string, error) {
+	var b strings.Builder
+
+	if new.Interface.PrivateKey != old.Interface.PrivateKey {
+		privateKey, err := parseKey(new.Interface.PrivateKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid private key: %w", err)
+		}
+		fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(privateKey))
+	}
+	if new.Interface.ListenPort != old.Interface.ListenPort {
+		fmt.Fprintf(&b, "listen_port=%d\n", new.Interface.ListenPort)
+	}
+
+	for i, peer := range old.Peers {
+		if slices.ContainsFunc(new.Peers, func(p PeerConfig) bool { return p.PublicKey == peer.PublicKey }) {
+			continue
+		}
+		publicKey, err := parseKey(peer.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("peer %d: invalid public key: %w", i, err)
+		}
+		fmt.Fprintf(&b, "public_key=%s\nremove=true\n", hex.EncodeToString(publicKey))
+	}
+
+	for i, peer := range new.Peers {
+		if err := writeUAPIPeer(&b, i, peer); err != nil {
+			return "", err
+		}
+	}
+
+	return b.String(), nil
+}
+
+// writeUAPIPeer renders a peer, replacing its allowed IPs
+func writeUAPIPeer(b *strings.Builder, i int, peer PeerConfig) error {
+	publicKey, err := parseKey(peer.PublicKey)
+	if err != nil {
+		return fmt.Errorf("peer %d: invalid public key: %w", i, err)
+	}
+	fmt.Fprintf(b, "public_key=%s\n", hex.EncodeToString(publicKey))
+
+	if peer.PresharedKey != "" {
+		presharedKey, err := parseKey(peer.PresharedKey)
+		if err != nil {
+			return fmt.Errorf("peer %d: invalid preshared key: %w", i, err)
+		}
+		fmt.Fprintf(b, "preshared_key=%s\n", hex.EncodeToString(presharedKey))
+	}
+
+	if peer.Endpoint != "" {
+		// The protocol only accepts IP endpoints
+		endpoint, err := net.ResolveUDPAddr("udp", peer.Endpoint)
+		if err != nil {
+			return fmt.Errorf("peer %d: invalid endpoint: %w", i, err)
+		}
+		addrPort := endpoint.AddrPort()
+		fmt.Fprintf(b, "endpoint=%s\n", netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()))
+	}
+
+	// Always written so a synced peer can turn keepalives off
+	fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+
+	b.WriteString("replace_allowed_ips=true\n")
+	for _, cidr := range peer.AllowedIPs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("peer %d: invalid allowed IP: %w", i, err)
+		}
+		fmt.Fprintf(b, "allowed_ip=%s\n", cidr)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// generateKeyPair returns a base64 WireGuard private and public key
+func generateKeyPair(t *testing.T) (string, string) {
+	private, err := GeneratePrivateKey()
+	require.NoError(t, err)
+	public, err := PublicKey(private)
+	require.NoError(t, err)
+	return private, public
+}
+
+// freeUDPPort returns a local UDP port that is currently unused
+func freeUDPPort(t *testing.T) int {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUserspaceBackend(t *testing.T) {
+	// The Service behind the tunnel echoes what it receives
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	udpTarget, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udpTarget.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpTarget.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpTarget.WriteTo(buf[:n], addr)
+		}
+	}()
+	udpTargetPort := udpTarget.LocalAddr().(*net.UDPAddr).Port
+
+	clientPrivate, clientPublic := generateKeyPair(t)
+	serverPrivate, serverPublic := generateKeyPair(t)
+	clientPort, serverPort := freeUDPPort(t), freeUDPPort(t)
+
+	// The tunnel server side is a second userspace device in the test
+	serverConfig, err := uapiConfig(&Config{
+		Interface: InterfaceConfig{PrivateKey: serverPrivate, ListenPort: serverPort},
+		Peers: []PeerConfig{{
+			PublicKey:  clientPublic,
+			Endpoint:   fmt.Sprintf("127.0.0.1:%d", clientPort),
+			AllowedIPs: []string{"10.0.0.2/32"},
+		}},
+	})
+	require.NoError(t, err)
+	serverTun, serverNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, userspaceMTU)
+	require.NoError(t, err)
+	serverDevice := device.NewDevice(serverTun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	defer serverDevice.Close()
+	require.NoError(t, serverDevice.IpcSet(serverConfig))
+	require.NoError(t, serverDevice.Up())
+
+	ctx := context.Background()
+	backend := NewUserspaceBackend()
+	config := &TunnelConfig{
+		TunnelID: "test",
+		WGConfig: fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.0.0.2/32
+ListenPort = %d
+
+[Peer]
+PublicKey = %s
+Endpoint = 127.0.0.1:%d
+AllowedIPs = 10.0.0.1/32
+`, clientPrivate, clientPort, serverPublic, serverPort),
+		Service:  "127.0.0.1",
+		Ports:    []int{targetPort},
+		UDPPorts: []int{udpTargetPort},
+	}
+	err = backend.Up(ctx, "wg-test", config)
+	require.NoError(t, err)
+	defer backend.Down(ctx, "wg-test")
+
+	// A connection from the server side reaches the Service through the proxy
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	c, err := serverNet.DialContextTCPAddrPort(dialCtx, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), uint16(targetPort)))
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// So does a datagram on a UDP port, and the reply finds its way back
+	udp, err := serverNet.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), uint16(udpTargetPort)))
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("datagram"))
+	require.NoError(t, err)
+	reply := make([]byte, 64)
+	udp.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := udp.Read(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "datagram", string(reply[:n]))
+
+	// Syncing a new allowed IP keeps the open connection working
+	updated := *config
+	updated.WGConfig = strings.Replace(config.WGConfig, "AllowedIPs = 10.0.0.1/32", "AllowedIPs = 10.0.0.1/32, 10.0.0.9/32", 1)
+	require.NoError(t, backend.Sync(ctx, "wg-test", config, &updated))
+
+	_, err = c.Write([]byte("again"))
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(buf))
+
+	// A new MTU cannot be applied to the running device
+	updated.WGConfig = strings.Replace(updated.WGConfig, "[Peer]", "MTU = 1280\n\n[Peer]", 1)
+	assert.ErrorIs(t, backend.Sync(ctx, "wg-test", config, &updated), ErrRestartRequired)
+
+	assert.NoError(t, backend.Down(ctx, "wg-test"))
+	assert.Empty(t, backend.devices)
+}
+
+func TestUapiConfig(t *testing.T) {
+	_, public := generateKeyPair(t)
+	private, _ := generateKeyPair(t)
+
+	uapi, err := uapiConfig(&Config{
+		Interface: InterfaceConfig{PrivateKey: private, ListenPort: 51820},
+		Peers: []PeerConfig{{
+			PublicKey:           public,
+			Endpoint:            "203.0.113.1:51821",
+			AllowedIPs:          []string{"10.0.0.1/32"},
+			PersistentKeepalive: 25,
+		}},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, uapi, "listen_port=51820\nreplace_peers=true\n")
+	assert.Contains(t, uapi, "endpoint=203.0.113.1:51821\npersistent_keepalive_interval=25\nreplace_allowed_ips=true\nallowed_ip=10.0.0.1/32\n")
+
+	_, err = uapiConfig(&Config{Interface: InterfaceConfig{PrivateKey: "short"}})
+	assert.Error(t, err)
+
+	_, err = uapiConfig(&Config{
+		Interface: InterfaceConfig{PrivateKey: private},
+		Peers:     []PeerConfig{{PublicKey: public, AllowedIPs: []string{"not-a-cidr"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestUapiSync(t *testing.T) {
+	private, _ := generateKeyPair(t)
+	_, kept := generateKeyPair(t)
+	_, removed := generateKeyPair(t)
+	keptKey, err := parseKey(kept)
+	require.NoError(t, err)
+	removedKey, err := parseKey(removed)
+	require.NoError(t, err)
+
+	old := &Config{
+		Interface: InterfaceConfig{PrivateKey: private, ListenPort: 51820},
+		Peers: []PeerConfig{
+			{PublicKey: kept, AllowedIPs: []string{"10.0.0.1/32"}, PersistentKeepalive: 25},
+			{PublicKey: removed, AllowedIPs: []string{"10.0.0.5/32"}},
+		},
+	}
+	new := &Config{
+		Interface: InterfaceConfig{PrivateKey: private, ListenPort: 51820},
+		Peers: []PeerConfig{
+			{PublicKey: kept, AllowedIPs: []string{"10.0.0.1/32", "10.1.0.0/24"}},
+		},
+	}
+
+	// Only the changes are sent; peers that stay are not replaced
+	uapi, err := uapiSync(old, new)
+	assert.NoError(t, err)
+	assert.Equal(t, "public_key="+hex.EncodeToString(removedKey)+"\nremove=true\n"+
+		"public_key="+hex.EncodeToString(keptKey)+"\npersistent_keepalive_interval=0\n"+
+		"replace_allowed_ips=true\nallowed_ip=10.0.0.1/32\nallowed_ip=10.1.0.0/24\n", uapi)
+	assert.NotContains(t, uapi, "replace_peers")
+}
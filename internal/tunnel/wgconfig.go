@@ -0,0 +1,426 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Peer describes the tunnel server end of a tunnel as handed out by the server,
+// together with the settings of our interface
+type Peer struct {
+	PublicKey           string
+	Endpoint            string
+	Addresses           []string
+	AllowedIPs          []string
+	PersistentKeepalive int
+	// MTU and ListenPort of our interface; zero leaves the choice to the backend
+	MTU        int
+	ListenPort int
+}
+
+// RenderConfig renders the wg-quick config of the local end of a tunnel
+func RenderConfig(privateKey string, peer *Peer) string {
+	config := &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: privateKey,
+			Addresses:  peer.Addresses,
+			MTU:        peer.MTU,
+			ListenPort: peer.ListenPort,
+		},
+		Peers: []PeerConfig{{
+			PublicKey:           peer.PublicKey,
+			Endpoint:            peer.Endpoint,
+			AllowedIPs:          peer.AllowedIPs,
+			PersistentKeepalive: peer.PersistentKeepalive,
+		}},
+	}
+	return config.String()
+}
+
+// wgKeyLen is the length of a decoded WireGuard key
+const wgKeyLen = 32
+
+// MTU bounds accepted for a WireGuard interface
+const (
+	MinMTU = 576
+	MaxMTU = 65535
+)
+
+// ErrUnsafeDirective is returned when a config contains directives the policy rejects
+var ErrUnsafeDirective = errors.New("config contains unsafe directives")
+
+// ConfigPolicy decides what happens to wg-quick directives that run commands or
+// change the host's resolver: PreUp, PostUp, PreDown, PostDown and DNS
+type ConfigPolicy int
+
+const (
+	// StripUnsafe removes unsafe directives from the config
+	StripUnsafe ConfigPolicy = iota
+	// RejectUnsafe refuses configs with unsafe directives
+	RejectUnsafe
+)
+
+// InterfaceConfig holds the [Interface] settings of a WireGuard config
+type InterfaceConfig struct {
+	PrivateKey string
+	Addresses  []string
+	ListenPort int
+	MTU        int
+	DNS        []string
+	Table      string
+	FwMark     string
+	SaveConfig bool
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+}
+
+// PeerConfig holds a [Peer] section of a WireGuard config
+type PeerConfig struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+}
+
+// Config is a parsed wg-quick config
+type Config struct {
+	Interface InterfaceConfig
+	Peers     []PeerConfig
+}
+
+// ParseConfig parses a wg-quick config. Unknown sections and keys are errors;
+// values are only checked for syntax, see Validate.
+func ParseConfig(config string) (*Config, error) {
+	parsed := &Config{}
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				parsed.Peers = append(parsed.Peers, PeerConfig{})
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", lineNo, line)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = parsed.Interface.set(key, value)
+		case "peer":
+			err = parsed.Peers[len(parsed.Peers)-1].set(key, value)
+		default:
+			err = fmt.Errorf("key outside of a section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if parsed.Interface.PrivateKey == "" {
+		return nil, fmt.Errorf("missing interface private key")
+	}
+	for i, peer := range parsed.Peers {
+		if peer.PublicKey == "" {
+			return nil, fmt.Errorf("peer %d: missing public key", i)
+		}
+	}
+	return parsed, nil
+}
+
+// LoadConfig parses and validates a config and applies the policy to it
+func LoadConfig(config string, policy ConfigPolicy) (*Config, error) {
+	parsed, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := parsed.Validate(); err != nil {
+		return nil, err
+	}
+	if err := parsed.ApplyPolicy(policy); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// Validate checks keys, addresses, endpoints, ports and the MTU
+func (c *Config) Validate() error {
+	if _, err := parseKey(c.Interface.PrivateKey); err != nil {
+		return fmt.Errorf("invalid private key: %w", err)
+	}
+	for _, address := range c.Interface.Addresses {
+		if _, err := netip.ParsePrefix(address); err != nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	if c.Interface.ListenPort < 0 || c.Interface.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", c.Interface.ListenPort)
+	}
+	if c.Interface.MTU != 0 && (c.Interface.MTU < MinMTU || c.Interface.MTU > MaxMTU) {
+		return fmt.Errorf("MTU %d is outside %d-%d", c.Interface.MTU, MinMTU, MaxMTU)
+	}
+
+	for i, peer := range c.Peers {
+		if _, err := parseKey(peer.PublicKey); err != nil {
+			return fmt.Errorf("peer %d: invalid public key: %w", i, err)
+		}
+		if peer.PresharedKey != "" {
+			if _, err := parseKey(peer.PresharedKey); err != nil {
+				return fmt.Errorf("peer %d: invalid preshared key: %w", i, err)
+			}
+		}
+		if peer.Endpoint != "" {
+			if err := validateEndpoint(peer.Endpoint); err != nil {
+				return fmt.Errorf("peer %d: invalid endpoint %q: %w", i, peer.Endpoint, err)
+			}
+		}
+		for _, cidr := range peer.AllowedIPs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("peer %d: invalid allowed IP %q", i, cidr)
+			}
+		}
+		if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > 65535 {
+			return fmt.Errorf("peer %d: invalid persistent keepalive %d", i, peer.PersistentKeepalive)
+		}
+	}
+	return nil
+}
+
+// ApplyPolicy strips or rejects the config's script hooks and DNS settings
+func (c *Config) ApplyPolicy(policy ConfigPolicy) error {
+	unsafe := c.unsafeDirectives()
+	if len(unsafe) == 0 {
+		return nil
+	}
+	if policy == RejectUnsafe {
+		return fmt.Errorf("%w: %s", ErrUnsafeDirective, strings.Join(unsafe, ", "))
+	}
+
+	c.Interface.DNS = nil
+	c.Interface.PreUp = nil
+	c.Interface.PostUp = nil
+	c.Interface.PreDown = nil
+	c.Interface.PostDown = nil
+	return nil
+}
+
+// unsafeDirectives lists the unsafe directives set in the config
+func (c *Config) unsafeDirectives() []string {
+	var unsafe []string
+	for _, directive := range []struct {
+		name   string
+		values []string
+	}{
+		{"DNS", c.Interface.DNS},
+		{"PreUp", c.Interface.PreUp},
+		{"PostUp", c.Interface.PostUp},
+		{"PreDown", c.Interface.PreDown},
+		{"PostDown", c.Interface.PostDown},
+	} {
+		if len(directive.values) > 0 {
+			unsafe = append(unsafe, directive.name)
+		}
+	}
+	return unsafe
+}
+
+// String renders the config in wg-quick format
+func (c *Config) String() string {
+	var b strings.Builder
+
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.Interface.PrivateKey)
+	if len(c.Interface.Addresses) > 0 {
+		fmt.Fprintf(&b, "Address = %s\n", strings.Join(c.Interface.Addresses, ", "))
+	}
+	if c.Interface.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", c.Interface.ListenPort)
+	}
+	if c.Interface.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", c.Interface.MTU)
+	}
+	if len(c.Interface.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(c.Interface.DNS, ", "))
+	}
+	if c.Interface.Table != "" {
+		fmt.Fprintf(&b, "Table = %s\n", c.Interface.Table)
+	}
+	if c.Interface.FwMark != "" {
+		fmt.Fprintf(&b, "FwMark = %s\n", c.Interface.FwMark)
+	}
+	if c.Interface.SaveConfig {
+		b.WriteString("SaveConfig = true\n")
+	}
+	for _, hook := range []struct {
+		name     string
+		commands []string
+	}{
+		{"PreUp", c.Interface.PreUp},
+		{"PostUp", c.Interface.PostUp},
+		{"PreDown", c.Interface.PreDown},
+		{"PostDown", c.Interface.PostDown},
+	} {
+		for _, command := range hook.commands {
+			fmt.Fprintf(&b, "%s = %s\n", hook.name, command)
+		}
+	}
+
+	for _, peer := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(&b, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	return b.String()
+}
+
+func (i *InterfaceConfig) set(key, value string) error {
+	switch key {
+	case "privatekey":
+		i.PrivateKey = value
+	case "address":
+		i.Addresses = append(i.Addresses, splitList(value)...)
+	case "listenport":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid listen port %q", value)
+		}
+		i.ListenPort = port
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid MTU %q", value)
+		}
+		i.MTU = mtu
+	case "dns":
+		i.DNS = append(i.DNS, splitList(value)...)
+	case "table":
+		i.Table = value
+	case "fwmark":
+		i.FwMark = value
+	case "saveconfig":
+		save, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SaveConfig %q", value)
+		}
+		i.SaveConfig = save
+	case "preup":
+		i.PreUp = append(i.PreUp, value)
+	case "postup":
+		i.PostUp = append(i.PostUp, value)
+	case "predown":
+		i.PreDown = append(i.PreDown, value)
+	case "postdown":
+		i.PostDown = append(i.PostDown, value)
+	default:
+		return fmt.Errorf("unknown interface key %q", key)
+	}
+	return nil
+}
+
+func (p *PeerConfig) set(key, value string) error {
+	switch key {
+	case "publickey":
+		p.PublicKey = value
+	case "presharedkey":
+		p.PresharedKey = value
+	case "endpoint":
+		p.Endpoint = value
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		if value == "off" {
+			p.PersistentKeepalive = 0
+			return nil
+		}
+		keepalive, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid persistent keepalive %q", value)
+		}
+		p.PersistentKeepalive = keepalive
+	default:
+		return fmt.Errorf("unknown peer key %q", key)
+	}
+	return nil
+}
+
+// splitList splits a comma separated config value
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateEndpoint checks a host:port endpoint
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	if host == "" || strings.ContainsAny(host, " \t/") {
+		return fmt.Errorf("invalid host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port")
+	}
+	return nil
+}
+
+// parseKey decodes a base64 WireGuard key
+func parseKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != wgKeyLen {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", wgKeyLen, len(decoded))
+	}
+	return decoded, nil
+}
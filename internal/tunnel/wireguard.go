@@ -2,10 +2,10 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
 	"os/exec"
-	"path/filepath"
+	"sync"
 )
 
 // execCommand allows us to replace exec.Command during testing
@@ -13,82 +13,182 @@ var execCommand = exec.Command
 
 // Tunnel represents a WireGuard tunnel instance
 type Tunnel struct {
-	id     string
-	config string
-	cmd    *exec.Cmd
+	id      string
+	name    string
+	config  *TunnelConfig
+	backend Backend
+	policy  ConfigPolicy
+
+	// mu serializes changes to the running interface. The manager takes it while
+	// holding its own lock; the health monitor takes it on its own.
+	mu sync.Mutex
+	// removed is set once the manager deleted the tunnel
+	removed bool
+	// down is set while a restart left the interface down, so the next update
+	// brings it up again even if the config did not change
+	down bool
 }
 
 // NewTunnel creates a new WireGuard tunnel instance
-func NewTunnel(config *TunnelConfig) (*Tunnel, error) {
+func NewTunnel(config *TunnelConfig, backend Backend) (*Tunnel, error) {
 	return &Tunnel{
-		id:     config.TunnelID,
-		config: config.WGConfig,
+		id:      config.TunnelID,
+		name:    interfaceName(tunnelInterfacePrefix, config.TunnelID),
+		config:  config,
+		backend: backend,
 	}, nil
 }
 
 // Start initializes and starts the WireGuard tunnel
 func (t *Tunnel) Start(ctx context.Context) error {
-	configPath, err := t.writeConfig()
+	config, err := t.checkedConfig(t.config)
 	if err != nil {
-		return fmt.Errorf("failed to write config: %w", err)
+		return err
 	}
 
-	cmd := execCommand("wg-quick", "up", configPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start wg-quick: %w", err)
+	if err := t.backend.Up(ctx, t.InterfaceName(), config); err != nil {
+		return fmt.Errorf("failed to bring up interface: %w", err)
 	}
-
-	t.cmd = cmd
 	return nil
 }
 
 // Stop terminates the WireGuard tunnel
 func (t *Tunnel) Stop(ctx context.Context) error {
-	if t.cmd != nil && t.cmd.Process != nil {
-		if err := t.cmd.Process.Kill(); err != nil {
-			return fmt.Errorf("failed to kill wg-quick process: %w", err)
+	if err := t.backend.Down(ctx, t.InterfaceName()); err != nil {
+		return fmt.Errorf("failed to bring down interface: %w", err)
+	}
+	return nil
+}
+
+// Update applies a new configuration. When the interface addresses stay the same
+// and the backend supports it, the running interface is synced in place so
+// established connections survive; otherwise it is restarted.
+func (t *Tunnel) Update(ctx context.Context, config *TunnelConfig) (UpdateMode, error) {
+	// Keep the running tunnel if the new config would not start
+	newConfig, err := t.checkedConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	if t.down {
+		t.config = config
+		return t.bringUp(ctx)
+	}
+
+	if sameTunnelConfig(t.config, config) {
+		t.config = config
+		return UpdateUnchanged, nil
+	}
+
+	if syncer, ok := t.backend.(SyncBackend); ok {
+		oldConfig, err := t.checkedConfig(t.config)
+		if err == nil && t.syncable(oldConfig, newConfig) {
+			err := syncer.Sync(ctx, t.InterfaceName(), oldConfig, newConfig)
+			if err == nil {
+				t.config = config
+				return UpdateInPlace, nil
+			}
+			if !errors.Is(err, ErrRestartRequired) {
+				return "", fmt.Errorf("failed to sync interface: %w", err)
+			}
 		}
 	}
 
-	configPath := t.getConfigPath()
-	cmd := execCommand("wg-quick", "down", configPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if err := t.Stop(ctx); err != nil {
+		return "", fmt.Errorf("failed to stop tunnel for update: %w", err)
+	}
+
+	t.config = config
+	return t.bringUp(ctx)
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to stop wg-quick: %w", err)
+// Replace restarts the tunnel with a new config on another backend, used when
+// the server provisioned it with a different transport
+func (t *Tunnel) Replace(ctx context.Context, config *TunnelConfig, backend Backend) (UpdateMode, error) {
+	// Keep the running tunnel if the new config would not start
+	if _, err := t.checkedConfig(config); err != nil {
+		return "", err
 	}
 
-	if err := os.Remove(configPath); err != nil {
-		return fmt.Errorf("failed to remove config file: %w", err)
+	if !t.down {
+		if err := t.Stop(ctx); err != nil {
+			return "", fmt.Errorf("failed to stop tunnel for update: %w", err)
+		}
 	}
 
-	return nil
+	t.config = config
+	t.backend = backend
+	return t.bringUp(ctx)
 }
 
-// Update updates the tunnel configuration
-func (t *Tunnel) Update(ctx context.Context, config *TunnelConfig) error {
-	if err := t.Stop(ctx); err != nil {
-		return fmt.Errorf("failed to stop tunnel for update: %w", err)
+// bringUp starts the stopped interface with the current config. A failed start
+// leaves the tunnel marked down, so the next update retries it.
+func (t *Tunnel) bringUp(ctx context.Context) (UpdateMode, error) {
+	if err := t.Start(ctx); err != nil {
+		t.down = true
+		return "", err
+	}
+	t.down = false
+	return UpdateRestart, nil
+}
+
+// syncable reports whether a change between two checked configs keeps the
+// interface addresses, the precondition for syncing in place
+func (t *Tunnel) syncable(old, new *TunnelConfig) bool {
+	// Other transports decide for themselves
+	if transportOf(new) != TransportWireGuard {
+		return true
+	}
+
+	oldParsed, err := ParseConfig(old.WGConfig)
+	if err != nil {
+		return false
+	}
+	newParsed, err := ParseConfig(new.WGConfig)
+	if err != nil {
+		return false
+	}
+	return sameAddresses(oldParsed, newParsed)
+}
+
+// checkedConfig validates a config and applies the tunnel's policy to it, so only
+// checked settings are handed to the backend
+func (t *Tunnel) checkedConfig(config *TunnelConfig) (*TunnelConfig, error) {
+	// Only WireGuard configs are checked here; other backends validate their own
+	if transportOf(config) != TransportWireGuard {
+		return config, nil
 	}
 
-	t.config = config.WGConfig
-	return t.Start(ctx)
+	parsed, err := LoadConfig(config.WGConfig, t.policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel config: %w", err)
+	}
+
+	checked := *config
+	checked.WGConfig = parsed.String()
+	return &checked, nil
 }
 
-// writeConfig writes the WireGuard configuration to a temporary file
-func (t *Tunnel) writeConfig() (string, error) {
-	configPath := t.getConfigPath()
-	if err := os.WriteFile(configPath, []byte(t.config), 0600); err != nil {
-		return "", fmt.Errorf("failed to write config file: %w", err)
+// keepsAlive reports whether any peer sends persistent keepalives, which makes
+// handshakes happen even when the tunnel is idle
+func (t *Tunnel) keepsAlive() bool {
+	if transportOf(t.config) != TransportWireGuard {
+		return false
+	}
+
+	parsed, err := ParseConfig(t.config.WGConfig)
+	if err != nil {
+		return false
 	}
-	return configPath, nil
+	for _, peer := range parsed.Peers {
+		if peer.PersistentKeepalive > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-// getConfigPath returns the path for the WireGuard configuration file
-func (t *Tunnel) getConfigPath() string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf("wg-%s.conf", t.id))
-} 
\ No newline at end of file
+// InterfaceName returns the name of the tunnel's network interface
+func (t *Tunnel) InterfaceName() string {
+	return t.name
+}
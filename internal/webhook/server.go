@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ValidatePath is the path the ValidatingWebhookConfiguration calls
+const ValidatePath = "/validate-service"
+
+// Server serves the validating admission webhook for Services
+type Server struct {
+	addr      string
+	certFile  string
+	keyFile   string
+	validator *Validator
+	logger    *utils.Logger
+}
+
+// NewServer creates a new webhook Server listening on addr with the given TLS certificate
+func NewServer(addr, certFile, keyFile string, validator *Validator, logger *utils.Logger) *Server {
+	return &Server{
+		addr:      addr,
+		certFile:  certFile,
+		keyFile:   keyFile,
+		validator: validator,
+		logger:    logger,
+	}
+}
+
+// Start serves the webhook until ctx is cancelled
+func (s *Server) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(ValidatePath, s)
+
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServeTLS(s.certFile, s.keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("webhook server failed: %w", err)
+	}
+	return nil
+}
+
+// ServeHTTP handles an AdmissionReview request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.review(r.Context(), review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		s.logger.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Error("Failed to write admission response")
+	}
+}
+
+// review decides whether an admission request is allowed
+func (s *Server) review(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation == admissionv1.Delete || req.Kind.Kind != "Service" {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	svc := &v1.Service{}
+	if err := json.Unmarshal(req.Object.Raw, svc); err != nil {
+		return deny(http.StatusBadRequest, fmt.Sprintf("failed to decode service: %v", err))
+	}
+	if svc.Namespace == "" {
+		svc.Namespace = req.Namespace
+	}
+
+	problems, err := s.validator.ValidateService(ctx, svc)
+	if err != nil {
+		s.logger.WithFields(map[string]interface{}{
+			"service": req.Namespace + "/" + req.Name,
+			"error":   err.Error(),
+		}).Error("Failed to validate service")
+		return deny(http.StatusInternalServerError, err.Error())
+	}
+	if len(problems) > 0 {
+		return deny(http.StatusUnprocessableEntity, strings.Join(problems, "; "))
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func deny(code int32, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
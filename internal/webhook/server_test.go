@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/controller"
+	"github.com/quinnovator/easy-tunnel-lb/internal/utils"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestServer_ServeHTTP(t *testing.T) {
+	server := NewServer(":0", "", "", NewValidator(nil, nil), utils.NewLogger("test"))
+
+	tests := []struct {
+		name        string
+		operation   admissionv1.Operation
+		annotations map[string]string
+		allowed     bool
+		message     string
+	}{
+		{
+			name:      "valid service",
+			operation: admissionv1.Create,
+			annotations: map[string]string{
+				controller.TunnelAnnotation: "true",
+			},
+			allowed: true,
+		},
+		{
+			name:      "invalid service",
+			operation: admissionv1.Update,
+			annotations: map[string]string{
+				controller.TunnelAnnotation: "on",
+			},
+			allowed: false,
+			message: `invalid value "on" for easy-tunnel-lb.quinnovator.com/enabled: must be true or false`,
+		},
+		{
+			name:      "deletes are always allowed",
+			operation: admissionv1.Delete,
+			annotations: map[string]string{
+				controller.TunnelAnnotation: "on",
+			},
+			allowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+			}
+			raw, err := json.Marshal(svc)
+			assert.NoError(t, err)
+
+			review := &admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "admission.k8s.io/v1",
+					Kind:       "AdmissionReview",
+				},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("test-uid"),
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+					Operation: tt.operation,
+					Namespace: "default",
+					Name:      "test-service",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			}
+			body, err := json.Marshal(review)
+			assert.NoError(t, err)
+
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, ValidatePath, bytes.NewReader(body)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			resp := &admissionv1.AdmissionReview{}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+			assert.Equal(t, types.UID("test-uid"), resp.Response.UID)
+			assert.Equal(t, tt.allowed, resp.Response.Allowed)
+			if !tt.allowed {
+				assert.Equal(t, tt.message, resp.Response.Result.Message)
+			}
+		})
+	}
+}
+
+func TestServer_ServeHTTPInvalidRequest(t *testing.T) {
+	server := NewServer(":0", "", "", NewValidator(nil, nil), utils.NewLogger("test"))
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, ValidatePath, bytes.NewReader([]byte("{}"))))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ValidatePath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,315 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/controller"
+	"github.com/quinnovator/easy-tunnel-lb/internal/tunnel"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ServerLookup resolves tunnel server names
+type ServerLookup interface {
+	Get(name string) (*controller.Server, bool)
+}
+
+// NamespaceClient interface for reading Namespace policy
+type NamespaceClient interface {
+	GetNamespace(ctx context.Context, name string) (*v1.Namespace, error)
+}
+
+// annotationValidator checks a single annotation value and returns a reason when invalid
+type annotationValidator func(v *Validator, value string) string
+
+// annotationValidators lists every annotation the controller understands. The
+// annotations the controller records itself have no validator, so a stale record,
+// e.g. of a server that was removed since, never blocks updates to the Service.
+var annotationValidators = map[string]annotationValidator{
+	controller.TunnelAnnotation:         validateBool,
+	controller.TunnelIDAnnotation:       nil,
+	controller.ServerAnnotation:         validateServerName,
+	controller.ServerSelectorAnnotation: validateSelector,
+	controller.AssignedServerAnnotation: nil,
+	controller.StandbyServerAnnotation:  validateServerName,
+	controller.FailbackAnnotation:       validateBool,
+	controller.ServersAnnotation:        validateServerList,
+	controller.ServerCountAnnotation:    validatePositiveInt,
+	controller.TunnelsAnnotation:        nil,
+	controller.HostnameAnnotation:       validateHostname,
+	controller.SourceRangesAnnotation:   validateCIDRs,
+	controller.RotateKeyAnnotation:      validateBool,
+	controller.KeyRotatedAtAnnotation:   validateTimestamp,
+
+	controller.MTUAnnotation:                 validateMTU,
+	controller.PersistentKeepaliveAnnotation: validateKeepalive,
+	controller.ListenPortAnnotation:          validatePort,
+	controller.EffectiveTuningAnnotation:     nil,
+	controller.TransportAnnotation:           validateTransport,
+	controller.TrafficAnnotation:             nil,
+}
+
+// Validator checks Services for invalid tunnel annotations and namespace port policy
+type Validator struct {
+	servers    ServerLookup
+	namespaces NamespaceClient
+	// sharedInterface rejects interface tuning when all tunnels share one interface
+	sharedInterface bool
+}
+
+// NewValidator creates a new Validator. servers and namespaces may be nil to skip
+// server existence and namespace policy checks.
+func NewValidator(servers ServerLookup, namespaces NamespaceClient) *Validator {
+	return &Validator{
+		servers:    servers,
+		namespaces: namespaces,
+	}
+}
+
+// SetSharedInterface rejects the tuning annotations a shared interface cannot honour
+func (v *Validator) SetSharedInterface(shared bool) {
+	v.sharedInterface = shared
+}
+
+// ValidateService returns the reasons a Service should be rejected, if any
+func (v *Validator) ValidateService(ctx context.Context, svc *v1.Service) ([]string, error) {
+	problems := v.ValidateAnnotations(svc.Annotations)
+	if v.sharedInterface {
+		if err := controller.CheckSharedTuning(svc.Annotations); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if _, enabled := svc.Annotations[controller.TunnelAnnotation]; !enabled || v.namespaces == nil {
+		return problems, nil
+	}
+
+	ns, err := v.namespaces.GetNamespace(ctx, svc.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %w", svc.Namespace, err)
+	}
+	policy, ok := ns.Annotations[controller.AllowedPortsAnnotation]
+	if !ok {
+		return problems, nil
+	}
+
+	allowed, err := parsePortRanges(policy)
+	if err != nil {
+		return append(problems, fmt.Sprintf("namespace %s has an invalid %s policy: %v", svc.Namespace, controller.AllowedPortsAnnotation, err)), nil
+	}
+	for _, sp := range svc.Spec.Ports {
+		if !allowed.contains(int(sp.Port)) {
+			problems = append(problems, fmt.Sprintf("port %d is not allowed by namespace %s (allowed: %s)", sp.Port, svc.Namespace, policy))
+		}
+	}
+	return problems, nil
+}
+
+// ValidateAnnotations checks every controller annotation for a known key and a valid value
+func (v *Validator) ValidateAnnotations(annotations map[string]string) []string {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if strings.HasPrefix(key, controller.AnnotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	problems := []string{}
+	for _, key := range keys {
+		validate, ok := annotationValidators[key]
+		if !ok {
+			problem := fmt.Sprintf("unknown annotation %s", key)
+			if suggestion := closestAnnotation(key); suggestion != "" {
+				problem += fmt.Sprintf(", did you mean %s?", suggestion)
+			}
+			problems = append(problems, problem)
+			continue
+		}
+		if validate == nil {
+			continue
+		}
+		if reason := validate(v, annotations[key]); reason != "" {
+			problems = append(problems, fmt.Sprintf("invalid value %q for %s: %s", annotations[key], key, reason))
+		}
+	}
+	return problems
+}
+
+func validateBool(v *Validator, value string) string {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return "must be true or false"
+	}
+	return ""
+}
+
+func validateServerName(v *Validator, value string) string {
+	if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+		return strings.Join(errs, "; ")
+	}
+	if v.servers != nil {
+		if _, ok := v.servers.Get(value); !ok {
+			return "no such tunnel server"
+		}
+	}
+	return ""
+}
+
+func validateServerList(v *Validator, value string) string {
+	for _, name := range strings.Split(value, ",") {
+		if reason := validateServerName(v, strings.TrimSpace(name)); reason != "" {
+			return fmt.Sprintf("server %q: %s", strings.TrimSpace(name), reason)
+		}
+	}
+	return ""
+}
+
+func validateSelector(v *Validator, value string) string {
+	if _, err := labels.Parse(value); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func validatePositiveInt(v *Validator, value string) string {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 {
+		return "must be a positive integer"
+	}
+	return ""
+}
+
+func validateHostname(v *Validator, value string) string {
+	if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+		return strings.Join(errs, "; ")
+	}
+	return ""
+}
+
+func validateCIDRs(v *Validator, value string) string {
+	for _, cidr := range strings.Split(value, ",") {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return fmt.Sprintf("%q is not a valid CIDR", strings.TrimSpace(cidr))
+		}
+	}
+	return ""
+}
+
+func validateTimestamp(v *Validator, value string) string {
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		return "must be an RFC 3339 timestamp"
+	}
+	return ""
+}
+
+func validateMTU(v *Validator, value string) string {
+	if n, err := strconv.Atoi(value); err != nil || n < tunnel.MinMTU || n > tunnel.MaxMTU {
+		return fmt.Sprintf("must be an MTU between %d and %d", tunnel.MinMTU, tunnel.MaxMTU)
+	}
+	return ""
+}
+
+func validateKeepalive(v *Validator, value string) string {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 65535 {
+		return "must be a number of seconds between 0 and 65535"
+	}
+	return ""
+}
+
+func validatePort(v *Validator, value string) string {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		return "must be a port between 1 and 65535"
+	}
+	return ""
+}
+
+func validateTransport(v *Validator, value string) string {
+	switch value {
+	case tunnel.TransportWireGuard, tunnel.TransportSSH, tunnel.TransportTLS:
+		return ""
+	}
+	return fmt.Sprintf("must be %s, %s or %s", tunnel.TransportWireGuard, tunnel.TransportSSH, tunnel.TransportTLS)
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	from, to int
+}
+
+// portRanges is a namespace port policy
+type portRanges []portRange
+
+func (p portRanges) contains(port int) bool {
+	for _, r := range p {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges parses a policy such as "80,443,8000-8100"
+func parsePortRanges(value string) (portRanges, error) {
+	ranges := portRanges{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		fromStr, toStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			toStr = fromStr
+		}
+
+		from, err := strconv.Atoi(fromStr)
+		if err != nil || len(validation.IsValidPortNum(from)) > 0 {
+			return nil, fmt.Errorf("invalid port %q", fromStr)
+		}
+		to, err := strconv.Atoi(toStr)
+		if err != nil || len(validation.IsValidPortNum(to)) > 0 {
+			return nil, fmt.Errorf("invalid port %q", toStr)
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, portRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+// closestAnnotation suggests the known annotation nearest to a mistyped key
+func closestAnnotation(key string) string {
+	best := ""
+	bestDistance := 4 // only suggest close matches
+	for known := range annotationValidators {
+		if d := editDistance(key, known); d < bestDistance || (d == bestDistance && known < best) {
+			best = known
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// editDistance computes the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
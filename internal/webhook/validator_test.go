@@ -0,0 +1,399 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb/internal/controller"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeServerLookup map[string]bool
+
+func (f fakeServerLookup) Get(name string) (*controller.Server, bool) {
+	if !f[name] {
+		return nil, false
+	}
+	return &controller.Server{Name: name}, true
+}
+
+type fakeNamespaceClient map[string]*v1.Namespace
+
+func (f fakeNamespaceClient) GetNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns, ok := f[name]
+	if !ok {
+		return nil, errors.New("namespace not found")
+	}
+	return ns, nil
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	validator := NewValidator(fakeServerLookup{"eu-1": true, "us-1": true}, nil)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		problems    []string
+	}{
+		{
+			name: "valid annotations",
+			annotations: map[string]string{
+				controller.TunnelAnnotation:         "true",
+				controller.ServerAnnotation:         "eu-1",
+				controller.StandbyServerAnnotation:  "us-1",
+				controller.FailbackAnnotation:       "false",
+				controller.HostnameAnnotation:       "app.example.com",
+				controller.SourceRangesAnnotation:   "10.0.0.0/8, 2001:db8::/32",
+				controller.ServerSelectorAnnotation: "region in (eu,us)",
+				"unrelated.example.com/annotation":  "anything",
+			},
+			problems: []string{},
+		},
+		{
+			name: "typo in key",
+			annotations: map[string]string{
+				"easy-tunnel-lb.quinnovator.com/enabeld": "true",
+			},
+			problems: []string{
+				"unknown annotation easy-tunnel-lb.quinnovator.com/enabeld, did you mean easy-tunnel-lb.quinnovator.com/enabled?",
+			},
+		},
+		{
+			name: "unknown key without suggestion",
+			annotations: map[string]string{
+				"easy-tunnel-lb.quinnovator.com/something-else": "true",
+			},
+			problems: []string{
+				"unknown annotation easy-tunnel-lb.quinnovator.com/something-else",
+			},
+		},
+		{
+			name: "invalid bool",
+			annotations: map[string]string{
+				controller.TunnelAnnotation: "yes",
+			},
+			problems: []string{
+				`invalid value "yes" for easy-tunnel-lb.quinnovator.com/enabled: must be true or false`,
+			},
+		},
+		{
+			name: "unknown server",
+			annotations: map[string]string{
+				controller.ServerAnnotation: "ap-1",
+			},
+			problems: []string{
+				`invalid value "ap-1" for easy-tunnel-lb.quinnovator.com/server: no such tunnel server`,
+			},
+		},
+		{
+			name: "unknown server in list",
+			annotations: map[string]string{
+				controller.ServersAnnotation: "eu-1,ap-1",
+			},
+			problems: []string{
+				`invalid value "eu-1,ap-1" for easy-tunnel-lb.quinnovator.com/servers: server "ap-1": no such tunnel server`,
+			},
+		},
+		{
+			name: "invalid server count",
+			annotations: map[string]string{
+				controller.ServerCountAnnotation: "0",
+			},
+			problems: []string{
+				`invalid value "0" for easy-tunnel-lb.quinnovator.com/server-count: must be a positive integer`,
+			},
+		},
+		{
+			name: "invalid CIDR",
+			annotations: map[string]string{
+				controller.SourceRangesAnnotation: "10.0.0.0/8,10.0.0.1",
+			},
+			problems: []string{
+				`invalid value "10.0.0.0/8,10.0.0.1" for easy-tunnel-lb.quinnovator.com/source-ranges: "10.0.0.1" is not a valid CIDR`,
+			},
+		},
+		{
+			name: "invalid hostname",
+			annotations: map[string]string{
+				controller.HostnameAnnotation: "Not_A_Host",
+			},
+			problems: []string{
+				`invalid value "Not_A_Host" for easy-tunnel-lb.quinnovator.com/hostname: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+			},
+		},
+		{
+			name: "records written by the controller are not validated",
+			annotations: map[string]string{
+				controller.TunnelIDAnnotation:        "",
+				controller.AssignedServerAnnotation:  "removed-server",
+				controller.TunnelsAnnotation:         "eu-1",
+				controller.EffectiveTuningAnnotation: "",
+				controller.TrafficAnnotation:         "",
+			},
+			problems: []string{},
+		},
+		{
+			name: "key rotation",
+			annotations: map[string]string{
+				controller.RotateKeyAnnotation:    "now",
+				controller.KeyRotatedAtAnnotation: "2024-01-02T03:04:05Z",
+			},
+			problems: []string{
+				`invalid value "now" for easy-tunnel-lb.quinnovator.com/rotate-key: must be true or false`,
+			},
+		},
+		{
+			name: "invalid rotation time",
+			annotations: map[string]string{
+				controller.KeyRotatedAtAnnotation: "yesterday",
+			},
+			problems: []string{
+				`invalid value "yesterday" for easy-tunnel-lb.quinnovator.com/key-rotated-at: must be an RFC 3339 timestamp`,
+			},
+		},
+		{
+			name: "tuning",
+			annotations: map[string]string{
+				controller.MTUAnnotation:                 "1380",
+				controller.PersistentKeepaliveAnnotation: "0",
+				controller.ListenPortAnnotation:          "51820",
+				controller.EffectiveTuningAnnotation:     "mtu=1380,persistent-keepalive=off,listen-port=51820",
+			},
+			problems: []string{},
+		},
+		{
+			name: "invalid tuning",
+			annotations: map[string]string{
+				controller.MTUAnnotation:                 "100",
+				controller.PersistentKeepaliveAnnotation: "-5",
+				controller.ListenPortAnnotation:          "70000",
+			},
+			problems: []string{
+				`invalid value "70000" for easy-tunnel-lb.quinnovator.com/listen-port: must be a port between 1 and 65535`,
+				`invalid value "100" for easy-tunnel-lb.quinnovator.com/mtu: must be an MTU between 576 and 65535`,
+				`invalid value "-5" for easy-tunnel-lb.quinnovator.com/persistent-keepalive: must be a number of seconds between 0 and 65535`,
+			},
+		},
+		{
+			name: "transport",
+			annotations: map[string]string{
+				controller.TransportAnnotation: "ssh",
+			},
+			problems: []string{},
+		},
+		{
+			name: "unknown transport",
+			annotations: map[string]string{
+				controller.TransportAnnotation: "carrier-pigeon",
+			},
+			problems: []string{
+				`invalid value "carrier-pigeon" for easy-tunnel-lb.quinnovator.com/transport: must be wireguard, ssh or tls`,
+			},
+		},
+		{
+			name: "multiple problems are sorted by key",
+			annotations: map[string]string{
+				controller.TunnelAnnotation:      "maybe",
+				controller.ServerCountAnnotation: "-1",
+			},
+			problems: []string{
+				`invalid value "maybe" for easy-tunnel-lb.quinnovator.com/enabled: must be true or false`,
+				`invalid value "-1" for easy-tunnel-lb.quinnovator.com/server-count: must be a positive integer`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.problems, validator.ValidateAnnotations(tt.annotations))
+		})
+	}
+}
+
+func TestValidateService_SharedInterface(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				controller.TunnelAnnotation:              "true",
+				controller.MTUAnnotation:                 "1400",
+				controller.PersistentKeepaliveAnnotation: "25",
+			},
+		},
+	}
+
+	validator := NewValidator(nil, nil)
+	problems, err := validator.ValidateService(context.Background(), svc)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Only the interface settings are refused on a shared interface
+	validator.SetSharedInterface(true)
+	problems, err = validator.ValidateService(context.Background(), svc)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		controller.MTUAnnotation + " cannot be used with TUNNEL_MODE=shared, all tunnels share one interface",
+	}, problems)
+}
+
+func TestValidateService_PortPolicy(t *testing.T) {
+	namespaces := fakeNamespaceClient{
+		"restricted": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "restricted",
+				Annotations: map[string]string{
+					controller.AllowedPortsAnnotation: "80,443,8000-8100",
+				},
+			},
+		},
+		"broken": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "broken",
+				Annotations: map[string]string{
+					controller.AllowedPortsAnnotation: "80,9000-8000",
+				},
+			},
+		},
+		"open": {
+			ObjectMeta: metav1.ObjectMeta{Name: "open"},
+		},
+	}
+	validator := NewValidator(nil, namespaces)
+
+	tests := []struct {
+		name        string
+		namespace   string
+		enabled     bool
+		ports       []int32
+		problems    []string
+		expectError bool
+	}{
+		{
+			name:      "ports within policy",
+			namespace: "restricted",
+			enabled:   true,
+			ports:     []int32{80, 443, 8050},
+			problems:  []string{},
+		},
+		{
+			name:      "port outside policy",
+			namespace: "restricted",
+			enabled:   true,
+			ports:     []int32{80, 22},
+			problems: []string{
+				"port 22 is not allowed by namespace restricted (allowed: 80,443,8000-8100)",
+			},
+		},
+		{
+			name:      "policy ignored for services without tunnel",
+			namespace: "restricted",
+			enabled:   false,
+			ports:     []int32{22},
+			problems:  []string{},
+		},
+		{
+			name:      "namespace without policy",
+			namespace: "open",
+			enabled:   true,
+			ports:     []int32{22},
+			problems:  []string{},
+		},
+		{
+			name:      "invalid policy",
+			namespace: "broken",
+			enabled:   true,
+			ports:     []int32{80},
+			problems: []string{
+				`namespace broken has an invalid easy-tunnel-lb.quinnovator.com/allowed-ports policy: invalid port range "9000-8000"`,
+			},
+		},
+		{
+			name:        "missing namespace",
+			namespace:   "missing",
+			enabled:     true,
+			ports:       []int32{80},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   tt.namespace,
+					Annotations: map[string]string{},
+				},
+			}
+			if tt.enabled {
+				svc.Annotations[controller.TunnelAnnotation] = "true"
+			}
+			for _, port := range tt.ports {
+				svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: port})
+			}
+
+			problems, err := validator.ValidateService(context.Background(), svc)
+
+			if tt.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		allowed     []int
+		denied      []int
+		expectError bool
+	}{
+		{
+			name:    "single ports and ranges",
+			value:   "80, 443,8000-8100",
+			allowed: []int{80, 443, 8000, 8100},
+			denied:  []int{81, 7999, 8101},
+		},
+		{
+			name:        "not a number",
+			value:       "http",
+			expectError: true,
+		},
+		{
+			name:        "out of range",
+			value:       "70000",
+			expectError: true,
+		},
+		{
+			name:        "empty entry",
+			value:       "80,",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parsePortRanges(tt.value)
+
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, port := range tt.allowed {
+				assert.True(t, ranges.contains(port), "port %d", port)
+			}
+			for _, port := range tt.denied {
+				assert.False(t, ranges.contains(port), "port %d", port)
+			}
+		})
+	}
+}